@@ -47,6 +47,19 @@ const (
 	MapRelativePathSockPairMap   = "/sock_pair_map"
 )
 
+// sidecarUserID returns the UID identifying the sidecar, as the ebpf programs
+// are able to recognize the sidecar's traffic only by a single UID
+func sidecarUserID(owner config.Owner) (string, error) {
+	if !owner.IsUIDOnly() {
+		return "", fmt.Errorf(
+			"ebpf programs support identifying the sidecar only by a single UID " +
+				"(multiple UIDs, GID and mark are not supported)",
+		)
+	}
+
+	return owner.UIDList()[0], nil
+}
+
 var programs = []*Program{
 	{
 		Name: "mb_connect",
@@ -55,9 +68,14 @@ var programs = []*Program{
 			cgroup string,
 			bpffs string,
 		) ([]string, error) {
+			uid, err := sidecarUserID(cfg.Owner)
+			if err != nil {
+				return nil, err
+			}
+
 			return Flags(map[string]string{
 				"--cgroup":            cgroup,
-				"--sidecar-user-id":   cfg.Owner.UID,
+				"--sidecar-user-id":   uid,
 				"--out-redirect-port": strconv.Itoa(int(cfg.Redirect.Outbound.Port)),
 				"--in-redirect-port":  strconv.Itoa(int(cfg.Redirect.Inbound.Port)),
 				"--dns-capture-port":  strconv.Itoa(int(cfg.Redirect.DNS.Port)),
@@ -107,9 +125,14 @@ var programs = []*Program{
 			cgroup string,
 			bpffs string,
 		) ([]string, error) {
+			uid, err := sidecarUserID(cfg.Owner)
+			if err != nil {
+				return nil, err
+			}
+
 			return Flags(map[string]string{
 				"--cgroup":            cgroup,
-				"--sidecar-user-id":   cfg.Owner.UID,
+				"--sidecar-user-id":   uid,
 				"--out-redirect-port": strconv.Itoa(int(cfg.Redirect.Outbound.Port)),
 				"--dns-capture-port":  strconv.Itoa(int(cfg.Redirect.DNS.Port)),
 			})(cfg, cgroup, bpffs)
@@ -190,6 +213,105 @@ type PodConfig struct {
 	ExcludeOutPorts  [MaxItemLen]uint16
 }
 
+// cidrsToRanges converts the IPv4 CIDRs (or addresses) to the format expected
+// by the ebpf programs. The programs don't support IPv6, so IPv6 CIDRs are
+// skipped and returned separately
+func cidrsToRanges(cidrs []string) ([MaxItemLen]Cidr, []string, error) {
+	var result [MaxItemLen]Cidr
+	var skipped []string
+	i := 0
+
+	for _, cidr := range cidrs {
+		network, ipv6, err := config.ParseCIDR(cidr)
+		if err != nil {
+			return result, nil, err
+		}
+
+		if ipv6 {
+			skipped = append(skipped, cidr)
+			continue
+		}
+
+		if i >= MaxItemLen {
+			return result, nil, fmt.Errorf(
+				"maximal allowed amount of IPv4 CIDRs (%d) exceeded: %+v",
+				MaxItemLen,
+				cidrs,
+			)
+		}
+
+		ones, _ := network.Mask.Size()
+		result[i] = Cidr{
+			// the address is already in network order, so we have to copy it
+			// without any conversion
+			Net:  *(*uint32)(unsafe.Pointer(&network.IP.To4()[0])),
+			Mask: uint8(ones),
+		}
+		i++
+	}
+
+	return result, skipped, nil
+}
+
+// includeCidrsToRanges converts the included outbound CIDRs like cidrsToRanges.
+// The programs treat the empty list as "capture everything", so when all
+// the included CIDRs are skipped (they're IPv6 ones), it returns an error
+// instead of capturing all the IPv4 traffic
+func includeCidrsToRanges(cidrs []string) ([MaxItemLen]Cidr, []string, error) {
+	result, skipped, err := cidrsToRanges(cidrs)
+	if err != nil {
+		return result, nil, err
+	}
+
+	if len(cidrs) > 0 && len(skipped) == len(cidrs) {
+		return result, nil, fmt.Errorf(
+			"ebpf programs don't support IPv6, and there are no IPv4 CIDRs to "+
+				"include, so all the outbound traffic would be captured: %v",
+			skipped,
+		)
+	}
+
+	return result, skipped, nil
+}
+
+// portsToArray converts the ports to the format expected by the ebpf programs,
+// which hold only discrete ports, so port ranges are expanded. Reserved ports
+// are placed first, and count towards the maximal amount of ports
+func portsToArray(name string, ranges []config.Range, reserved ...uint16) ([MaxItemLen]uint16, error) {
+	var result [MaxItemLen]uint16
+
+	ports := append([]uint16{}, reserved...)
+	for _, r := range ranges {
+		if int(r.To-r.From) >= MaxItemLen {
+			return result, fmt.Errorf(
+				"%s port range %s cannot be used, as ebpf programs support only "+
+					"discrete ports (maximal allowed amount: %d)",
+				name,
+				r.String(),
+				MaxItemLen-len(reserved),
+			)
+		}
+
+		for port := r.From; port <= r.To; port++ {
+			ports = append(ports, uint16(port))
+		}
+	}
+
+	if len(ports) > MaxItemLen {
+		return result, fmt.Errorf(
+			"maximal allowed amount of %s ports (%d) exceeded (%d): %s",
+			name,
+			MaxItemLen-len(reserved),
+			len(ports)-len(reserved),
+			config.NewValueOrRangeList(ranges...),
+		)
+	}
+
+	copy(result[:], ports)
+
+	return result, nil
+}
+
 func ipStrToPtr(ipstr string) (unsafe.Pointer, error) {
 	var ip net.IP
 
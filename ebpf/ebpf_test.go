@@ -0,0 +1,39 @@
+//go:build linux
+
+package ebpf
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Included outbound CIDRs", func() {
+	It("should skip IPv6 CIDRs when there are IPv4 ones", func() {
+		// when
+		ranges, skipped, err := includeCidrsToRanges([]string{"10.0.0.0/8", "fd00::/8"})
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(skipped).To(Equal([]string{"fd00::/8"}))
+		Expect(ranges[0].Mask).To(Equal(uint8(8)))
+		Expect(ranges[1]).To(Equal(Cidr{}))
+	})
+
+	It("should capture all the traffic when nothing is included", func() {
+		// when
+		ranges, skipped, err := includeCidrsToRanges(nil)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(skipped).To(BeEmpty())
+		Expect(ranges).To(Equal([MaxItemLen]Cidr{}))
+	})
+
+	It("should return an error when all the CIDRs are skipped", func() {
+		// when
+		_, _, err := includeCidrsToRanges([]string{"fd00::/8", "2001:db8::1"})
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring("all the outbound traffic would be captured")))
+	})
+})
@@ -101,39 +101,73 @@ func Setup(cfg config.Config) (string, error) {
 
 	// exclude inbound ports
 
-	excludeInboundPorts := [MaxItemLen]uint16{
+	excludeInboundPorts, err := portsToArray(
+		"exclude inbound",
+		cfg.Redirect.Inbound.ExcludedPorts(),
 		cfg.Redirect.Inbound.Port,
 		cfg.Redirect.Inbound.PortIPv6,
 		cfg.Redirect.Outbound.Port,
+	)
+	if err != nil {
+		return "", err
 	}
 
-	allowedAmountOfExcludeInPorts := MaxItemLen - len(excludeInboundPorts)
+	// exclude outbound ports
 
-	if len(cfg.Redirect.Inbound.ExcludePorts) > allowedAmountOfExcludeInPorts {
-		return "", fmt.Errorf(
-			"maximal allowed amound of exclude inbound ports (%d) exceeded (%d): %+v",
-			allowedAmountOfExcludeInPorts,
-			len(cfg.Redirect.Inbound.ExcludePorts),
-			cfg.Redirect.Inbound.ExcludePorts,
-		)
+	excludeOutPorts, err := portsToArray("exclude outbound", cfg.Redirect.Outbound.ExcludedPorts())
+	if err != nil {
+		return "", err
 	}
 
-	// exclude outbound ports
+	// exclude outbound IP ranges
 
-	excludeOutPorts := [MaxItemLen]uint16{}
+	excludeOutRanges, skipped, err := cidrsToRanges(cfg.Redirect.Outbound.ExcludeOutboundIPs)
+	if err != nil {
+		return "", fmt.Errorf("invalid exclude outbound IPs: %s", err)
+	}
 
-	if len(cfg.Redirect.Outbound.ExcludePorts) > MaxItemLen {
-		return "", fmt.Errorf(
-			"maximal allowed amound of exclude outbound ports (%d) exceeded (%d): %+v",
-			MaxItemLen,
-			len(cfg.Redirect.Outbound.ExcludePorts),
-			cfg.Redirect.Outbound.ExcludePorts,
-		)
+	if len(skipped) > 0 {
+		_, _ = cfg.RuntimeStdout.Write([]byte(fmt.Sprintf(
+			"[WARNING] ebpf programs don't support IPv6, so following exclude "+
+				"outbound IPs will be ignored: %v\n",
+			skipped,
+		)))
+	}
+
+	if len(cfg.Redirect.Inbound.ExcludeInboundSourceIPs) > 0 {
+		_, _ = cfg.RuntimeStdout.Write([]byte(
+			"[WARNING] ebpf programs don't support excluding inbound traffic " +
+				"by the source IP, so exclude inbound source IPs will be ignored\n",
+		))
+	}
+
+	if cfg.IPSet.Enabled {
+		_, _ = cfg.RuntimeStdout.Write([]byte(
+			"[WARNING] ebpf programs don't support ipset sets, so excluded " +
+				"IPs and ports cannot be updated at runtime\n",
+		))
+	}
+
+	// include outbound IP ranges
+
+	includeOutRanges, skipped, err := includeCidrsToRanges(cfg.Redirect.Outbound.IncludeOutboundIPs)
+	if err != nil {
+		return "", fmt.Errorf("invalid include outbound IPs: %s", err)
+	}
+
+	if len(skipped) > 0 {
+		_, _ = cfg.RuntimeStdout.Write([]byte(fmt.Sprintf(
+			"[WARNING] ebpf programs don't support IPv6, so following include "+
+				"outbound IPs will be ignored: %v\n",
+			skipped,
+		)))
 	}
 
 	if err := localPodIPsMap.Update(ip, &PodConfig{
-		ExcludeInPorts:  excludeInboundPorts,
-		ExcludeOutPorts: excludeOutPorts,
+		ExcludeOutRanges: excludeOutRanges,
+		IncludeOutRanges: includeOutRanges,
+		ExcludeInPorts:   excludeInboundPorts,
+		ExcludeOutPorts:  excludeOutPorts,
 	}, ciliumebpf.UpdateAny); err != nil {
 		return "", fmt.Errorf(
 			"updating pinned local_pod_ips map with current instance IP (%s) failed: %v",
@@ -0,0 +1,416 @@
+package ipset
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+const (
+	TypeHashNet    = "hash:net"
+	TypeBitmapPort = "bitmap:port"
+)
+
+// Set is the ipset set managed by us. hash:net sets hold IPv4 or (when IPv6
+// is set) IPv6 networks, bitmap:port sets hold ports of any family
+type Set struct {
+	Name string
+	Type string
+	IPv6 bool
+}
+
+// ExcludeOutboundIPs returns the set holding excluded outbound IPs
+// of the provided family
+func ExcludeOutboundIPs(cfg config.Config, ipv6 bool) Set {
+	name := cfg.Redirect.NamePrefix + cfg.IPSet.ExcludeOutboundIPs
+	if ipv6 {
+		name += "6"
+	}
+
+	return Set{Name: name, Type: TypeHashNet, IPv6: ipv6}
+}
+
+// ExcludeOutboundPorts returns the set holding excluded outbound ports
+func ExcludeOutboundPorts(cfg config.Config) Set {
+	return Set{
+		Name: cfg.Redirect.NamePrefix + cfg.IPSet.ExcludeOutboundPorts,
+		Type: TypeBitmapPort,
+	}
+}
+
+// ExcludeInboundPorts returns the set holding excluded inbound ports
+func ExcludeInboundPorts(cfg config.Config) Set {
+	return Set{
+		Name: cfg.Redirect.NamePrefix + cfg.IPSet.ExcludeInboundPorts,
+		Type: TypeBitmapPort,
+	}
+}
+
+// temp returns the temporary set, which is filled with the new members
+// of the set before it's swapped with it
+func (s Set) temp() Set {
+	return Set{Name: s.Name + config.IPSetTempSuffix, Type: s.Type, IPv6: s.IPv6}
+}
+
+func portsToMembers(ports []uint16) []string {
+	return rangesToMembers(config.PortsToRanges(ports...))
+}
+
+func rangesToMembers(ranges []config.Range) []string {
+	var result []string
+
+	for _, r := range ranges {
+		result = append(result, r.String())
+	}
+
+	return result
+}
+
+// setsWithMembers returns all the sets, which have to be created for the
+// provided configuration, with their initial members
+func setsWithMembers(cfg config.Config) map[Set][]string {
+	result := map[Set][]string{
+		ExcludeOutboundIPs(cfg, false): config.CIDRsOfFamily(
+			cfg.Redirect.Outbound.ExcludeOutboundIPs,
+			false,
+		),
+		ExcludeOutboundPorts(cfg): rangesToMembers(cfg.Redirect.Outbound.ExcludedPorts()),
+		ExcludeInboundPorts(cfg):  rangesToMembers(cfg.Redirect.Inbound.ExcludedPorts()),
+	}
+
+	if cfg.IPv6 {
+		result[ExcludeOutboundIPs(cfg, true)] = config.CIDRsOfFamily(
+			cfg.Redirect.Outbound.ExcludeOutboundIPs,
+			true,
+		)
+	}
+
+	return result
+}
+
+// Sets returns all the sets which have to be created for the provided
+// configuration
+func Sets(cfg config.Config) []Set {
+	result := []Set{
+		ExcludeOutboundIPs(cfg, false),
+		ExcludeOutboundPorts(cfg),
+		ExcludeInboundPorts(cfg),
+	}
+
+	if cfg.IPv6 {
+		result = append(result, ExcludeOutboundIPs(cfg, true))
+	}
+
+	return result
+}
+
+type member struct {
+	network *net.IPNet
+	ports   config.Range
+}
+
+func parsePort(value string) (uint32, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: %s", value, err)
+	}
+
+	return uint32(port), nil
+}
+
+// parseMember converts the member provided as the string (a CIDR or an IP
+// address for hash:net sets, or a port or a port range, i.e. 30000:32767,
+// for bitmap:port ones) so it can be added to, or deleted from the set
+func parseMember(set Set, value string) (member, error) {
+	switch set.Type {
+	case TypeHashNet:
+		network, ipv6, err := config.ParseCIDR(value)
+		if err != nil {
+			return member{}, err
+		}
+
+		if ipv6 != set.IPv6 {
+			return member{}, fmt.Errorf("%s doesn't belong to the family of the set %s",
+				value, set.Name)
+		}
+
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			return member{}, fmt.Errorf("%s sets cannot hold %s", TypeHashNet, value)
+		}
+
+		return member{network: network}, nil
+	case TypeBitmapPort:
+		bounds := strings.SplitN(value, ":", 2)
+
+		from, err := parsePort(bounds[0])
+		if err != nil {
+			return member{}, err
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			if to, err = parsePort(bounds[1]); err != nil {
+				return member{}, err
+			}
+		}
+
+		if from > to {
+			return member{}, fmt.Errorf("invalid port range %q: %d is greater than %d",
+				value, from, to)
+		}
+
+		return member{ports: config.Range{From: from, To: to}}, nil
+	default:
+		return member{}, fmt.Errorf("unsupported set type %s", set.Type)
+	}
+}
+
+// Update keeps track of the sets changed by Setup, so the changes can be
+// reverted when applying the rules referencing them fails
+type Update struct {
+	// created are the sets which didn't exist before
+	created []Set
+	// replaced are the sets which members were replaced. Until the update is
+	// committed, their previous members are held by the temporary sets
+	replaced []Set
+}
+
+// Created reports if any set had to be created
+func (u *Update) Created() bool {
+	return len(u.created) > 0
+}
+
+// Commit destroys the temporary sets holding the previous members of
+// the replaced sets
+func (u *Update) Commit() error {
+	for _, set := range u.replaced {
+		if err := destroy(set.temp()); err != nil && !isSetNotFound(err) {
+			return wrap("destroy", set.temp(), err)
+		}
+	}
+
+	u.replaced = nil
+
+	return nil
+}
+
+// Rollback restores the previous members of the replaced sets, and destroys
+// the created ones. The created sets can be destroyed only when the rules
+// referencing them were already removed
+func (u *Update) Rollback() error {
+	var errs []string
+
+	for _, set := range u.replaced {
+		if err := swap(set, set.temp()); err != nil {
+			errs = append(errs, wrap("swap", set, err).Error())
+			continue
+		}
+
+		if err := destroy(set.temp()); err != nil && !isSetNotFound(err) {
+			errs = append(errs, wrap("destroy", set.temp(), err).Error())
+		}
+	}
+
+	for _, set := range u.created {
+		if err := destroy(set); err != nil && !isSetNotFound(err) {
+			errs = append(errs, wrap("destroy", set, err).Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// replace fills the temporary set with the members and swaps it with the set,
+// so the rules referencing the set never match it partially filled.
+// Afterwards the temporary set holds the previous members of the set
+func replace(set Set, members []string) error {
+	temp := set.temp()
+
+	// the temporary set can be left behind by the interrupted update
+	if err := destroy(temp); err != nil && !isSetNotFound(err) {
+		return wrap("destroy", temp, err)
+	}
+
+	if err := create(temp); err != nil {
+		return wrap("create", temp, err)
+	}
+
+	if err := Add(temp, members...); err != nil {
+		_ = destroy(temp)
+		return err
+	}
+
+	if err := swap(set, temp); err != nil {
+		_ = destroy(temp)
+		return wrap("swap", set, err)
+	}
+
+	return nil
+}
+
+// Setup creates the sets (when they don't exist) and atomically replaces
+// their members with the ones from the configuration. As after the re-apply
+// the sets reflect the configuration, members added at runtime (i.e. with
+// AddExcludedOutboundIPs) are not kept, and have to be added again. Previous
+// members are kept until the returned update is committed or rolled back.
+// The update is returned also with the error, so the already applied changes
+// can be reverted
+func Setup(cfg config.Config) (*Update, error) {
+	cfg = config.MergeConfigWithDefaults(cfg)
+	update := &Update{}
+
+	members := setsWithMembers(cfg)
+	for _, set := range Sets(cfg) {
+		err := create(set)
+		switch {
+		case err == nil:
+			update.created = append(update.created, set)
+
+			if err := Add(set, members[set]...); err != nil {
+				return update, err
+			}
+		case isSetExists(err):
+			if err := replace(set, members[set]); err != nil {
+				return update, err
+			}
+
+			update.replaced = append(update.replaced, set)
+		default:
+			return update, wrap("create", set, err)
+		}
+	}
+
+	return update, nil
+}
+
+// Cleanup destroys all the sets created by Setup (and the temporary ones left
+// behind by the interrupted updates). Sets which don't exist are skipped.
+// The sets cannot be destroyed while the rules are still referencing them
+func Cleanup(cfg config.Config) error {
+	cfg = config.MergeConfigWithDefaults(cfg)
+
+	for _, set := range Sets(cfg) {
+		for _, s := range []Set{set, set.temp()} {
+			if err := destroy(s); err != nil && !isSetNotFound(err) {
+				return wrap("destroy", s, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Add adds the members to the set
+func Add(set Set, members ...string) error {
+	for _, m := range members {
+		if err := addDel(nl.IPSET_CMD_ADD, set, m); err != nil {
+			return fmt.Errorf("cannot add %s to set %s: %s", m, set.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Del deletes the members from the set
+func Del(set Set, members ...string) error {
+	for _, m := range members {
+		if err := addDel(nl.IPSET_CMD_DEL, set, m); err != nil {
+			return fmt.Errorf("cannot delete %s from set %s: %s", m, set.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// splitCIDRsByFamily returns sets of both families with the provided CIDRs
+// which belong to them
+func splitCIDRsByFamily(cfg config.Config, cidrs []string) (map[Set][]string, error) {
+	result := map[Set][]string{}
+
+	for _, cidr := range cidrs {
+		_, ipv6, err := config.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		if ipv6 && !cfg.IPv6 {
+			return nil, fmt.Errorf("cannot use IPv6 address %s, as IPv6 is disabled", cidr)
+		}
+
+		set := ExcludeOutboundIPs(cfg, ipv6)
+		result[set] = append(result[set], cidr)
+	}
+
+	return result, nil
+}
+
+// AddExcludedOutboundIPs excludes outbound traffic to the provided IPs
+// or CIDRs (IPv4 and IPv6) from the redirection at runtime
+func AddExcludedOutboundIPs(cfg config.Config, cidrs ...string) error {
+	cfg = config.MergeConfigWithDefaults(cfg)
+
+	sets, err := splitCIDRsByFamily(cfg, cidrs)
+	if err != nil {
+		return err
+	}
+
+	for set, members := range sets {
+		if err := Add(set, members...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveExcludedOutboundIPs removes the provided IPs or CIDRs (IPv4
+// and IPv6) from the excluded outbound IPs at runtime
+func RemoveExcludedOutboundIPs(cfg config.Config, cidrs ...string) error {
+	cfg = config.MergeConfigWithDefaults(cfg)
+
+	sets, err := splitCIDRsByFamily(cfg, cidrs)
+	if err != nil {
+		return err
+	}
+
+	for set, members := range sets {
+		if err := Del(set, members...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddExcludedOutboundPorts excludes outbound traffic to the provided ports
+// from the redirection at runtime
+func AddExcludedOutboundPorts(cfg config.Config, ports ...uint16) error {
+	return Add(ExcludeOutboundPorts(config.MergeConfigWithDefaults(cfg)), portsToMembers(ports)...)
+}
+
+// RemoveExcludedOutboundPorts removes the provided ports from the excluded
+// outbound ports at runtime
+func RemoveExcludedOutboundPorts(cfg config.Config, ports ...uint16) error {
+	return Del(ExcludeOutboundPorts(config.MergeConfigWithDefaults(cfg)), portsToMembers(ports)...)
+}
+
+// AddExcludedInboundPorts excludes inbound traffic to the provided ports
+// from the redirection at runtime
+func AddExcludedInboundPorts(cfg config.Config, ports ...uint16) error {
+	return Add(ExcludeInboundPorts(config.MergeConfigWithDefaults(cfg)), portsToMembers(ports)...)
+}
+
+// RemoveExcludedInboundPorts removes the provided ports from the excluded
+// inbound ports at runtime
+func RemoveExcludedInboundPorts(cfg config.Config, ports ...uint16) error {
+	return Del(ExcludeInboundPorts(config.MergeConfigWithDefaults(cfg)), portsToMembers(ports)...)
+}
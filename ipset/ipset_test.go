@@ -0,0 +1,119 @@
+package ipset
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("IPSet", func() {
+	It("should name the sets using the prefix and the family", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{NamePrefix: "KUMA_"},
+			IPv6:     true,
+		})
+
+		// when
+		sets := Sets(cfg)
+
+		// then
+		Expect(sets).To(Equal([]Set{
+			{Name: "KUMA_MESH_OUT_EXCLUDE_NET", Type: TypeHashNet},
+			{Name: "KUMA_MESH_OUT_EXCLUDE_PORT", Type: TypeBitmapPort},
+			{Name: "KUMA_MESH_IN_EXCLUDE_PORT", Type: TypeBitmapPort},
+			{Name: "KUMA_MESH_OUT_EXCLUDE_NET6", Type: TypeHashNet, IPv6: true},
+		}))
+	})
+
+	It("should name the temporary sets using the suffix", func() {
+		// given
+		set := Set{Name: "KUMA_MESH_OUT_EXCLUDE_NET6", Type: TypeHashNet, IPv6: true}
+
+		// when
+		temp := set.temp()
+
+		// then
+		Expect(temp).To(Equal(Set{Name: "KUMA_MESH_OUT_EXCLUDE_NET6-tmp", Type: TypeHashNet, IPv6: true}))
+		Expect(len(temp.Name)).To(BeNumerically("<=", config.IPSetMaxNameLength))
+	})
+
+	It("should report created sets", func() {
+		Expect((&Update{}).Created()).To(BeFalse())
+		Expect((&Update{replaced: []Set{{Name: "NET"}}}).Created()).To(BeFalse())
+		Expect((&Update{created: []Set{{Name: "NET"}}}).Created()).To(BeTrue())
+	})
+
+	It("should fill the sets with the members from the configuration", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{
+				Inbound: config.TrafficFlow{
+					ExcludePorts:      []uint16{22},
+					ExcludePortRanges: "30000:32767",
+				},
+				Outbound: config.TrafficFlow{
+					ExcludePorts:       []uint16{5432, 6379},
+					ExcludeOutboundIPs: []string{"10.0.0.0/8", "fd00::/8"},
+				},
+			},
+		})
+
+		// when
+		members := setsWithMembers(cfg)
+
+		// then
+		Expect(members).To(Equal(map[Set][]string{
+			ExcludeOutboundIPs(cfg, false): {"10.0.0.0/8"},
+			ExcludeOutboundPorts(cfg):      {"5432", "6379"},
+			ExcludeInboundPorts(cfg):       {"22", "30000:32767"},
+		}))
+	})
+
+	DescribeTable("should parse valid members",
+		func(set Set, value string, want string) {
+			// when
+			m, err := parseMember(set, value)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			if m.network != nil {
+				Expect(m.network.String()).To(Equal(want))
+			} else {
+				Expect(m.ports.String()).To(Equal(want))
+			}
+		},
+		Entry("IPv4 CIDR", Set{Type: TypeHashNet}, "10.1.2.3/8", "10.0.0.0/8"),
+		Entry("IPv4 address", Set{Type: TypeHashNet}, "10.1.2.3", "10.1.2.3/32"),
+		Entry("IPv6 CIDR", Set{Type: TypeHashNet, IPv6: true}, "fd00::1/8", "fd00::/8"),
+		Entry("port", Set{Type: TypeBitmapPort}, "8080", "8080"),
+		Entry("port range", Set{Type: TypeBitmapPort}, "30000:32767", "30000:32767"),
+	)
+
+	DescribeTable("should reject invalid members",
+		func(set Set, value string, errorMessage string) {
+			// when
+			_, err := parseMember(set, value)
+
+			// then
+			Expect(err).To(MatchError(ContainSubstring(errorMessage)))
+		},
+		Entry("IPv6 CIDR in IPv4 set",
+			Set{Name: "NET", Type: TypeHashNet}, "fd00::/8",
+			"fd00::/8 doesn't belong to the family of the set NET",
+		),
+		Entry("network of zero length",
+			Set{Type: TypeHashNet}, "0.0.0.0/0",
+			"hash:net sets cannot hold 0.0.0.0/0",
+		),
+		Entry("port out of range",
+			Set{Type: TypeBitmapPort}, "65536",
+			`invalid port "65536"`,
+		),
+		Entry("reversed port range",
+			Set{Type: TypeBitmapPort}, "32767:30000",
+			`invalid port range "32767:30000"`,
+		),
+	)
+})
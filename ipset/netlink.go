@@ -0,0 +1,172 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// attrIPAddrIPv6 is the attribute nested in the IPSET_ATTR_IP, which holds
+// IPv6 address (IPSET_ATTR_IPADDR_IPV6), not exported by the netlink package
+const attrIPAddrIPv6 = 2
+
+func isSetNotFound(err error) bool {
+	return errors.Is(err, syscall.ENOENT)
+}
+
+func isSetExists(err error) bool {
+	var ipsetErr nl.IPSetError
+
+	return errors.As(err, &ipsetErr) && int(ipsetErr) == nl.IPSET_ERR_EXIST
+}
+
+func newRequest(cmd int) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(cmd|(unix.NFNL_SUBSYS_IPSET<<8), nl.GetIpsetFlags(cmd))
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: uint8(unix.AF_NETLINK),
+		Version:     nl.NFNETLINK_V0,
+	})
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_PROTOCOL, nl.Uint8Attr(nl.IPSET_PROTOCOL)))
+
+	return req
+}
+
+func execute(req *nl.NetlinkRequest) error {
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) && int(errno) >= nl.IPSET_ERR_PRIVATE {
+		return nl.IPSetError(uintptr(errno))
+	}
+
+	return err
+}
+
+// createHashNet6 creates IPv6 hash:net set, as netlink.IpsetCreate is able
+// to create hash:net sets only of the IPv4 family
+func createHashNet6(name string) error {
+	req := newRequest(nl.IPSET_CMD_CREATE)
+	req.Flags |= unix.NLM_F_EXCL
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(name)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_TYPENAME, nl.ZeroTerminated(TypeHashNet)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_REVISION, nl.Uint8Attr(0)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_FAMILY, nl.Uint8Attr(unix.AF_INET6)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_DATA|int(nl.NLA_F_NESTED), nil))
+
+	return execute(req)
+}
+
+// addDelNet6 adds (or deletes) the IPv6 network to (or from) the hash:net set.
+// netlink.IpsetAdd and netlink.IpsetDel always send addresses as the IPv4 ones
+func addDelNet6(cmd int, name string, network *net.IPNet) error {
+	ones, _ := network.Mask.Size()
+
+	ip := nl.NewRtAttr(nl.IPSET_ATTR_IP|int(nl.NLA_F_NESTED), nil)
+	ip.AddChild(nl.NewRtAttr(attrIPAddrIPv6|int(nl.NLA_F_NET_BYTEORDER), network.IP.To16()))
+
+	data := nl.NewRtAttr(nl.IPSET_ATTR_DATA|int(nl.NLA_F_NESTED), nil)
+	data.AddChild(ip)
+	data.AddChild(nl.NewRtAttr(nl.IPSET_ATTR_CIDR, nl.Uint8Attr(uint8(ones))))
+
+	req := newRequest(cmd)
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(name)))
+	req.AddData(data)
+
+	return execute(req)
+}
+
+// addDelPortRange adds (or deletes) the range of ports to (or from)
+// the bitmap:port set, as netlink.IPSetEntry cannot hold port ranges
+func addDelPortRange(cmd int, name string, from uint16, to uint16) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf, from)
+	binary.BigEndian.PutUint16(buf[2:], to)
+
+	data := nl.NewRtAttr(nl.IPSET_ATTR_DATA|int(nl.NLA_F_NESTED), nil)
+	data.AddChild(nl.NewRtAttr(nl.IPSET_ATTR_PORT|int(nl.NLA_F_NET_BYTEORDER), buf[:2]))
+	data.AddChild(nl.NewRtAttr(nl.IPSET_ATTR_PORT_TO|int(nl.NLA_F_NET_BYTEORDER), buf[2:]))
+
+	req := newRequest(cmd)
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(name)))
+	req.AddData(data)
+
+	return execute(req)
+}
+
+func create(set Set) error {
+	switch {
+	case set.Type == TypeHashNet && set.IPv6:
+		return createHashNet6(set.Name)
+	case set.Type == TypeBitmapPort:
+		return netlink.IpsetCreate(set.Name, set.Type, netlink.IpsetCreateOptions{
+			PortFrom: 0,
+			PortTo:   65535,
+		})
+	default:
+		return netlink.IpsetCreate(set.Name, set.Type, netlink.IpsetCreateOptions{})
+	}
+}
+
+// addDel adds (or deletes) the member to (or from) the set. Adding a member
+// which is already in the set, or deleting the one which isn't, is not
+// treated as an error
+func addDel(cmd int, set Set, member string) error {
+	m, err := parseMember(set, member)
+	if err != nil {
+		return err
+	}
+
+	if m.network != nil && set.IPv6 {
+		return addDelNet6(cmd, set.Name, m.network)
+	}
+
+	if m.network == nil && m.ports.From != m.ports.To {
+		return addDelPortRange(cmd, set.Name, uint16(m.ports.From), uint16(m.ports.To))
+	}
+
+	// Replace prevents the netlink package from setting NLM_F_EXCL flag
+	entry := &netlink.IPSetEntry{Replace: true}
+
+	if m.network != nil {
+		ones, _ := m.network.Mask.Size()
+		entry.IP = m.network.IP.To4()
+		entry.CIDR = uint8(ones)
+	} else {
+		port := uint16(m.ports.From)
+		entry.Port = &port
+	}
+
+	if cmd == nl.IPSET_CMD_ADD {
+		return netlink.IpsetAdd(set.Name, entry)
+	}
+
+	return netlink.IpsetDel(set.Name, entry)
+}
+
+// swap exchanges the members of two sets of the same type and family. Rules
+// referencing any of them are not touched
+func swap(set Set, other Set) error {
+	req := newRequest(nl.IPSET_CMD_SWAP)
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(set.Name)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME2, nl.ZeroTerminated(other.Name)))
+
+	return execute(req)
+}
+
+func destroy(set Set) error {
+	return netlink.IpsetDestroy(set.Name)
+}
+
+func wrap(action string, set Set, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("cannot %s set %s: %s", action, set.Name, err)
+}
@@ -12,6 +12,8 @@ import (
 
 	"github.com/vishvananda/netlink"
 
+	"github.com/kumahq/kuma-net/ipset"
+	"github.com/kumahq/kuma-net/iptables/parser"
 	"github.com/kumahq/kuma-net/iptables/table"
 	"github.com/kumahq/kuma-net/transparent-proxy/config"
 )
@@ -20,17 +22,20 @@ type IPTables struct {
 	raw    *table.RawTable
 	nat    *table.NatTable
 	mangle *table.MangleTable
+	filter *table.FilterTable
 }
 
 func newIPTables(
 	raw *table.RawTable,
 	nat *table.NatTable,
 	mangle *table.MangleTable,
+	filter *table.FilterTable,
 ) *IPTables {
 	return &IPTables{
 		raw:    raw,
 		nat:    nat,
 		mangle: mangle,
+		filter: filter,
 	}
 }
 
@@ -52,6 +57,11 @@ func (t *IPTables) Build(verbose bool) string {
 		tables = append(tables, mangle)
 	}
 
+	filter := t.filter.Build(verbose)
+	if filter != "" {
+		tables = append(tables, filter)
+	}
+
 	separator := "\n"
 	if verbose {
 		separator = "\n\n"
@@ -60,24 +70,160 @@ func (t *IPTables) Build(verbose bool) string {
 	return strings.Join(tables, separator) + "\n"
 }
 
-func BuildIPTables(cfg config.Config, dnsServers []string, ipv6 bool) (string, error) {
+type tableCommands struct {
+	table    string
+	commands []string
+}
+
+// BuildCleanup returns, per table, commands which will remove all rules
+// and chains Build would install
+func (t *IPTables) BuildCleanup(verbose bool) []tableCommands {
+	return []tableCommands{
+		{table: "raw", commands: t.raw.BuildCleanup(verbose)},
+		{table: "nat", commands: t.nat.BuildCleanup(verbose)},
+		{table: "mangle", commands: t.mangle.BuildCleanup(verbose)},
+		{table: "filter", commands: t.filter.BuildCleanup(verbose)},
+	}
+}
+
+func buildIPTables(cfg config.Config, dnsServers []string, ipv6 bool) (*IPTables, error) {
 	cfg = config.MergeConfigWithDefaults(cfg)
 
-	loopbackIface, err := getLoopback()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err)
+	}
+
+	if err := validateRedirectModes(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateCommentPrefix(cfg.Redirect.NamePrefix); err != nil {
+		return nil, err
+	}
+
+	if usesSystemdResolvedStub(cfg, dnsServers) {
+		cfg = resolveSystemdResolvedUser(cfg)
+	} else {
+		// the user matters only when queries to the stub are redirected
+		cfg.Redirect.DNS.SystemdResolvedUser = ""
+	}
+
+	loopbackIface, err := GetLoopback()
 	if err != nil {
-		return "", fmt.Errorf("cannot obtain loopback interface: %s", err)
+		return nil, fmt.Errorf("cannot obtain loopback interface: %s", err)
 	}
 
 	natTable, err := buildNatTable(cfg, dnsServers, loopbackIface.Name, ipv6)
 	if err != nil {
-		return "", fmt.Errorf("build nat table: %s", err)
+		return nil, fmt.Errorf("build nat table: %s", err)
+	}
+
+	filterTable, err := buildFilterTable(cfg, loopbackIface.Name, ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("build filter table: %s", err)
 	}
 
 	return newIPTables(
-		buildRawTable(cfg, dnsServers),
+		buildRawTable(cfg, dnsServers, ipv6),
 		natTable,
-		buildMangleTable(cfg),
-	).Build(cfg.Verbose), nil
+		buildMangleTable(cfg, loopbackIface.Name, ipv6),
+		filterTable,
+	), nil
+}
+
+func validateRedirectMode(name string, mode config.RedirectMode) error {
+	switch mode {
+	case config.RedirectModeRedirect, config.RedirectModeTProxy:
+		return nil
+	default:
+		return fmt.Errorf("unknown %s redirect mode %q, only %q or %q allowed",
+			name, mode, config.RedirectModeRedirect, config.RedirectModeTProxy)
+	}
+}
+
+func validateRedirectModes(cfg config.Config) error {
+	if err := validateRedirectMode("inbound", cfg.Redirect.Inbound.Mode); err != nil {
+		return err
+	}
+
+	if err := validateRedirectMode("outbound", cfg.Redirect.Outbound.Mode); err != nil {
+		return err
+	}
+
+	if cfg.Redirect.Outbound.Mode == config.RedirectModeTProxy {
+		return fmt.Errorf("%s redirect mode is supported only for the inbound traffic",
+			config.RedirectModeTProxy)
+	}
+
+	return nil
+}
+
+func BuildIPTables(cfg config.Config, dnsServers []string, ipv6 bool) (string, error) {
+	cfg = config.MergeConfigWithDefaults(cfg)
+
+	tables, err := buildIPTables(cfg, dnsServers, ipv6)
+	if err != nil {
+		return "", err
+	}
+
+	return tables.Build(cfg.Verbose), nil
+}
+
+// buildFamiliesIPTables resolves DNS servers and builds the rules for IPv4
+// and, when IPv6 is enabled, for IPv6 (nil otherwise). It's used by both
+// the dry run and the real run, so the rules displayed by the dry run are
+// exactly the ones which would be applied
+func buildFamiliesIPTables(cfg config.Config) (*IPTables, *IPTables, error) {
+	dnsIpv4, dnsIpv6, err := GetDnsServersIfNecessary(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// servers read from the resolv.conf file are stored in the configuration,
+	// so the IPv6 rules know if the systemd-resolved stub is used as well
+	if len(cfg.Redirect.DNS.Servers) == 0 {
+		cfg.Redirect.DNS.Servers = append(append([]string{}, dnsIpv4...), dnsIpv6...)
+	}
+
+	ipv4, err := buildIPTables(cfg, dnsIpv4, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to build ipv4 iptable rules: %s", err)
+	}
+
+	if !cfg.IPv6 {
+		return ipv4, nil, nil
+	}
+
+	ipv6, err := buildIPTables(cfg, dnsIpv6, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to build ipv6 iptable rules: %s", err)
+	}
+
+	return ipv4, ipv6, nil
+}
+
+// BuildIPTablesDryRun returns the rules RestoreIPTables would install with
+// the same configuration, for IPv4 and (when enabled) IPv6, in the
+// iptables-restore format. Rules of every family are preceded by the comment
+// with the name of the family, so the output can be still passed to
+// iptables-restore
+func BuildIPTablesDryRun(cfg config.Config) (string, error) {
+	cfg = config.MergeConfigWithDefaults(cfg)
+
+	ipv4, ipv6, err := buildFamiliesIPTables(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	output := fmt.Sprintf("# IPv4 rules (%s)\n%s",
+		cfg.IPTables.Executable("iptables-restore", false), ipv4.Build(cfg.Verbose))
+
+	if ipv6 != nil {
+		output += fmt.Sprintf("\n# IPv6 rules (%s)\n%s",
+			cfg.IPTables.Executable("iptables-restore", true), ipv6.Build(cfg.Verbose))
+	}
+
+	return output, nil
 }
 
 // runtimeOutput is the file (should be os.Stdout by default) where we can dump generated
@@ -112,8 +258,8 @@ func createRulesFile(ipv6 bool) (*os.File, error) {
 	return f, nil
 }
 
-func runRestoreCmd(cmdName string, f *os.File) (string, error) {
-	cmd := exec.Command(cmdName, "--noflush", f.Name())
+func runRestoreCmd(cmdName string, f *os.File, flags ...string) (string, error) {
+	cmd := exec.Command(cmdName, append(flags, f.Name())...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("executing command failed: %s (with output: %q)", err, output)
@@ -122,86 +268,198 @@ func runRestoreCmd(cmdName string, f *os.File) (string, error) {
 	return string(output), nil
 }
 
-func restoreIPTables(cfg config.Config, dnsServers []string, ipv6 bool) (string, error) {
-	rulesFile, err := createRulesFile(cfg.IPv6)
+// buildRestore returns the iptables-restore input, which installs the desired
+// rules unless they are already installed (according to the provided
+// iptables-save output). Returned bool reports if anything has to be changed
+func buildRestore(
+	cfg config.Config,
+	tables *IPTables,
+	snapshot string,
+) (string, bool, error) {
+	desired, err := parser.Parse(strings.NewReader(tables.Build(false)))
 	if err != nil {
-		return "", err
+		return "", false, fmt.Errorf("unable to parse built iptables rules: %s", err)
 	}
-	defer rulesFile.Close()
-	defer os.Remove(rulesFile.Name())
 
-	err = configureIPv6Address(ipv6)
+	current, err := parser.Parse(strings.NewReader(snapshot))
 	if err != nil {
-		return "", err
+		return "", false, fmt.Errorf("unable to parse installed iptables rules: %s", err)
 	}
 
-	rules, err := BuildIPTables(cfg, dnsServers, ipv6)
+	return buildIPTablesUpdate(desired, current, cfg.Redirect.NamePrefix)
+}
+
+// restoreIPTables applies the iptables-restore input returned by buildRestore
+func restoreIPTables(cfg config.Config, rules string, ipv6 bool) (string, error) {
+	rulesFile, err := createRulesFile(ipv6)
 	if err != nil {
-		return "", fmt.Errorf("unable to build iptable rules: %s", err)
+		return "", err
 	}
+	defer rulesFile.Close()
+	defer os.Remove(rulesFile.Name())
 
 	if err := saveIPTablesRestoreFile(cfg.RuntimeStdout, rulesFile, rules); err != nil {
 		return "", fmt.Errorf("unable to save iptables restore file: %s", err)
 	}
 
-	cmdName := "iptables-restore"
-	if ipv6 {
-		cmdName = "ip6tables-restore"
-	}
+	cmdName := cfg.IPTables.Executable("iptables-restore", ipv6)
 
-	return runRestoreCmd(cmdName, rulesFile)
+	// the restore could be applied partially, as every table is committed
+	// separately
+	return runRestoreCmd(cmdName, rulesFile, "--noflush")
 }
 
-// RestoreIPTables
+// RestoreResult describes the outcome of RestoreIPTables
+type RestoreResult struct {
+	Output string
+	// Changed is false when all the rules were already installed, so nothing
+	// had to be applied
+	Changed bool
+}
+
+// RestoreIPTables installs the rules, or updates the previously installed
+// ones, so it can be safely run more than once
 // TODO (bartsmykla): add validation if ip{,6}tables are available
-func RestoreIPTables(cfg config.Config) (string, error) {
-	cfg = config.MergeConfigWithDefaults(cfg)
+func RestoreIPTables(cfg config.Config) (*RestoreResult, error) {
+	cfg, err := resolveIPTablesMode(config.MergeConfigWithDefaults(cfg))
+	if err != nil {
+		return nil, err
+	}
 
 	_, _ = cfg.RuntimeStdout.Write([]byte("kumactl is about to apply the " +
 		"iptables rules that will enable transparent proxying on the machine. " +
 		"The SSH connection may drop. If that happens, just reconnect again.\n"))
 
-	var err error
-	var dnsIpv6, dnsIpv4 []string
+	ipv4Tables, ipv6Tables, err := buildFamiliesIPTables(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := takeSnapshots(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	if cfg.ShouldRedirectDNS() && !cfg.ShouldCaptureAllDNS() {
-		dnsIpv4, dnsIpv6, err = GetDnsServers(cfg.Redirect.DNS.ResolvConfigPath)
+	result := &RestoreResult{}
+	state := &rollbackState{snapshots: snapshots}
+
+	// sets have to exist before the rules referencing them are restored
+	if cfg.ShouldUseIPSet() {
+		state.ipsets, err = ipset.Setup(cfg)
 		if err != nil {
-			return "", err
+			return nil, state.rollback(cfg, fmt.Errorf("cannot setup ipset sets: %s", err))
 		}
 	}
 
-	output, err := restoreIPTables(cfg, dnsIpv4, false)
+	rules, changed, err := buildRestore(cfg, ipv4Tables, snapshots.ipv4)
 	if err != nil {
-		return "", fmt.Errorf("cannot restore ipv4 iptable rules: %s", err)
+		return nil, state.rollback(cfg, err)
 	}
 
+	var ipv6Rules string
+	var ipv6Changed bool
+
 	if cfg.IPv6 {
-		ipv6Output, err := restoreIPTables(cfg, dnsIpv6, true)
+		ipv6Rules, ipv6Changed, err = buildRestore(cfg, ipv6Tables, snapshots.ipv6)
 		if err != nil {
-			return "", fmt.Errorf("cannot restore ipv6 iptable rules: %s", err)
+			return nil, state.rollback(cfg, err)
 		}
+	}
 
-		output += ipv6Output
+	// rules of both families are tested before any of them is applied, so
+	// the rules rejected by iptables don't leave the previous ones half
+	// replaced
+	if changed {
+		if err := testRestore(cfg, rules, false, "--noflush"); err != nil {
+			return nil, state.rollback(cfg, err)
+		}
+	}
+
+	if ipv6Changed {
+		if err := testRestore(cfg, ipv6Rules, true, "--noflush"); err != nil {
+			return nil, state.rollback(cfg, err)
+		}
+	}
+
+	if cfg.ShouldConfigureTProxyRouting() {
+		state.ipv4Routing, err = configureTProxyRouting(cfg, false)
+		if err != nil {
+			return nil, state.rollback(cfg, err)
+		}
+	}
+
+	if changed {
+		output, err := restoreIPTables(cfg, rules, false)
+		state.ipv4 = true
+		if err != nil {
+			return nil, state.rollback(cfg, fmt.Errorf("cannot restore ipv4 iptable rules: %s", err))
+		}
+
+		result.Output = output
+	}
+
+	result.Changed = changed || state.ipv4Routing ||
+		(state.ipsets != nil && state.ipsets.Created())
+
+	if cfg.IPv6 {
+		state.ipv6Address, err = configureIPv6Address(true)
+		if err != nil {
+			return nil, state.rollback(cfg, err)
+		}
+
+		if cfg.ShouldConfigureTProxyRouting() {
+			state.ipv6Routing, err = configureTProxyRouting(cfg, true)
+			if err != nil {
+				return nil, state.rollback(cfg, err)
+			}
+		}
+
+		if ipv6Changed {
+			ipv6Output, err := restoreIPTables(cfg, ipv6Rules, true)
+			state.ipv6 = true
+			if err != nil {
+				return nil, state.rollback(cfg, fmt.Errorf("cannot restore ipv6 iptable rules: %s", err))
+			}
+
+			result.Output += ipv6Output
+		}
+
+		result.Changed = result.Changed || ipv6Changed || state.ipv6Address ||
+			state.ipv6Routing
+	}
+
+	// previous members of the sets are not needed anymore
+	if state.ipsets != nil {
+		if err := state.ipsets.Commit(); err != nil {
+			_, _ = fmt.Fprintf(cfg.RuntimeStdout, "[WARNING] %s\n", err)
+		}
+	}
+
+	if !result.Changed {
+		_, _ = cfg.RuntimeStdout.Write([]byte("iptables rules diverging the " +
+			"traffic to Envoy are already installed, nothing changed.\n"))
+
+		return result, nil
 	}
 
 	_, _ = cfg.RuntimeStdout.Write([]byte("iptables set to diverge the traffic " +
 		"to Envoy.\n"))
 
-	return output, nil
+	return result, nil
 }
 
 // configureIPv6Address sets up a new IP address on local interface. This is needed
 // for IPv6 but not IPv4, as IPv4 defaults to `netmask 255.0.0.0`, which allows binding to addresses
 // in the 127.x.y.z range, while IPv6 defaults to `prefixlen 128` which allows binding only to ::1.
-// Equivalent to `ip -6 addr add "::6/128" dev lo`
-func configureIPv6Address(ipv6 bool) error {
+// Equivalent to `ip -6 addr add "::6/128" dev lo`. Returned bool reports if
+// the address was added (it's false when the address was already configured)
+func configureIPv6Address(ipv6 bool) (bool, error) {
 	if !ipv6 {
-		return nil
+		return false, nil
 	}
 	link, err := netlink.LinkByName("lo")
 	if err != nil {
-		return fmt.Errorf("failed to find 'lo' link: %v", err)
+		return false, fmt.Errorf("failed to find 'lo' link: %v", err)
 	}
 	// Equivalent to `ip -6 addr add "::6/128" dev lo`
 	address := &net.IPNet{IP: net.ParseIP("::6"), Mask: net.CIDRMask(128, 128)}
@@ -209,9 +467,9 @@ func configureIPv6Address(ipv6 bool) error {
 
 	err = netlink.AddrAdd(link, addr)
 	if ignoreExists(err) != nil {
-		return fmt.Errorf("failed to add IPv6 inbound address: %v", err)
+		return false, fmt.Errorf("failed to add IPv6 inbound address: %v", err)
 	}
-	return nil
+	return err == nil, nil
 }
 
 func ignoreExists(err error) error {
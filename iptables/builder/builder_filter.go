@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"fmt"
+	"net"
+
+	. "github.com/kumahq/kuma-net/iptables/chain"
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	. "github.com/kumahq/kuma-net/iptables/parameters/match/conntrack"
+	"github.com/kumahq/kuma-net/iptables/table"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+const (
+	rejectWithTcpReset              = "tcp-reset"
+	rejectWithICMPPortUnreachable   = "icmp-port-unreachable"
+	rejectWithICMPv6PortUnreachable = "icmp6-port-unreachable"
+)
+
+// buildEgressLockdown returns the chain which rejects outbound traffic
+// which bypassed the sidecar. Traffic redirected to the sidecar is already
+// going through the loopback interface when it reaches the filter table, so
+// only the traffic which escaped the redirection will be rejected
+func buildEgressLockdown(cfg config.Config, loopback string, ipv6 bool) (*Chain, error) {
+	prefix := cfg.Redirect.NamePrefix
+	lockdown := cfg.EgressLockdown
+
+	rejectUdpWith := rejectWithICMPPortUnreachable
+	if ipv6 {
+		rejectUdpWith = rejectWithICMPv6PortUnreachable
+	}
+
+	egressLockdown := NewChain(lockdown.Chain.GetFullName(prefix)).
+		Append(
+			OutInterface(loopback),
+			comment(prefix, ReasonLoopback),
+			Jump(Return()),
+		)
+
+	for _, sidecar := range sidecarMatches(cfg) {
+		egressLockdown.Append(
+			sidecar,
+			comment(prefix, ReasonSidecarOwned),
+			Jump(Return()),
+		)
+	}
+
+	egressLockdown.
+		// responses for the inbound connections (i.e. to the excluded inbound
+		// ports), and connections established before the lockdown
+		Append(
+			Match(Conntrack(Ctstate(ESTABLISHED, RELATED))),
+			comment(prefix, ReasonEgressEstablished),
+			Jump(Return()),
+		)
+
+	for _, allowed := range lockdown.AllowedIPs {
+		ip, _, err := net.ParseCIDR(allowed)
+		if err != nil {
+			if ip = net.ParseIP(allowed); ip == nil {
+				return nil, fmt.Errorf("invalid allowed IP or CIDR: %q", allowed)
+			}
+		}
+
+		// if is ipv6 and address is ipv6 or is ipv4 and address is ipv4
+		if (ipv6 && ip.To4() == nil) || (!ipv6 && ip.To4() != nil) {
+			egressLockdown.Append(
+				Destination(allowed),
+				comment(prefix, ReasonEgressAllowedIP),
+				Jump(Return()),
+			)
+		}
+	}
+
+	for _, port := range lockdown.AllowedPorts {
+		egressLockdown.
+			Append(
+				Protocol(Tcp(DestinationPort(port))),
+				comment(prefix, ReasonEgressAllowedPort),
+				Jump(Return()),
+			).
+			Append(
+				Protocol(Udp(DestinationPort(port))),
+				comment(prefix, ReasonEgressAllowedPort),
+				Jump(Return()),
+			)
+	}
+
+	return egressLockdown.
+		Append(
+			Protocol(Tcp()),
+			comment(prefix, ReasonEgressReject),
+			Jump(Reject(rejectWithTcpReset)),
+		).
+		Append(
+			Protocol(Udp()),
+			comment(prefix, ReasonEgressReject),
+			Jump(Reject(rejectUdpWith)),
+		), nil
+}
+
+func buildFilterTable(cfg config.Config, loopback string, ipv6 bool) (*table.FilterTable, error) {
+	filter := table.Filter()
+
+	if !cfg.ShouldLockdownEgress() {
+		return filter, nil
+	}
+
+	egressLockdown, err := buildEgressLockdown(cfg, loopback, ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("could not build egress lockdown chain: %s", err)
+	}
+
+	filter.Output().Append(
+		comment(cfg.Redirect.NamePrefix, ReasonEgressLockdown),
+		Jump(ToUserDefinedChain(egressLockdown.Name())),
+	)
+
+	return filter.WithChain(egressLockdown), nil
+}
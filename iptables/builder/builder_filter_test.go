@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Builder filter", func() {
+	DescribeTable("should build egress lockdown rules",
+		func(lockdown config.EgressLockdown, ipv6 bool, expect ...string) {
+			// given
+			cfg := config.MergeConfigWithDefaults(config.Config{
+				EgressLockdown: lockdown,
+			})
+
+			// when
+			filter, err := buildFilterTable(cfg, "lo", ipv6)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Split(filter.Build(false), "\n")).To(Equal(expect))
+		},
+		Entry("ipv4 with allowed addresses and ports",
+			config.EgressLockdown{
+				Enabled:      true,
+				AllowedIPs:   []string{"10.0.0.0/8", "fd00::/8", "169.254.169.254"},
+				AllowedPorts: []uint16{22},
+			},
+			false,
+			"* filter",
+			"-N MESH_EGRESS_LOCKDOWN",
+			"-A OUTPUT -m comment --comment kuma-net:dev::egress-lockdown -j MESH_EGRESS_LOCKDOWN",
+			"-A MESH_EGRESS_LOCKDOWN -o lo -m comment --comment kuma-net:dev::loopback -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -m conntrack --ctstate ESTABLISHED,RELATED -m comment --comment kuma-net:dev::egress-established -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -d 10.0.0.0/8 -m comment --comment kuma-net:dev::egress-allowed-ip -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -d 169.254.169.254 -m comment --comment kuma-net:dev::egress-allowed-ip -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -p tcp --dport 22 -m comment --comment kuma-net:dev::egress-allowed-port -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -p udp --dport 22 -m comment --comment kuma-net:dev::egress-allowed-port -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -p tcp -m comment --comment kuma-net:dev::egress-reject -j REJECT --reject-with tcp-reset",
+			"-A MESH_EGRESS_LOCKDOWN -p udp -m comment --comment kuma-net:dev::egress-reject -j REJECT --reject-with icmp-port-unreachable",
+			"COMMIT",
+		),
+		Entry("ipv6",
+			config.EgressLockdown{
+				Enabled:    true,
+				AllowedIPs: []string{"10.0.0.0/8", "fd00::/8"},
+			},
+			true,
+			"* filter",
+			"-N MESH_EGRESS_LOCKDOWN",
+			"-A OUTPUT -m comment --comment kuma-net:dev::egress-lockdown -j MESH_EGRESS_LOCKDOWN",
+			"-A MESH_EGRESS_LOCKDOWN -o lo -m comment --comment kuma-net:dev::loopback -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -m conntrack --ctstate ESTABLISHED,RELATED -m comment --comment kuma-net:dev::egress-established -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -d fd00::/8 -m comment --comment kuma-net:dev::egress-allowed-ip -j RETURN",
+			"-A MESH_EGRESS_LOCKDOWN -p tcp -m comment --comment kuma-net:dev::egress-reject -j REJECT --reject-with tcp-reset",
+			"-A MESH_EGRESS_LOCKDOWN -p udp -m comment --comment kuma-net:dev::egress-reject -j REJECT --reject-with icmp6-port-unreachable",
+			"COMMIT",
+		),
+	)
+
+	It("should not build any rules when egress lockdown is disabled", func() {
+		// when
+		filter, err := buildFilterTable(config.MergeConfigWithDefaults(config.Config{}), "lo", false)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filter.Build(false)).To(BeEmpty())
+	})
+
+	It("should return error for invalid allowed address", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			EgressLockdown: config.EgressLockdown{
+				Enabled:    true,
+				AllowedIPs: []string{"10.0.0.0/33"},
+			},
+		})
+
+		// when
+		_, err := buildFilterTable(cfg, "lo", false)
+
+		// then
+		Expect(err).To(MatchError(`could not build egress lockdown chain: invalid allowed IP or CIDR: "10.0.0.0/33"`))
+	})
+})
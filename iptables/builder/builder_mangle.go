@@ -1,20 +1,405 @@
 package builder
 
 import (
+	"fmt"
+
+	"github.com/kumahq/kuma-net/ipset"
+	. "github.com/kumahq/kuma-net/iptables/chain"
+	. "github.com/kumahq/kuma-net/iptables/consts"
 	. "github.com/kumahq/kuma-net/iptables/parameters"
 	. "github.com/kumahq/kuma-net/iptables/parameters/match/conntrack"
 	"github.com/kumahq/kuma-net/iptables/table"
 	"github.com/kumahq/kuma-net/transparent-proxy/config"
 )
 
-func buildMangleTable(cfg config.Config) *table.MangleTable {
+// tproxyMark returns the mark used by the tproxy redirect mode in the format
+// printed by iptables-save (i.e. "0x539")
+func tproxyMark(cfg config.Config) string {
+	return fmt.Sprintf("0x%x", cfg.Redirect.TProxy.Mark)
+}
+
+// tproxyMarkWithMask returns the mark with the mask in the format printed
+// by iptables-save (i.e. "0x539/0xffffffff")
+func tproxyMarkWithMask(cfg config.Config) string {
+	return tproxyMark(cfg) + "/0xffffffff"
+}
+
+// buildMeshInboundTProxy builds the mangle MESH_INBOUND chain used by the tproxy
+// redirect mode. Packets of the connections already accepted by the proxy
+// (which has to use transparent sockets) are marked and delivered locally,
+// new connections are diverted to the proxy by the TPROXY target
+func buildMeshInboundTProxy(cfg config.Config, ipv6 bool) *Chain {
+	prefix := cfg.Redirect.NamePrefix
+	inbound := cfg.Redirect.Inbound
+	inboundRedirectChainName := inbound.RedirectChain.GetFullName(prefix)
+	divertChainName := cfg.Redirect.TProxy.DivertChain.GetFullName(prefix)
+
+	meshInbound := NewChain(inbound.Chain.GetFullName(prefix))
+
+	// Excluded inbound sources
+	for _, cidr := range config.CIDRsOfFamily(inbound.ExcludeInboundSourceIPs, ipv6) {
+		meshInbound.Append(
+			Source(Address(cidr)),
+			comment(prefix, ReasonExcludeInboundSource),
+			Jump(Return()),
+		)
+	}
+
+	if !inbound.HasIncludedPorts() {
+		// Excluded inbound ports
+		excludedPortsSet := setNameIf(cfg, ipset.ExcludeInboundPorts(cfg))
+		for _, ports := range excludedPorts(inbound.ExcludedPorts(), excludedPortsSet) {
+			meshInbound.Append(withPorts(nil, ports,
+				comment(prefix, ReasonExcludeInboundPort),
+				Jump(Return()),
+			)...)
+		}
+	}
+
+	meshInbound.Append(
+		Protocol(Tcp()),
+		Match(Socket(Transparent())),
+		comment(prefix, ReasonTransparentSocket),
+		Jump(ToUserDefinedChain(divertChainName)),
+	)
+
+	// Include inbound ports
+	for _, ports := range destinationPorts(Tcp, inbound.IncludedPorts()) {
+		meshInbound.Append(withPorts(nil, ports,
+			comment(prefix, ReasonIncludeInboundPort),
+			Jump(ToUserDefinedChain(inboundRedirectChainName)),
+		)...)
+	}
+
+	if !inbound.HasIncludedPorts() {
+		meshInbound.Append(
+			Protocol(Tcp()),
+			comment(prefix, ReasonRedirectInbound),
+			Jump(ToUserDefinedChain(inboundRedirectChainName)),
+		)
+	}
+
+	return meshInbound
+}
+
+func buildMeshInboundDivert(cfg config.Config) *Chain {
+	prefix := cfg.Redirect.NamePrefix
+
+	return NewChain(cfg.Redirect.TProxy.DivertChain.GetFullName(prefix)).
+		Append(
+			comment(prefix, ReasonDivertMark),
+			Jump(SetMark(tproxyMarkWithMask(cfg))),
+		).
+		Append(
+			comment(prefix, ReasonDivertAccept),
+			Jump(Accept()),
+		)
+}
+
+// tproxyTo returns the TPROXY target diverting the traffic to the provided
+// port and address, marking it so it will be delivered locally
+func tproxyTo(cfg config.Config, port uint16, address string) *JumpParameter {
+	return TProxy(
+		OnPort(port),
+		OnIP(address),
+		TProxyMark(tproxyMarkWithMask(cfg)),
+	)
+}
+
+func buildMeshInboundTProxyRedirect(cfg config.Config, ipv6 bool) *Chain {
+	prefix := cfg.Redirect.NamePrefix
+	inbound := cfg.Redirect.Inbound
+	chainName := inbound.RedirectChain.GetFullName(prefix)
+
+	localhost := LocalhostCIDRIPv4
+	anyAddress := "0.0.0.0"
+	redirectPort := inbound.Port
+	if ipv6 {
+		localhost = LocalhostCIDRIPv6
+		anyAddress = "::"
+		if inbound.PortIPv6 != 0 {
+			redirectPort = inbound.PortIPv6
+		}
+	}
+
+	return NewChain(chainName).
+		Append(
+			NotDestination(localhost),
+			Protocol(Tcp()),
+			comment(prefix, ReasonInboundListener),
+			Jump(tproxyTo(cfg, redirectPort, anyAddress)),
+		)
+}
+
+func udpPort(cfg config.UDP, ipv6 bool) uint16 {
+	if ipv6 && cfg.PortIPv6 != 0 {
+		return cfg.PortIPv6
+	}
+
+	return cfg.Port
+}
+
+// buildMeshInboundUDP builds the chain which diverts the inbound UDP traffic
+// to the proxy's UDP listener. Datagrams of the flows already handled by
+// the proxy's transparent sockets are delivered to them directly
+func buildMeshInboundUDP(cfg config.Config, loopback string, ipv6 bool) *Chain {
+	prefix := cfg.Redirect.NamePrefix
+	udp := cfg.Redirect.Inbound.UDP
+	divertChainName := cfg.Redirect.TProxy.DivertChain.GetFullName(prefix)
+
+	localhost := LocalhostCIDRIPv4
+	anyAddress := "0.0.0.0"
+	if ipv6 {
+		localhost = LocalhostCIDRIPv6
+		anyAddress = "::"
+	}
+
+	meshInboundUDP := NewChain(udp.Chain.GetFullName(prefix)).
+		// locally generated traffic is handled by the outbound rules
+		Append(
+			InInterface(loopback),
+			comment(prefix, ReasonLoopback),
+			Jump(Return()),
+		).
+		// responses to the flows initiated from this machine
+		Append(
+			Protocol(Udp()),
+			Match(Conntrack(Ctdir(REPLY))),
+			comment(prefix, ReasonReply),
+			Jump(Return()),
+		)
+
+	// Excluded inbound sources
+	for _, cidr := range config.CIDRsOfFamily(cfg.Redirect.Inbound.ExcludeInboundSourceIPs, ipv6) {
+		meshInboundUDP.Append(
+			Source(Address(cidr)),
+			comment(prefix, ReasonExcludeInboundSource),
+			Jump(Return()),
+		)
+	}
+
+	if !udp.HasIncludedPorts() {
+		// Excluded inbound UDP ports
+		for _, ports := range destinationPorts(Udp, udp.ExcludedPorts()) {
+			meshInboundUDP.Append(withPorts(nil, ports,
+				comment(prefix, ReasonExcludeInboundUDPPort),
+				Jump(Return()),
+			)...)
+		}
+	}
+
+	meshInboundUDP.Append(
+		Protocol(Udp()),
+		Match(Socket(Transparent())),
+		comment(prefix, ReasonTransparentSocket),
+		Jump(ToUserDefinedChain(divertChainName)),
+	)
+
+	tproxy := tproxyTo(cfg, udpPort(udp, ipv6), anyAddress)
+
+	// Include inbound UDP ports
+	for _, ports := range destinationPorts(Udp, udp.IncludedPorts()) {
+		meshInboundUDP.Append(withPorts([]*Parameter{NotDestination(localhost)}, ports,
+			comment(prefix, ReasonIncludeInboundUDPPort),
+			Jump(tproxy),
+		)...)
+	}
+
+	if !udp.HasIncludedPorts() {
+		meshInboundUDP.Append(
+			NotDestination(localhost),
+			Protocol(Udp()),
+			comment(prefix, ReasonRedirectInboundUDP),
+			Jump(tproxy),
+		)
+	}
+
+	return meshInboundUDP
+}
+
+// buildMeshOutboundUDP builds the chain which marks the outbound UDP traffic,
+// so it will be routed through the loopback interface, where it's diverted
+// to the proxy's UDP listener in the PREROUTING chain (TPROXY target is not
+// valid in the OUTPUT chain)
+func buildMeshOutboundUDP(cfg config.Config, ipv6 bool) *Chain {
+	prefix := cfg.Redirect.NamePrefix
+	udp := cfg.Redirect.Outbound.UDP
+
+	localhost := LocalhostCIDRIPv4
+	if ipv6 {
+		localhost = LocalhostCIDRIPv6
+	}
+
+	meshOutboundUDP := NewChain(udp.Chain.GetFullName(prefix)).
+		// responses to the flows accepted by this machine (including
+		// the ones from the proxy's upstream sockets)
+		Append(
+			Protocol(Udp()),
+			Match(Conntrack(Ctdir(REPLY))),
+			comment(prefix, ReasonReply),
+			Jump(Return()),
+		)
+
+	for _, sidecar := range sidecarMatches(cfg) {
+		meshOutboundUDP.Append(
+			sidecar,
+			comment(prefix, ReasonSidecarOwned),
+			Jump(Return()),
+		)
+	}
+
+	// Excluded outbound ports for UIDs
+	for _, uIDsToPorts := range cfg.Redirect.Outbound.ExcludePortsForUIDs {
+		if uIDsToPorts.Protocol != UDP {
+			continue
+		}
+
+		meshOutboundUDP.Append(
+			Protocol(Udp(DestinationPortRangeOrValue(uIDsToPorts))),
+			Match(Owner(UidRangeOrValue(uIDsToPorts))),
+			comment(prefix, ReasonExcludeOutboundPortForUID),
+			Jump(Return()),
+		)
+	}
+
+	// DNS traffic is redirected by the nat table rules
+	meshOutboundUDP.
+		AppendIf(cfg.ShouldRedirectDNS,
+			Protocol(Udp(DestinationPort(DNSPort))),
+			comment(prefix, ReasonDNS),
+			Jump(Return()),
+		).
+		Append(
+			Destination(localhost),
+			comment(prefix, ReasonLocalhost),
+			Jump(Return()),
+		)
+
+	if !udp.HasIncludedPorts() {
+		// Excluded outbound UDP ports
+		for _, ports := range destinationPorts(Udp, udp.ExcludedPorts()) {
+			meshOutboundUDP.Append(withPorts(nil, ports,
+				comment(prefix, ReasonExcludeOutboundUDPPort),
+				Jump(Return()),
+			)...)
+		}
+
+		meshOutboundUDP.Append(
+			Protocol(Udp()),
+			comment(prefix, ReasonRedirectOutboundUDP),
+			Jump(SetMark(tproxyMarkWithMask(cfg))),
+		)
+	}
+
+	// Include outbound UDP ports
+	for _, ports := range destinationPorts(Udp, udp.IncludedPorts()) {
+		meshOutboundUDP.Append(withPorts(nil, ports,
+			comment(prefix, ReasonIncludeOutboundUDPPort),
+			Jump(SetMark(tproxyMarkWithMask(cfg))),
+		)...)
+	}
+
+	return meshOutboundUDP
+}
+
+func buildMangleTable(cfg config.Config, loopback string, ipv6 bool) *table.MangleTable {
+	prefix := cfg.Redirect.NamePrefix
 	mangle := table.Mangle()
 
 	mangle.Prerouting().
 		AppendIf(cfg.ShouldDropInvalidPackets,
 			Match(Conntrack(Ctstate(INVALID))),
+			comment(prefix, ReasonDropInvalid),
 			Jump(Drop()),
 		)
 
+	if cfg.ShouldInterceptOutboundUDP() {
+		localhost := "127.0.0.1"
+		if ipv6 {
+			localhost = "::1"
+		}
+
+		// outbound UDP traffic marked in MESH_OUTBOUND_UDP is looped back
+		// through the loopback interface
+		mangle.Prerouting().Append(
+			InInterface(loopback),
+			Protocol(Udp()),
+			Match(Mark(tproxyMark(cfg))),
+			comment(prefix, ReasonOutboundListener),
+			Jump(tproxyTo(cfg, udpPort(cfg.Redirect.Outbound.UDP, ipv6), localhost)),
+		)
+	}
+
+	if cfg.ShouldTProxyInbound() {
+		mangle.Prerouting().Append(
+			Protocol(Tcp()),
+			comment(prefix, ReasonCaptureInbound),
+			Jump(ToUserDefinedChain(cfg.Redirect.Inbound.Chain.GetFullName(prefix))),
+		)
+	}
+
+	if cfg.ShouldInterceptInboundUDP() {
+		mangle.Prerouting().Append(
+			Protocol(Udp()),
+			comment(prefix, ReasonCaptureInboundUDP),
+			Jump(ToUserDefinedChain(cfg.Redirect.Inbound.UDP.Chain.GetFullName(prefix))),
+		)
+	}
+
+	// the proxy marks its upstream connections, which preserve the original
+	// source address, so the responses of the application (restored from
+	// the connection mark) will be routed locally back to the proxy
+	var protocols []*ProtocolParameter
+	if cfg.ShouldTProxyInbound() {
+		protocols = append(protocols, Tcp())
+	}
+	if cfg.ShouldInterceptInboundUDP() {
+		protocols = append(protocols, Udp())
+	}
+
+	for _, protocol := range protocols {
+		mangle.Output().
+			Append(
+				Protocol(protocol),
+				Match(Connmark(tproxyMark(cfg))),
+				comment(prefix, ReasonRestoreMark),
+				Jump(RestoreMark()),
+			).
+			Append(
+				Protocol(protocol),
+				Match(Mark(tproxyMark(cfg))),
+				comment(prefix, ReasonSaveMark),
+				Jump(SaveMark()),
+			)
+	}
+
+	if cfg.ShouldInterceptOutboundUDP() {
+		mangle.Output().Append(
+			Protocol(Udp()),
+			comment(prefix, ReasonCaptureOutboundUDP),
+			Jump(ToUserDefinedChain(cfg.Redirect.Outbound.UDP.Chain.GetFullName(prefix))),
+		)
+	}
+
+	if cfg.ShouldTProxyInbound() {
+		mangle.WithChain(buildMeshInboundTProxy(cfg, ipv6))
+	}
+
+	if cfg.ShouldInterceptInboundUDP() {
+		mangle.WithChain(buildMeshInboundUDP(cfg, loopback, ipv6))
+	}
+
+	if cfg.ShouldTProxyInbound() || cfg.ShouldInterceptInboundUDP() {
+		mangle.WithChain(buildMeshInboundDivert(cfg))
+	}
+
+	if cfg.ShouldTProxyInbound() {
+		mangle.WithChain(buildMeshInboundTProxyRedirect(cfg, ipv6))
+	}
+
+	if cfg.ShouldInterceptOutboundUDP() {
+		mangle.WithChain(buildMeshOutboundUDP(cfg, ipv6))
+	}
+
 	return mangle
 }
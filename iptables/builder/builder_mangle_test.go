@@ -0,0 +1,210 @@
+package builder
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Builder mangle", func() {
+	DescribeTable("should build tproxy inbound rules",
+		func(inbound config.TrafficFlow, ipv6 bool, expect ...string) {
+			// given
+			cfg := config.MergeConfigWithDefaults(config.Config{
+				Redirect: config.Redirect{Inbound: inbound},
+			})
+
+			// when
+			mangle := buildMangleTable(cfg, "lo", ipv6)
+
+			// then
+			Expect(strings.Split(mangle.Build(false), "\n")).To(Equal(expect))
+		},
+		Entry("ipv4",
+			config.TrafficFlow{
+				Enabled:      true,
+				Mode:         config.RedirectModeTProxy,
+				ExcludePorts: []uint16{22},
+			},
+			false,
+			"* mangle",
+			"-N MESH_INBOUND",
+			"-N MESH_INBOUND_DIVERT",
+			"-N MESH_INBOUND_REDIRECT",
+			"-A PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			"-A OUTPUT -p tcp -m connmark --mark 0x539 -m comment --comment kuma-net:dev::restore-mark -j CONNMARK --restore-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A OUTPUT -p tcp -m mark --mark 0x539 -m comment --comment kuma-net:dev::save-mark -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A MESH_INBOUND -p tcp --dport 22 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN",
+			"-A MESH_INBOUND -p tcp -m socket --transparent -m comment --comment kuma-net:dev::transparent-socket -j MESH_INBOUND_DIVERT",
+			"-A MESH_INBOUND -p tcp -m comment --comment kuma-net:dev::redirect-inbound -j MESH_INBOUND_REDIRECT",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-mark -j MARK --set-xmark 0x539/0xffffffff",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-accept -j ACCEPT",
+			"-A MESH_INBOUND_REDIRECT ! -d 127.0.0.1/32 -p tcp -m comment --comment kuma-net:dev::inbound-listener -j TPROXY --on-port 15006 --on-ip 0.0.0.0 --tproxy-mark 0x539/0xffffffff",
+			"COMMIT",
+		),
+		Entry("ipv6 with included ports",
+			config.TrafficFlow{
+				Enabled:      true,
+				Mode:         config.RedirectModeTProxy,
+				IncludePorts: []uint16{8080},
+			},
+			true,
+			"* mangle",
+			"-N MESH_INBOUND",
+			"-N MESH_INBOUND_DIVERT",
+			"-N MESH_INBOUND_REDIRECT",
+			"-A PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			"-A OUTPUT -p tcp -m connmark --mark 0x539 -m comment --comment kuma-net:dev::restore-mark -j CONNMARK --restore-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A OUTPUT -p tcp -m mark --mark 0x539 -m comment --comment kuma-net:dev::save-mark -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A MESH_INBOUND -p tcp -m socket --transparent -m comment --comment kuma-net:dev::transparent-socket -j MESH_INBOUND_DIVERT",
+			"-A MESH_INBOUND -p tcp --dport 8080 -m comment --comment kuma-net:dev::include-inbound-port -j MESH_INBOUND_REDIRECT",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-mark -j MARK --set-xmark 0x539/0xffffffff",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-accept -j ACCEPT",
+			"-A MESH_INBOUND_REDIRECT ! -d ::1/128 -p tcp -m comment --comment kuma-net:dev::inbound-listener -j TPROXY --on-port 15010 --on-ip :: --tproxy-mark 0x539/0xffffffff",
+			"COMMIT",
+		),
+	)
+
+	DescribeTable("should build UDP interception rules",
+		func(redirect config.Redirect, ipv6 bool, expect ...string) {
+			// given
+			cfg := config.MergeConfigWithDefaults(config.Config{
+				Redirect: redirect,
+			})
+
+			// when
+			mangle := buildMangleTable(cfg, "lo", ipv6)
+
+			// then
+			Expect(strings.Split(mangle.Build(false), "\n")).To(Equal(expect))
+		},
+		Entry("ipv4 inbound and outbound",
+			config.Redirect{
+				Inbound: config.TrafficFlow{
+					Enabled: true,
+					UDP: config.UDP{
+						Enabled:      true,
+						ExcludePorts: []uint16{5000},
+					},
+				},
+				Outbound: config.TrafficFlow{
+					Enabled: true,
+					UDP: config.UDP{
+						Enabled:      true,
+						IncludePorts: []uint16{443},
+					},
+					ExcludePortsForUIDs: []config.UIDsToPorts{
+						{Protocol: "udp", UIDs: "1000", Ports: "8125"},
+						{Protocol: "tcp", UIDs: "1000", Ports: "80"},
+					},
+				},
+				DNS: config.DNS{Enabled: true},
+			},
+			false,
+			"* mangle",
+			"-N MESH_INBOUND_UDP",
+			"-N MESH_INBOUND_DIVERT",
+			"-N MESH_OUTBOUND_UDP",
+			"-A PREROUTING -i lo -p udp -m mark --mark 0x539 -m comment --comment kuma-net:dev::outbound-listener -j TPROXY --on-port 15002 --on-ip 127.0.0.1 --tproxy-mark 0x539/0xffffffff",
+			"-A PREROUTING -p udp -m comment --comment kuma-net:dev::capture-inbound-udp -j MESH_INBOUND_UDP",
+			"-A OUTPUT -p udp -m connmark --mark 0x539 -m comment --comment kuma-net:dev::restore-mark -j CONNMARK --restore-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A OUTPUT -p udp -m mark --mark 0x539 -m comment --comment kuma-net:dev::save-mark -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A OUTPUT -p udp -m comment --comment kuma-net:dev::capture-outbound-udp -j MESH_OUTBOUND_UDP",
+			"-A MESH_INBOUND_UDP -i lo -m comment --comment kuma-net:dev::loopback -j RETURN",
+			"-A MESH_INBOUND_UDP -p udp -m conntrack --ctdir REPLY -m comment --comment kuma-net:dev::reply -j RETURN",
+			"-A MESH_INBOUND_UDP -p udp --dport 5000 -m comment --comment kuma-net:dev::exclude-inbound-udp-port -j RETURN",
+			"-A MESH_INBOUND_UDP -p udp -m socket --transparent -m comment --comment kuma-net:dev::transparent-socket -j MESH_INBOUND_DIVERT",
+			"-A MESH_INBOUND_UDP ! -d 127.0.0.1/32 -p udp -m comment --comment kuma-net:dev::redirect-inbound-udp -j TPROXY --on-port 15007 --on-ip 0.0.0.0 --tproxy-mark 0x539/0xffffffff",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-mark -j MARK --set-xmark 0x539/0xffffffff",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-accept -j ACCEPT",
+			"-A MESH_OUTBOUND_UDP -p udp -m conntrack --ctdir REPLY -m comment --comment kuma-net:dev::reply -j RETURN",
+			"-A MESH_OUTBOUND_UDP -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND_UDP -p udp --dport 8125 -m owner --uid-owner 1000 -m comment --comment kuma-net:dev::exclude-outbound-port-for-uid -j RETURN",
+			"-A MESH_OUTBOUND_UDP -p udp --dport 53 -m comment --comment kuma-net:dev::dns -j RETURN",
+			"-A MESH_OUTBOUND_UDP -d 127.0.0.1/32 -m comment --comment kuma-net:dev::localhost -j RETURN",
+			"-A MESH_OUTBOUND_UDP -p udp --dport 443 -m comment --comment kuma-net:dev::include-outbound-udp-port -j MARK --set-xmark 0x539/0xffffffff",
+			"COMMIT",
+		),
+		Entry("ipv4 port ranges and excluded inbound sources",
+			config.Redirect{
+				Inbound: config.TrafficFlow{
+					Enabled:                 true,
+					ExcludeInboundSourceIPs: []string{"10.0.0.0/8", "fd00::/8"},
+					UDP: config.UDP{
+						Enabled:           true,
+						ExcludePorts:      []uint16{5000, 5001},
+						ExcludePortRanges: "6000:6100",
+					},
+				},
+				Outbound: config.TrafficFlow{
+					Enabled: true,
+					UDP: config.UDP{
+						Enabled:           true,
+						IncludePorts:      []uint16{443},
+						IncludePortRanges: "8000:8080",
+					},
+				},
+			},
+			false,
+			"* mangle",
+			"-N MESH_INBOUND_UDP",
+			"-N MESH_INBOUND_DIVERT",
+			"-N MESH_OUTBOUND_UDP",
+			"-A PREROUTING -i lo -p udp -m mark --mark 0x539 -m comment --comment kuma-net:dev::outbound-listener -j TPROXY --on-port 15002 --on-ip 127.0.0.1 --tproxy-mark 0x539/0xffffffff",
+			"-A PREROUTING -p udp -m comment --comment kuma-net:dev::capture-inbound-udp -j MESH_INBOUND_UDP",
+			"-A OUTPUT -p udp -m connmark --mark 0x539 -m comment --comment kuma-net:dev::restore-mark -j CONNMARK --restore-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A OUTPUT -p udp -m mark --mark 0x539 -m comment --comment kuma-net:dev::save-mark -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+			"-A OUTPUT -p udp -m comment --comment kuma-net:dev::capture-outbound-udp -j MESH_OUTBOUND_UDP",
+			"-A MESH_INBOUND_UDP -i lo -m comment --comment kuma-net:dev::loopback -j RETURN",
+			"-A MESH_INBOUND_UDP -p udp -m conntrack --ctdir REPLY -m comment --comment kuma-net:dev::reply -j RETURN",
+			"-A MESH_INBOUND_UDP -s 10.0.0.0/8 -m comment --comment kuma-net:dev::exclude-inbound-source -j RETURN",
+			"-A MESH_INBOUND_UDP -p udp -m multiport --dports 5000,5001,6000:6100 -m comment --comment kuma-net:dev::exclude-inbound-udp-port -j RETURN",
+			"-A MESH_INBOUND_UDP -p udp -m socket --transparent -m comment --comment kuma-net:dev::transparent-socket -j MESH_INBOUND_DIVERT",
+			"-A MESH_INBOUND_UDP ! -d 127.0.0.1/32 -p udp -m comment --comment kuma-net:dev::redirect-inbound-udp -j TPROXY --on-port 15007 --on-ip 0.0.0.0 --tproxy-mark 0x539/0xffffffff",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-mark -j MARK --set-xmark 0x539/0xffffffff",
+			"-A MESH_INBOUND_DIVERT -m comment --comment kuma-net:dev::divert-accept -j ACCEPT",
+			"-A MESH_OUTBOUND_UDP -p udp -m conntrack --ctdir REPLY -m comment --comment kuma-net:dev::reply -j RETURN",
+			"-A MESH_OUTBOUND_UDP -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND_UDP -d 127.0.0.1/32 -m comment --comment kuma-net:dev::localhost -j RETURN",
+			"-A MESH_OUTBOUND_UDP -p udp -m multiport --dports 443,8000:8080 -m comment --comment kuma-net:dev::include-outbound-udp-port -j MARK --set-xmark 0x539/0xffffffff",
+			"COMMIT",
+		),
+		Entry("ipv6 outbound",
+			config.Redirect{
+				Outbound: config.TrafficFlow{
+					Enabled: true,
+					UDP: config.UDP{
+						Enabled:  true,
+						PortIPv6: 15003,
+					},
+				},
+			},
+			true,
+			"* mangle",
+			"-N MESH_OUTBOUND_UDP",
+			"-A PREROUTING -i lo -p udp -m mark --mark 0x539 -m comment --comment kuma-net:dev::outbound-listener -j TPROXY --on-port 15003 --on-ip ::1 --tproxy-mark 0x539/0xffffffff",
+			"-A OUTPUT -p udp -m comment --comment kuma-net:dev::capture-outbound-udp -j MESH_OUTBOUND_UDP",
+			"-A MESH_OUTBOUND_UDP -p udp -m conntrack --ctdir REPLY -m comment --comment kuma-net:dev::reply -j RETURN",
+			"-A MESH_OUTBOUND_UDP -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND_UDP -d ::1/128 -m comment --comment kuma-net:dev::localhost -j RETURN",
+			"-A MESH_OUTBOUND_UDP -p udp -m comment --comment kuma-net:dev::redirect-outbound-udp -j MARK --set-xmark 0x539/0xffffffff",
+			"COMMIT",
+		),
+	)
+
+	It("should not divert inbound traffic in the redirect mode", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{Inbound: config.TrafficFlow{Enabled: true}},
+		})
+
+		// when
+		mangle := buildMangleTable(cfg, "lo", false)
+
+		// then
+		Expect(mangle.Build(false)).To(BeEmpty())
+	})
+})
@@ -2,9 +2,8 @@ package builder
 
 import (
 	"fmt"
-	"net"
-	"strings"
 
+	"github.com/kumahq/kuma-net/ipset"
 	. "github.com/kumahq/kuma-net/iptables/chain"
 	. "github.com/kumahq/kuma-net/iptables/consts"
 	. "github.com/kumahq/kuma-net/iptables/parameters"
@@ -12,34 +11,55 @@ import (
 	"github.com/kumahq/kuma-net/transparent-proxy/config"
 )
 
-func buildMeshInbound(cfg config.TrafficFlow, prefix string, meshInboundRedirect string) *Chain {
+func buildMeshInbound(
+	cfg config.TrafficFlow,
+	prefix string,
+	log config.LogConfig,
+	meshInboundRedirect string,
+	excludedPortsSet string,
+	ipv6 bool,
+) *Chain {
 	meshInbound := NewChain(cfg.Chain.GetFullName(prefix))
 	if !cfg.Enabled {
 		meshInbound.Append(
 			Protocol(Tcp()),
+			comment(prefix, ReasonInboundDisabled),
 			Jump(Return()),
 		)
 		return meshInbound
 	}
 
-	// Include inbound ports
-	for _, port := range cfg.IncludePorts {
+	// Excluded inbound sources
+	for _, cidr := range config.CIDRsOfFamily(cfg.ExcludeInboundSourceIPs, ipv6) {
 		meshInbound.Append(
-			Protocol(Tcp(DestinationPort(port))),
-			Jump(ToUserDefinedChain(meshInboundRedirect)),
+			Source(Address(cidr)),
+			comment(prefix, ReasonExcludeInboundSource),
+			Jump(Return()),
 		)
 	}
 
-	if len(cfg.IncludePorts) == 0 {
-		// Excluded outbound ports
-		for _, port := range cfg.ExcludePorts {
-			meshInbound.Append(
-				Protocol(Tcp(DestinationPort(port))),
-				Jump(Return()),
+	// Include inbound ports
+	for _, ports := range destinationPorts(Tcp, cfg.IncludedPorts()) {
+		meshInbound.Append(withPorts(nil, ports,
+			comment(prefix, ReasonIncludeInboundPort),
+			Jump(ToUserDefinedChain(meshInboundRedirect)),
+		)...)
+	}
+
+	if !cfg.HasIncludedPorts() {
+		// Excluded inbound ports
+		for _, ports := range excludedPorts(cfg.ExcludedPorts(), excludedPortsSet) {
+			meshInbound.AppendIf(log.ShouldNflog,
+				nflogRule(log, prefix, LogDecisionExcludedPort, ports...)...,
 			)
+			meshInbound.Append(withPorts(nil, ports,
+				comment(prefix, ReasonExcludeInboundPort),
+				Jump(Return()),
+			)...)
 		}
 		meshInbound.Append(
 			Protocol(Tcp()),
+			comment(prefix, ReasonRedirectInbound),
 			Jump(ToUserDefinedChain(meshInboundRedirect)),
 		)
 	}
@@ -57,11 +77,10 @@ func buildMeshOutbound(
 	inboundRedirectChainName := cfg.Redirect.Inbound.RedirectChain.GetFullName(prefix)
 	outboundChainName := cfg.Redirect.Outbound.Chain.GetFullName(prefix)
 	outboundRedirectChainName := cfg.Redirect.Outbound.RedirectChain.GetFullName(prefix)
-	excludePorts := cfg.Redirect.Outbound.ExcludePorts
-	includePorts := cfg.Redirect.Outbound.IncludePorts
-	hasIncludedPorts := len(includePorts) > 0
+	excludePorts := cfg.Redirect.Outbound.ExcludedPorts()
+	includePorts := cfg.Redirect.Outbound.IncludedPorts()
+	hasIncludedPorts := cfg.Redirect.Outbound.HasIncludedPorts()
 	dnsRedirectPort := cfg.Redirect.DNS.Port
-	uid := cfg.Owner.UID
 
 	localhost := LocalhostCIDRIPv4
 	inboundPassthroughSourceAddress := InboundPassthroughSourceAddressCIDRIPv4
@@ -74,18 +93,32 @@ func buildMeshOutbound(
 	if !cfg.Redirect.Outbound.Enabled {
 		meshOutbound.Append(
 			Protocol(Tcp()),
+			comment(prefix, ReasonOutboundDisabled),
 			Jump(Return()),
 		)
 		return meshOutbound
 	}
 
+	// Upstream connections of the proxy in the tproxy mode (marked by
+	// the proxy) have to reach the application directly
+	meshOutbound.AppendIf(cfg.ShouldTProxyInbound,
+		Protocol(Tcp()),
+		Match(Mark(tproxyMark(cfg))),
+		comment(prefix, ReasonProxyUpstream),
+		Jump(Return()),
+	)
+
 	// Excluded outbound ports
 	if !hasIncludedPorts {
-		for _, port := range excludePorts {
-			meshOutbound.Append(
-				Protocol(Tcp(DestinationPort(port))),
-				Jump(Return()),
+		excludedPortsSet := setNameIf(cfg, ipset.ExcludeOutboundPorts(cfg))
+		for _, ports := range excludedPorts(excludePorts, excludedPortsSet) {
+			meshOutbound.AppendIf(cfg.ShouldNflog,
+				nflogRule(cfg.Log, prefix, LogDecisionExcludedPort, ports...)...,
 			)
+			meshOutbound.Append(withPorts(nil, ports,
+				comment(prefix, ReasonExcludeOutboundPort),
+				Jump(Return()),
+			)...)
 		}
 	}
 	meshOutbound.
@@ -117,36 +150,66 @@ func buildMeshOutbound(
 		Append(
 			Source(Address(inboundPassthroughSourceAddress)),
 			OutInterface(loopback),
+			comment(prefix, ReasonInboundPassthrough),
 			Jump(Return()),
-		).
-		Append(
+		)
+	for _, sidecar := range sidecarMatches(cfg) {
+		meshOutbound.Append(
 			Protocol(Tcp(NotDestinationPortIf(cfg.ShouldRedirectDNS, DNSPort))),
 			OutInterface(loopback),
 			NotDestination(localhost),
-			Match(Owner(Uid(uid))),
+			sidecar,
+			comment(prefix, ReasonSidecarHairpin),
 			Jump(ToUserDefinedChain(inboundRedirectChainName)),
-		).
-		Append(
-			Protocol(Tcp(NotDestinationPortIf(cfg.ShouldRedirectDNS, DNSPort))),
-			OutInterface(loopback),
-			Match(Owner(NotUid(uid))),
-			Jump(Return()),
-		).
-		Append(
-			Match(Owner(Uid(uid))),
+		)
+	}
+	notSidecar := []*Parameter{
+		Protocol(Tcp(NotDestinationPortIf(cfg.ShouldRedirectDNS, DNSPort))),
+		OutInterface(loopback),
+	}
+	notSidecar = append(notSidecar, notSidecarMatches(cfg)...)
+	meshOutbound.Append(append(notSidecar,
+		comment(prefix, ReasonApplicationLoopback),
+		Jump(Return()),
+	)...)
+	for _, sidecar := range sidecarMatches(cfg) {
+		meshOutbound.AppendIf(cfg.ShouldNflog,
+			nflogRule(cfg.Log, prefix, LogDecisionSidecarOwned, sidecar)...,
+		)
+		meshOutbound.Append(
+			sidecar,
+			comment(prefix, ReasonSidecarOwned),
 			Jump(Return()),
 		)
+	}
 	if cfg.ShouldRedirectDNS() {
 		if cfg.ShouldCaptureAllDNS() {
+			meshOutbound.AppendIf(cfg.ShouldNflog,
+				nflogRule(cfg.Log, prefix, LogDecisionDNS, Protocol(Tcp(DestinationPort(DNSPort))))...,
+			)
 			meshOutbound.Append(
 				Protocol(Tcp(DestinationPort(DNSPort))),
+				comment(prefix, ReasonRedirectDNS),
 				Jump(ToPort(dnsRedirectPort)),
 			)
 		} else {
+			if exemptsStubUpstream(cfg) {
+				meshOutbound.Append(
+					Protocol(Tcp(DestinationPort(DNSPort))),
+					Match(Owner(Uid(cfg.Redirect.DNS.SystemdResolvedUser))),
+					comment(prefix, ReasonStubUpstream),
+					Jump(Return()),
+				)
+			}
 			for _, dnsIp := range dnsServers {
+				meshOutbound.AppendIf(cfg.ShouldNflog, nflogRule(cfg.Log, prefix, LogDecisionDNS,
+					Destination(dnsIp),
+					Protocol(Tcp(DestinationPort(DNSPort))),
+				)...)
 				meshOutbound.Append(
 					Destination(dnsIp),
 					Protocol(Tcp(DestinationPort(DNSPort))),
+					comment(prefix, ReasonRedirectDNS),
 					Jump(ToPort(dnsRedirectPort)),
 				)
 			}
@@ -155,26 +218,69 @@ func buildMeshOutbound(
 	meshOutbound.
 		Append(
 			Destination(localhost),
+			comment(prefix, ReasonLocalhost),
 			Jump(Return()),
 		)
 
-	if hasIncludedPorts {
-		for _, port := range includePorts {
+	// Excluded outbound destinations
+	if cfg.ShouldUseIPSet() {
+		meshOutbound.Append(
+			Match(Set(MatchSet(ipset.ExcludeOutboundIPs(cfg, ipv6).Name, SetFlagDst))),
+			comment(prefix, ReasonExcludeOutboundIP),
+			Jump(Return()),
+		)
+	} else {
+		for _, cidr := range config.CIDRsOfFamily(cfg.Redirect.Outbound.ExcludeOutboundIPs, ipv6) {
 			meshOutbound.Append(
-				Protocol(Tcp(DestinationPort(port))),
-				Jump(ToUserDefinedChain(outboundRedirectChainName)),
+				Destination(cidr),
+				comment(prefix, ReasonExcludeOutboundIP),
+				Jump(Return()),
 			)
 		}
-	} else {
-		meshOutbound.Append(
-			Jump(ToUserDefinedChain(outboundRedirectChainName)),
-		)
+	}
+
+	// when included destinations are set, only the traffic to them will be
+	// redirected (nil means any destination)
+	includeDestinations := []*Parameter{nil}
+	if len(cfg.Redirect.Outbound.IncludeOutboundIPs) > 0 {
+		includeDestinations = nil
+		for _, cidr := range config.CIDRsOfFamily(cfg.Redirect.Outbound.IncludeOutboundIPs, ipv6) {
+			includeDestinations = append(includeDestinations, Destination(cidr))
+		}
+	}
+
+	jumpToRedirect := Jump(ToUserDefinedChain(outboundRedirectChainName))
+	for _, destination := range includeDestinations {
+		var parameters []*Parameter
+		if destination != nil {
+			parameters = append(parameters, destination)
+		}
+
+		if hasIncludedPorts {
+			for _, ports := range destinationPorts(Tcp, includePorts) {
+				meshOutbound.Append(withPorts(parameters, ports,
+					comment(prefix, ReasonIncludeOutboundPort),
+					jumpToRedirect,
+				)...)
+			}
+		} else {
+			meshOutbound.Append(append(parameters,
+				comment(prefix, ReasonRedirectOutbound),
+				jumpToRedirect,
+			)...)
+		}
 	}
 
 	return meshOutbound
 }
 
-func buildMeshRedirect(cfg config.TrafficFlow, prefix string, ipv6 bool) *Chain {
+func buildMeshRedirect(
+	cfg config.TrafficFlow,
+	prefix string,
+	log config.LogConfig,
+	reason Reason,
+	ipv6 bool,
+) *Chain {
 	chainName := cfg.RedirectChain.GetFullName(prefix)
 
 	redirectPort := cfg.Port
@@ -183,20 +289,25 @@ func buildMeshRedirect(cfg config.TrafficFlow, prefix string, ipv6 bool) *Chain
 	}
 
 	return NewChain(chainName).
+		AppendIf(log.ShouldNflog,
+			nflogRule(log, prefix, LogDecisionCaptured, Protocol(Tcp()))...,
+		).
 		Append(
 			Protocol(Tcp()),
+			comment(prefix, reason),
 			Jump(ToPort(redirectPort)),
 		)
 }
 
 func addOutputRules(cfg config.Config, dnsServers []string, nat *table.NatTable) error {
-	outboundChainName := cfg.Redirect.Outbound.Chain.GetFullName(cfg.Redirect.NamePrefix)
+	prefix := cfg.Redirect.NamePrefix
+	outboundChainName := cfg.Redirect.Outbound.Chain.GetFullName(prefix)
 	dnsRedirectPort := cfg.Redirect.DNS.Port
-	uid := cfg.Owner.UID
 	rulePosition := 1
-	if cfg.Log.Enabled {
+	if cfg.ShouldLog() {
 		nat.Output().Insert(
 			rulePosition,
+			comment(prefix, ReasonLog),
 			Jump(Log(OutputLogPrefix, cfg.Log.Level)),
 		)
 		rulePosition++
@@ -219,31 +330,69 @@ func addOutputRules(cfg config.Config, dnsServers []string, nat *table.NatTable)
 			rulePosition,
 			protocol,
 			Match(Owner(UidRangeOrValue(uIDsToPorts))),
+			comment(prefix, ReasonExcludeOutboundPortForUID),
 			Jump(Return()),
 		)
 		rulePosition++
 	}
 
 	if cfg.ShouldRedirectDNS() {
-		nat.Output().Insert(
-			rulePosition,
-			Protocol(Udp(DestinationPort(DNSPort))),
-			Match(Owner(Uid(uid))),
-			Jump(Return()),
-		)
-		rulePosition++
+		for _, sidecar := range sidecarMatches(cfg) {
+			if cfg.ShouldNflog() {
+				nat.Output().Insert(rulePosition, nflogRule(cfg.Log, prefix, LogDecisionSidecarOwned,
+					Protocol(Udp(DestinationPort(DNSPort))),
+					sidecar,
+				)...)
+				rulePosition++
+			}
+			nat.Output().Insert(
+				rulePosition,
+				Protocol(Udp(DestinationPort(DNSPort))),
+				sidecar,
+				comment(prefix, ReasonSidecarOwned),
+				Jump(Return()),
+			)
+			rulePosition++
+		}
+		// queries of the systemd-resolved stub to the upstream servers are
+		// made on behalf of the DNS proxy, so redirecting them would loop
+		if exemptsStubUpstream(cfg) {
+			nat.Output().Insert(
+				rulePosition,
+				Protocol(Udp(DestinationPort(DNSPort))),
+				Match(Owner(Uid(cfg.Redirect.DNS.SystemdResolvedUser))),
+				comment(prefix, ReasonStubUpstream),
+				Jump(Return()),
+			)
+			rulePosition++
+		}
 		if cfg.ShouldCaptureAllDNS() {
+			if cfg.ShouldNflog() {
+				nat.Output().Insert(rulePosition, nflogRule(cfg.Log, prefix, LogDecisionDNS,
+					Protocol(Udp(DestinationPort(DNSPort))),
+				)...)
+				rulePosition++
+			}
 			nat.Output().Insert(
 				rulePosition,
 				Protocol(Udp(DestinationPort(DNSPort))),
+				comment(prefix, ReasonRedirectDNS),
 				Jump(ToPort(dnsRedirectPort)),
 			)
 		} else {
 			for _, dnsIp := range dnsServers {
+				if cfg.ShouldNflog() {
+					nat.Output().Insert(rulePosition, nflogRule(cfg.Log, prefix, LogDecisionDNS,
+						Destination(dnsIp),
+						Protocol(Udp(DestinationPort(DNSPort))),
+					)...)
+					rulePosition++
+				}
 				nat.Output().Insert(
 					rulePosition,
 					Destination(dnsIp),
 					Protocol(Udp(DestinationPort(DNSPort))),
+					comment(prefix, ReasonRedirectDNS),
 					Jump(ToPort(dnsRedirectPort)),
 				)
 				rulePosition++
@@ -253,63 +402,64 @@ func addOutputRules(cfg config.Config, dnsServers []string, nat *table.NatTable)
 	nat.Output().
 		Append(
 			Protocol(Tcp()),
+			comment(prefix, ReasonCaptureOutbound),
 			Jump(ToUserDefinedChain(outboundChainName)),
 		)
 	return nil
 }
 
 func addPreroutingRules(cfg config.Config, nat *table.NatTable, ipv6 bool) error {
-	inboundChainName := cfg.Redirect.Inbound.Chain.GetFullName(cfg.Redirect.NamePrefix)
+	prefix := cfg.Redirect.NamePrefix
+	inboundChainName := cfg.Redirect.Inbound.Chain.GetFullName(prefix)
 	rulePosition := 1
-	if cfg.Log.Enabled {
+	if cfg.ShouldLog() {
 		nat.Prerouting().Append(
+			comment(prefix, ReasonLog),
 			Jump(Log(PreroutingLogPrefix, cfg.Log.Level)),
 		)
 	}
 
-	if len(cfg.Redirect.VNet.Networks) > 0 {
-		interfaceAndCidr := map[string]string{}
-		for i := 0; i < len(cfg.Redirect.VNet.Networks); i++ {
-			// we accept only first : so in case of IPv6 there should be no problem with parsing
-			pair := strings.SplitN(cfg.Redirect.VNet.Networks[i], ":", 2)
-			if len(pair) < 2 {
-				return fmt.Errorf("incorrect definition of virtual network: %s", cfg.Redirect.VNet.Networks[i])
-			}
-			ipAddress, _, err := net.ParseCIDR(pair[1])
-			if err != nil {
-				return fmt.Errorf("incorrect CIDR definition: %s", err)
-			}
-			// if is ipv6 and address is ipv6 or is ipv4 and address is ipv4
-			if (ipv6 && ipAddress.To4() == nil) || (!ipv6 && ipAddress.To4() != nil) {
-				interfaceAndCidr[pair[0]] = pair[1]
-			}
-		}
-		for iface, cidr := range interfaceAndCidr {
+	// networks are validated, and rules are inserted in the configured order,
+	// so the more specific interfaces can precede the wildcard ones
+	for _, network := range cfg.Redirect.VNet.NetworksOfFamily(ipv6) {
+		if network.RedirectDNS {
 			nat.Prerouting().Insert(
 				rulePosition,
-				InInterface(iface),
+				InInterface(network.Interface),
 				Match(MatchUdp()),
 				Protocol(Udp(DestinationPort(DNSPort))),
+				comment(prefix, ReasonVNetRedirectDNS),
 				Jump(ToPort(cfg.Redirect.DNS.Port)),
 			)
 			rulePosition += 1
-			nat.Prerouting().Insert(
-				rulePosition,
-				NotDestination(cidr),
-				InInterface(iface),
-				Protocol(Tcp()),
-				Jump(ToPort(cfg.Redirect.Outbound.Port)),
-			)
-			rulePosition += 1
 		}
 		nat.Prerouting().Insert(
 			rulePosition,
+			NotDestination(network.CIDR),
+			InInterface(network.Interface),
 			Protocol(Tcp()),
+			comment(prefix, ReasonVNetRedirectOutbound),
+			Jump(ToPort(network.TCPPort(cfg.Redirect.Outbound.Port))),
+		)
+		rulePosition += 1
+	}
+
+	// in the tproxy mode the inbound traffic is diverted in the mangle table
+	if cfg.ShouldTProxyInbound() {
+		return nil
+	}
+
+	if len(cfg.Redirect.VNet.Networks) > 0 {
+		nat.Prerouting().Insert(
+			rulePosition,
+			Protocol(Tcp()),
+			comment(prefix, ReasonCaptureInbound),
 			Jump(ToUserDefinedChain(inboundChainName)),
 		)
 	} else {
 		nat.Prerouting().Append(
 			Protocol(Tcp()),
+			comment(prefix, ReasonCaptureInbound),
 			Jump(ToUserDefinedChain(inboundChainName)),
 		)
 	}
@@ -334,19 +484,32 @@ func buildNatTable(
 	}
 
 	// MESH_INBOUND
-	meshInbound := buildMeshInbound(cfg.Redirect.Inbound, prefix, inboundRedirectChainName)
+	meshInbound := buildMeshInbound(
+		cfg.Redirect.Inbound,
+		prefix,
+		cfg.Log,
+		inboundRedirectChainName,
+		setNameIf(cfg, ipset.ExcludeInboundPorts(cfg)),
+		ipv6,
+	)
 
 	// MESH_INBOUND_REDIRECT
-	meshInboundRedirect := buildMeshRedirect(cfg.Redirect.Inbound, prefix, ipv6)
+	meshInboundRedirect := buildMeshRedirect(cfg.Redirect.Inbound, prefix, cfg.Log, ReasonInboundListener, ipv6)
 
 	// MESH_OUTBOUND
 	meshOutbound := buildMeshOutbound(cfg, dnsServers, loopback, ipv6)
 
 	// MESH_OUTBOUND_REDIRECT
-	meshOutboundRedirect := buildMeshRedirect(cfg.Redirect.Outbound, prefix, ipv6)
+	meshOutboundRedirect := buildMeshRedirect(cfg.Redirect.Outbound, prefix, cfg.Log, ReasonOutboundListener, ipv6)
+
+	// in the tproxy mode MESH_INBOUND is the part of the mangle table, but
+	// MESH_INBOUND_REDIRECT is still used by the traffic sent by the application
+	// to itself through the outbound listener
+	if !cfg.ShouldTProxyInbound() {
+		nat.WithChain(meshInbound)
+	}
 
 	return nat.
-		WithChain(meshInbound).
 		WithChain(meshOutbound).
 		WithChain(meshInboundRedirect).
 		WithChain(meshOutboundRedirect), nil
@@ -12,6 +12,8 @@ var _ = Describe("Builder nat", func() {
 	DescribeTable("should insert PREROUTING rules",
 		func(vnet []string, verbose bool, ipv6 bool, expect ...string) {
 			// given
+			networks, err := config.ParseVNetNetworks(vnet)
+			Expect(err).ToNot(HaveOccurred())
 			nat := table.Nat()
 			cfg := config.Config{
 				Redirect: config.Redirect{
@@ -27,7 +29,7 @@ var _ = Describe("Builder nat", func() {
 					},
 					DNS: config.DNS{Port: 15053},
 					VNet: config.VNet{
-						Networks: vnet,
+						Networks: networks,
 					},
 				},
 			}
@@ -46,77 +48,93 @@ var _ = Describe("Builder nat", func() {
 			[]string{"docker:1.2.3.4/24", "br+:127.0.0.0/32"},
 			false,
 			false,
-			// rules have random order so we cannot compare addresses and names
-			"-I PREROUTING 1",
-			"-i docker -m udp -p udp --dport 53 -j REDIRECT --to-ports 15053",
-			"-I PREROUTING 2",
-			"! -d 1.2.3.4/24 -i docker -p tcp -j REDIRECT --to-ports 12345",
-			"-I PREROUTING 3",
-			"-i br+ -m udp -p udp --dport 53 -j REDIRECT --to-ports 15053",
-			"-I PREROUTING 4",
-			"! -d 127.0.0.0/32 -i br+ -p tcp -j REDIRECT --to-ports 12345",
-			"-I PREROUTING 5 -p tcp -j MESH_INBOUND",
+			"-I PREROUTING 1 -i docker -m udp -p udp --dport 53 -m comment --comment kuma-net:dev::vnet-redirect-dns -j REDIRECT --to-ports 15053",
+			"-I PREROUTING 2 ! -d 1.2.3.4/24 -i docker -p tcp -m comment --comment kuma-net:dev::vnet-redirect-outbound -j REDIRECT --to-ports 12345",
+			"-I PREROUTING 3 -i br+ -m udp -p udp --dport 53 -m comment --comment kuma-net:dev::vnet-redirect-dns -j REDIRECT --to-ports 15053",
+			"-I PREROUTING 4 ! -d 127.0.0.0/32 -i br+ -p tcp -m comment --comment kuma-net:dev::vnet-redirect-outbound -j REDIRECT --to-ports 12345",
+			"-I PREROUTING 5 -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
 		),
 		Entry("ipv4 not verbose",
 			[]string{"docker:1.2.3.4/24", "br+:127.0.0.0/32"},
 			true,
 			false,
-			"--insert PREROUTING 1",
-			"--in-interface docker --match udp --protocol udp --destination-port 53 --jump REDIRECT --to-ports 15053",
-			"--insert PREROUTING 2",
-			"! --destination 1.2.3.4/24 --in-interface docker --protocol tcp --jump REDIRECT --to-ports 12345",
-			"--insert PREROUTING 3",
-			"--in-interface br+ --match udp --protocol udp --destination-port 53 --jump REDIRECT --to-ports 15053",
-			"--insert PREROUTING 4",
-			"! --destination 127.0.0.0/32 --in-interface br+ --protocol tcp --jump REDIRECT --to-ports 12345",
-			"--insert PREROUTING 5 --protocol tcp --jump MESH_INBOUND",
+			"--insert PREROUTING 1 --in-interface docker --match udp --protocol udp --destination-port 53 --match comment --comment kuma-net:dev::vnet-redirect-dns --jump REDIRECT --to-ports 15053",
+			"--insert PREROUTING 2 ! --destination 1.2.3.4/24 --in-interface docker --protocol tcp --match comment --comment kuma-net:dev::vnet-redirect-outbound --jump REDIRECT --to-ports 12345",
+			"--insert PREROUTING 3 --in-interface br+ --match udp --protocol udp --destination-port 53 --match comment --comment kuma-net:dev::vnet-redirect-dns --jump REDIRECT --to-ports 15053",
+			"--insert PREROUTING 4 ! --destination 127.0.0.0/32 --in-interface br+ --protocol tcp --match comment --comment kuma-net:dev::vnet-redirect-outbound --jump REDIRECT --to-ports 12345",
+			"--insert PREROUTING 5 --protocol tcp --match comment --comment kuma-net:dev::capture-inbound --jump MESH_INBOUND",
 		),
 		Entry("ipv6 not verbose",
 			[]string{"docker:::6/24", "br+:1::1/128"},
 			false,
 			true,
-			"-I PREROUTING 1",
-			"-i docker -m udp -p udp --dport 53 -j REDIRECT --to-ports 15053",
-			"-I PREROUTING 2",
-			"! -d ::6/24 -i docker -p tcp -j REDIRECT --to-ports 12345",
-			"-I PREROUTING 3",
-			"-i br+ -m udp -p udp --dport 53 -j REDIRECT --to-ports 15053",
-			"-I PREROUTING 4",
-			"! -d 1::1/128 -i br+ -p tcp -j REDIRECT --to-ports 12345",
-			"-I PREROUTING 5 -p tcp -j MESH_INBOUND",
+			"-I PREROUTING 1 -i docker -m udp -p udp --dport 53 -m comment --comment kuma-net:dev::vnet-redirect-dns -j REDIRECT --to-ports 15053",
+			"-I PREROUTING 2 ! -d ::6/24 -i docker -p tcp -m comment --comment kuma-net:dev::vnet-redirect-outbound -j REDIRECT --to-ports 12345",
+			"-I PREROUTING 3 -i br+ -m udp -p udp --dport 53 -m comment --comment kuma-net:dev::vnet-redirect-dns -j REDIRECT --to-ports 15053",
+			"-I PREROUTING 4 ! -d 1::1/128 -i br+ -p tcp -m comment --comment kuma-net:dev::vnet-redirect-outbound -j REDIRECT --to-ports 12345",
+			"-I PREROUTING 5 -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
 		),
 		Entry("ipv6 not verbose",
 			[]string{"docker:::6/24", "br+:1::1/128"},
 			true,
 			true,
-			"--insert PREROUTING 1",
-			"--in-interface docker --match udp --protocol udp --destination-port 53 --jump REDIRECT --to-ports 15053",
-			"--insert PREROUTING 2",
-			"! --destination ::6/24 --in-interface docker --protocol tcp --jump REDIRECT --to-ports 12345",
-			"--insert PREROUTING 3",
-			"--in-interface br+ --match udp --protocol udp --destination-port 53 --jump REDIRECT --to-ports 15053",
-			"--insert PREROUTING 4",
-			"! --destination 1::1/128 --in-interface br+ --protocol tcp --jump REDIRECT --to-ports 12345",
-			"--insert PREROUTING 5 --protocol tcp --jump MESH_INBOUND",
+			"--insert PREROUTING 1 --in-interface docker --match udp --protocol udp --destination-port 53 --match comment --comment kuma-net:dev::vnet-redirect-dns --jump REDIRECT --to-ports 15053",
+			"--insert PREROUTING 2 ! --destination ::6/24 --in-interface docker --protocol tcp --match comment --comment kuma-net:dev::vnet-redirect-outbound --jump REDIRECT --to-ports 12345",
+			"--insert PREROUTING 3 --in-interface br+ --match udp --protocol udp --destination-port 53 --match comment --comment kuma-net:dev::vnet-redirect-dns --jump REDIRECT --to-ports 15053",
+			"--insert PREROUTING 4 ! --destination 1::1/128 --in-interface br+ --protocol tcp --match comment --comment kuma-net:dev::vnet-redirect-outbound --jump REDIRECT --to-ports 12345",
+			"--insert PREROUTING 5 --protocol tcp --match comment --comment kuma-net:dev::capture-inbound --jump MESH_INBOUND",
 		),
 		Entry("ipv4 without ipv6 rules",
 			[]string{"docker:127.0.0.6/24", "br+:1::1/128"},
 			true,
 			false,
-			"--insert PREROUTING 1 --in-interface docker --match udp --protocol udp --destination-port 53 --jump REDIRECT --to-ports 15053",
-			"--insert PREROUTING 2 ! --destination 127.0.0.6/24 --in-interface docker --protocol tcp --jump REDIRECT --to-ports 12345",
-			"--insert PREROUTING 3 --protocol tcp --jump MESH_INBOUND",
+			"--insert PREROUTING 1 --in-interface docker --match udp --protocol udp --destination-port 53 --match comment --comment kuma-net:dev::vnet-redirect-dns --jump REDIRECT --to-ports 15053",
+			"--insert PREROUTING 2 ! --destination 127.0.0.6/24 --in-interface docker --protocol tcp --match comment --comment kuma-net:dev::vnet-redirect-outbound --jump REDIRECT --to-ports 12345",
+			"--insert PREROUTING 3 --protocol tcp --match comment --comment kuma-net:dev::capture-inbound --jump MESH_INBOUND",
 		),
 		Entry("ipv6 without ipv4 rules",
 			[]string{"docker:127.0.0.6/24", "br+:1::1/128"},
 			true,
 			true,
-			"--insert PREROUTING 1 --in-interface br+ --match udp --protocol udp --destination-port 53 --jump REDIRECT --to-ports 15053",
-			"--insert PREROUTING 2 ! --destination 1::1/128 --in-interface br+ --protocol tcp --jump REDIRECT --to-ports 12345",
-			"--insert PREROUTING 3 --protocol tcp --jump MESH_INBOUND",
+			"--insert PREROUTING 1 --in-interface br+ --match udp --protocol udp --destination-port 53 --match comment --comment kuma-net:dev::vnet-redirect-dns --jump REDIRECT --to-ports 15053",
+			"--insert PREROUTING 2 ! --destination 1::1/128 --in-interface br+ --protocol tcp --match comment --comment kuma-net:dev::vnet-redirect-outbound --jump REDIRECT --to-ports 12345",
+			"--insert PREROUTING 3 --protocol tcp --match comment --comment kuma-net:dev::capture-inbound --jump MESH_INBOUND",
 		),
 	)
 
+	It("should insert PREROUTING rules of typed virtual networks in the configured order", func() {
+		// given
+		nat := table.Nat()
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound: config.TrafficFlow{
+					Enabled: true,
+					Chain:   config.Chain{Name: "MESH_INBOUND"},
+				},
+				Outbound: config.TrafficFlow{Enabled: true, Port: 12345},
+				DNS:      config.DNS{Port: 15053},
+				VNet: config.VNet{
+					Networks: []config.VNetNetwork{
+						{Interface: "docker0", CIDR: "172.17.0.0/16", RedirectTCPPort: 15002},
+						{Interface: "docker+", CIDR: "172.18.0.0/16", RedirectDNS: true},
+						{Interface: "br0", CIDR: "fd00::/8", RedirectDNS: true},
+					},
+				},
+			},
+		}
+
+		// when
+		Expect(addPreroutingRules(cfg, nat, false)).ToNot(HaveOccurred())
+
+		// then
+		Expect(nat.Prerouting().Build(false)).To(Equal([]string{
+			"-I PREROUTING 1 ! -d 172.17.0.0/16 -i docker0 -p tcp -m comment --comment kuma-net:dev::vnet-redirect-outbound -j REDIRECT --to-ports 15002",
+			"-I PREROUTING 2 -i docker+ -m udp -p udp --dport 53 -m comment --comment kuma-net:dev::vnet-redirect-dns -j REDIRECT --to-ports 15053",
+			"-I PREROUTING 3 ! -d 172.18.0.0/16 -i docker+ -p tcp -m comment --comment kuma-net:dev::vnet-redirect-outbound -j REDIRECT --to-ports 12345",
+			"-I PREROUTING 4 -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+		}))
+	})
+
 	DescribeTable("should append PREROUTING rules",
 		func(verbose bool, ipv6 bool, expect ...string) {
 			// given
@@ -146,6 +164,386 @@ var _ = Describe("Builder nat", func() {
 				Expect(table).To(ContainSubstring(rule))
 			}
 		},
-		Entry("ipv4 not verbose", false, false, "-A PREROUTING -p tcp -j MESH_INBOUND"),
+		Entry("ipv4 not verbose", false, false, "-A PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND"),
+	)
+
+	It("should leave inbound traffic to the mangle table in the tproxy mode", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{
+				Inbound: config.TrafficFlow{
+					Enabled: true,
+					Mode:    config.RedirectModeTProxy,
+				},
+				Outbound: config.TrafficFlow{Enabled: true},
+			},
+		})
+
+		// when
+		nat, err := buildNatTable(cfg, nil, "lo", false)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		rules := nat.Build(false)
+		Expect(rules).ToNot(ContainSubstring("-N MESH_INBOUND\n"))
+		Expect(rules).ToNot(ContainSubstring("-A PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND"))
+		Expect(rules).To(ContainSubstring("-N MESH_INBOUND_REDIRECT"))
+		Expect(rules).To(ContainSubstring(
+			"-A MESH_OUTBOUND -p tcp -m mark --mark 0x539 -m comment --comment kuma-net:dev::proxy-upstream -j RETURN",
+		))
+	})
+
+	It("should reject the tproxy mode for the outbound traffic", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{
+					Enabled: true,
+					Mode:    config.RedirectModeTProxy,
+				},
+			},
+		})
+
+		// expect
+		Expect(validateRedirectModes(cfg)).To(MatchError(
+			"tproxy redirect mode is supported only for the inbound traffic",
+		))
+	})
+
+	DescribeTable("should return excluded outbound destinations of the right family",
+		func(ipv6 bool, expected string, unexpected string) {
+			// given
+			cfg := config.MergeConfigWithDefaults(config.Config{
+				Redirect: config.Redirect{
+					Outbound: config.TrafficFlow{
+						Enabled:            true,
+						ExcludeOutboundIPs: []string{"10.0.0.0/8", "fd00::/8"},
+					},
+				},
+			})
+
+			// when
+			rules := buildMeshOutbound(cfg, nil, "lo", ipv6).Build(false)
+
+			// then
+			Expect(rules).To(ContainElement(expected))
+			Expect(rules).ToNot(ContainElement(unexpected))
+		},
+		Entry("ipv4", false,
+			"-A MESH_OUTBOUND -d 10.0.0.0/8 -m comment --comment kuma-net:dev::exclude-outbound-ip -j RETURN",
+			"-A MESH_OUTBOUND -d fd00::/8 -m comment --comment kuma-net:dev::exclude-outbound-ip -j RETURN",
+		),
+		Entry("ipv6", true,
+			"-A MESH_OUTBOUND -d fd00::/8 -m comment --comment kuma-net:dev::exclude-outbound-ip -j RETURN",
+			"-A MESH_OUTBOUND -d 10.0.0.0/8 -m comment --comment kuma-net:dev::exclude-outbound-ip -j RETURN",
+		),
+	)
+
+	It("should reject invalid excluded outbound CIDRs", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{
+					Enabled:            true,
+					ExcludeOutboundIPs: []string{"10.0.0.0/8", "10.0.0.300/8"},
+				},
+			},
+		}
+
+		// when
+		_, err := buildIPTables(cfg, nil, false)
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring(
+			`Redirect.Outbound.ExcludeOutboundIPs: invalid IP address or CIDR "10.0.0.300/8"`,
+		)))
+	})
+
+	DescribeTable("should redirect outbound traffic only to included destinations",
+		func(includePorts []uint16, expected ...string) {
+			// given
+			cfg := config.MergeConfigWithDefaults(config.Config{
+				Redirect: config.Redirect{
+					Outbound: config.TrafficFlow{
+						Enabled:            true,
+						IncludePorts:       includePorts,
+						IncludeOutboundIPs: []string{"10.96.0.0/12", "240.0.0.0/4", "fd00::/8"},
+					},
+				},
+			})
+
+			// when
+			rules := buildMeshOutbound(cfg, nil, "lo", false).Build(false)
+
+			// then
+			Expect(rules[len(rules)-len(expected):]).To(Equal(expected))
+			Expect(rules).ToNot(ContainElement("-A MESH_OUTBOUND -m comment --comment kuma-net:dev::redirect-outbound -j MESH_OUTBOUND_REDIRECT"))
+		},
+		Entry("without included ports", nil,
+			"-A MESH_OUTBOUND -d 10.96.0.0/12 -m comment --comment kuma-net:dev::redirect-outbound -j MESH_OUTBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -d 240.0.0.0/4 -m comment --comment kuma-net:dev::redirect-outbound -j MESH_OUTBOUND_REDIRECT",
+		),
+		Entry("with included ports", []uint16{80, 443},
+			"-A MESH_OUTBOUND -d 10.96.0.0/12 -p tcp -m multiport --dports 80,443 -m comment --comment kuma-net:dev::include-outbound-port -j MESH_OUTBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -d 240.0.0.0/4 -p tcp -m multiport --dports 80,443 -m comment --comment kuma-net:dev::include-outbound-port -j MESH_OUTBOUND_REDIRECT",
+		),
+		Entry("with single included port", []uint16{443},
+			"-A MESH_OUTBOUND -d 10.96.0.0/12 -p tcp --dport 443 -m comment --comment kuma-net:dev::include-outbound-port -j MESH_OUTBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -d 240.0.0.0/4 -p tcp --dport 443 -m comment --comment kuma-net:dev::include-outbound-port -j MESH_OUTBOUND_REDIRECT",
+		),
 	)
+
+	It("should group excluded ports into multiport rules", func() {
+		// given
+		var ports []uint16
+		for port := uint16(8000); port < 8017; port++ {
+			ports = append(ports, port)
+		}
+
+		cfg := config.TrafficFlow{
+			Enabled:      true,
+			Chain:        config.Chain{Name: "MESH_INBOUND"},
+			ExcludePorts: ports,
+		}
+
+		// when
+		rules := buildMeshInbound(cfg, "", config.LogConfig{}, "MESH_INBOUND_REDIRECT", "", false).Build(false)
+
+		// then
+		Expect(rules).To(Equal([]string{
+			"-A MESH_INBOUND -p tcp -m multiport --dports " +
+				"8000,8001,8002,8003,8004,8005,8006,8007,8008,8009,8010,8011,8012,8013,8014 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN",
+			"-A MESH_INBOUND -p tcp -m multiport --dports 8015,8016 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN",
+			"-A MESH_INBOUND -p tcp -m comment --comment kuma-net:dev::redirect-inbound -j MESH_INBOUND_REDIRECT",
+		}))
+	})
+
+	DescribeTable("should match port ranges",
+		func(cfg config.TrafficFlow, expect ...string) {
+			// given
+			cfg.Enabled = true
+			cfg.Chain = config.Chain{Name: "MESH_INBOUND"}
+
+			// when
+			rules := buildMeshInbound(cfg, "", config.LogConfig{}, "MESH_INBOUND_REDIRECT", "", false).Build(false)
+
+			// then
+			Expect(rules).To(Equal(expect))
+		},
+		Entry("excluded port range",
+			config.TrafficFlow{ExcludePortRanges: "30000:32767"},
+			"-A MESH_INBOUND -p tcp --dport 30000:32767 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN",
+			"-A MESH_INBOUND -p tcp -m comment --comment kuma-net:dev::redirect-inbound -j MESH_INBOUND_REDIRECT",
+		),
+		Entry("excluded ports and port ranges",
+			config.TrafficFlow{
+				ExcludePorts:      []uint16{22},
+				ExcludePortRanges: "30000:32767,8000",
+			},
+			"-A MESH_INBOUND -p tcp -m multiport --dports 22,30000:32767,8000 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN",
+			"-A MESH_INBOUND -p tcp -m comment --comment kuma-net:dev::redirect-inbound -j MESH_INBOUND_REDIRECT",
+		),
+		Entry("included port range",
+			config.TrafficFlow{IncludePortRanges: "8000:8080"},
+			"-A MESH_INBOUND -p tcp --dport 8000:8080 -m comment --comment kuma-net:dev::include-inbound-port -j MESH_INBOUND_REDIRECT",
+		),
+	)
+
+	DescribeTable("should not redirect inbound traffic from excluded sources",
+		func(ipv6 bool, expect ...string) {
+			// given
+			cfg := config.TrafficFlow{
+				Enabled:                 true,
+				Chain:                   config.Chain{Name: "MESH_INBOUND"},
+				ExcludePorts:            []uint16{22},
+				ExcludeInboundSourceIPs: []string{"10.0.0.1", "192.168.0.0/16", "fd00::/8"},
+			}
+
+			// when
+			rules := buildMeshInbound(cfg, "", config.LogConfig{}, "MESH_INBOUND_REDIRECT", "", ipv6).Build(false)
+
+			// then
+			Expect(rules).To(Equal(expect))
+		},
+		Entry("ipv4", false,
+			"-A MESH_INBOUND -s 10.0.0.1 -m comment --comment kuma-net:dev::exclude-inbound-source -j RETURN",
+			"-A MESH_INBOUND -s 192.168.0.0/16 -m comment --comment kuma-net:dev::exclude-inbound-source -j RETURN",
+			"-A MESH_INBOUND -p tcp --dport 22 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN",
+			"-A MESH_INBOUND -p tcp -m comment --comment kuma-net:dev::redirect-inbound -j MESH_INBOUND_REDIRECT",
+		),
+		Entry("ipv6", true,
+			"-A MESH_INBOUND -s fd00::/8 -m comment --comment kuma-net:dev::exclude-inbound-source -j RETURN",
+			"-A MESH_INBOUND -p tcp --dport 22 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN",
+			"-A MESH_INBOUND -p tcp -m comment --comment kuma-net:dev::redirect-inbound -j MESH_INBOUND_REDIRECT",
+		),
+	)
+
+	It("should identify the sidecar by all the provided UIDs, GID and mark", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Owner: config.Owner{
+				UID:  "5678",
+				UIDs: []string{"0"},
+				GID:  "1337",
+				Mark: 0x10,
+			},
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{Enabled: true},
+			},
+		})
+
+		// when
+		rules := buildMeshOutbound(cfg, nil, "lo", false).Build(false)
+
+		// then
+		Expect(rules).To(Equal([]string{
+			"-A MESH_OUTBOUND -s 127.0.0.6/32 -o lo -m comment --comment kuma-net:dev::inbound-passthrough -j RETURN",
+			"-A MESH_OUTBOUND -p tcp -o lo ! -d 127.0.0.1/32 -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-hairpin -j MESH_INBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -p tcp -o lo ! -d 127.0.0.1/32 -m owner --uid-owner 0 -m comment --comment kuma-net:dev::sidecar-hairpin -j MESH_INBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -p tcp -o lo ! -d 127.0.0.1/32 -m owner --gid-owner 1337 -m comment --comment kuma-net:dev::sidecar-hairpin -j MESH_INBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -p tcp -o lo ! -d 127.0.0.1/32 -m mark --mark 0x10 -m comment --comment kuma-net:dev::sidecar-hairpin -j MESH_INBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -p tcp -o lo -m owner ! --uid-owner 5678 -m owner ! --uid-owner 0 -m owner ! --gid-owner 1337 -m mark ! --mark 0x10 -m comment --comment kuma-net:dev::application-loopback -j RETURN",
+			"-A MESH_OUTBOUND -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND -m owner --uid-owner 0 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND -m owner --gid-owner 1337 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND -m mark --mark 0x10 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND -d 127.0.0.1/32 -m comment --comment kuma-net:dev::localhost -j RETURN",
+			"-A MESH_OUTBOUND -m comment --comment kuma-net:dev::redirect-outbound -j MESH_OUTBOUND_REDIRECT",
+		}))
+	})
+
+	DescribeTable("should identify the sidecar only by the provided owner",
+		func(owner config.Owner, expect ...string) {
+			// given
+			cfg := config.MergeConfigWithDefaults(config.Config{
+				Owner: owner,
+				Redirect: config.Redirect{
+					Outbound: config.TrafficFlow{Enabled: true},
+				},
+			})
+
+			// when
+			rules := buildMeshOutbound(cfg, nil, "lo", false).Build(false)
+
+			// then
+			Expect(rules).To(Equal(expect))
+		},
+		Entry("gid only", config.Owner{GID: "1337"},
+			"-A MESH_OUTBOUND -s 127.0.0.6/32 -o lo -m comment --comment kuma-net:dev::inbound-passthrough -j RETURN",
+			"-A MESH_OUTBOUND -p tcp -o lo ! -d 127.0.0.1/32 -m owner --gid-owner 1337 -m comment --comment kuma-net:dev::sidecar-hairpin -j MESH_INBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -p tcp -o lo -m owner ! --gid-owner 1337 -m comment --comment kuma-net:dev::application-loopback -j RETURN",
+			"-A MESH_OUTBOUND -m owner --gid-owner 1337 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND -d 127.0.0.1/32 -m comment --comment kuma-net:dev::localhost -j RETURN",
+			"-A MESH_OUTBOUND -m comment --comment kuma-net:dev::redirect-outbound -j MESH_OUTBOUND_REDIRECT",
+		),
+		Entry("mark only", config.Owner{Mark: 0x10},
+			"-A MESH_OUTBOUND -s 127.0.0.6/32 -o lo -m comment --comment kuma-net:dev::inbound-passthrough -j RETURN",
+			"-A MESH_OUTBOUND -p tcp -o lo ! -d 127.0.0.1/32 -m mark --mark 0x10 -m comment --comment kuma-net:dev::sidecar-hairpin -j MESH_INBOUND_REDIRECT",
+			"-A MESH_OUTBOUND -p tcp -o lo -m mark ! --mark 0x10 -m comment --comment kuma-net:dev::application-loopback -j RETURN",
+			"-A MESH_OUTBOUND -m mark --mark 0x10 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-A MESH_OUTBOUND -d 127.0.0.1/32 -m comment --comment kuma-net:dev::localhost -j RETURN",
+			"-A MESH_OUTBOUND -m comment --comment kuma-net:dev::redirect-outbound -j MESH_OUTBOUND_REDIRECT",
+		),
+	)
+
+	It("should reject the owner without any UID, GID or mark", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Owner: config.Owner{UIDs: []string{""}},
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{Enabled: true},
+			},
+		})
+
+		// when
+		_, err := BuildIPTables(cfg, nil, false)
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring(
+			"Owner: sidecar has to be identified by UID, GID or mark",
+		)))
+	})
+
+	It("should reject the sidecar mark used by the tproxy mode", func() {
+		// given
+		cfg := config.Config{
+			Owner: config.Owner{UID: "5678", Mark: 0x539},
+			Redirect: config.Redirect{
+				Inbound: config.TrafficFlow{
+					Enabled: true,
+					Mode:    config.RedirectModeTProxy,
+				},
+			},
+		}
+
+		// when
+		_, err := BuildIPTables(cfg, nil, false)
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring(
+			"Owner.Mark: 0x539 is already used as Redirect.TProxy.Mark",
+		)))
+	})
+
+	It("should match excluded ports and outbound IPs with ipset sets", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{
+				NamePrefix: "KUMA_",
+				Inbound: config.TrafficFlow{
+					Enabled:      true,
+					ExcludePorts: []uint16{22},
+				},
+				Outbound: config.TrafficFlow{
+					Enabled:            true,
+					ExcludeOutboundIPs: []string{"10.0.0.0/8"},
+				},
+			},
+			IPSet: config.IPSet{Enabled: true},
+		})
+
+		// when
+		nat, err := buildNatTable(cfg, nil, "lo", true)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nat.Build(false)).To(And(
+			ContainSubstring("-A KUMA_MESH_INBOUND -p tcp -m set --match-set KUMA_MESH_IN_EXCLUDE_PORT dst -m comment --comment kuma-net:dev:KUMA_:exclude-inbound-port -j RETURN\n"),
+			ContainSubstring("-A KUMA_MESH_OUTBOUND -p tcp -m set --match-set KUMA_MESH_OUT_EXCLUDE_PORT dst -m comment --comment kuma-net:dev:KUMA_:exclude-outbound-port -j RETURN\n"),
+			ContainSubstring("-A KUMA_MESH_OUTBOUND -m set --match-set KUMA_MESH_OUT_EXCLUDE_NET6 dst -m comment --comment kuma-net:dev:KUMA_:exclude-outbound-ip -j RETURN\n"),
+			Not(ContainSubstring("--dport 22")),
+			Not(ContainSubstring("10.0.0.0/8")),
+		))
+	})
+
+	It("should log decisions to the NFLOG group with rate limiting", func() {
+		// given
+		cfg := config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{
+				Inbound: config.TrafficFlow{
+					Enabled:      true,
+					ExcludePorts: []uint16{22},
+				},
+				Outbound: config.TrafficFlow{Enabled: true},
+			},
+			Log: config.LogConfig{
+				Enabled:   true,
+				Mode:      config.LogModeNflog,
+				RateLimit: "600/minute",
+			},
+		})
+
+		// when
+		nat, err := buildNatTable(cfg, nil, "lo", false)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nat.Build(false)).To(And(
+			ContainSubstring("-A MESH_INBOUND -p tcp --dport 22 -m limit --limit 10/sec -m comment --comment kuma-net:dev::log -j NFLOG --nflog-prefix excluded-port --nflog-group 1337\n"+
+				"-A MESH_INBOUND -p tcp --dport 22 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN\n"),
+			ContainSubstring("-A MESH_OUTBOUND_REDIRECT -p tcp -m limit --limit 10/sec -m comment --comment kuma-net:dev::log -j NFLOG --nflog-prefix captured --nflog-group 1337\n"+
+				"-A MESH_OUTBOUND_REDIRECT -p tcp -m comment --comment kuma-net:dev::outbound-listener -j REDIRECT --to-ports 15001\n"),
+			Not(ContainSubstring("-j LOG")),
+		))
+	})
 })
@@ -1,6 +1,8 @@
 package builder
 
 import (
+	"strconv"
+
 	. "github.com/kumahq/kuma-net/iptables/consts"
 	. "github.com/kumahq/kuma-net/iptables/parameters"
 	"github.com/kumahq/kuma-net/iptables/table"
@@ -10,45 +12,72 @@ import (
 func buildRawTable(
 	cfg config.Config,
 	dnsServers []string,
+	ipv6 bool,
 ) *table.RawTable {
+	prefix := cfg.Redirect.NamePrefix
 	raw := table.Raw()
 
-	if cfg.ShouldConntrackZoneSplit() {
-		raw.Output().
-			Append(
+	if cfg.ShouldConntrackZoneSplit(ipv6) {
+		sidecarZone := strconv.FormatUint(uint64(cfg.Redirect.DNS.SidecarConntrackZone), 10)
+		applicationZone := strconv.FormatUint(uint64(cfg.Redirect.DNS.ApplicationConntrackZone), 10)
+		sidecarMatches := sidecarMatches(cfg)
+
+		for _, sidecar := range sidecarMatches {
+			raw.Output().Append(
 				Protocol(Udp(DestinationPort(DNSPort))),
-				Match(Owner(Uid(cfg.Owner.UID))),
-				Jump(Ct(Zone("1"))),
-			).
-			Append(
+				sidecar,
+				comment(prefix, ReasonSidecarDNSZone),
+				Jump(Ct(Zone(sidecarZone))),
+			)
+		}
+
+		// queries of the systemd-resolved stub to the upstream servers are
+		// made on behalf of the DNS proxy, so they share its zone
+		if exemptsStubUpstream(cfg) {
+			raw.Output().Append(
+				Protocol(Udp(DestinationPort(DNSPort))),
+				Match(Owner(Uid(cfg.Redirect.DNS.SystemdResolvedUser))),
+				comment(prefix, ReasonStubUpstreamZone),
+				Jump(Ct(Zone(sidecarZone))),
+			)
+		}
+
+		for _, sidecar := range sidecarMatches {
+			raw.Output().Append(
 				Protocol(Udp(SourcePort(cfg.Redirect.DNS.Port))),
-				Match(Owner(Uid(cfg.Owner.UID))),
-				Jump(Ct(Zone("2"))),
+				sidecar,
+				comment(prefix, ReasonDNSProxyZone),
+				Jump(Ct(Zone(applicationZone))),
 			)
+		}
 
 		if cfg.ShouldCaptureAllDNS() {
 			raw.Output().Append(
 				Protocol(Udp(DestinationPort(DNSPort))),
-				Jump(Ct(Zone("2"))),
+				comment(prefix, ReasonApplicationDNSZone),
+				Jump(Ct(Zone(applicationZone))),
 			)
 
 			raw.Prerouting().
 				Append(
 					Protocol(Udp(SourcePort(DNSPort))),
-					Jump(Ct(Zone("1"))),
+					comment(prefix, ReasonDNSResponseZone),
+					Jump(Ct(Zone(sidecarZone))),
 				)
 		} else {
 			for _, ip := range dnsServers {
 				raw.Output().Append(
 					Destination(ip),
 					Protocol(Udp(DestinationPort(DNSPort))),
-					Jump(Ct(Zone("2"))),
+					comment(prefix, ReasonApplicationDNSZone),
+					Jump(Ct(Zone(applicationZone))),
 				)
 				raw.Prerouting().
 					Append(
 						Destination(ip),
 						Protocol(Udp(SourcePort(DNSPort))),
-						Jump(Ct(Zone("1"))),
+						comment(prefix, ReasonDNSResponseZone),
+						Jump(Ct(Zone(sidecarZone))),
 					)
 			}
 		}
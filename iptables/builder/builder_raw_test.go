@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Builder raw", func() {
+	var stdout *bytes.Buffer
+	var cfg config.Config
+
+	BeforeEach(func() {
+		// conntrack extensions are probed with the iptables binaries, so they
+		// are replaced with ones which support them only for IPv4
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "iptables"), []byte("#!/bin/sh\nexit 0\n"), 0o755)).
+			To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "ip6tables"), []byte("#!/bin/sh\nexit 2\n"), 0o755)).
+			To(Succeed())
+		GinkgoT().Setenv("PATH", dir)
+
+		stdout = &bytes.Buffer{}
+		cfg = config.MergeConfigWithDefaults(config.Config{
+			Redirect: config.Redirect{
+				DNS: config.DNS{
+					Enabled:                  true,
+					ConntrackZoneSplit:       true,
+					CaptureAll:               true,
+					SidecarConntrackZone:     4001,
+					ApplicationConntrackZone: 4002,
+				},
+			},
+			RuntimeStdout: stdout,
+		})
+	})
+
+	It("should split DNS traffic into configured conntrack zones", func() {
+		// when
+		raw := buildRawTable(cfg, nil, false).Build(false)
+
+		// then
+		Expect(raw).To(ContainSubstring(
+			"-A OUTPUT -p udp --dport 53 -m owner --uid-owner 5678 " +
+				"-m comment --comment kuma-net:dev::sidecar-dns-zone -j CT --zone 4001",
+		))
+		Expect(raw).To(ContainSubstring(
+			"-A OUTPUT -p udp --dport 53 -m comment --comment kuma-net:dev::application-dns-zone -j CT --zone 4002",
+		))
+		Expect(raw).To(ContainSubstring(
+			"-A PREROUTING -p udp --sport 53 -m comment --comment kuma-net:dev::dns-response-zone -j CT --zone 4001",
+		))
+		Expect(stdout.String()).To(BeEmpty())
+	})
+
+	It("should skip conntrack zones when extensions are missing for the family", func() {
+		// when
+		raw := buildRawTable(cfg, nil, true).Build(false)
+
+		// then
+		Expect(raw).ToNot(ContainSubstring("-j CT"))
+		Expect(stdout.String()).To(ContainSubstring("'conntrack' ip6tables extension is present"))
+	})
+})
@@ -0,0 +1,221 @@
+package builder
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Builder dry run", func() {
+	It("should render rules of both address families with the configured DNS servers", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound:  config.TrafficFlow{Enabled: true},
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled: true,
+					Servers: []string{"10.0.0.10", "fd00::10"},
+				},
+			},
+			IPv6: true,
+		}
+
+		// when
+		output, err := BuildIPTablesDryRun(cfg)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+
+		ipv4, ipv6, found := strings.Cut(output, "\n# IPv6 rules (ip6tables-restore)\n")
+		Expect(found).To(BeTrue())
+		Expect(ipv4).To(HavePrefix("# IPv4 rules (iptables-restore)\n* nat\n"))
+		Expect(ipv4).To(ContainSubstring("-d 10.0.0.10 -p udp --dport 53"))
+		Expect(ipv4).ToNot(ContainSubstring("fd00::10"))
+		Expect(ipv6).To(HavePrefix("* nat\n"))
+		Expect(ipv6).To(ContainSubstring("-d fd00::10 -p udp --dport 53"))
+		Expect(ipv6).ToNot(ContainSubstring("10.0.0.10"))
+	})
+
+	It("should render only IPv4 rules when IPv6 is disabled", func() {
+		// when
+		output, err := BuildIPTablesDryRun(config.Config{})
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(HavePrefix("# IPv4 rules (iptables-restore)\n"))
+		Expect(output).ToNot(ContainSubstring("# IPv6"))
+	})
+
+	It("should reject invalid DNS servers", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				DNS: config.DNS{Enabled: true, Servers: []string{"10.0.0.0/8"}},
+			},
+		}
+
+		// when
+		_, err := BuildIPTablesDryRun(cfg)
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring(
+			`Redirect.DNS.Servers: invalid IP address "10.0.0.0/8"`,
+		)))
+	})
+
+	It("should reject invalid UDP port ranges", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound: config.TrafficFlow{
+					Enabled: true,
+					UDP:     config.UDP{Enabled: true, ExcludePortRanges: "6000:70000"},
+				},
+			},
+		}
+
+		// when
+		_, err := BuildIPTablesDryRun(cfg)
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring("Redirect.Inbound.UDP.ExcludePortRanges")))
+	})
+
+	It("should reject UDP ports and port ranges set together", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{
+					Enabled: true,
+					UDP: config.UDP{
+						Enabled:           true,
+						IncludePorts:      []uint16{5353},
+						IncludePortRanges: "6000:6100",
+					},
+				},
+			},
+		}
+
+		// when
+		_, err := BuildIPTablesDryRun(cfg)
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring(
+			"Redirect.Outbound.UDP.IncludePortRanges: cannot be used together " +
+				"with Redirect.Outbound.UDP.IncludePorts",
+		)))
+	})
+
+	It("should exclude upstream queries of the systemd-resolved stub", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound:  config.TrafficFlow{Enabled: true},
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled:             true,
+					Servers:             []string{"127.0.0.53", "10.0.0.10"},
+					SystemdResolvedUser: "101",
+				},
+			},
+		}
+
+		// when
+		output, err := BuildIPTablesDryRun(cfg)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring(
+			"-p udp --dport 53 -m owner --uid-owner 101 " +
+				"-m comment --comment kuma-net:dev::stub-upstream -j RETURN",
+		))
+		Expect(output).To(ContainSubstring(
+			"-A MESH_OUTBOUND -p tcp --dport 53 -m owner --uid-owner 101 " +
+				"-m comment --comment kuma-net:dev::stub-upstream -j RETURN",
+		))
+		Expect(output).To(ContainSubstring("-d 127.0.0.53 -p udp --dport 53"))
+	})
+
+	It("should skip the stub exemption when the systemd-resolved user doesn't exist", func() {
+		// given
+		var stdout strings.Builder
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound:  config.TrafficFlow{Enabled: true},
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled:             true,
+					Servers:             []string{"127.0.0.53", "10.0.0.10"},
+					SystemdResolvedUser: "kuma-net-missing-user",
+				},
+			},
+			RuntimeStdout: &stdout,
+		}
+
+		// when
+		output, err := BuildIPTablesDryRun(cfg)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).ToNot(ContainSubstring("stub-upstream"))
+		Expect(output).To(ContainSubstring("-d 127.0.0.53 -p udp --dport 53"))
+		Expect(stdout.String()).To(ContainSubstring(
+			`[WARNING] cannot find user "kuma-net-missing-user" systemd-resolved runs as`,
+		))
+	})
+})
+
+var _ = Describe("BuildIPTables", func() {
+	It("should exclude upstream queries of the systemd-resolved stub from the provided DNS servers", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound:  config.TrafficFlow{Enabled: true},
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled:             true,
+					SystemdResolvedUser: "101",
+				},
+			},
+		}
+
+		// when
+		output, err := BuildIPTables(cfg, []string{"127.0.0.53"}, false)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring(
+			"-I OUTPUT 2 -p udp --dport 53 -m owner --uid-owner 101 " +
+				"-m comment --comment kuma-net:dev::stub-upstream -j RETURN",
+		))
+		Expect(output).To(ContainSubstring(
+			"-A MESH_OUTBOUND -p tcp --dport 53 -m owner --uid-owner 101 " +
+				"-m comment --comment kuma-net:dev::stub-upstream -j RETURN",
+		))
+	})
+
+	It("should not exclude queries of the systemd-resolved user when the stub isn't used", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound:  config.TrafficFlow{Enabled: true},
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled:             true,
+					SystemdResolvedUser: "101",
+				},
+			},
+		}
+
+		// when
+		output, err := BuildIPTables(cfg, []string{"10.0.0.10"}, false)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).ToNot(ContainSubstring("stub-upstream"))
+	})
+})
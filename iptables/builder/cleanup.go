@@ -0,0 +1,266 @@
+package builder
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/kumahq/kuma-net/ipset"
+	"github.com/kumahq/kuma-net/iptables/parser"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+func BuildIPTablesCleanup(cfg config.Config, dnsServers []string, ipv6 bool) (string, error) {
+	tables, err := buildIPTables(cfg, dnsServers, ipv6)
+	if err != nil {
+		return "", err
+	}
+
+	return buildCleanupCommands(cfg, tables, ipv6), nil
+}
+
+// BuildIPTablesCleanupDryRun returns the commands CleanupIPTables would run
+// with the same configuration, for IPv4 and (when enabled) IPv6. DNS servers
+// are resolved the same way as by the real cleanup, so the rules redirecting
+// traffic to the particular servers are included
+func BuildIPTablesCleanupDryRun(cfg config.Config) (string, error) {
+	cfg = config.MergeConfigWithDefaults(cfg)
+
+	ipv4, ipv6, err := buildFamiliesIPTables(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	output := buildCleanupCommands(cfg, ipv4, false)
+	if ipv6 != nil {
+		output += buildCleanupCommands(cfg, ipv6, true)
+	}
+
+	return output, nil
+}
+
+func buildCleanupCommands(cfg config.Config, tables *IPTables, ipv6 bool) string {
+	cmdName := cfg.IPTables.Executable("iptables", ipv6)
+
+	var lines []string
+
+	for _, t := range tables.BuildCleanup(false) {
+		for _, cmd := range t.commands {
+			lines = append(lines, fmt.Sprintf("%s -t %s %s", cmdName, t.table, cmd))
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func runIPTablesCmd(cmdName string, table string, args ...string) (string, error) {
+	cmd := exec.Command(cmdName, append([]string{"-t", table}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("executing command failed: %s (with output: %q)", err, output)
+	}
+
+	return string(output), nil
+}
+
+// noMatchingRuleMessages are printed by iptables when the rule to delete
+// cannot be found (or the chain it jumps to doesn't exist anymore)
+var noMatchingRuleMessages = []string{
+	"does a matching rule exist",
+	"No chain/target/match by that name",
+	"Couldn't load target",
+}
+
+// deleteRule deletes the rule and reports if it was found. Only the failure
+// caused by the missing rule is not treated as an error, so the other ones
+// (i.e. the xtables lock timeout, or the missing binary) don't leave
+// the rules behind unnoticed
+func deleteRule(cmdName string, table string, args ...string) (bool, error) {
+	cmd := exec.Command(cmdName, append([]string{"-t", table}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+
+	if _, ok := err.(*exec.ExitError); ok {
+		for _, message := range noMatchingRuleMessages {
+			if strings.Contains(string(output), message) {
+				return false, nil
+			}
+		}
+	}
+
+	return false, fmt.Errorf("executing command failed: %s (with output: %q)", err, output)
+}
+
+func chainExists(cmdName string, table string, chain string) bool {
+	_, err := runIPTablesCmd(cmdName, table, "-S", chain)
+	return err == nil
+}
+
+// cleanupTable executes provided cleanup commands for the table. As we cannot
+// be sure in which state the previous installation was left (it could have
+// been applied partially or more than once), rules are deleted for as long as
+// iptables is able to find matching ones, and chains which don't exist are
+// skipped
+func cleanupTable(cmdName string, t tableCommands) error {
+	for _, command := range t.commands {
+		args := strings.Fields(command)
+
+		switch args[0] {
+		case "-D":
+			for {
+				deleted, err := deleteRule(cmdName, t.table, args...)
+				if err != nil {
+					return fmt.Errorf("cannot delete rule %q from table %s: %s", command, t.table, err)
+				}
+
+				if !deleted {
+					break
+				}
+			}
+		default:
+			if !chainExists(cmdName, t.table, args[1]) {
+				continue
+			}
+
+			if _, err := runIPTablesCmd(cmdName, t.table, args...); err != nil {
+				return fmt.Errorf("cannot cleanup chain %s in table %s: %s", args[1], t.table, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cleanupTaggedRules deletes rules tagged with our comment and the provided
+// name prefix, which were installed (i.e. by another version) in chains
+// other than the ones removed by the cleanup commands
+func cleanupTaggedRules(cmdName string, t tableCommands, prefix string) error {
+	removed := map[string]bool{}
+	for _, command := range t.commands {
+		if args := strings.Fields(command); args[0] == "-X" {
+			removed[args[1]] = true
+		}
+	}
+
+	output, err := runIPTablesCmd(cmdName, t.table, "-S")
+	if err != nil {
+		return fmt.Errorf("cannot list rules in table %s: %s", t.table, err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "-A ") || !ownedByPrefix(line, prefix) {
+			continue
+		}
+
+		args, err := parser.Tokenize(line)
+		if err != nil {
+			return fmt.Errorf("cannot parse rule %q: %s", line, err)
+		}
+
+		if removed[args[1]] {
+			continue
+		}
+
+		args[0] = "-D"
+		if _, err := runIPTablesCmd(cmdName, t.table, args...); err != nil {
+			return fmt.Errorf("cannot delete rule %q from table %s: %s", line, t.table, err)
+		}
+	}
+
+	return nil
+}
+
+func cleanupIPTables(cfg config.Config, tables *IPTables, ipv6 bool) error {
+	cmdName := cfg.IPTables.Executable("iptables", ipv6)
+
+	for _, t := range tables.BuildCleanup(false) {
+		if err := cleanupTaggedRules(cmdName, t, cfg.Redirect.NamePrefix); err != nil {
+			return err
+		}
+
+		if err := cleanupTable(cmdName, t); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ShouldConfigureTProxyRouting() {
+		if err := cleanupTProxyRouting(cfg, ipv6); err != nil {
+			return err
+		}
+	}
+
+	return cleanupIPv6Address(ipv6)
+}
+
+// CleanupIPTables removes all the rules and chains which would be installed
+// by RestoreIPTables with the same configuration. Rules in the built-in chains
+// which were not created by us are left untouched
+func CleanupIPTables(cfg config.Config) (string, error) {
+	cfg, err := resolveIPTablesMode(config.MergeConfigWithDefaults(cfg))
+	if err != nil {
+		return "", err
+	}
+
+	ipv4Tables, ipv6Tables, err := buildFamiliesIPTables(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cleanupIPTables(cfg, ipv4Tables, false); err != nil {
+		return "", fmt.Errorf("cannot cleanup ipv4 iptable rules: %s", err)
+	}
+
+	if ipv6Tables != nil {
+		if err := cleanupIPTables(cfg, ipv6Tables, true); err != nil {
+			return "", fmt.Errorf("cannot cleanup ipv6 iptable rules: %s", err)
+		}
+	}
+
+	// sets can be destroyed only after all the rules referencing them
+	// were removed
+	if cfg.ShouldUseIPSet() {
+		if err := ipset.Cleanup(cfg); err != nil {
+			return "", fmt.Errorf("cannot cleanup ipset sets: %s", err)
+		}
+	}
+
+	_, _ = cfg.RuntimeStdout.Write([]byte("iptables rules diverging the traffic " +
+		"to Envoy removed.\n"))
+
+	return "", nil
+}
+
+// cleanupIPv6Address removes IP address configured by configureIPv6Address.
+// Equivalent to `ip -6 addr del "::6/128" dev lo`
+func cleanupIPv6Address(ipv6 bool) error {
+	if !ipv6 {
+		return nil
+	}
+	link, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to find 'lo' link: %v", err)
+	}
+	address := &net.IPNet{IP: net.ParseIP("::6"), Mask: net.CIDRMask(128, 128)}
+	addr := &netlink.Addr{IPNet: address}
+
+	err = netlink.AddrDel(link, addr)
+	if ignoreNotExists(err) != nil {
+		return fmt.Errorf("failed to remove IPv6 inbound address: %v", err)
+	}
+	return nil
+}
+
+func ignoreNotExists(err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(strings.ToLower(err.Error()), "cannot assign requested address") {
+		return nil
+	}
+	return err
+}
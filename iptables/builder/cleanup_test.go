@@ -0,0 +1,232 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Builder cleanup", func() {
+	DescribeTable("should generate commands removing installed rules and chains",
+		func(cfg config.Config, ipv6 bool, expect ...string) {
+			// when
+			output, err := BuildIPTablesCleanup(cfg, nil, ipv6)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Split(strings.TrimSpace(output), "\n")).To(Equal(expect))
+		},
+		Entry("ipv4 with the name prefix",
+			config.Config{
+				Redirect: config.Redirect{
+					NamePrefix: "KUMA_",
+					Inbound:    config.TrafficFlow{Enabled: true},
+					Outbound:   config.TrafficFlow{Enabled: true},
+				},
+				DropInvalidPackets: true,
+			},
+			false,
+			"iptables -t nat -D PREROUTING -p tcp -m comment --comment kuma-net:dev:KUMA_:capture-inbound -j KUMA_MESH_INBOUND",
+			"iptables -t nat -D OUTPUT -p tcp -m comment --comment kuma-net:dev:KUMA_:capture-outbound -j KUMA_MESH_OUTBOUND",
+			"iptables -t nat -F KUMA_MESH_INBOUND",
+			"iptables -t nat -F KUMA_MESH_OUTBOUND",
+			"iptables -t nat -F KUMA_MESH_INBOUND_REDIRECT",
+			"iptables -t nat -F KUMA_MESH_OUTBOUND_REDIRECT",
+			"iptables -t nat -X KUMA_MESH_INBOUND",
+			"iptables -t nat -X KUMA_MESH_OUTBOUND",
+			"iptables -t nat -X KUMA_MESH_INBOUND_REDIRECT",
+			"iptables -t nat -X KUMA_MESH_OUTBOUND_REDIRECT",
+			"iptables -t mangle -D PREROUTING -m conntrack --ctstate INVALID -m comment --comment kuma-net:dev:KUMA_:drop-invalid -j DROP",
+		),
+		Entry("ipv6 with logs and inserted rules",
+			config.Config{
+				Redirect: config.Redirect{
+					Inbound:  config.TrafficFlow{Enabled: true},
+					Outbound: config.TrafficFlow{Enabled: true},
+				},
+				Log: config.LogConfig{Enabled: true, Level: config.DebugLogLevel},
+			},
+			true,
+			"ip6tables -t nat -D PREROUTING -m comment --comment kuma-net:dev::log -j LOG --log-prefix PREROUTING: --log-level 7",
+			"ip6tables -t nat -D PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			"ip6tables -t nat -D OUTPUT -m comment --comment kuma-net:dev::log -j LOG --log-prefix OUTPUT: --log-level 7",
+			"ip6tables -t nat -D OUTPUT -p tcp -m comment --comment kuma-net:dev::capture-outbound -j MESH_OUTBOUND",
+			"ip6tables -t nat -F MESH_INBOUND",
+			"ip6tables -t nat -F MESH_OUTBOUND",
+			"ip6tables -t nat -F MESH_INBOUND_REDIRECT",
+			"ip6tables -t nat -F MESH_OUTBOUND_REDIRECT",
+			"ip6tables -t nat -X MESH_INBOUND",
+			"ip6tables -t nat -X MESH_OUTBOUND",
+			"ip6tables -t nat -X MESH_INBOUND_REDIRECT",
+			"ip6tables -t nat -X MESH_OUTBOUND_REDIRECT",
+		),
+		Entry("ipv6 with nft mode",
+			config.Config{
+				Redirect: config.Redirect{
+					Inbound:  config.TrafficFlow{Enabled: true},
+					Outbound: config.TrafficFlow{Enabled: true},
+				},
+				IPTables: config.IPTables{Mode: config.IPTablesModeNft},
+			},
+			true,
+			"ip6tables-nft -t nat -D PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			"ip6tables-nft -t nat -D OUTPUT -p tcp -m comment --comment kuma-net:dev::capture-outbound -j MESH_OUTBOUND",
+			"ip6tables-nft -t nat -F MESH_INBOUND",
+			"ip6tables-nft -t nat -F MESH_OUTBOUND",
+			"ip6tables-nft -t nat -F MESH_INBOUND_REDIRECT",
+			"ip6tables-nft -t nat -F MESH_OUTBOUND_REDIRECT",
+			"ip6tables-nft -t nat -X MESH_INBOUND",
+			"ip6tables-nft -t nat -X MESH_OUTBOUND",
+			"ip6tables-nft -t nat -X MESH_INBOUND_REDIRECT",
+			"ip6tables-nft -t nat -X MESH_OUTBOUND_REDIRECT",
+		),
+	)
+
+	It("should include rules for the configured DNS servers in the dry run", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled: true,
+					Port:    15053,
+					Servers: []string{"10.0.0.10"},
+				},
+			},
+		}
+
+		// when
+		output, err := BuildIPTablesCleanupDryRun(cfg)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring(
+			"iptables -t nat -D OUTPUT -d 10.0.0.10 -p udp --dport 53 -m comment --comment kuma-net:dev::redirect-dns -j REDIRECT --to-ports 15053\n",
+		))
+	})
+
+	DescribeTable("should choose iptables binaries of the configured variant",
+		func(mode config.IPTablesMode, name string, ipv6 bool, want string) {
+			// when
+			got := config.IPTables{Mode: mode}.Executable(name, ipv6)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("auto", config.IPTablesModeAuto, "iptables-restore", false, "iptables-restore"),
+		Entry("legacy", config.IPTablesModeLegacy, "iptables", false, "iptables-legacy"),
+		Entry("legacy ipv6", config.IPTablesModeLegacy, "iptables-save", true, "ip6tables-legacy-save"),
+		Entry("nft", config.IPTablesModeNft, "iptables-restore", false, "iptables-nft-restore"),
+	)
+
+	Describe("deleting rules", func() {
+		var dir string
+
+		// fakeIPTables installs the iptables binary, which deletes the rule
+		// successfully the provided number of times, and then fails with
+		// the provided output and exit code
+		fakeIPTables := func(deletions int, output string, code int) string {
+			script := fmt.Sprintf(`#!/bin/sh
+count=$(/bin/cat %[1]s/count 2>/dev/null || echo 0)
+echo $((count + 1)) > %[1]s/count
+[ "$count" -lt %[2]d ] && exit 0
+echo "%[3]s" >&2
+exit %[4]d
+`, dir, deletions, output, code)
+			path := filepath.Join(dir, "iptables")
+			Expect(os.WriteFile(path, []byte(script), 0o755)).To(Succeed())
+
+			return path
+		}
+
+		calls := func() string {
+			count, err := os.ReadFile(filepath.Join(dir, "count"))
+			Expect(err).ToNot(HaveOccurred())
+
+			return strings.TrimSpace(string(count))
+		}
+
+		commands := tableCommands{
+			table:    "nat",
+			commands: []string{"-D OUTPUT -p tcp -j MESH_OUTBOUND"},
+		}
+
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+		})
+
+		DescribeTable("should delete rules until there are no matching ones",
+			func(output string, code int) {
+				// given
+				cmdName := fakeIPTables(2, output, code)
+
+				// when
+				err := cleanupTable(cmdName, commands)
+
+				// then
+				Expect(err).ToNot(HaveOccurred())
+				Expect(calls()).To(Equal("3"))
+			},
+			Entry("legacy",
+				"iptables: Bad rule (does a matching rule exist in that chain?).", 1,
+			),
+			Entry("missing chain",
+				"iptables: No chain/target/match by that name.", 1,
+			),
+		)
+
+		It("should return other errors", func() {
+			// given
+			cmdName := fakeIPTables(1, "Another app is currently holding the xtables lock.", 4)
+
+			// when
+			err := cleanupTable(cmdName, commands)
+
+			// then
+			Expect(err).To(MatchError(ContainSubstring("holding the xtables lock")))
+			Expect(calls()).To(Equal("2"))
+		})
+
+		It("should delete our rules left by the interrupted trace", func() {
+			// given
+			script := fmt.Sprintf(`#!/bin/sh
+if [ "$3" = "-S" ]; then
+  echo "-P OUTPUT ACCEPT"
+  echo "-A OUTPUT -p tcp -m comment --comment kuma-net:dev::trace -j TRACE"
+  echo "-A OUTPUT -p tcp -m comment --comment kuma-net:dev:OTHER_:trace -j TRACE"
+  exit 0
+fi
+echo "$@" >> %s/calls
+`, dir)
+			cmdName := filepath.Join(dir, "iptables")
+			Expect(os.WriteFile(cmdName, []byte(script), 0o755)).To(Succeed())
+
+			// when
+			err := cleanupTaggedRules(cmdName, tableCommands{table: "raw"}, "")
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			calls, err := os.ReadFile(filepath.Join(dir, "calls"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(calls)).To(Equal(
+				"-t raw -D OUTPUT -p tcp -m comment --comment kuma-net:dev::trace -j TRACE\n",
+			))
+		})
+
+		It("should return an error when the binary is missing", func() {
+			// when
+			err := cleanupTable(filepath.Join(dir, "missing"), commands)
+
+			// then
+			Expect(err).To(MatchError(ContainSubstring(
+				`cannot delete rule "-D OUTPUT -p tcp -j MESH_OUTBOUND" from table nat`,
+			)))
+		})
+	})
+})
@@ -0,0 +1,134 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/version"
+)
+
+// commentOwner is the first part of the comment of every rule generated
+// by the builder
+const commentOwner = "kuma-net"
+
+// Reason describes why the rule was generated. Reasons are stable, so they
+// can be used to identify rules regardless of the version which installed them
+type Reason string
+
+const (
+	ReasonInboundDisabled           Reason = "inbound-disabled"
+	ReasonOutboundDisabled          Reason = "outbound-disabled"
+	ReasonCaptureInbound            Reason = "capture-inbound"
+	ReasonCaptureInboundUDP         Reason = "capture-inbound-udp"
+	ReasonCaptureOutbound           Reason = "capture-outbound"
+	ReasonCaptureOutboundUDP        Reason = "capture-outbound-udp"
+	ReasonExcludeInboundSource      Reason = "exclude-inbound-source"
+	ReasonExcludeInboundPort        Reason = "exclude-inbound-port"
+	ReasonExcludeInboundUDPPort     Reason = "exclude-inbound-udp-port"
+	ReasonIncludeInboundPort        Reason = "include-inbound-port"
+	ReasonIncludeInboundUDPPort     Reason = "include-inbound-udp-port"
+	ReasonRedirectInbound           Reason = "redirect-inbound"
+	ReasonRedirectInboundUDP        Reason = "redirect-inbound-udp"
+	ReasonExcludeOutboundPort       Reason = "exclude-outbound-port"
+	ReasonExcludeOutboundUDPPort    Reason = "exclude-outbound-udp-port"
+	ReasonExcludeOutboundPortForUID Reason = "exclude-outbound-port-for-uid"
+	ReasonExcludeOutboundIP         Reason = "exclude-outbound-ip"
+	ReasonIncludeOutboundPort       Reason = "include-outbound-port"
+	ReasonIncludeOutboundUDPPort    Reason = "include-outbound-udp-port"
+	ReasonRedirectOutbound          Reason = "redirect-outbound"
+	ReasonRedirectOutboundUDP       Reason = "redirect-outbound-udp"
+	ReasonInboundListener           Reason = "inbound-listener"
+	ReasonOutboundListener          Reason = "outbound-listener"
+	ReasonProxyUpstream             Reason = "proxy-upstream"
+	ReasonInboundPassthrough        Reason = "inbound-passthrough"
+	ReasonSidecarHairpin            Reason = "sidecar-hairpin"
+	ReasonApplicationLoopback       Reason = "application-loopback"
+	ReasonSidecarOwned              Reason = "sidecar-owned"
+	ReasonLoopback                  Reason = "loopback"
+	ReasonLocalhost                 Reason = "localhost"
+	ReasonReply                     Reason = "reply"
+	ReasonTransparentSocket         Reason = "transparent-socket"
+	ReasonDivertMark                Reason = "divert-mark"
+	ReasonDivertAccept              Reason = "divert-accept"
+	ReasonRestoreMark               Reason = "restore-mark"
+	ReasonSaveMark                  Reason = "save-mark"
+	ReasonDNS                       Reason = "dns"
+	ReasonRedirectDNS               Reason = "redirect-dns"
+	ReasonSidecarDNSZone            Reason = "sidecar-dns-zone"
+	ReasonDNSProxyZone              Reason = "dns-proxy-zone"
+	ReasonApplicationDNSZone        Reason = "application-dns-zone"
+	ReasonDNSResponseZone           Reason = "dns-response-zone"
+	ReasonStubUpstream              Reason = "stub-upstream"
+	ReasonStubUpstreamZone          Reason = "stub-upstream-zone"
+	ReasonVNetRedirectDNS           Reason = "vnet-redirect-dns"
+	ReasonVNetRedirectOutbound      Reason = "vnet-redirect-outbound"
+	ReasonDropInvalid               Reason = "drop-invalid"
+	ReasonLog                       Reason = "log"
+	ReasonEgressLockdown            Reason = "egress-lockdown"
+	ReasonEgressEstablished         Reason = "egress-established"
+	ReasonEgressAllowedIP           Reason = "egress-allowed-ip"
+	ReasonEgressAllowedPort         Reason = "egress-allowed-port"
+	ReasonEgressReject              Reason = "egress-reject"
+	ReasonTrace                     Reason = "trace"
+)
+
+// RuleComment identifies the rule generated by the builder. It's rendered
+// as "kuma-net:<version>:<prefix>:<reason>" (i.e.
+// "kuma-net:1.0.0:KUMA_:exclude-outbound-port"), without any whitespaces,
+// so the rule can be still split into arguments by whitespaces
+type RuleComment struct {
+	Version string
+	Prefix  string
+	Reason  Reason
+}
+
+func (c RuleComment) String() string {
+	return strings.Join([]string{commentOwner, c.Version, c.Prefix, string(c.Reason)}, ":")
+}
+
+// ParseRuleComment parses the comment of the rule generated by the builder.
+// Returned bool reports if the comment belongs to such a rule
+func ParseRuleComment(comment string) (RuleComment, bool) {
+	parts := strings.Split(comment, ":")
+	if len(parts) != 4 || parts[0] != commentOwner || parts[3] == "" {
+		return RuleComment{}, false
+	}
+
+	return RuleComment{
+		Version: parts[1],
+		Prefix:  parts[2],
+		Reason:  Reason(parts[3]),
+	}, true
+}
+
+// comment returns the match tagging the rule with the comment, which
+// identifies it as generated by kuma-net with the provided prefix
+func comment(prefix string, reason Reason) *Parameter {
+	return Match(Comment(RuleComment{
+		Version: version.Get(),
+		Prefix:  prefix,
+		Reason:  reason,
+	}.String()))
+}
+
+// validateCommentPrefix checks if the prefix can be used in the comments
+func validateCommentPrefix(prefix string) error {
+	if strings.ContainsAny(prefix, ": \t\"'\\") {
+		return fmt.Errorf("name prefix %q cannot contain colons, quotes, "+
+			"backslashes or whitespaces", prefix)
+	}
+
+	// the longest reason determines the longest comment we generate
+	longest := RuleComment{
+		Version: version.Get(),
+		Prefix:  prefix,
+		Reason:  ReasonExcludeOutboundPortForUID,
+	}
+	if len(longest.String()) > CommentMaxLength {
+		return fmt.Errorf("name prefix %q is too long to be used in the comments "+
+			"of the rules (maximal comment length: %d)", prefix, CommentMaxLength)
+	}
+
+	return nil
+}
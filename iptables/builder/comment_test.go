@@ -0,0 +1,109 @@
+package builder
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/iptables/parser"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Builder comments", func() {
+	DescribeTable("should parse rule comments",
+		func(comment string, want RuleComment, ok bool) {
+			// when
+			got, parsed := ParseRuleComment(comment)
+
+			// then
+			Expect(parsed).To(Equal(ok))
+			Expect(got).To(Equal(want))
+		},
+		Entry("without the name prefix",
+			"kuma-net:dev::capture-inbound",
+			RuleComment{Version: "dev", Reason: ReasonCaptureInbound},
+			true,
+		),
+		Entry("with the name prefix",
+			"kuma-net:1.0.0:KUMA_:exclude-outbound-port",
+			RuleComment{Version: "1.0.0", Prefix: "KUMA_", Reason: ReasonExcludeOutboundPort},
+			true,
+		),
+		Entry("comment of another owner", "foo:dev::dns", RuleComment{}, false),
+		Entry("comment without the reason", "kuma-net:dev::", RuleComment{}, false),
+		Entry("comment with spaces", "some comment", RuleComment{}, false),
+	)
+
+	DescribeTable("should tag every rule with the comment",
+		func(ipv6 bool) {
+			// given
+			cfg := config.Config{
+				Redirect: config.Redirect{
+					NamePrefix: "KUMA_",
+					Inbound: config.TrafficFlow{
+						Enabled:                 true,
+						ExcludePorts:            []uint16{22},
+						ExcludeInboundSourceIPs: []string{"10.0.0.0/8", "fd00::/8"},
+						UDP:                     config.UDP{Enabled: true},
+					},
+					Outbound: config.TrafficFlow{
+						Enabled:            true,
+						ExcludePorts:       []uint16{8080},
+						ExcludeOutboundIPs: []string{"10.0.0.0/8", "fd00::/8"},
+						UDP:                config.UDP{Enabled: true, ExcludePorts: []uint16{8125}},
+						ExcludePortsForUIDs: []config.UIDsToPorts{
+							{Protocol: "tcp", UIDs: "1000", Ports: "80"},
+						},
+					},
+					DNS: config.DNS{Enabled: true, CaptureAll: true},
+					VNet: config.VNet{Networks: []config.VNetNetwork{
+						{Interface: "docker0", CIDR: "172.17.0.0/16", RedirectDNS: true},
+					}},
+				},
+				EgressLockdown:     config.EgressLockdown{Enabled: true, AllowedPorts: []uint16{22}},
+				DropInvalidPackets: true,
+				Log:                config.LogConfig{Enabled: true},
+			}
+
+			// when
+			tables, err := buildIPTables(cfg, nil, ipv6)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			for _, line := range strings.Split(tables.Build(false), "\n") {
+				if !strings.HasPrefix(line, "-A ") && !strings.HasPrefix(line, "-I ") {
+					continue
+				}
+
+				comment, ok := ParseRuleComment(parser.CommentOf(line))
+				Expect(ok).To(BeTrue(), line)
+				Expect(comment.Prefix).To(Equal("KUMA_"), line)
+			}
+		},
+		Entry("ipv4", false),
+		Entry("ipv6", true),
+	)
+
+	DescribeTable("should reject name prefixes which cannot be used in comments",
+		func(prefix string, want string) {
+			// given
+			cfg := config.Config{
+				Redirect: config.Redirect{
+					NamePrefix: prefix,
+					Inbound:    config.TrafficFlow{Enabled: true},
+				},
+			}
+
+			// when
+			_, err := buildIPTables(cfg, nil, false)
+
+			// then
+			Expect(err).To(MatchError(ContainSubstring(want)))
+		},
+		Entry("colon", "KUMA:", "cannot contain colons"),
+		Entry("whitespace", "KUMA ", "cannot contain colons"),
+		Entry("quote", `KUMA"`, "cannot contain colons"),
+		Entry("too long", strings.Repeat("K", 250), "is too long"),
+	)
+})
@@ -0,0 +1,127 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/iptables/parser"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// RuleCounter holds packet and byte counters of the installed rule generated
+// by the builder
+type RuleCounter struct {
+	IPv6  bool
+	Table string
+	Chain string
+	// Rule is the rule specification as printed by iptables-save, without
+	// the comment
+	Rule    string
+	Comment RuleComment
+	Packets uint64
+	Bytes   uint64
+}
+
+// String returns the human-readable description of the counter, i.e.
+// "nat MESH_OUTBOUND exclude-outbound-port (-p tcp -m tcp --dport 5432
+// -j RETURN): 1204 packets, 72240 bytes"
+func (c RuleCounter) String() string {
+	return fmt.Sprintf("%s %s %s (%s): %d packets, %d bytes",
+		c.Table, c.Chain, c.Comment.Reason, c.Rule, c.Packets, c.Bytes)
+}
+
+// withoutComment removes the comment match from the rule specification
+func withoutComment(rule string) string {
+	args, err := parser.Tokenize(rule)
+	if err != nil {
+		return rule
+	}
+
+	var result []string
+
+	for i := 0; i < len(args); i++ {
+		if i+3 < len(args) && args[i] == "-m" && args[i+1] == "comment" &&
+			args[i+2] == "--comment" {
+			i += 3
+			continue
+		}
+
+		result = append(result, Quote(args[i]))
+	}
+
+	return strings.Join(result, " ")
+}
+
+// countersFromSnapshot returns counters of the rules from the
+// "iptables-save --counters" output, which are tagged with our comment and
+// the provided name prefix
+func countersFromSnapshot(snapshot string, prefix string, ipv6 bool) ([]RuleCounter, error) {
+	counters, err := parser.ParseCounters(strings.NewReader(snapshot))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []RuleCounter
+
+	for _, counter := range counters {
+		comment, ok := ParseRuleComment(parser.CommentOf(counter.Rule))
+		if !ok || comment.Prefix != prefix {
+			continue
+		}
+
+		result = append(result, RuleCounter{
+			IPv6:    ipv6,
+			Table:   counter.Table,
+			Chain:   counter.Chain,
+			Rule:    withoutComment(counter.Rule),
+			Comment: comment,
+			Packets: counter.Packets,
+			Bytes:   counter.Bytes,
+		})
+	}
+
+	return result, nil
+}
+
+// ReadCounters returns packet and byte counters of the installed rules
+// generated by the builder with the provided configuration (rules installed
+// by other versions of kuma-net are included)
+func ReadCounters(cfg config.Config) ([]RuleCounter, error) {
+	cfg, err := resolveIPTablesMode(config.MergeConfigWithDefaults(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	return readCounters(cfg)
+}
+
+// readCounters reads the counters with the configuration, which iptables
+// mode was already resolved
+func readCounters(cfg config.Config) ([]RuleCounter, error) {
+	families := []bool{false}
+	if cfg.IPv6 {
+		families = append(families, true)
+	}
+
+	var result []RuleCounter
+
+	for _, ipv6 := range families {
+		snapshot, err := saveIPTables(
+			cfg.IPTables.Executable("iptables-save", ipv6),
+			"--counters",
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		counters, err := countersFromSnapshot(snapshot, cfg.Redirect.NamePrefix, ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse iptables counters: %s", err)
+		}
+
+		result = append(result, counters...)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+const (
+	metricPackets = "kuma_net_iptables_rule_packets_total"
+	metricBytes   = "kuma_net_iptables_rule_bytes_total"
+)
+
+// prometheusContentType is the content type of the Prometheus text format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// counterLabels returns labels identifying the logical rule. The reason
+// alone isn't enough, as many rules share it (i.e. every excluded port), so
+// the rule specification without the comment is used as well. It doesn't
+// contain the version from the comment, so counters of the same rule
+// installed by different versions of kuma-net are summed up
+func counterLabels(c RuleCounter) string {
+	family := "ipv4"
+	if c.IPv6 {
+		family = "ipv6"
+	}
+
+	labels := [][2]string{
+		{"family", family},
+		{"table", c.Table},
+		{"chain", c.Chain},
+		{"prefix", c.Comment.Prefix},
+		{"reason", string(c.Comment.Reason)},
+		{"rule", c.Rule},
+	}
+
+	var result []string
+	for _, label := range labels {
+		result = append(result, fmt.Sprintf(`%s="%s"`, label[0], labelValueEscaper.Replace(label[1])))
+	}
+
+	return "{" + strings.Join(result, ",") + "}"
+}
+
+// WriteCountersPrometheus writes the counters in the Prometheus text format.
+// Counters of the rules with the same labels (i.e. the same rule installed
+// more than once) are summed up
+func WriteCountersPrometheus(w io.Writer, counters []RuleCounter) error {
+	var order []string
+	packets := map[string]uint64{}
+	octets := map[string]uint64{}
+
+	for _, counter := range counters {
+		labels := counterLabels(counter)
+		if _, ok := packets[labels]; !ok {
+			order = append(order, labels)
+		}
+
+		packets[labels] += counter.Packets
+		octets[labels] += counter.Bytes
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# HELP %s Packets matched by the transparent proxy rule.\n", metricPackets)
+	fmt.Fprintf(&b, "# TYPE %s counter\n", metricPackets)
+	for _, labels := range order {
+		fmt.Fprintf(&b, "%s%s %d\n", metricPackets, labels, packets[labels])
+	}
+
+	fmt.Fprintf(&b, "# HELP %s Bytes matched by the transparent proxy rule.\n", metricBytes)
+	fmt.Fprintf(&b, "# TYPE %s counter\n", metricBytes)
+	for _, labels := range order {
+		fmt.Fprintf(&b, "%s%s %d\n", metricBytes, labels, octets[labels])
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// CountersHandler returns the HTTP handler exposing (in the Prometheus text
+// format) counters of the installed rules generated with the provided
+// configuration. The iptables mode is resolved once, when the handler is
+// built, and counters are read on every request
+func CountersHandler(cfg config.Config) (http.Handler, error) {
+	cfg, err := resolveIPTablesMode(config.MergeConfigWithDefaults(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counters, err := readCounters(cfg)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot read iptables counters: %s", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := WriteCountersPrometheus(&buf, counters); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", prometheusContentType)
+		_, _ = w.Write(buf.Bytes())
+	}), nil
+}
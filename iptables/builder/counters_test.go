@@ -0,0 +1,189 @@
+package builder
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+const countersSnapshot = `*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:DOCKER - [0:0]
+:KUMA_MESH_OUTBOUND - [0:0]
+[7:420] -A OUTPUT -p tcp -m comment --comment "kuma-net:dev:KUMA_:capture-outbound" -j KUMA_MESH_OUTBOUND
+[9:540] -A OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER
+[1:60] -A OUTPUT -p udp -m comment --comment "kuma-net:dev:OTHER_:dns" -j RETURN
+[1204:72240] -A KUMA_MESH_OUTBOUND -p tcp -m tcp --dport 5432 -m comment --comment "kuma-net:0.9.0:KUMA_:exclude-outbound-port" -j RETURN
+[3:180] -A KUMA_MESH_OUTBOUND -p tcp -m tcp --dport 5432 -m comment --comment "kuma-net:dev:KUMA_:exclude-outbound-port" -j RETURN
+COMMIT
+`
+
+var _ = Describe("Builder counters", func() {
+	It("should read counters of the rules tagged with our comment", func() {
+		// when
+		counters, err := countersFromSnapshot(countersSnapshot, "KUMA_", true)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(counters).To(Equal([]RuleCounter{
+			{
+				IPv6:    true,
+				Table:   "nat",
+				Chain:   "OUTPUT",
+				Rule:    "-p tcp -j KUMA_MESH_OUTBOUND",
+				Comment: RuleComment{Version: "dev", Prefix: "KUMA_", Reason: ReasonCaptureOutbound},
+				Packets: 7,
+				Bytes:   420,
+			},
+			{
+				IPv6:    true,
+				Table:   "nat",
+				Chain:   "KUMA_MESH_OUTBOUND",
+				Rule:    "-p tcp -m tcp --dport 5432 -j RETURN",
+				Comment: RuleComment{Version: "0.9.0", Prefix: "KUMA_", Reason: ReasonExcludeOutboundPort},
+				Packets: 1204,
+				Bytes:   72240,
+			},
+			{
+				IPv6:    true,
+				Table:   "nat",
+				Chain:   "KUMA_MESH_OUTBOUND",
+				Rule:    "-p tcp -m tcp --dport 5432 -j RETURN",
+				Comment: RuleComment{Version: "dev", Prefix: "KUMA_", Reason: ReasonExcludeOutboundPort},
+				Packets: 3,
+				Bytes:   180,
+			},
+		}))
+		Expect(counters[1].String()).To(Equal(
+			"nat KUMA_MESH_OUTBOUND exclude-outbound-port (-p tcp -m tcp --dport 5432 -j RETURN): " +
+				"1204 packets, 72240 bytes",
+		))
+	})
+
+	It("should write counters in the Prometheus text format", func() {
+		// given
+		counters, err := countersFromSnapshot(countersSnapshot, "KUMA_", false)
+		Expect(err).ToNot(HaveOccurred())
+		var output strings.Builder
+
+		// when
+		err = WriteCountersPrometheus(&output, counters)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.String()).To(Equal(`# HELP kuma_net_iptables_rule_packets_total Packets matched by the transparent proxy rule.
+# TYPE kuma_net_iptables_rule_packets_total counter
+kuma_net_iptables_rule_packets_total{family="ipv4",table="nat",chain="OUTPUT",prefix="KUMA_",reason="capture-outbound",rule="-p tcp -j KUMA_MESH_OUTBOUND"} 7
+kuma_net_iptables_rule_packets_total{family="ipv4",table="nat",chain="KUMA_MESH_OUTBOUND",prefix="KUMA_",reason="exclude-outbound-port",rule="-p tcp -m tcp --dport 5432 -j RETURN"} 1207
+# HELP kuma_net_iptables_rule_bytes_total Bytes matched by the transparent proxy rule.
+# TYPE kuma_net_iptables_rule_bytes_total counter
+kuma_net_iptables_rule_bytes_total{family="ipv4",table="nat",chain="OUTPUT",prefix="KUMA_",reason="capture-outbound",rule="-p tcp -j KUMA_MESH_OUTBOUND"} 420
+kuma_net_iptables_rule_bytes_total{family="ipv4",table="nat",chain="KUMA_MESH_OUTBOUND",prefix="KUMA_",reason="exclude-outbound-port",rule="-p tcp -m tcp --dport 5432 -j RETURN"} 72420
+`))
+	})
+
+	It("should escape label values", func() {
+		// given
+		counters := []RuleCounter{{
+			Table:   "nat",
+			Chain:   `PRE"ROUTING\`,
+			Rule:    "-j LOG",
+			Comment: RuleComment{Version: "dev", Reason: ReasonLog},
+			Packets: 1,
+			Bytes:   2,
+		}}
+		var output strings.Builder
+
+		// when
+		err := WriteCountersPrometheus(&output, counters)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.String()).To(ContainSubstring(
+			`chain="PRE\"ROUTING\\",prefix="",reason="log",rule="-j LOG"} 1`,
+		))
+	})
+
+	It("should export separate series for different rules with the same reason", func() {
+		// given
+		counters := []RuleCounter{
+			{
+				Table:   "nat",
+				Chain:   "KUMA_MESH_OUTBOUND",
+				Rule:    "-p tcp -m tcp --dport 5432 -j RETURN",
+				Comment: RuleComment{Version: "dev", Prefix: "KUMA_", Reason: ReasonExcludeOutboundPort},
+				Packets: 1,
+				Bytes:   60,
+			},
+			{
+				Table:   "nat",
+				Chain:   "KUMA_MESH_OUTBOUND",
+				Rule:    "-p tcp -m tcp --dport 6379 -j RETURN",
+				Comment: RuleComment{Version: "dev", Prefix: "KUMA_", Reason: ReasonExcludeOutboundPort},
+				Packets: 2,
+				Bytes:   120,
+			},
+		}
+		var output strings.Builder
+
+		// when
+		err := WriteCountersPrometheus(&output, counters)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.String()).To(ContainSubstring(
+			`kuma_net_iptables_rule_packets_total{family="ipv4",table="nat",chain="KUMA_MESH_OUTBOUND",` +
+				`prefix="KUMA_",reason="exclude-outbound-port",rule="-p tcp -m tcp --dport 5432 -j RETURN"} 1` + "\n",
+		))
+		Expect(output.String()).To(ContainSubstring(
+			`kuma_net_iptables_rule_packets_total{family="ipv4",table="nat",chain="KUMA_MESH_OUTBOUND",` +
+				`prefix="KUMA_",reason="exclude-outbound-port",rule="-p tcp -m tcp --dport 6379 -j RETURN"} 2` + "\n",
+		))
+	})
+
+	It("should detect the iptables mode only when the handler is built", func() {
+		// given
+		dir := GinkgoT().TempDir()
+		snapshot := filepath.Join(dir, "snapshot")
+		Expect(os.WriteFile(snapshot, []byte(countersSnapshot), 0o600)).To(Succeed())
+		Expect(os.WriteFile(
+			filepath.Join(dir, "iptables-nft-save"),
+			[]byte("#!/bin/sh\n/bin/cat "+snapshot+"\n"),
+			0o755,
+		)).To(Succeed())
+		GinkgoT().Setenv("PATH", dir)
+
+		stdout := &bytes.Buffer{}
+		cfg := config.Config{
+			Redirect:      config.Redirect{NamePrefix: "KUMA_"},
+			IPTables:      config.IPTables{Mode: config.IPTablesModeAuto},
+			RuntimeStdout: stdout,
+		}
+
+		// when
+		handler, err := CountersHandler(cfg)
+		Expect(err).ToNot(HaveOccurred())
+
+		var responses []*httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+			responses = append(responses, response)
+		}
+
+		// then
+		for _, response := range responses {
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Body.String()).To(ContainSubstring(`reason="exclude-outbound-port",rule="-p tcp -m tcp --dport 5432 -j RETURN"} 1207`))
+		}
+		Expect(stdout.String()).To(Equal("iptables mode detected: nft\n"))
+	})
+})
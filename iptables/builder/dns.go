@@ -3,8 +3,13 @@ package builder
 import (
 	"fmt"
 	"net"
+	"os/user"
+	"strconv"
 
 	"github.com/miekg/dns"
+
+	. "github.com/kumahq/kuma-net/iptables/consts"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
 )
 
 func GetDnsServers(cfgPath string) ([]string, []string, error) {
@@ -16,6 +21,112 @@ func GetDnsServers(cfgPath string) ([]string, []string, error) {
 	return ipv4, ipv6, nil
 }
 
+// GetDnsServersIfNecessary returns IPv4 and IPv6 DNS servers only when they
+// are needed to generate rules (DNS redirection is enabled, but we don't want
+// to capture all DNS traffic). Servers provided in the configuration take
+// precedence over the ones from the resolv.conf file
+func GetDnsServersIfNecessary(cfg config.Config) ([]string, []string, error) {
+	if !cfg.ShouldRedirectDNS() || cfg.ShouldCaptureAllDNS() {
+		return nil, nil, nil
+	}
+
+	if len(cfg.Redirect.DNS.Servers) > 0 {
+		ipv4, ipv6 := groupIps(cfg.Redirect.DNS.Servers)
+		return ipv4, ipv6, nil
+	}
+
+	ipv4, ipv6, err := GetDnsServers(cfg.Redirect.DNS.ResolvConfigPath)
+	if err != nil || !contains(ipv4, SystemdResolvedStub) {
+		return ipv4, ipv6, err
+	}
+
+	// the stub forwards queries to the upstream servers, which can be also
+	// queried directly (i.e. from containers, which get the resolv.conf file
+	// with the upstream servers)
+	upstreamIPv4, upstreamIPv6, err := GetDnsServers(cfg.Redirect.DNS.SystemdResolvedConfigPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(cfg.RuntimeStdout, "systemd-resolved stub detected, "+
+			"but its upstream DNS servers cannot be read: %s\n", err)
+
+		return ipv4, ipv6, nil
+	}
+
+	return appendMissing(ipv4, upstreamIPv4...), appendMissing(ipv6, upstreamIPv6...), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendMissing(values []string, missing ...string) []string {
+	for _, value := range missing {
+		if !contains(values, value) {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// usesSystemdResolvedStub reports if DNS traffic to the local stub of
+// systemd-resolved is redirected by the rules built for dnsServers. Servers
+// from the configuration are checked as well, as the stub is an IPv4 address,
+// but its upstream servers can be also IPv6 ones
+func usesSystemdResolvedStub(cfg config.Config, dnsServers []string) bool {
+	return cfg.ShouldRedirectDNS() && !cfg.ShouldCaptureAllDNS() &&
+		(contains(dnsServers, SystemdResolvedStub) ||
+			contains(cfg.Redirect.DNS.Servers, SystemdResolvedStub))
+}
+
+// exemptsStubUpstream reports if queries of the systemd-resolved stub
+// to the upstream servers should be exempted from the redirection. The user
+// systemd-resolved runs as is left only when the stub is used and the user
+// exists (look at buildIPTables)
+func exemptsStubUpstream(cfg config.Config) bool {
+	return cfg.ShouldRedirectDNS() && !cfg.ShouldCaptureAllDNS() &&
+		cfg.Redirect.DNS.SystemdResolvedUser != ""
+}
+
+// SystemdResolvedUID returns the UID of the user systemd-resolved runs as
+func SystemdResolvedUID(cfg config.Config) (string, error) {
+	name := cfg.Redirect.DNS.SystemdResolvedUser
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return name, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("cannot find user %q systemd-resolved runs as: %s", name, err)
+	}
+
+	return u.Uid, nil
+}
+
+// resolveSystemdResolvedUser returns the configuration with the UID of
+// the user systemd-resolved runs as, as iptables-save prints owner matches
+// with UIDs (the user name would be treated as a drift). When there is no
+// such user (i.e. systemd-resolved runs as root, or the stub address is
+// configured without systemd-resolved), instead of failing the whole
+// installation, we log the warning and skip rules exempting its queries
+func resolveSystemdResolvedUser(cfg config.Config) config.Config {
+	uid, err := SystemdResolvedUID(cfg)
+	if err != nil {
+		_, _ = fmt.Fprintf(cfg.RuntimeStdout, "[WARNING] %s. Queries of "+
+			"systemd-resolved to the upstream DNS servers won't be exempted "+
+			"from the redirection\n", err)
+	}
+
+	cfg.Redirect.DNS.SystemdResolvedUser = uid
+
+	return cfg
+}
+
 func groupIps(addresses []string) ([]string, []string) {
 	var ipv4 []string
 	var ipv6 []string
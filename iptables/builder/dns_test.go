@@ -0,0 +1,116 @@
+package builder
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Builder DNS servers", func() {
+	var resolvConf string
+
+	BeforeEach(func() {
+		resolvConf = filepath.Join(GinkgoT().TempDir(), "resolv.conf")
+		Expect(os.WriteFile(resolvConf, []byte("nameserver 10.0.0.10\nnameserver fd00::10\n"), 0o600)).
+			To(Succeed())
+	})
+
+	DescribeTable("should return DNS servers only when they are needed",
+		func(dns config.DNS, wantIPv4 []string, wantIPv6 []string) {
+			// given
+			dns.ResolvConfigPath = resolvConf
+			cfg := config.Config{Redirect: config.Redirect{DNS: dns}}
+
+			// when
+			ipv4, ipv6, err := GetDnsServersIfNecessary(cfg)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipv4).To(Equal(wantIPv4))
+			Expect(ipv6).To(Equal(wantIPv6))
+		},
+		Entry("DNS redirection disabled", config.DNS{}, nil, nil),
+		Entry("all DNS traffic captured", config.DNS{Enabled: true, CaptureAll: true}, nil, nil),
+		Entry("servers from resolv.conf",
+			config.DNS{Enabled: true},
+			[]string{"10.0.0.10"},
+			[]string{"fd00::10"},
+		),
+		Entry("servers from the configuration",
+			config.DNS{Enabled: true, Servers: []string{"8.8.8.8", "2001:4860:4860::8888", "1.1.1.1"}},
+			[]string{"8.8.8.8", "1.1.1.1"},
+			[]string{"2001:4860:4860::8888"},
+		),
+	)
+
+	Describe("systemd-resolved stub", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+			resolvConf = filepath.Join(dir, "resolv.conf")
+			Expect(os.WriteFile(resolvConf, []byte("nameserver 127.0.0.53\n"), 0o600)).To(Succeed())
+		})
+
+		It("should return the stub and its upstream servers", func() {
+			// given
+			upstream := filepath.Join(dir, "upstream.conf")
+			Expect(os.WriteFile(upstream, []byte("nameserver 10.0.0.10\nnameserver fd00::10\n"), 0o600)).
+				To(Succeed())
+			cfg := config.Config{Redirect: config.Redirect{DNS: config.DNS{
+				Enabled:                   true,
+				ResolvConfigPath:          resolvConf,
+				SystemdResolvedConfigPath: upstream,
+			}}}
+
+			// when
+			ipv4, ipv6, err := GetDnsServersIfNecessary(cfg)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipv4).To(Equal([]string{"127.0.0.53", "10.0.0.10"}))
+			Expect(ipv6).To(Equal([]string{"fd00::10"}))
+		})
+
+		It("should return only the stub when upstream servers cannot be read", func() {
+			// given
+			cfg := config.Config{
+				Redirect: config.Redirect{DNS: config.DNS{
+					Enabled:                   true,
+					ResolvConfigPath:          resolvConf,
+					SystemdResolvedConfigPath: filepath.Join(dir, "missing.conf"),
+				}},
+				RuntimeStdout: io.Discard,
+			}
+
+			// when
+			ipv4, ipv6, err := GetDnsServersIfNecessary(cfg)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipv4).To(Equal([]string{"127.0.0.53"}))
+			Expect(ipv6).To(BeNil())
+		})
+	})
+
+	DescribeTable("should return the UID of the systemd-resolved user",
+		func(user string, want string) {
+			// given
+			cfg := config.Config{Redirect: config.Redirect{DNS: config.DNS{SystemdResolvedUser: user}}}
+
+			// when
+			uid, err := SystemdResolvedUID(cfg)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(uid).To(Equal(want))
+		},
+		Entry("numeric UID", "101", "101"),
+		Entry("user name", "root", "0"),
+	)
+})
@@ -0,0 +1,44 @@
+package builder
+
+import (
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// LogDecision describes the decision made about the packet logged in
+// the nflog mode. It's used as the prefix of the NFLOG target, so it's
+// available to the listener reading the NFLOG group
+type LogDecision string
+
+const (
+	// LogDecisionCaptured is used for the packets redirected to the proxy
+	LogDecisionCaptured LogDecision = "captured"
+	// LogDecisionExcludedPort is used for the packets not redirected because
+	// of the excluded destination ports
+	LogDecisionExcludedPort LogDecision = "excluded-port"
+	// LogDecisionSidecarOwned is used for the packets sent by the sidecar
+	LogDecisionSidecarOwned LogDecision = "sidecar-owned"
+	// LogDecisionDNS is used for the DNS queries redirected to the DNS proxy
+	LogDecisionDNS LogDecision = "dns"
+)
+
+// nflogRule returns parameters of the rule sending the packets matched by
+// the provided parameters to the NFLOG group with the decision as the prefix.
+// As the NFLOG target is non-terminating, the rule should be placed right
+// before the one making the decision
+func nflogRule(
+	cfg config.LogConfig,
+	prefix string,
+	decision LogDecision,
+	matches ...*Parameter,
+) []*Parameter {
+	var result []*Parameter
+
+	result = append(result, matches...)
+
+	return append(result,
+		Match(Limit(cfg.RateLimit, cfg.RateLimitBurst)),
+		comment(prefix, ReasonLog),
+		Jump(Nflog(cfg.NflogGroup, string(decision))),
+	)
+}
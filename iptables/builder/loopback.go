@@ -5,7 +5,7 @@ import (
 	"net"
 )
 
-func getLoopback() (*net.Interface, error) {
+func GetLoopback() (*net.Interface, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return nil, fmt.Errorf("listig network interfaces failed: %s", err)
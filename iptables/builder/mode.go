@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// countRules returns the number of rules printed by the provided
+// iptables-save binaries (binaries which fail are skipped)
+func countRules(saveCmdNames ...string) int {
+	count := 0
+
+	for _, cmdName := range saveCmdNames {
+		output, err := exec.Command(cmdName).Output()
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "-") {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+func available(cmdName string) bool {
+	_, err := exec.LookPath(cmdName)
+	return err == nil
+}
+
+// detectIPTablesMode chooses the iptables variant the same way kube-proxy
+// does it: the variant with more rules already installed is the one used
+// by other components on the host, and our rules have to be installed
+// there as well (if they land in the other one, kernel may never evaluate
+// them)
+func detectIPTablesMode() config.IPTablesMode {
+	legacy := available("iptables-legacy-save")
+	nft := available("iptables-nft-save")
+
+	switch {
+	case legacy && !nft:
+		return config.IPTablesModeLegacy
+	case nft && !legacy:
+		return config.IPTablesModeNft
+	case !legacy && !nft:
+		// binaries without the variant suffix will be used
+		return config.IPTablesModeAuto
+	}
+
+	legacyRules := countRules("iptables-legacy-save", "ip6tables-legacy-save")
+	nftRules := countRules("iptables-nft-save", "ip6tables-nft-save")
+
+	if legacyRules > nftRules {
+		return config.IPTablesModeLegacy
+	}
+
+	return config.IPTablesModeNft
+}
+
+// resolveIPTablesMode returns the configuration with the iptables mode
+// which should be used to install the rules (the explicitly configured one,
+// or detected if set to auto)
+func resolveIPTablesMode(cfg config.Config) (config.Config, error) {
+	switch cfg.IPTables.Mode {
+	case config.IPTablesModeLegacy, config.IPTablesModeNft:
+		return cfg, nil
+	case config.IPTablesModeAuto:
+		cfg.IPTables.Mode = detectIPTablesMode()
+
+		if cfg.IPTables.Mode != config.IPTablesModeAuto {
+			_, _ = fmt.Fprintf(cfg.RuntimeStdout, "iptables mode detected: %s\n",
+				cfg.IPTables.Mode)
+		}
+
+		return cfg, nil
+	default:
+		return cfg, fmt.Errorf("unsupported iptables mode: %q", cfg.IPTables.Mode)
+	}
+}
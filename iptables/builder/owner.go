@@ -0,0 +1,51 @@
+package builder
+
+import (
+	"fmt"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// sidecarMatches returns matches identifying the sidecar's traffic. The traffic
+// belongs to the sidecar when it matches any of them, so every match has to be
+// used in a separate rule
+func sidecarMatches(cfg config.Config) []*Parameter {
+	var result []*Parameter
+
+	for _, uid := range cfg.Owner.UIDList() {
+		result = append(result, Match(Owner(Uid(uid))))
+	}
+
+	if cfg.Owner.GID != "" {
+		result = append(result, Match(Owner(Gid(cfg.Owner.GID))))
+	}
+
+	if cfg.Owner.Mark != 0 {
+		result = append(result, Match(Mark(fmt.Sprintf("0x%x", cfg.Owner.Mark))))
+	}
+
+	return result
+}
+
+// notSidecarMatches returns matches identifying the traffic which doesn't
+// belong to the sidecar. All of them have to be used in a single rule
+func notSidecarMatches(cfg config.Config) []*Parameter {
+	var result []*Parameter
+
+	// iptables doesn't allow to provide --uid-owner more than once
+	// in a single owner match
+	for _, uid := range cfg.Owner.UIDList() {
+		result = append(result, Match(Owner(NotUid(uid))))
+	}
+
+	if cfg.Owner.GID != "" {
+		result = append(result, Match(Owner(NotGid(cfg.Owner.GID))))
+	}
+
+	if cfg.Owner.Mark != 0 {
+		result = append(result, Match(NotMark(fmt.Sprintf("0x%x", cfg.Owner.Mark))))
+	}
+
+	return result
+}
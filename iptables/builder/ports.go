@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"github.com/kumahq/kuma-net/ipset"
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// destinationPorts returns, for every rule which has to be generated,
+// parameters matching the provided destination ports. To keep chains short
+// ports are grouped into multiport matches (up to MultiportMaxPorts each),
+// but when a group contains only a single port (or a port range) it's matched
+// by --dport
+func destinationPorts(
+	protocol func(...*TcpUdpParameter) *ProtocolParameter,
+	ports []config.Range,
+) [][]*Parameter {
+	var result [][]*Parameter
+
+	for _, group := range SplitMultiportPorts(ports) {
+		if len(group) == 1 {
+			result = append(result, []*Parameter{
+				Protocol(protocol(DestinationPortRange(uint16(group[0].From), uint16(group[0].To)))),
+			})
+			continue
+		}
+
+		result = append(result, []*Parameter{
+			Protocol(protocol()),
+			Match(Multiport(DestinationPorts(config.NewValueOrRangeList(group...)))),
+		})
+	}
+
+	return result
+}
+
+// excludedPorts returns, for every rule which has to be generated, parameters
+// matching the excluded TCP ports. When the name of the set is provided,
+// ports are matched by the set instead, so it can be updated at runtime
+func excludedPorts(ports []config.Range, set string) [][]*Parameter {
+	if set != "" {
+		return [][]*Parameter{{
+			Protocol(Tcp()),
+			Match(Set(MatchSet(set, SetFlagDst))),
+		}}
+	}
+
+	return destinationPorts(Tcp, ports)
+}
+
+// setNameIf returns the name of the set when ipset sets should be used,
+// or an empty string otherwise
+func setNameIf(cfg config.Config, set ipset.Set) string {
+	if !cfg.ShouldUseIPSet() {
+		return ""
+	}
+
+	return set.Name
+}
+
+// withPorts returns parameters of the rule which consist of the provided
+// prefix, parameters matching the ports and the suffix (i.e. the comment
+// and the jump)
+func withPorts(prefix []*Parameter, ports []*Parameter, suffix ...*Parameter) []*Parameter {
+	var result []*Parameter
+
+	result = append(result, prefix...)
+	result = append(result, ports...)
+
+	return append(result, suffix...)
+}
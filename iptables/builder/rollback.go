@@ -0,0 +1,216 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kumahq/kuma-net/ipset"
+	"github.com/kumahq/kuma-net/iptables/parser"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// snapshots hold iptables-save outputs taken before any change was applied
+type snapshots struct {
+	ipv4 string
+	ipv6 string
+}
+
+func takeSnapshots(cfg config.Config) (*snapshots, error) {
+	ipv4Snapshot, err := saveIPTables(cfg.IPTables.Executable("iptables-save", false))
+	if err != nil {
+		return nil, fmt.Errorf("cannot save ipv4 iptables rules: %s", err)
+	}
+
+	result := &snapshots{ipv4: ipv4Snapshot}
+
+	if cfg.IPv6 {
+		result.ipv6, err = saveIPTables(cfg.IPTables.Executable("iptables-save", true))
+		if err != nil {
+			return nil, fmt.Errorf("cannot save ipv6 iptables rules: %s", err)
+		}
+	}
+
+	return result, nil
+}
+
+// buildOwnedSnapshot returns the iptables-restore formatted part
+// of the snapshot with our chains and our rules from the built-in chains only.
+// Our rules placed before any other rule of the built-in chain are inserted
+// at the same positions, the remaining ones are appended
+func buildOwnedSnapshot(snapshot *parser.Tables, prefix string) string {
+	var lines []string
+
+	for _, tableName := range managedTables {
+		owned := ownedChains(tableName, prefix, nil, snapshot)
+		ours := map[string]bool{}
+
+		lines = append(lines, "*"+tableName)
+
+		for _, name := range owned {
+			ours[name] = true
+			lines = append(lines, fmt.Sprintf(":%s - [0:0]", name))
+		}
+
+		for _, name := range snapshot.BuiltinChains(tableName) {
+			foreign := false
+			position := 0
+
+			for _, rule := range snapshot.Chain(tableName, name).Rules(false) {
+				if !ownedByPrefix(rule, prefix) && !ours[parser.JumpTarget(rule)] {
+					foreign = true
+					continue
+				}
+
+				position++
+
+				if foreign {
+					lines = append(lines, fmt.Sprintf("-A %s %s", name, rule))
+				} else {
+					lines = append(lines, fmt.Sprintf("-I %s %d %s", name, position, rule))
+				}
+			}
+		}
+
+		for _, name := range owned {
+			for _, rule := range snapshot.Chain(tableName, name).Rules(false) {
+				lines = append(lines, fmt.Sprintf("-A %s %s", name, rule))
+			}
+		}
+
+		lines = append(lines, "COMMIT")
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// buildSnapshotRestore returns the input for "iptables-restore --noflush",
+// which brings our chains and our rules from the built-in chains back
+// to the state from the snapshot, and reports if anything has to be restored.
+// Rules and chains which aren't ours are left untouched, so the changes
+// applied by others since the snapshot was taken are not reverted
+func buildSnapshotRestore(snapshot, current, prefix string) (string, bool, error) {
+	snapshotTables, err := parser.Parse(strings.NewReader(snapshot))
+	if err != nil {
+		return "", false, fmt.Errorf("unable to parse iptables rules snapshot: %s", err)
+	}
+
+	desired, err := parser.Parse(strings.NewReader(buildOwnedSnapshot(snapshotTables, prefix)))
+	if err != nil {
+		return "", false, fmt.Errorf("unable to parse our iptables rules from snapshot: %s", err)
+	}
+
+	currentTables, err := parser.Parse(strings.NewReader(current))
+	if err != nil {
+		return "", false, fmt.Errorf("unable to parse installed iptables rules: %s", err)
+	}
+
+	return buildIPTablesUpdate(desired, currentTables, prefix)
+}
+
+func restoreSnapshot(cfg config.Config, snapshot string, ipv6 bool) error {
+	current, err := saveIPTables(cfg.IPTables.Executable("iptables-save", ipv6))
+	if err != nil {
+		return err
+	}
+
+	rules, changed, err := buildSnapshotRestore(snapshot, current, cfg.Redirect.NamePrefix)
+	if err != nil || !changed {
+		return err
+	}
+
+	_, err = restoreIPTables(cfg, rules, ipv6)
+
+	return err
+}
+
+// RollbackError is returned when applying the rules failed and the rules
+// from before the change had to be restored. Err is the original error,
+// and RollbackErr is the error of the rollback itself (nil when the previous
+// state was successfully restored)
+type RollbackError struct {
+	Err         error
+	RollbackErr error
+}
+
+func (e *RollbackError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%s (rollback failed: %s)", e.Err, e.RollbackErr)
+	}
+
+	return fmt.Sprintf("%s (previous rules restored)", e.Err)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// rollbackState keeps track of the changes applied by RestoreIPTables,
+// which have to be reverted when a subsequent step fails
+type rollbackState struct {
+	snapshots   *snapshots
+	ipv4        bool
+	ipv6        bool
+	ipv6Address bool
+	ipv4Routing bool
+	ipv6Routing bool
+	ipsets      *ipset.Update
+}
+
+// rollback reverts all the applied changes. When nothing was applied it
+// returns the original error as it is
+func (s *rollbackState) rollback(cfg config.Config, err error) error {
+	if !s.ipv4 && !s.ipv6 && !s.ipv6Address && !s.ipv4Routing && !s.ipv6Routing &&
+		s.ipsets == nil {
+		return err
+	}
+
+	_, _ = cfg.RuntimeStdout.Write([]byte("applying iptables rules failed, " +
+		"restoring previously installed rules.\n"))
+
+	var errs []string
+
+	if s.ipv4 {
+		if rollbackErr := restoreSnapshot(cfg, s.snapshots.ipv4, false); rollbackErr != nil {
+			errs = append(errs, fmt.Sprintf("cannot restore ipv4 iptables rules: %s", rollbackErr))
+		}
+	}
+
+	if s.ipv6 {
+		if rollbackErr := restoreSnapshot(cfg, s.snapshots.ipv6, true); rollbackErr != nil {
+			errs = append(errs, fmt.Sprintf("cannot restore ipv6 iptables rules: %s", rollbackErr))
+		}
+	}
+
+	if s.ipv6Address {
+		if rollbackErr := cleanupIPv6Address(true); rollbackErr != nil {
+			errs = append(errs, rollbackErr.Error())
+		}
+	}
+
+	if s.ipv4Routing {
+		if rollbackErr := cleanupTProxyRouting(cfg, false); rollbackErr != nil {
+			errs = append(errs, rollbackErr.Error())
+		}
+	}
+
+	if s.ipv6Routing {
+		if rollbackErr := cleanupTProxyRouting(cfg, true); rollbackErr != nil {
+			errs = append(errs, rollbackErr.Error())
+		}
+	}
+
+	// created sets can be destroyed only when the rules referencing them
+	// were already restored
+	if s.ipsets != nil {
+		if rollbackErr := s.ipsets.Rollback(); rollbackErr != nil {
+			errs = append(errs, rollbackErr.Error())
+		}
+	}
+
+	result := &RollbackError{Err: err}
+	if len(errs) > 0 {
+		result.RollbackErr = fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return result
+}
@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Builder rollback", func() {
+	It("should remove our rules and chains installed after the snapshot", func() {
+		// given
+		current := strings.Replace(installedRules,
+			"-A POSTROUTING",
+			"-A POSTROUTING -s 10.0.0.0/8 -j MASQUERADE\n-A POSTROUTING",
+			1,
+		)
+
+		// when
+		restore, changed, err := buildSnapshotRestore(foreignRules, current, "")
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		// rules which aren't ours are not touched, even if they were added
+		// after the snapshot was taken
+		Expect(restore).To(Equal(`*nat
+:MESH_INBOUND - [0:0]
+:MESH_INBOUND_REDIRECT - [0:0]
+:MESH_OUTBOUND - [0:0]
+:MESH_OUTBOUND_REDIRECT - [0:0]
+-D PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND
+-D OUTPUT -p udp --dport 53 -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN
+-D OUTPUT -d 8.8.8.8/32 -p udp --dport 53 -m comment --comment kuma-net:dev::redirect-dns -j REDIRECT --to-ports 15053
+-D OUTPUT -p tcp -m comment --comment kuma-net:dev::capture-outbound -j MESH_OUTBOUND
+-X MESH_INBOUND
+-X MESH_INBOUND_REDIRECT
+-X MESH_OUTBOUND
+-X MESH_OUTBOUND_REDIRECT
+COMMIT
+`))
+	})
+
+	It("should restore our rules from the snapshot leaving others untouched", func() {
+		// given
+		current := strings.Replace(installedRules,
+			"-A MESH_INBOUND -p tcp -m tcp --dport 22 -m",
+			"-A MESH_INBOUND -p tcp -m tcp --dport 2222 -m",
+			1,
+		)
+
+		// when
+		restore, changed, err := buildSnapshotRestore(installedRules, current, "")
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(strings.Split(restore, "\n")[5:13]).To(Equal([]string{
+			"-D PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			"-D OUTPUT -p udp --dport 53 -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-D OUTPUT -d 8.8.8.8/32 -p udp --dport 53 -m comment --comment kuma-net:dev::redirect-dns -j REDIRECT --to-ports 15053",
+			"-D OUTPUT -p tcp -m comment --comment kuma-net:dev::capture-outbound -j MESH_OUTBOUND",
+			// rules placed before the other ones are restored at the same positions
+			"-I PREROUTING 1 -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			"-I OUTPUT 1 -p udp --dport 53 -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-I OUTPUT 2 -d 8.8.8.8/32 -p udp --dport 53 -m comment --comment kuma-net:dev::redirect-dns -j REDIRECT --to-ports 15053",
+			"-A OUTPUT -p tcp -m comment --comment kuma-net:dev::capture-outbound -j MESH_OUTBOUND",
+		}))
+		Expect(restore).To(ContainSubstring(
+			"-A MESH_INBOUND -p tcp --dport 22 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN\n",
+		))
+		Expect(restore).ToNot(ContainSubstring("DOCKER"))
+		Expect(restore).ToNot(ContainSubstring("MASQUERADE"))
+	})
+
+	It("should do nothing when our rules didn't change", func() {
+		// given
+		current := strings.Replace(installedRules,
+			"-A POSTROUTING",
+			"-A POSTROUTING -s 10.0.0.0/8 -j MASQUERADE\n-A POSTROUTING",
+			1,
+		)
+
+		// when
+		restore, changed, err := buildSnapshotRestore(installedRules, current, "")
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(restore).To(BeEmpty())
+	})
+
+	DescribeTable("should report the original error and the rollback outcome",
+		func(err *RollbackError, message string) {
+			Expect(err.Error()).To(Equal(message))
+			Expect(errors.Unwrap(err)).To(Equal(err.Err))
+		},
+		Entry("successful rollback",
+			&RollbackError{Err: fmt.Errorf("cannot restore ipv6 iptable rules")},
+			"cannot restore ipv6 iptable rules (previous rules restored)",
+		),
+		Entry("failed rollback",
+			&RollbackError{
+				Err:         fmt.Errorf("cannot restore ipv6 iptable rules"),
+				RollbackErr: fmt.Errorf("cannot restore ipv4 iptables rules"),
+			},
+			"cannot restore ipv6 iptable rules (rollback failed: cannot restore ipv4 iptables rules)",
+		),
+	)
+})
@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// tproxyRouting returns the policy routing rule and the local route used
+// by the tproxy redirect mode
+func tproxyRouting(cfg config.Config, ipv6 bool) (*netlink.Rule, *netlink.Route, error) {
+	link, err := netlink.LinkByName("lo")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find 'lo' link: %v", err)
+	}
+
+	family := netlink.FAMILY_V4
+	dst := &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	if ipv6 {
+		family = netlink.FAMILY_V6
+		dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Mark = int(cfg.Redirect.TProxy.Mark)
+	rule.Table = cfg.Redirect.TProxy.RouteTable
+
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Table:     cfg.Redirect.TProxy.RouteTable,
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+	}
+
+	return rule, route, nil
+}
+
+func ruleExists(rule *netlink.Rule) (bool, error) {
+	rules, err := netlink.RuleList(rule.Family)
+	if err != nil {
+		return false, err
+	}
+
+	for _, r := range rules {
+		if r.Mark == rule.Mark && r.Table == rule.Table {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// configureTProxyRouting sets up the policy routing, which delivers packets
+// marked by the TPROXY target (or by the proxy itself) locally.
+// Equivalent to `ip rule add fwmark <mark> lookup <table>` and
+// `ip route add local 0.0.0.0/0 dev lo table <table>` (`::/0` for IPv6).
+// Returned bool reports if anything was added (it's false when the routing
+// was already configured)
+func configureTProxyRouting(cfg config.Config, ipv6 bool) (bool, error) {
+	rule, route, err := tproxyRouting(cfg, ipv6)
+	if err != nil {
+		return false, err
+	}
+
+	added := false
+
+	exists, err := ruleExists(rule)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routing rules: %v", err)
+	}
+
+	if !exists {
+		if err := netlink.RuleAdd(rule); err != nil {
+			return false, fmt.Errorf("failed to add tproxy routing rule: %v", err)
+		}
+		added = true
+	}
+
+	err = netlink.RouteAdd(route)
+	if ignoreExists(err) != nil {
+		return added, fmt.Errorf("failed to add tproxy local route: %v", err)
+	}
+
+	return added || err == nil, nil
+}
+
+// cleanupTProxyRouting removes the routing configured by configureTProxyRouting.
+// Equivalent to `ip rule del fwmark <mark> lookup <table>` and
+// `ip route del local 0.0.0.0/0 dev lo table <table>` (`::/0` for IPv6)
+func cleanupTProxyRouting(cfg config.Config, ipv6 bool) error {
+	rule, route, err := tproxyRouting(cfg, ipv6)
+	if err != nil {
+		return err
+	}
+
+	if err := netlink.RouteDel(route); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to remove tproxy local route: %v", err)
+	}
+
+	// the rule could have been added more than once
+	for {
+		err := netlink.RuleDel(rule)
+		if errors.Is(err, syscall.ENOENT) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to remove tproxy routing rule: %v", err)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/kumahq/kuma-net/iptables/consts"
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/iptables/parser"
+	"github.com/kumahq/kuma-net/iptables/table"
+	"github.com/kumahq/kuma-net/nftrace"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// TraceFilter selects the flow which should be traced. Empty fields match
+// any value
+type TraceFilter struct {
+	// Protocol is "tcp" or "udp", and is required when any port is provided
+	Protocol        string
+	Source          string
+	SourcePort      uint16
+	Destination     string
+	DestinationPort uint16
+	// UID of the socket owner. As only locally generated packets have one,
+	// when it's provided packets are traced only from the OUTPUT chain
+	UID *uint32
+}
+
+// parseTraceAddress validates the address (IP or CIDR) and reports if it's
+// the IPv6 one
+func parseTraceAddress(name string, address string) (bool, error) {
+	if address == "" {
+		return false, nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(address); err != nil {
+			return false, fmt.Errorf("invalid %s address %q", name, address)
+		}
+	}
+
+	return ip.To4() == nil, nil
+}
+
+// families returns address families (false for IPv4, true for IPv6) of
+// the packets matching the filter. IPv6 packets can be traced only when
+// IPv6 is enabled
+func (f TraceFilter) families(ipv6 bool) ([]bool, error) {
+	switch f.Protocol {
+	case "", TCP, UDP:
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q, only %q or %q allowed",
+			f.Protocol, TCP, UDP)
+	}
+
+	if f.Protocol == "" && (f.SourcePort != 0 || f.DestinationPort != 0) {
+		return nil, fmt.Errorf("protocol is required to match ports")
+	}
+
+	sourceIPv6, err := parseTraceAddress("source", f.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	destinationIPv6, err := parseTraceAddress("destination", f.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case f.Source != "" && f.Destination != "" && sourceIPv6 != destinationIPv6:
+		return nil, fmt.Errorf("source and destination addresses are of different families")
+	// rules left by the interrupted trace are removed by the cleanup, which
+	// doesn't touch ip6tables when IPv6 is disabled
+	case !ipv6 && (sourceIPv6 || destinationIPv6):
+		return nil, fmt.Errorf("IPv6 packets cannot be traced when IPv6 is disabled")
+	case f.Source != "":
+		return []bool{sourceIPv6}, nil
+	case f.Destination != "":
+		return []bool{destinationIPv6}, nil
+	case ipv6:
+		return []bool{false, true}, nil
+	default:
+		return []bool{false}, nil
+	}
+}
+
+func (f TraceFilter) matches() []*Parameter {
+	var matches []*Parameter
+
+	if f.Source != "" {
+		matches = append(matches, Source(Address(f.Source)))
+	}
+
+	if f.Destination != "" {
+		matches = append(matches, Destination(f.Destination))
+	}
+
+	if f.Protocol != "" {
+		var ports []*TcpUdpParameter
+
+		if f.SourcePort != 0 {
+			ports = append(ports, SourcePort(f.SourcePort))
+		}
+
+		if f.DestinationPort != 0 {
+			ports = append(ports, DestinationPort(f.DestinationPort))
+		}
+
+		matches = append(matches, Protocol(traceProtocol(f.Protocol, ports...)))
+	}
+
+	return matches
+}
+
+func traceProtocol(protocol string, ports ...*TcpUdpParameter) *ProtocolParameter {
+	if protocol == UDP {
+		return Udp(ports...)
+	}
+
+	return Tcp(ports...)
+}
+
+// buildTraceTable returns the raw table with TRACE rules for the flow,
+// inserted at the top of PREROUTING and OUTPUT chains
+func buildTraceTable(filter TraceFilter, prefix string) *table.RawTable {
+	raw := table.Raw()
+	matches := filter.matches()
+
+	if filter.UID == nil {
+		raw.Prerouting().Insert(1, append(matches,
+			comment(prefix, ReasonTrace),
+			Jump(Trace()),
+		)...)
+	} else {
+		uid := strconv.FormatUint(uint64(*filter.UID), 10)
+		matches = append(matches, Match(Owner(Uid(uid))))
+	}
+
+	raw.Output().Insert(1, append(matches,
+		comment(prefix, ReasonTrace),
+		Jump(Trace()),
+	)...)
+
+	return raw
+}
+
+func runTraceCommands(cmdName string, commands []string) error {
+	for _, command := range commands {
+		args, err := parser.Tokenize(command)
+		if err != nil {
+			return fmt.Errorf("cannot parse command %q: %s", command, err)
+		}
+
+		if _, err := runIPTablesCmd(cmdName, "raw", args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tracedChain reports if the chain was generated by the builder with
+// the provided name prefix
+func tracedChain(chain string, prefix string) bool {
+	return strings.HasPrefix(chain, prefix+"MESH_")
+}
+
+// writeTracePaths writes, for every traced packet, steps it took through
+// our chains (in order in which events were received)
+func writeTracePaths(w io.Writer, events []nftrace.Event, prefix string) error {
+	var order []uint32
+	steps := map[uint32][]nftrace.Event{}
+	families := map[uint32]bool{}
+
+	for _, event := range events {
+		if _, ok := families[event.ID]; !ok {
+			order = append(order, event.ID)
+			families[event.ID] = event.IPv6
+		}
+
+		if tracedChain(event.Chain, prefix) || tracedChain(event.Target, prefix) {
+			steps[event.ID] = append(steps[event.ID], event)
+		}
+	}
+
+	var b strings.Builder
+
+	for _, id := range order {
+		family := "ipv4"
+		if families[id] {
+			family = "ipv6"
+		}
+
+		fmt.Fprintf(&b, "packet %08x (%s):\n", id, family)
+
+		if len(steps[id]) == 0 {
+			fmt.Fprintf(&b, "  did not traverse %sMESH_* chains\n", prefix)
+			continue
+		}
+
+		for _, step := range steps[id] {
+			fmt.Fprintf(&b, "  %s\n", step)
+		}
+	}
+
+	if len(order) == 0 {
+		b.WriteString("no packets matching the filter were traced\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// TraceFlow installs TRACE rules for the flow selected by the filter, collects
+// nf_trace events of the matching packets until the timeout passes (or
+// the context is done, or SIGINT or SIGTERM is received), removes the rules
+// and writes the path every packet took through our chains. Rules are tagged
+// with our comment (with the "trace" reason), so if they cannot be removed
+// (i.e. the process is killed), the cleanup will do it. Events are emitted
+// only by the nft variant of iptables
+func TraceFlow(
+	ctx context.Context,
+	cfg config.Config,
+	filter TraceFilter,
+	timeout time.Duration,
+	w io.Writer,
+) error {
+	cfg, err := resolveIPTablesMode(config.MergeConfigWithDefaults(cfg))
+	if err != nil {
+		return err
+	}
+
+	if cfg.IPTables.Mode == config.IPTablesModeLegacy {
+		return fmt.Errorf("tracing is not supported with the %s iptables mode, "+
+			"as it doesn't emit nf_trace events", config.IPTablesModeLegacy)
+	}
+
+	prefix := cfg.Redirect.NamePrefix
+	if err := validateCommentPrefix(prefix); err != nil {
+		return err
+	}
+
+	families, err := filter.families(cfg.IPv6)
+	if err != nil {
+		return fmt.Errorf("invalid trace filter: %s", err)
+	}
+
+	// interrupting the trace stops collecting the events, so the rules are
+	// removed and paths of already traced packets are written
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	monitor, err := nftrace.Subscribe()
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	raw := buildTraceTable(filter, prefix)
+	install := append(raw.Prerouting().Build(false), raw.Output().Build(false)...)
+
+	for _, ipv6 := range families {
+		cmdName := cfg.IPTables.Executable("iptables", ipv6)
+
+		// deletions of rules which weren't installed fail, and are ignored
+		defer func() {
+			for _, command := range raw.BuildCleanup(false) {
+				_ = runTraceCommands(cmdName, []string{command})
+			}
+		}()
+
+		if err := runTraceCommands(cmdName, install); err != nil {
+			return fmt.Errorf("cannot install trace rules: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var events []nftrace.Event
+	if err := monitor.Listen(ctx, func(event nftrace.Event) {
+		events = append(events, event)
+	}); err != nil {
+		return err
+	}
+
+	return writeTracePaths(w, events, prefix)
+}
@@ -0,0 +1,115 @@
+package builder
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/nftrace"
+)
+
+var _ = Describe("Builder trace", func() {
+	DescribeTable("should insert TRACE rules for the flow",
+		func(filter TraceFilter, want []string) {
+			// when
+			raw := buildTraceTable(filter, "KUMA_")
+
+			// then
+			Expect(append(raw.Prerouting().Build(false), raw.Output().Build(false)...)).
+				To(Equal(want))
+		},
+		Entry("5-tuple",
+			TraceFilter{
+				Protocol:        "tcp",
+				Source:          "10.0.0.1",
+				SourcePort:      54321,
+				Destination:     "10.0.0.2",
+				DestinationPort: 5432,
+			},
+			[]string{
+				"-I PREROUTING 1 -s 10.0.0.1 -d 10.0.0.2 -p tcp --sport 54321 --dport 5432 -m comment --comment kuma-net:dev:KUMA_:trace -j TRACE",
+				"-I OUTPUT 1 -s 10.0.0.1 -d 10.0.0.2 -p tcp --sport 54321 --dport 5432 -m comment --comment kuma-net:dev:KUMA_:trace -j TRACE",
+			},
+		),
+		Entry("destination only",
+			TraceFilter{Protocol: "udp", DestinationPort: 53},
+			[]string{
+				"-I PREROUTING 1 -p udp --dport 53 -m comment --comment kuma-net:dev:KUMA_:trace -j TRACE",
+				"-I OUTPUT 1 -p udp --dport 53 -m comment --comment kuma-net:dev:KUMA_:trace -j TRACE",
+			},
+		),
+		Entry("socket owner",
+			TraceFilter{Destination: "fd00::1", UID: func() *uint32 { uid := uint32(1000); return &uid }()},
+			[]string{
+				"-I OUTPUT 1 -d fd00::1 -m owner --uid-owner 1000 -m comment --comment kuma-net:dev:KUMA_:trace -j TRACE",
+			},
+		),
+	)
+
+	DescribeTable("should trace packets of the address families matching the filter",
+		func(filter TraceFilter, ipv6 bool, want []bool) {
+			// when
+			families, err := filter.families(ipv6)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(families).To(Equal(want))
+		},
+		Entry("any address with IPv6 enabled", TraceFilter{}, true, []bool{false, true}),
+		Entry("any address with IPv6 disabled", TraceFilter{}, false, []bool{false}),
+		Entry("IPv6 source", TraceFilter{Source: "fd00::/8"}, true, []bool{true}),
+		Entry("IPv4 destination", TraceFilter{Destination: "10.0.0.1"}, true, []bool{false}),
+	)
+
+	DescribeTable("should reject invalid filters",
+		func(filter TraceFilter, want string) {
+			// when
+			_, err := filter.families(true)
+
+			// then
+			Expect(err).To(MatchError(want))
+		},
+		Entry("unknown protocol", TraceFilter{Protocol: "sctp"},
+			`unsupported protocol "sctp", only "tcp" or "udp" allowed`),
+		Entry("port without protocol", TraceFilter{DestinationPort: 80},
+			"protocol is required to match ports"),
+		Entry("invalid address", TraceFilter{Source: "10.0.0"},
+			`invalid source address "10.0.0"`),
+		Entry("mixed families", TraceFilter{Source: "10.0.0.1", Destination: "fd00::1"},
+			"source and destination addresses are of different families"),
+	)
+
+	It("should reject IPv6 addresses when IPv6 is disabled", func() {
+		// when
+		_, err := TraceFilter{Destination: "fd00::1"}.families(false)
+
+		// then
+		Expect(err).To(MatchError("IPv6 packets cannot be traced when IPv6 is disabled"))
+	})
+
+	It("should write paths of the packets through our chains", func() {
+		// given
+		events := []nftrace.Event{
+			{ID: 0xa1, Type: nftrace.TypeRule, Table: "raw", Chain: "OUTPUT", Handle: 2, Verdict: "continue"},
+			{ID: 0xa1, Type: nftrace.TypeRule, Table: "nat", Chain: "OUTPUT", Handle: 5, Verdict: "jump", Target: "KUMA_MESH_OUTBOUND"},
+			{ID: 0xb2, IPv6: true, Type: nftrace.TypePolicy, Table: "raw", Chain: "OUTPUT", Verdict: "accept"},
+			{ID: 0xa1, Type: nftrace.TypeRule, Table: "nat", Chain: "KUMA_MESH_OUTBOUND", Handle: 9, Verdict: "jump", Target: "KUMA_MESH_OUTBOUND_REDIRECT"},
+			{ID: 0xa1, Type: nftrace.TypeRule, Table: "nat", Chain: "KUMA_MESH_OUTBOUND_REDIRECT", Handle: 11, Verdict: "accept"},
+		}
+		var output strings.Builder
+
+		// when
+		err := writeTracePaths(&output, events, "KUMA_")
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.String()).To(Equal(`packet 000000a1 (ipv4):
+  nat OUTPUT rule 5: jump KUMA_MESH_OUTBOUND
+  nat KUMA_MESH_OUTBOUND rule 9: jump KUMA_MESH_OUTBOUND_REDIRECT
+  nat KUMA_MESH_OUTBOUND_REDIRECT rule 11: accept
+packet 000000b2 (ipv6):
+  did not traverse KUMA_MESH_* chains
+`))
+	})
+})
@@ -0,0 +1,256 @@
+package builder
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/kumahq/kuma-net/iptables/parser"
+)
+
+// tables managed by us in order in which they are restored
+var managedTables = []string{"raw", "nat", "mangle", "filter"}
+
+func saveIPTables(cmdName string, args ...string) (string, error) {
+	cmd := exec.Command(cmdName, args...)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("executing command %s failed: %s", cmdName, err)
+	}
+
+	return string(output), nil
+}
+
+func canonicalRules(rules []string) ([]string, error) {
+	var result []string
+
+	for _, rule := range rules {
+		canonical, err := parser.Canonical(rule)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse rule %q: %s", rule, err)
+		}
+
+		result = append(result, canonical)
+	}
+
+	return result, nil
+}
+
+func equalRules(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ownedByPrefix reports if the rule is tagged with the comment of the rule
+// generated by us with the provided name prefix (by any version)
+func ownedByPrefix(rule string, prefix string) bool {
+	comment, ok := ParseRuleComment(parser.CommentOf(rule))
+	return ok && comment.Prefix == prefix
+}
+
+// ownedChains returns our custom chains from the provided tables. The chain
+// is ours when it's one of the known ones, or when it's reachable from
+// the rules tagged with our comment in the built-in chains, or from our other
+// chains (i.e. MESH_INBOUND_DIVERT jumped to from MESH_INBOUND_UDP)
+func ownedChains(
+	tableName string,
+	prefix string,
+	known map[string]bool,
+	tables *parser.Tables,
+) []string {
+	custom := map[string]bool{}
+	for _, name := range tables.CustomChains(tableName) {
+		custom[name] = true
+	}
+
+	reachable := map[string]bool{}
+	var queue []string
+
+	visit := func(name string) {
+		if custom[name] && !reachable[name] {
+			reachable[name] = true
+			queue = append(queue, name)
+		}
+	}
+
+	for _, name := range tables.BuiltinChains(tableName) {
+		for _, rule := range tables.Chain(tableName, name).Rules(false) {
+			if ownedByPrefix(rule, prefix) {
+				visit(parser.JumpTarget(rule))
+			}
+		}
+	}
+
+	for _, name := range tables.CustomChains(tableName) {
+		if known[name] {
+			visit(name)
+		}
+	}
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		for _, rule := range tables.Chain(tableName, name).Rules(false) {
+			visit(parser.JumpTarget(rule))
+		}
+	}
+
+	var result []string
+
+	for _, name := range tables.CustomChains(tableName) {
+		if reachable[name] {
+			result = append(result, name)
+		}
+	}
+
+	return result
+}
+
+// buildTableUpdate returns the iptables-restore input for a single table,
+// which replaces our chains and our rules from the built-in chains with
+// the desired ones, removes our chains which aren't desired anymore,
+// and reports if the table differs from the desired state
+func buildTableUpdate(
+	tableName string,
+	prefix string,
+	desired *parser.Tables,
+	current *parser.Tables,
+) ([]string, bool, error) {
+	var chains, deletions, removals, rules []string
+	changed := false
+	ours := map[string]bool{}
+	stale := map[string]bool{}
+
+	for _, name := range desired.CustomChains(tableName) {
+		ours[name] = true
+		// when iptables-restore is run with --noflush, declaring a chain
+		// which already exists will flush it
+		chains = append(chains, fmt.Sprintf(":%s - [0:0]", name))
+
+		want, err := canonicalRules(desired.Chain(tableName, name).Rules(false))
+		if err != nil {
+			return nil, false, err
+		}
+
+		existing := current.Chain(tableName, name)
+		if existing == nil {
+			changed = true
+			continue
+		}
+
+		got, err := canonicalRules(existing.Rules(false))
+		if err != nil {
+			return nil, false, err
+		}
+
+		changed = changed || !equalRules(want, got)
+	}
+
+	// our chains which aren't desired anymore (i.e. MESH_INBOUND_UDP after
+	// the UDP redirection was disabled) are flushed by declaring them,
+	// so they can be deleted after removing rules jumping to them from
+	// the built-in chains
+	for _, name := range ownedChains(tableName, prefix, ours, current) {
+		if ours[name] {
+			continue
+		}
+
+		stale[name] = true
+		chains = append(chains, fmt.Sprintf(":%s - [0:0]", name))
+		removals = append(removals, fmt.Sprintf("-X %s", name))
+		changed = true
+	}
+
+	for _, name := range desired.BuiltinChains(tableName) {
+		want, err := canonicalRules(desired.Chain(tableName, name).Rules(false))
+		if err != nil {
+			return nil, false, err
+		}
+
+		wanted := map[string]bool{}
+		for _, rule := range want {
+			wanted[rule] = true
+		}
+
+		var got []string
+
+		// rules from the built-in chains are ours if they are one of the rules
+		// we want to have, if they are jumping to our chains, or if they are
+		// tagged with our comment (i.e. were installed by another version)
+		for _, rule := range current.Chain(tableName, name).Rules(false) {
+			canonical, err := parser.Canonical(rule)
+			if err != nil {
+				return nil, false, fmt.Errorf("cannot parse rule %q: %s", rule, err)
+			}
+
+			target := parser.JumpTarget(rule)
+			if wanted[canonical] || ours[target] || stale[target] || ownedByPrefix(rule, prefix) {
+				got = append(got, canonical)
+				deletions = append(deletions, fmt.Sprintf("-D %s %s", name, rule))
+			}
+		}
+
+		changed = changed || !equalRules(want, got)
+		rules = append(rules, desired.Chain(tableName, name).Build(false)...)
+	}
+
+	for _, name := range desired.CustomChains(tableName) {
+		rules = append(rules, desired.Chain(tableName, name).Build(false)...)
+	}
+
+	if len(chains)+len(deletions)+len(removals)+len(rules) == 0 {
+		return nil, changed, nil
+	}
+
+	lines := []string{"*" + tableName}
+	lines = append(lines, chains...)
+	lines = append(lines, deletions...)
+	lines = append(lines, removals...)
+	lines = append(lines, rules...)
+	lines = append(lines, "COMMIT")
+
+	return lines, changed, nil
+}
+
+// buildIPTablesUpdate compares desired rules with the currently installed ones
+// and returns the input for "iptables-restore --noflush", which will replace
+// (in one atomic operation) our chains and our rules from the built-in chains
+// and remove our chains which aren't desired anymore, leaving all the other
+// rules untouched. When the desired rules are already
+// installed it returns an empty string and false. Rules from the built-in
+// chains tagged with our comment and the provided name prefix are treated
+// as ours
+func buildIPTablesUpdate(
+	desired *parser.Tables,
+	current *parser.Tables,
+	prefix string,
+) (string, bool, error) {
+	var lines []string
+	changed := false
+
+	for _, tableName := range managedTables {
+		tableLines, tableChanged, err := buildTableUpdate(tableName, prefix, desired, current)
+		if err != nil {
+			return "", false, fmt.Errorf("cannot compare %s table: %s", tableName, err)
+		}
+
+		lines = append(lines, tableLines...)
+		changed = changed || tableChanged
+	}
+
+	if !changed {
+		return "", false, nil
+	}
+
+	return strings.Join(lines, "\n") + "\n", true, nil
+}
@@ -0,0 +1,219 @@
+package builder
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/iptables/parser"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+const foreignRules = `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+-A OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER
+-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE
+COMMIT
+`
+
+const installedRules = `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+:MESH_INBOUND - [0:0]
+:MESH_INBOUND_REDIRECT - [0:0]
+:MESH_OUTBOUND - [0:0]
+:MESH_OUTBOUND_REDIRECT - [0:0]
+-A PREROUTING -p tcp -m comment --comment "kuma-net:dev::capture-inbound" -j MESH_INBOUND
+-A OUTPUT -p udp -m udp --dport 53 -m owner --uid-owner 5678 -m comment --comment "kuma-net:dev::sidecar-owned" -j RETURN
+-A OUTPUT -d 8.8.8.8/32 -p udp -m udp --dport 53 -m comment --comment "kuma-net:dev::redirect-dns" -j REDIRECT --to-ports 15053
+-A OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER
+-A OUTPUT -p tcp -m comment --comment "kuma-net:dev::capture-outbound" -j MESH_OUTBOUND
+-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE
+-A MESH_INBOUND -p tcp -m tcp --dport 22 -m comment --comment "kuma-net:dev::exclude-inbound-port" -j RETURN
+-A MESH_INBOUND -p tcp -m comment --comment "kuma-net:dev::redirect-inbound" -j MESH_INBOUND_REDIRECT
+-A MESH_INBOUND_REDIRECT -p tcp -m comment --comment "kuma-net:dev::inbound-listener" -j REDIRECT --to-ports 15006
+-A MESH_OUTBOUND -s 127.0.0.6/32 -o lo -m comment --comment "kuma-net:dev::inbound-passthrough" -j RETURN
+-A MESH_OUTBOUND ! -d 127.0.0.1/32 -o lo -p tcp -m tcp ! --dport 53 -m owner --uid-owner 5678 -m comment --comment "kuma-net:dev::sidecar-hairpin" -j MESH_INBOUND_REDIRECT
+-A MESH_OUTBOUND -o lo -p tcp -m tcp ! --dport 53 -m owner ! --uid-owner 5678 -m comment --comment "kuma-net:dev::application-loopback" -j RETURN
+-A MESH_OUTBOUND -m owner --uid-owner 5678 -m comment --comment "kuma-net:dev::sidecar-owned" -j RETURN
+-A MESH_OUTBOUND -d 8.8.8.8/32 -p tcp -m tcp --dport 53 -m comment --comment "kuma-net:dev::redirect-dns" -j REDIRECT --to-ports 15053
+-A MESH_OUTBOUND -d 127.0.0.1/32 -m comment --comment "kuma-net:dev::localhost" -j RETURN
+-A MESH_OUTBOUND -m comment --comment "kuma-net:dev::redirect-outbound" -j MESH_OUTBOUND_REDIRECT
+-A MESH_OUTBOUND_REDIRECT -p tcp -m comment --comment "kuma-net:dev::outbound-listener" -j REDIRECT --to-ports 15001
+COMMIT
+`
+
+var _ = Describe("Builder update", func() {
+	cfg := config.Config{
+		Redirect: config.Redirect{
+			Inbound:  config.TrafficFlow{Enabled: true, ExcludePorts: []uint16{22}},
+			Outbound: config.TrafficFlow{Enabled: true},
+			DNS:      config.DNS{Enabled: true},
+		},
+	}
+
+	update := func(installed string) (string, bool) {
+		tables, err := buildIPTables(cfg, []string{"8.8.8.8"}, false)
+		Expect(err).ToNot(HaveOccurred())
+
+		desired, err := parser.Parse(strings.NewReader(tables.Build(false)))
+		Expect(err).ToNot(HaveOccurred())
+
+		current, err := parser.Parse(strings.NewReader(installed))
+		Expect(err).ToNot(HaveOccurred())
+
+		rules, changed, err := buildIPTablesUpdate(desired, current, cfg.Redirect.NamePrefix)
+		Expect(err).ToNot(HaveOccurred())
+
+		return rules, changed
+	}
+
+	It("should do nothing when the rules are already installed", func() {
+		// when
+		rules, changed := update(installedRules)
+
+		// then
+		Expect(changed).To(BeFalse())
+		Expect(rules).To(BeEmpty())
+	})
+
+	It("should install our chains and rules next to the existing ones", func() {
+		// when
+		rules, changed := update(foreignRules)
+
+		// then
+		Expect(changed).To(BeTrue())
+		Expect(rules).To(Equal(`*nat
+:MESH_INBOUND - [0:0]
+:MESH_OUTBOUND - [0:0]
+:MESH_INBOUND_REDIRECT - [0:0]
+:MESH_OUTBOUND_REDIRECT - [0:0]
+-A PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND
+-I OUTPUT 1 -p udp --dport 53 -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN
+-I OUTPUT 2 -d 8.8.8.8 -p udp --dport 53 -m comment --comment kuma-net:dev::redirect-dns -j REDIRECT --to-ports 15053
+-A OUTPUT -p tcp -m comment --comment kuma-net:dev::capture-outbound -j MESH_OUTBOUND
+-A MESH_INBOUND -p tcp --dport 22 -m comment --comment kuma-net:dev::exclude-inbound-port -j RETURN
+-A MESH_INBOUND -p tcp -m comment --comment kuma-net:dev::redirect-inbound -j MESH_INBOUND_REDIRECT
+-A MESH_OUTBOUND -s 127.0.0.6/32 -o lo -m comment --comment kuma-net:dev::inbound-passthrough -j RETURN
+-A MESH_OUTBOUND -p tcp ! --dport 53 -o lo ! -d 127.0.0.1/32 -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-hairpin -j MESH_INBOUND_REDIRECT
+-A MESH_OUTBOUND -p tcp ! --dport 53 -o lo -m owner ! --uid-owner 5678 -m comment --comment kuma-net:dev::application-loopback -j RETURN
+-A MESH_OUTBOUND -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN
+-A MESH_OUTBOUND -d 8.8.8.8 -p tcp --dport 53 -m comment --comment kuma-net:dev::redirect-dns -j REDIRECT --to-ports 15053
+-A MESH_OUTBOUND -d 127.0.0.1/32 -m comment --comment kuma-net:dev::localhost -j RETURN
+-A MESH_OUTBOUND -m comment --comment kuma-net:dev::redirect-outbound -j MESH_OUTBOUND_REDIRECT
+-A MESH_INBOUND_REDIRECT -p tcp -m comment --comment kuma-net:dev::inbound-listener -j REDIRECT --to-ports 15006
+-A MESH_OUTBOUND_REDIRECT -p tcp -m comment --comment kuma-net:dev::outbound-listener -j REDIRECT --to-ports 15001
+COMMIT
+`))
+	})
+
+	It("should replace only our rules when they differ", func() {
+		// given
+		installed := strings.Replace(installedRules,
+			"-A MESH_INBOUND -p tcp -m tcp --dport 22 -m",
+			"-A MESH_INBOUND -p tcp -m tcp --dport 2222 -m",
+			1,
+		)
+		// rules installed twice, the second time by the versions which didn't
+		// tag rules with comments
+		installed = strings.Replace(installed,
+			"-A POSTROUTING",
+			"-A OUTPUT -p tcp -j MESH_OUTBOUND\n-A POSTROUTING",
+			1,
+		)
+
+		// when
+		rules, changed := update(installed)
+
+		// then
+		Expect(changed).To(BeTrue())
+		Expect(strings.Split(rules, "\n")[:11]).To(Equal([]string{
+			"*nat",
+			":MESH_INBOUND - [0:0]",
+			":MESH_OUTBOUND - [0:0]",
+			":MESH_INBOUND_REDIRECT - [0:0]",
+			":MESH_OUTBOUND_REDIRECT - [0:0]",
+			"-D PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			"-D OUTPUT -p udp --dport 53 -m owner --uid-owner 5678 -m comment --comment kuma-net:dev::sidecar-owned -j RETURN",
+			"-D OUTPUT -d 8.8.8.8/32 -p udp --dport 53 -m comment --comment kuma-net:dev::redirect-dns -j REDIRECT --to-ports 15053",
+			"-D OUTPUT -p tcp -m comment --comment kuma-net:dev::capture-outbound -j MESH_OUTBOUND",
+			"-D OUTPUT -p tcp -j MESH_OUTBOUND",
+			"-A PREROUTING -p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+		}))
+		Expect(rules).ToNot(ContainSubstring("DOCKER"))
+		Expect(rules).ToNot(ContainSubstring("MASQUERADE"))
+	})
+
+	It("should replace rules tagged by another version", func() {
+		// given
+		installed := strings.ReplaceAll(installedRules, "kuma-net:dev:", "kuma-net:0.9.0:")
+		// rule which is not jumping to our chains, and which we don't want
+		// to have anymore
+		installed = strings.Replace(installed,
+			"-A POSTROUTING",
+			`-A OUTPUT -p udp -m comment --comment "kuma-net:0.9.0::dns" -j RETURN`+"\n-A POSTROUTING",
+			1,
+		)
+
+		// when
+		rules, changed := update(installed)
+
+		// then
+		Expect(changed).To(BeTrue())
+		Expect(rules).To(ContainSubstring(
+			"-D OUTPUT -p udp -m comment --comment kuma-net:0.9.0::dns -j RETURN\n",
+		))
+		Expect(rules).To(ContainSubstring(
+			"-D OUTPUT -d 8.8.8.8/32 -p udp --dport 53 -m comment --comment kuma-net:0.9.0::redirect-dns -j REDIRECT --to-ports 15053\n",
+		))
+		Expect(rules).ToNot(ContainSubstring("DOCKER"))
+	})
+
+	It("should remove our chains of the disabled features", func() {
+		// given
+		withUDP := cfg
+		withUDP.Redirect.Inbound.UDP = config.UDP{Enabled: true, Port: 15007}
+		tables, err := buildIPTables(config.MergeConfigWithDefaults(withUDP), []string{"8.8.8.8"}, false)
+		Expect(err).ToNot(HaveOccurred())
+
+		// when
+		rules, changed := update(tables.Build(false))
+
+		// then
+		Expect(changed).To(BeTrue())
+		Expect(rules).To(HaveSuffix(`*mangle
+:MESH_INBOUND_UDP - [0:0]
+:MESH_INBOUND_DIVERT - [0:0]
+-D PREROUTING -p udp -m comment --comment kuma-net:dev::capture-inbound-udp -j MESH_INBOUND_UDP
+-D OUTPUT -p udp -m connmark --mark 0x539 -m comment --comment kuma-net:dev::restore-mark -j CONNMARK --restore-mark --nfmask 0xffffffff --ctmask 0xffffffff
+-D OUTPUT -p udp -m mark --mark 0x539 -m comment --comment kuma-net:dev::save-mark -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff
+-X MESH_INBOUND_UDP
+-X MESH_INBOUND_DIVERT
+COMMIT
+`))
+	})
+
+	It("should leave rules tagged with another name prefix", func() {
+		// given
+		installed := strings.Replace(installedRules,
+			"-A POSTROUTING",
+			`-A OUTPUT -p udp -m comment --comment "kuma-net:dev:OTHER_:dns" -j RETURN`+"\n-A POSTROUTING",
+			1,
+		)
+
+		// when
+		rules, changed := update(installed)
+
+		// then
+		Expect(changed).To(BeFalse())
+		Expect(rules).To(BeEmpty())
+	})
+})
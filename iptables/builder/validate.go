@@ -0,0 +1,138 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kumahq/kuma-net/iptables/parser"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// restoreErrorLine matches the number of the rejected line, as reported by
+// iptables-restore, i.e. "iptables-restore: line 12 failed" (legacy),
+// "iptables-restore v1.8.7 (nf_tables): line 12: RULE_APPEND failed" (nft)
+// or "Error occurred at line: 12"
+var restoreErrorLine = regexp.MustCompile(`line:? (\d+)`)
+
+// RestoreTestError is returned when the rules were rejected by
+// "iptables-restore --test"
+type RestoreTestError struct {
+	IPv6 bool
+	// Line is the number of the rejected line of the iptables-restore input
+	// (0 when iptables-restore didn't report it)
+	Line int
+	// Content is the rejected line
+	Content string
+	// Comment identifies the logical rule, if the rejected line is the rule
+	// generated by the builder
+	Comment *RuleComment
+	// Output is the output of iptables-restore
+	Output string
+}
+
+func (e *RestoreTestError) Error() string {
+	family := "ipv4"
+	if e.IPv6 {
+		family = "ipv6"
+	}
+
+	if e.Line == 0 {
+		return fmt.Sprintf("%s rules rejected by iptables-restore: %s", family, e.Output)
+	}
+
+	rule := ""
+	if e.Comment != nil {
+		rule = fmt.Sprintf(" (%s rule)", e.Comment.Reason)
+	}
+
+	return fmt.Sprintf("%s rules rejected by iptables-restore at line %d%s %q: %s",
+		family, e.Line, rule, e.Content, e.Output)
+}
+
+// newRestoreTestError maps the iptables-restore output back to the rejected
+// line of the input and its logical rule
+func newRestoreTestError(rules string, output string, ipv6 bool) *RestoreTestError {
+	err := &RestoreTestError{
+		IPv6:   ipv6,
+		Output: strings.TrimSpace(output),
+	}
+
+	match := restoreErrorLine.FindStringSubmatch(output)
+	if match == nil {
+		return err
+	}
+
+	lines := strings.Split(rules, "\n")
+	line, _ := strconv.Atoi(match[1])
+	if line < 1 || line > len(lines) {
+		return err
+	}
+
+	err.Line = line
+	err.Content = lines[line-1]
+
+	if comment, ok := ParseRuleComment(parser.CommentOf(err.Content)); ok {
+		err.Comment = &comment
+	}
+
+	return err
+}
+
+// testRestore runs "iptables-restore --test" (which only parses and
+// constructs the rules, without committing them) with the provided input
+func testRestore(cfg config.Config, rules string, ipv6 bool, flags ...string) error {
+	rulesFile, err := createRulesFile(ipv6)
+	if err != nil {
+		return err
+	}
+	defer rulesFile.Close()
+	defer os.Remove(rulesFile.Name())
+
+	if _, err := rulesFile.WriteString(rules); err != nil {
+		return fmt.Errorf("unable to write iptables-restore file: %s", err)
+	}
+
+	cmdName := cfg.IPTables.Executable("iptables-restore", ipv6)
+	args := append(append([]string{"--test"}, flags...), rulesFile.Name())
+
+	output, err := exec.Command(cmdName, args...).CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return fmt.Errorf("executing command failed: %s", err)
+		}
+
+		return newRestoreTestError(rules, string(output), ipv6)
+	}
+
+	return nil
+}
+
+// ValidateIPTables checks if the rules generated with the provided
+// configuration would be accepted by iptables-restore (all the required
+// kernel extensions are available, and all the arguments are valid) without
+// applying them. When ipset sets are used, they have to already exist
+func ValidateIPTables(cfg config.Config) error {
+	cfg, err := resolveIPTablesMode(config.MergeConfigWithDefaults(cfg))
+	if err != nil {
+		return err
+	}
+
+	ipv4, ipv6, err := buildFamiliesIPTables(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := testRestore(cfg, ipv4.Build(false), false); err != nil {
+		return err
+	}
+
+	if ipv6 != nil {
+		return testRestore(cfg, ipv6.Build(false), true)
+	}
+
+	return nil
+}
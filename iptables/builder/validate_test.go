@@ -0,0 +1,75 @@
+package builder
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const restoreTestInput = `*nat
+:KUMA_MESH_OUTBOUND - [0:0]
+-A OUTPUT -p tcp -m comment --comment kuma-net:dev:KUMA_:capture-outbound -j KUMA_MESH_OUTBOUND
+-A KUMA_MESH_OUTBOUND -p tcp -m multiport --dports 80 -m owner --uid-owner 1000-abc -m comment --comment kuma-net:dev:KUMA_:exclude-outbound-port-for-uid -j RETURN
+-A KUMA_MESH_OUTBOUND -j KUMA_MESH_MISSING
+COMMIT
+`
+
+var _ = Describe("Builder validation", func() {
+	DescribeTable("should map iptables-restore errors to the rejected rule",
+		func(output string, ipv6 bool, want *RestoreTestError, message string) {
+			// when
+			err := newRestoreTestError(restoreTestInput, output, ipv6)
+
+			// then
+			Expect(err).To(Equal(want))
+			Expect(err.Error()).To(Equal(message))
+		},
+		Entry("legacy error with the logical rule",
+			"iptables-restore v1.8.7 (legacy): owner: Bad value for \"--uid-owner\" option: \"1000-abc\"\n"+
+				"Error occurred at line: 4\n"+
+				"Try `iptables-restore -h' or 'iptables-restore --help' for more information.\n",
+			false,
+			&RestoreTestError{
+				Line: 4,
+				Content: "-A KUMA_MESH_OUTBOUND -p tcp -m multiport --dports 80 -m owner --uid-owner 1000-abc " +
+					"-m comment --comment kuma-net:dev:KUMA_:exclude-outbound-port-for-uid -j RETURN",
+				Comment: &RuleComment{Version: "dev", Prefix: "KUMA_", Reason: ReasonExcludeOutboundPortForUID},
+				Output: "iptables-restore v1.8.7 (legacy): owner: Bad value for \"--uid-owner\" option: \"1000-abc\"\n" +
+					"Error occurred at line: 4\n" +
+					"Try `iptables-restore -h' or 'iptables-restore --help' for more information.",
+			},
+			`ipv4 rules rejected by iptables-restore at line 4 (exclude-outbound-port-for-uid rule) `+
+				`"-A KUMA_MESH_OUTBOUND -p tcp -m multiport --dports 80 -m owner --uid-owner 1000-abc `+
+				`-m comment --comment kuma-net:dev:KUMA_:exclude-outbound-port-for-uid -j RETURN": `+
+				`iptables-restore v1.8.7 (legacy): owner: Bad value for "--uid-owner" option: "1000-abc"`+"\n"+
+				"Error occurred at line: 4\n"+
+				"Try `iptables-restore -h' or 'iptables-restore --help' for more information.",
+		),
+		Entry("nft error of the rule without the comment",
+			"ip6tables-restore v1.8.7 (nf_tables): line 5: RULE_APPEND failed (No such file or directory): "+
+				"rule in chain KUMA_MESH_OUTBOUND\n",
+			true,
+			&RestoreTestError{
+				IPv6:    true,
+				Line:    5,
+				Content: "-A KUMA_MESH_OUTBOUND -j KUMA_MESH_MISSING",
+				Output: "ip6tables-restore v1.8.7 (nf_tables): line 5: RULE_APPEND failed " +
+					"(No such file or directory): rule in chain KUMA_MESH_OUTBOUND",
+			},
+			`ipv6 rules rejected by iptables-restore at line 5 "-A KUMA_MESH_OUTBOUND -j KUMA_MESH_MISSING": `+
+				"ip6tables-restore v1.8.7 (nf_tables): line 5: RULE_APPEND failed "+
+				"(No such file or directory): rule in chain KUMA_MESH_OUTBOUND",
+		),
+		Entry("error without the line number",
+			"iptables-restore: unable to initialize table 'nat'\n",
+			false,
+			&RestoreTestError{Output: "iptables-restore: unable to initialize table 'nat'"},
+			"ipv4 rules rejected by iptables-restore: iptables-restore: unable to initialize table 'nat'",
+		),
+		Entry("line number out of the input",
+			"iptables-restore: line 42 failed\n",
+			false,
+			&RestoreTestError{Output: "iptables-restore: line 42 failed"},
+			"ipv4 rules rejected by iptables-restore: iptables-restore: line 42 failed",
+		),
+	)
+})
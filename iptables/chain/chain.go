@@ -44,6 +44,39 @@ func (b *Chain) Build(verbose bool) []string {
 	return cmds
 }
 
+// Rules returns specifications of the chain rules in order in which they
+// would end up in the (previously empty) chain, so inserted rules are placed
+// at their positions instead of the order in which they were added
+func (b *Chain) Rules(verbose bool) []string {
+	var rules []string
+
+	for _, cmd := range b.commands {
+		rule := cmd.BuildRule(verbose)
+		position := cmd.Position()
+
+		if position == 0 || position > len(rules) {
+			rules = append(rules, rule)
+			continue
+		}
+
+		rules = append(rules[:position-1], append([]string{rule}, rules[position-1:]...)...)
+	}
+
+	return rules
+}
+
+// BuildDeletions will generate commands which remove all the rules previously
+// appended or inserted to the chain
+func (b *Chain) BuildDeletions(verbose bool) []string {
+	var cmds []string
+
+	for _, cmd := range b.commands {
+		cmds = append(cmds, cmd.Deletion().Build(verbose))
+	}
+
+	return cmds
+}
+
 func NewChain(name string) *Chain {
 	return &Chain{
 		name: name,
@@ -0,0 +1,21 @@
+package iptables
+
+import (
+	"github.com/kumahq/kuma-net/iptables/builder"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+func Cleanup(cfg config.Config) (string, error) {
+	if cfg.DryRun {
+		output, err := builder.BuildIPTablesCleanupDryRun(cfg)
+		if err != nil {
+			return "", err
+		}
+
+		_, _ = cfg.RuntimeStdout.Write([]byte(output))
+
+		return output, nil
+	}
+
+	return builder.CleanupIPTables(cfg)
+}
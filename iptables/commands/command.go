@@ -41,6 +41,26 @@ func (c *Command) Build(verbose bool) string {
 	return strings.Join(cmd, " ")
 }
 
+// Position returns the position of the inserted rule, or 0 if the rule
+// is appended
+func (c *Command) Position() int {
+	return c.position
+}
+
+// BuildRule will generate the rule specification only (without the command
+// and the chain name)
+func (c *Command) BuildRule(verbose bool) string {
+	var rule []string
+
+	for _, parameter := range c.parameters {
+		if parameter != nil {
+			rule = append(rule, parameter.Build(verbose))
+		}
+	}
+
+	return strings.Join(rule, " ")
+}
+
 func Append(chainName string, parameters []*parameters.Parameter) *Command {
 	return &Command{
 		long:       "--append",
@@ -60,3 +80,34 @@ func Insert(chainName string, position int, parameters []*parameters.Parameter)
 		parameters: parameters,
 	}
 }
+
+// Deletion returns the command which removes the rule created by c
+// (the position of inserted rules is irrelevant for the deletion)
+func (c *Command) Deletion() *Command {
+	return Delete(c.chainName, c.parameters)
+}
+
+func Delete(chainName string, parameters []*parameters.Parameter) *Command {
+	return &Command{
+		long:       "--delete",
+		short:      "-D",
+		chainName:  chainName,
+		parameters: parameters,
+	}
+}
+
+func Flush(chainName string) *Command {
+	return &Command{
+		long:      "--flush",
+		short:     "-F",
+		chainName: chainName,
+	}
+}
+
+func DeleteChain(chainName string) *Command {
+	return &Command{
+		long:      "--delete-chain",
+		short:     "-X",
+		chainName: chainName,
+	}
+}
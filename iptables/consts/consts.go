@@ -19,6 +19,9 @@ const (
 	PreroutingLogPrefix                     = "PREROUTING:"
 	UDP                                     = "udp"
 	TCP                                     = "tcp"
+	// SystemdResolvedStub is the address of the local DNS stub listener of
+	// systemd-resolved
+	SystemdResolvedStub = "127.0.0.53"
 )
 
 var Flags = map[string]map[bool]string{
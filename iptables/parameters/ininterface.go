@@ -19,10 +19,19 @@ func (p *InInterfaceParameter) Negate() ParameterBuilder {
 //
 // ref. iptables(8) > PARAMETERS
 func InInterface(name string) *Parameter {
+	return inInterface(name, false)
+}
+
+func NotInInterface(name string) *Parameter {
+	return inInterface(name, true)
+}
+
+func inInterface(name string, negative bool) *Parameter {
 	return &Parameter{
 		long:       "--in-interface",
 		short:      "-i",
 		parameters: []ParameterBuilder{&InInterfaceParameter{name: name}},
 		negate:     negateSelf,
+		negative:   negative,
 	}
 }
@@ -45,11 +45,25 @@ func Drop() *JumpParameter {
 	return &JumpParameter{parameters: []string{"DROP"}}
 }
 
+func Accept() *JumpParameter {
+	return &JumpParameter{parameters: []string{"ACCEPT"}}
+}
+
+// Reject will reject the packet responding with the provided error packet
+// i.e. Reject("tcp-reset") or Reject("icmp-port-unreachable")
+func Reject(with string) *JumpParameter {
+	return &JumpParameter{parameters: []string{
+		"REJECT",
+		"--reject-with",
+		with,
+	}}
+}
+
 func Log(prefix string, level uint16) *JumpParameter {
 	return &JumpParameter{
 		parameters: []string{
 			"LOG",
-			"--log-prefix", prefix,
+			"--log-prefix", Quote(prefix),
 			"--log-level", strconv.Itoa(int(level)),
 		},
 	}
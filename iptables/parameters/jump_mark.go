@@ -0,0 +1,52 @@
+package parameters
+
+// MARK
+//       This target is used to set the Netfilter mark value associated with
+//       the packet.
+//
+//       --set-xmark value[/mask]
+//              Zeroes out the bits given by mask and XORs value into the packet
+//              mark.
+//
+// CONNMARK
+//       This module sets the netfilter mark value associated with a connection.
+//
+//       --save-mark [--nfmask nfmask] [--ctmask ctmask]
+//              Copy the packet mark (nfmark) to the connection mark (ctmark).
+//
+//       --restore-mark [--nfmask nfmask] [--ctmask ctmask]
+//              Copy the connection mark (ctmark) to the packet mark (nfmark).
+//
+// Targets are built in the same form as iptables-save prints them, so the
+// installed rules can be compared with the desired ones
+//
+// ref. iptables-extensions(8) > MARK, CONNMARK
+
+// SetMark expects the mark in the format value/mask i.e. "0x539/0xffffffff"
+func SetMark(mark string) *JumpParameter {
+	return &JumpParameter{parameters: []string{
+		"MARK",
+		"--set-xmark",
+		mark,
+	}}
+}
+
+// SaveMark copies the packet mark to the connection mark
+func SaveMark() *JumpParameter {
+	return &JumpParameter{parameters: []string{
+		"CONNMARK",
+		"--save-mark",
+		"--nfmask", "0xffffffff",
+		"--ctmask", "0xffffffff",
+	}}
+}
+
+// RestoreMark copies the connection mark to the packet mark
+func RestoreMark() *JumpParameter {
+	return &JumpParameter{parameters: []string{
+		"CONNMARK",
+		"--restore-mark",
+		"--nfmask", "0xffffffff",
+		"--ctmask", "0xffffffff",
+	}}
+}
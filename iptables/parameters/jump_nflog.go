@@ -0,0 +1,46 @@
+package parameters
+
+// NFLOG
+//       This target provides logging of matching packets. When this target
+//       is set for a rule, the Linux kernel will pass the packet to the loaded
+//       logging backend to log the packet. This is usually used in combination
+//       with nfnetlink_log as logging backend, which will multicast the packet
+//       through a netlink socket to the specified multicast group. One or more
+//       userspace processes may subscribe to the group to receive the packets.
+//       Like LOG, this is a non-terminating target, i.e. rule traversal
+//       continues at the next rule.
+//
+//       --nflog-group nlgroup
+//              The netlink group (0 - 2^16-1) to which packets are (only
+//              applicable for nfnetlink_log). The default value is 0.
+//
+//       --nflog-prefix prefix
+//              A prefix string to include in the log message, up to 64
+//              characters long, useful for distinguishing messages in the logs.
+//
+// Target is built in the same form as iptables-save prints it (the prefix
+// first, and the group only when it's not the default one)
+//
+// ref. iptables-extensions(8) > NFLOG
+
+import (
+	"strconv"
+)
+
+// NflogPrefixMaxLength is the maximal length of the NFLOG prefix
+const NflogPrefixMaxLength = 64
+
+// Nflog sends the packet to the provided netlink group with the prefix
+func Nflog(group uint16, prefix string) *JumpParameter {
+	parameters := []string{"NFLOG"}
+
+	if prefix != "" {
+		parameters = append(parameters, "--nflog-prefix", Quote(prefix))
+	}
+
+	if group != 0 {
+		parameters = append(parameters, "--nflog-group", strconv.Itoa(int(group)))
+	}
+
+	return &JumpParameter{parameters: parameters}
+}
@@ -0,0 +1,27 @@
+package parameters_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+)
+
+var _ = Describe("Nflog", func() {
+	DescribeTable("should build the NFLOG target",
+		func(group uint16, prefix string, want string) {
+			// when
+			got := Jump(Nflog(group, prefix)).Build(false)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("with group and prefix", uint16(5), "captured",
+			"-j NFLOG --nflog-prefix captured --nflog-group 5",
+		),
+		Entry("default group", uint16(0), "dns", "-j NFLOG --nflog-prefix dns"),
+		Entry("prefix with whitespaces", uint16(1), "excluded port",
+			`-j NFLOG --nflog-prefix "excluded port" --nflog-group 1`,
+		),
+	)
+})
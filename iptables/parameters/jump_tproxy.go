@@ -0,0 +1,68 @@
+package parameters
+
+// TPROXY
+//       This target is only valid in the mangle table, in the PREROUTING chain
+//       and user-defined chains which are only called from this chain. It
+//       redirects the packet to a local socket without changing the packet
+//       header in any way. It can also change the mark value which can then be
+//       used in advanced routing rules.
+//
+//       --on-port port
+//              This specifies a destination port to use.
+//
+//       --on-ip address
+//              This specifies a destination address to use. By default the
+//              address is the IP address of the incoming interface.
+//
+//       --tproxy-mark value[/mask]
+//              Marks packets with the given value/mask. The fwmark value set here
+//              can be used by advanced routing.
+//
+// ref. iptables-extensions(8) > TPROXY
+
+import (
+	"strconv"
+)
+
+type TProxyParameter struct {
+	name  string
+	value string
+}
+
+func (p *TProxyParameter) Build() []string {
+	return []string{p.name, p.value}
+}
+
+func TProxy(tproxyParameters ...*TProxyParameter) *JumpParameter {
+	parameters := []string{"TPROXY"}
+
+	for _, parameter := range tproxyParameters {
+		parameters = append(parameters, parameter.Build()...)
+	}
+
+	return &JumpParameter{
+		parameters: parameters,
+	}
+}
+
+func OnPort(port uint16) *TProxyParameter {
+	return &TProxyParameter{
+		name:  "--on-port",
+		value: strconv.Itoa(int(port)),
+	}
+}
+
+func OnIP(address string) *TProxyParameter {
+	return &TProxyParameter{
+		name:  "--on-ip",
+		value: address,
+	}
+}
+
+// TProxyMark expects the mark in the format value[/mask] i.e. "0x539/0xffffffff"
+func TProxyMark(mark string) *TProxyParameter {
+	return &TProxyParameter{
+		name:  "--tproxy-mark",
+		value: mark,
+	}
+}
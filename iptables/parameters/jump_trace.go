@@ -0,0 +1,18 @@
+package parameters
+
+// TRACE
+//       This target marks packets so that the kernel will log every rule
+//       which match the packets as those traverse the tables, chains, rules.
+//       It can only be used in the raw table.
+//
+//       With iptables-legacy, a logging backend, such as ip(6)t_LOG or
+//       nfnetlink_log, must be loaded for this to be visible. With
+//       iptables-nft, the target emits nf_trace events, which can be read
+//       over netlink (i.e. with "xtables-monitor --trace")
+//
+// ref. iptables-extensions(8) > TRACE
+
+// Trace marks the packet to be traced through all the chains it traverses
+func Trace() *JumpParameter {
+	return &JumpParameter{parameters: []string{"TRACE"}}
+}
@@ -0,0 +1,18 @@
+package parameters_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+)
+
+var _ = Describe("Trace", func() {
+	It("should build the TRACE target", func() {
+		// when
+		got := Jump(Trace()).Build(false)
+
+		// then
+		Expect(got).To(Equal("-j TRACE"))
+	})
+})
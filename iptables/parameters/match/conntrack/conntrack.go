@@ -26,3 +26,14 @@ const (
 	// from the reply source.
 	DNAT State = "DNAT"
 )
+
+type Direction string
+
+const (
+	// ORIGINAL direction means the packet travels in the same direction as
+	// the first packet of the connection
+	ORIGINAL Direction = "ORIGINAL"
+	// REPLY direction means the packet travels in the opposite direction
+	// to the first packet of the connection
+	REPLY Direction = "REPLY"
+)
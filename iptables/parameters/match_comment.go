@@ -0,0 +1,43 @@
+package parameters
+
+// Comment
+//       Allows you to add comments (up to 256 characters) to any rule.
+//
+//       --comment comment
+//
+//       Example:
+//              iptables -A INPUT -i eth1 -m comment --comment "my local LAN"
+//
+// ref. iptables-extensions(8) > comment
+
+import (
+	"fmt"
+)
+
+// CommentMaxLength is the maximal length of the comment accepted by iptables
+const CommentMaxLength = 256
+
+type CommentParameter struct {
+	value string
+}
+
+func (p *CommentParameter) Negate() ParameterBuilder {
+	return p
+}
+
+func (p *CommentParameter) Build(bool) string {
+	return fmt.Sprintf("--comment %s", Quote(p.value))
+}
+
+// Value returns the comment
+func (p *CommentParameter) Value() string {
+	return p.value
+}
+
+// Comment adds the comment to the rule
+func Comment(comment string) *MatchParameter {
+	return &MatchParameter{
+		name:       "comment",
+		parameters: []ParameterBuilder{&CommentParameter{value: comment}},
+	}
+}
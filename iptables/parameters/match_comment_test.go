@@ -0,0 +1,28 @@
+package parameters_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+)
+
+var _ = Describe("CommentParameter", func() {
+	DescribeTable("should build valid comment match",
+		func(comment string, want string) {
+			// when
+			got := Match(Comment(comment)).Build(false)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("comment without whitespaces",
+			"kuma-net:dev:KUMA_:exclude-outbound-port",
+			"-m comment --comment kuma-net:dev:KUMA_:exclude-outbound-port",
+		),
+		Entry("comment with whitespaces",
+			"my local LAN",
+			`-m comment --comment "my local LAN"`,
+		),
+	)
+})
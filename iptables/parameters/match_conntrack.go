@@ -15,6 +15,11 @@ import (
 //              statelist is a comma separated list of the connection states to match.
 //              Possible states are listed in ./parameters/match/conntrack
 //
+//       --ctdir {ORIGINAL|REPLY}
+//              Match packets that are flowing in the specified direction.
+//              If this flag is not specified at all, matches packets in both
+//              directions.
+//
 // ref. iptables-extensions(8) > conntrack
 
 type ConntrackParameter struct {
@@ -55,6 +60,15 @@ func Ctstate(state conntrack.State, states ...conntrack.State) *ConntrackParamet
 	}
 }
 
+// Ctdir matches packets which are flowing in the specified direction
+func Ctdir(direction conntrack.Direction) *ConntrackParameter {
+	return &ConntrackParameter{
+		flag:     "--ctdir",
+		values:   []string{string(direction)},
+		negative: false,
+	}
+}
+
 // Conntrack when combined with connection tracking, allows access to the connection tracking state for this packet/connection.
 func Conntrack(conntrackParameters ...*ConntrackParameter) *MatchParameter {
 	var parameters []ParameterBuilder
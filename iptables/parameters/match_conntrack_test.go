@@ -204,6 +204,10 @@ var _ = Describe("ConntrackParameter", func() {
 				)}, true,
 				"conntrack --ctstate INVALID,NEW,ESTABLISHED,RELATED,UNTRACKED,SNAT,DNAT",
 			),
+			Entry("1 parameter (Ctdir)",
+				[]*ConntrackParameter{Ctdir(REPLY)}, false,
+				"conntrack --ctdir REPLY",
+			),
 		)
 	})
 })
@@ -0,0 +1,61 @@
+package parameters
+
+// Limit
+//       This module matches at a limited rate using a token bucket filter.
+//       A rule using this extension will match until this limit is reached.
+//
+//       --limit rate[/second|/minute|/hour|/day]
+//              Maximum average matching rate: specified as a number, with an
+//              optional `/second', `/minute', `/hour', or `/day' suffix;
+//              the default is 3/hour.
+//
+//       --limit-burst number
+//              Maximum initial number of packets to match: this number gets
+//              recharged by one every time the limit specified above is not
+//              reached, up to this number; the default is 5.
+//
+// The rate is built in the same form as iptables-save prints it (i.e.
+// "10/second" is printed as "10/sec" and "60/minute" as "1/sec"), so
+// the installed rules can be compared with the desired ones
+//
+// ref. iptables-extensions(8) > limit
+
+import (
+	"fmt"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// LimitDefaultBurst is the burst used by iptables when it's not specified
+const LimitDefaultBurst uint16 = 5
+
+type LimitParameter struct {
+	rate  string
+	burst uint16
+}
+
+func (p *LimitParameter) Negate() ParameterBuilder {
+	return p
+}
+
+func (p *LimitParameter) Build(bool) string {
+	rate := p.rate
+	if period, err := config.ParseLimitRate(p.rate); err == nil {
+		rate = config.FormatLimitRate(period)
+	}
+
+	if p.burst == 0 || p.burst == LimitDefaultBurst {
+		return fmt.Sprintf("--limit %s", rate)
+	}
+
+	return fmt.Sprintf("--limit %s --limit-burst %d", rate, p.burst)
+}
+
+// Limit matches packets at the limited rate (i.e. "10/second"), allowing
+// the provided burst
+func Limit(rate string, burst uint16) *MatchParameter {
+	return &MatchParameter{
+		name:       "limit",
+		parameters: []ParameterBuilder{&LimitParameter{rate: rate, burst: burst}},
+	}
+}
@@ -0,0 +1,26 @@
+package parameters_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+)
+
+var _ = Describe("LimitParameter", func() {
+	DescribeTable("should build the rate the same way iptables-save prints it",
+		func(rate string, burst uint16, want string) {
+			// when
+			got := Match(Limit(rate, burst)).Build(false)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("per second", "10/second", uint16(0), "-m limit --limit 10/sec"),
+		Entry("abbreviated unit", "10/s", uint16(5), "-m limit --limit 10/sec"),
+		Entry("per minute", "600/minute", uint16(0), "-m limit --limit 10/sec"),
+		Entry("not divisible per minute", "7/minute", uint16(0), "-m limit --limit 7/min"),
+		Entry("per hour", "3/hour", uint16(0), "-m limit --limit 3/hour"),
+		Entry("per day", "1/day", uint16(20), "-m limit --limit 1/day --limit-burst 20"),
+	)
+})
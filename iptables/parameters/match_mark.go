@@ -0,0 +1,110 @@
+package parameters
+
+// Mark
+//       This module matches the netfilter mark field associated with a packet
+//       (which can be set using the MARK target).
+//
+//       [!] --mark value[/mask]
+//              Matches packets with the given unsigned mark value (if a mask
+//              is specified, this is logically ANDed with the mask before the
+//              comparison).
+//
+// ref. iptables-extensions(8) > mark
+//
+// Connmark
+//       This module matches the netfilter mark field associated with
+//       a connection (which can be set using the CONNMARK target).
+//
+//       [!] --mark value[/mask]
+//              Matches packets in connections with the given mark value.
+//
+// ref. iptables-extensions(8) > connmark
+//
+// Socket
+//       This matches if an open TCP/UDP socket can be found by doing a socket
+//       lookup on the packet.
+//
+//       --transparent
+//              Ignore non-transparent sockets.
+//
+// ref. iptables-extensions(8) > socket
+
+import (
+	"fmt"
+)
+
+type MarkParameter struct {
+	value    string
+	negative bool
+}
+
+func (p *MarkParameter) Negate() ParameterBuilder {
+	p.negative = !p.negative
+
+	return p
+}
+
+func (p *MarkParameter) Build(bool) string {
+	if p.negative {
+		return fmt.Sprintf("! --mark %s", p.value)
+	}
+
+	return fmt.Sprintf("--mark %s", p.value)
+}
+
+// Mark matches packets with the given mark in the format value[/mask]
+func Mark(mark string) *MatchParameter {
+	return &MatchParameter{
+		name:       "mark",
+		parameters: []ParameterBuilder{&MarkParameter{value: mark}},
+	}
+}
+
+// NotMark matches packets without the given mark in the format value[/mask]
+func NotMark(mark string) *MatchParameter {
+	return &MatchParameter{
+		name:       "mark",
+		parameters: []ParameterBuilder{&MarkParameter{value: mark, negative: true}},
+	}
+}
+
+// Connmark matches packets in connections with the given mark in the format
+// value[/mask]
+func Connmark(mark string) *MatchParameter {
+	return &MatchParameter{
+		name:       "connmark",
+		parameters: []ParameterBuilder{&MarkParameter{value: mark}},
+	}
+}
+
+type SocketParameter struct {
+	flag string
+}
+
+func (p *SocketParameter) Negate() ParameterBuilder {
+	return p
+}
+
+func (p *SocketParameter) Build(bool) string {
+	return p.flag
+}
+
+// Transparent ignores non-transparent sockets
+func Transparent() *SocketParameter {
+	return &SocketParameter{flag: "--transparent"}
+}
+
+// Socket matches if an open TCP/UDP socket can be found by doing a socket
+// lookup on the packet
+func Socket(socketParameters ...*SocketParameter) *MatchParameter {
+	var parameters []ParameterBuilder
+
+	for _, parameter := range socketParameters {
+		parameters = append(parameters, parameter)
+	}
+
+	return &MatchParameter{
+		name:       "socket",
+		parameters: parameters,
+	}
+}
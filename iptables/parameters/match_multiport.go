@@ -0,0 +1,136 @@
+package parameters
+
+// Multiport
+//       This module matches a set of source or destination ports. Up to 15 ports
+//       can be specified. A port range (port:port) counts as two ports. It can only
+//       be used in conjunction with one of the following protocols: tcp, udp,
+//       udplite, dccp and sctp.
+//
+//       [!] --source-ports,--sports port[,port|,port:port]...
+//              Match if the source port is one of the given ports.
+//
+//       [!] --destination-ports,--dports port[,port|,port:port]...
+//              Match if the destination port is one of the given ports.
+//
+// ref. iptables-extensions(8) > multiport
+
+import (
+	"fmt"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// MultiportMaxPorts is the maximum number of ports which can be provided to
+// a single multiport match (a range counts as two ports)
+const MultiportMaxPorts = 15
+
+type MultiportParameter struct {
+	long     string
+	short    string
+	value    config.ValueOrRangeList
+	negative bool
+}
+
+func (p *MultiportParameter) Negate() ParameterBuilder {
+	p.negative = !p.negative
+
+	return p
+}
+
+func (p *MultiportParameter) Build(verbose bool) string {
+	flag := p.short
+
+	if verbose {
+		flag = p.long
+	}
+
+	if p.negative {
+		return fmt.Sprintf("! %s %s", flag, p.value)
+	}
+
+	return fmt.Sprintf("%s %s", flag, p.value)
+}
+
+// DestinationPorts matches if the destination port is one of the given ports
+func DestinationPorts(ports config.ValueOrRangeList) *MultiportParameter {
+	return &MultiportParameter{
+		long:  "--destination-ports",
+		short: "--dports",
+		value: ports,
+	}
+}
+
+// NotDestinationPorts matches if the destination port is none of the given ports
+func NotDestinationPorts(ports config.ValueOrRangeList) *MultiportParameter {
+	return &MultiportParameter{
+		long:     "--destination-ports",
+		short:    "--dports",
+		value:    ports,
+		negative: true,
+	}
+}
+
+// SourcePorts matches if the source port is one of the given ports
+func SourcePorts(ports config.ValueOrRangeList) *MultiportParameter {
+	return &MultiportParameter{
+		long:  "--source-ports",
+		short: "--sports",
+		value: ports,
+	}
+}
+
+// NotSourcePorts matches if the source port is none of the given ports
+func NotSourcePorts(ports config.ValueOrRangeList) *MultiportParameter {
+	return &MultiportParameter{
+		long:     "--source-ports",
+		short:    "--sports",
+		value:    ports,
+		negative: true,
+	}
+}
+
+// Multiport matches a set of source or destination ports. It can be used only
+// together with the tcp or udp protocol
+func Multiport(multiportParameters ...*MultiportParameter) *MatchParameter {
+	var parameters []ParameterBuilder
+
+	for _, parameter := range multiportParameters {
+		parameters = append(parameters, parameter)
+	}
+
+	return &MatchParameter{
+		name:       "multiport",
+		parameters: parameters,
+	}
+}
+
+// SplitMultiportPorts splits the provided ports and port ranges into groups
+// which are small enough to be used by a single multiport match, keeping
+// their order
+func SplitMultiportPorts(ranges []config.Range) [][]config.Range {
+	var result [][]config.Range
+	var current []config.Range
+	size := 0
+
+	for _, r := range ranges {
+		weight := 1
+		if r.From != r.To {
+			weight = 2
+		}
+
+		if size+weight > MultiportMaxPorts {
+			result = append(result, current)
+			current = nil
+			size = 0
+		}
+
+		current = append(current, r)
+		size += weight
+	}
+
+	if len(current) > 0 {
+		result = append(result, current)
+	}
+
+	return result
+}
@@ -0,0 +1,78 @@
+package parameters_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("MultiportParameter", func() {
+	DescribeTable("should build valid multiport parameter",
+		func(parameter *MultiportParameter, verbose bool, want string) {
+			// when
+			got := parameter.Build(verbose)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("destination ports",
+			DestinationPorts("22,80,1000:2000"), false,
+			"--dports 22,80,1000:2000",
+		),
+		Entry("destination ports - verbose",
+			DestinationPorts("22,80"), true,
+			"--destination-ports 22,80",
+		),
+		Entry("negated destination ports",
+			NotDestinationPorts("22,80"), false,
+			"! --dports 22,80",
+		),
+		Entry("source ports",
+			SourcePorts("53,5353"), false,
+			"--sports 53,5353",
+		),
+		Entry("negated source ports - verbose",
+			NotSourcePorts("53,5353"), true,
+			"! --source-ports 53,5353",
+		),
+	)
+
+	It("should negate multiport match", func() {
+		// when
+		got := Match(Multiport(DestinationPorts("22,80"))).Negate().Build(false)
+
+		// then
+		Expect(got).To(Equal("-m multiport ! --dports 22,80"))
+	})
+
+	DescribeTable("should split ports into groups accepted by a single multiport match",
+		func(ports config.ValueOrRangeList, want []config.ValueOrRangeList) {
+			// given
+			ranges, err := ports.Parse()
+			Expect(err).ToNot(HaveOccurred())
+
+			// when
+			var got []config.ValueOrRangeList
+			for _, group := range SplitMultiportPorts(ranges) {
+				got = append(got, config.NewValueOrRangeList(group...))
+			}
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("ports which fit into a single match",
+			config.ValueOrRangeList("22,80,443"),
+			[]config.ValueOrRangeList{"22,80,443"},
+		),
+		Entry("more than 15 ports",
+			config.ValueOrRangeList("1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16"),
+			[]config.ValueOrRangeList{"1,2,3,4,5,6,7,8,9,10,11,12,13,14,15", "16"},
+		),
+		Entry("ranges counted as two ports",
+			config.ValueOrRangeList("1,2,3,4,5,6,7,8,9,10,11,12,13,14,1000:2000"),
+			[]config.ValueOrRangeList{"1,2,3,4,5,6,7,8,9,10,11,12,13,14", "1000:2000"},
+		),
+	)
+})
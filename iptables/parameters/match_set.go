@@ -0,0 +1,89 @@
+package parameters
+
+// Set
+//       This module matches IP sets which can be defined by ipset(8).
+//
+//       [!] --match-set setname flag[,flag]...
+//              where flags are the comma separated list of src and/or dst
+//              specifications and there can be no more than six of them.
+//              Hence the command
+//
+//                     iptables -A FORWARD -m set --match-set test src,dst
+//
+//              will match packets, for which (if the set type is ipportmap)
+//              the source address and destination port pair can be found
+//              in the specified set.
+//
+// ref. iptables-extensions(8) > set
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetFlag specifies which address or port of the packet is looked up
+// in the set
+type SetFlag string
+
+const (
+	SetFlagSrc SetFlag = "src"
+	SetFlagDst SetFlag = "dst"
+)
+
+type SetParameter struct {
+	name     string
+	flags    []SetFlag
+	negative bool
+}
+
+func (p *SetParameter) Negate() ParameterBuilder {
+	p.negative = !p.negative
+
+	return p
+}
+
+func (p *SetParameter) Build(bool) string {
+	var flags []string
+	for _, flag := range p.flags {
+		flags = append(flags, string(flag))
+	}
+
+	if p.negative {
+		return fmt.Sprintf("! --match-set %s %s", p.name, strings.Join(flags, ","))
+	}
+
+	return fmt.Sprintf("--match-set %s %s", p.name, strings.Join(flags, ","))
+}
+
+// MatchSet matches packets which address or port specified by the flag
+// (and the following ones) can be found in the set
+func MatchSet(name string, flag SetFlag, flags ...SetFlag) *SetParameter {
+	return &SetParameter{
+		name:  name,
+		flags: append([]SetFlag{flag}, flags...),
+	}
+}
+
+// NotMatchSet matches packets which address or port specified by the flag
+// (and the following ones) cannot be found in the set
+func NotMatchSet(name string, flag SetFlag, flags ...SetFlag) *SetParameter {
+	return &SetParameter{
+		name:     name,
+		flags:    append([]SetFlag{flag}, flags...),
+		negative: true,
+	}
+}
+
+// Set matches IP sets which can be defined by ipset(8)
+func Set(setParameters ...*SetParameter) *MatchParameter {
+	var parameters []ParameterBuilder
+
+	for _, parameter := range setParameters {
+		parameters = append(parameters, parameter)
+	}
+
+	return &MatchParameter{
+		name:       "set",
+		parameters: parameters,
+	}
+}
@@ -0,0 +1,28 @@
+package parameters_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+)
+
+var _ = Describe("SetParameter", func() {
+	DescribeTable("should build valid set match",
+		func(parameter *MatchParameter, want string) {
+			// when
+			got := Match(parameter).Build(false)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("destination address",
+			Set(MatchSet("MESH_OUT_EXCLUDE_NET", SetFlagDst)),
+			"-m set --match-set MESH_OUT_EXCLUDE_NET dst",
+		),
+		Entry("negated source address and destination port",
+			Set(NotMatchSet("ALLOWED", SetFlagSrc, SetFlagDst)),
+			"-m set ! --match-set ALLOWED src,dst",
+		),
+	)
+})
@@ -0,0 +1,83 @@
+package parameters
+
+import (
+	"strings"
+)
+
+// OpaqueParameter holds arguments which are not modelled by any typed
+// parameter (i.e. unknown matches or targets found when parsing iptables-save
+// output), so they can be built back without any loss
+type OpaqueParameter struct {
+	args []string
+}
+
+func (p *OpaqueParameter) Build(bool) string {
+	var result []string
+
+	for _, arg := range p.args {
+		result = append(result, Quote(arg))
+	}
+
+	return strings.Join(result, " ")
+}
+
+func (p *OpaqueParameter) Negate() ParameterBuilder {
+	return p
+}
+
+// Quote will wrap provided argument in double quotes if it's necessary
+// for iptables-restore to read it as a single argument
+func Quote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"\\'") {
+		return arg
+	}
+
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+
+	return `"` + arg + `"`
+}
+
+// Opaque will generate the flag with provided arguments as they are
+// i.e. Opaque("-f") or Opaque("--fragment")
+func Opaque(flag string, args ...string) *Parameter {
+	var parameters []ParameterBuilder
+
+	if len(args) > 0 {
+		parameters = append(parameters, &OpaqueParameter{args: args})
+	}
+
+	return &Parameter{
+		long:       flag,
+		short:      flag,
+		parameters: parameters,
+		negate:     negateSelf,
+	}
+}
+
+// OpaqueMatch will generate the match with the provided name and arguments
+// as they are i.e. OpaqueMatch("comment", "--comment", "kuma")
+func OpaqueMatch(name string, args ...string) *MatchParameter {
+	var parameters []ParameterBuilder
+
+	if len(args) > 0 {
+		parameters = append(parameters, &OpaqueParameter{args: args})
+	}
+
+	return &MatchParameter{
+		name:       name,
+		parameters: parameters,
+	}
+}
+
+// Target will generate the jump target with provided name and arguments
+// as they are i.e. Target("MARK", "--set-xmark", "0x1/0xffffffff")
+func Target(name string, args ...string) *JumpParameter {
+	parameters := []string{name}
+
+	for _, arg := range args {
+		parameters = append(parameters, Quote(arg))
+	}
+
+	return &JumpParameter{parameters: parameters}
+}
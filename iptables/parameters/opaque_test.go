@@ -0,0 +1,50 @@
+package parameters_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+)
+
+var _ = Describe("OpaqueParameter", func() {
+	DescribeTable("Quote",
+		func(arg string, want string) {
+			// when
+			got := Quote(arg)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("simple argument", "RETURN", "RETURN"),
+		Entry("empty argument", "", `""`),
+		Entry("argument with spaces", "a b", `"a b"`),
+		Entry("argument with quotes and backslashes", `a "b" \c`, `"a \"b\" \\c"`),
+	)
+
+	DescribeTable("Opaque",
+		func(parameter *Parameter, verbose bool, want string) {
+			// when
+			got := parameter.Build(verbose)
+
+			// then
+			Expect(got).To(Equal(want))
+		},
+		Entry("flag without arguments",
+			Opaque("-f"), false,
+			"-f",
+		),
+		Entry("negated flag with arguments",
+			Opaque("-p", "icmp").Negate(), true,
+			"! -p icmp",
+		),
+		Entry("match",
+			Match(OpaqueMatch("comment", "--comment", "kuma rule")), false,
+			`-m comment --comment "kuma rule"`,
+		),
+		Entry("target",
+			Jump(Target("MARK", "--set-xmark", "0x1/0xffffffff")), true,
+			"--jump MARK --set-xmark 0x1/0xffffffff",
+		),
+	)
+})
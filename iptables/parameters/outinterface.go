@@ -19,10 +19,19 @@ func (p *OutInterfaceParameter) Negate() ParameterBuilder {
 //
 // ref. iptables(8) > PARAMETERS
 func OutInterface(name string) *Parameter {
+	return outInterface(name, false)
+}
+
+func NotOutInterface(name string) *Parameter {
+	return outInterface(name, true)
+}
+
+func outInterface(name string, negative bool) *Parameter {
 	return &Parameter{
 		long:       "--out-interface",
 		short:      "-o",
 		parameters: []ParameterBuilder{&OutInterfaceParameter{name: name}},
 		negate:     negateSelf,
+		negative:   negative,
 	}
 }
@@ -1,6 +1,7 @@
 package parameters
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -101,6 +102,24 @@ func NotDestinationPortIf(predicate func() bool, port uint16) *TcpUdpParameter {
 	return nil
 }
 
+// DestinationPortRange matches destination ports from the provided range
+// (inclusive). If from and to are equal it's the same as DestinationPort
+func DestinationPortRange(from, to uint16) *TcpUdpParameter {
+	return &TcpUdpParameter{
+		long:  "--destination-port",
+		short: "--dport",
+		value: portRange(from, to),
+	}
+}
+
+func portRange(from, to uint16) string {
+	if from == to {
+		return strconv.Itoa(int(from))
+	}
+
+	return fmt.Sprintf("%d:%d", from, to)
+}
+
 func sourcePort(port uint16, negative bool) *TcpUdpParameter {
 	return &TcpUdpParameter{
 		long:     "--source-port",
@@ -114,6 +133,20 @@ func SourcePort(port uint16) *TcpUdpParameter {
 	return sourcePort(port, false)
 }
 
+func NotSourcePort(port uint16) *TcpUdpParameter {
+	return sourcePort(port, true)
+}
+
+// SourcePortRange matches source ports from the provided range (inclusive).
+// If from and to are equal it's the same as SourcePort
+func SourcePortRange(from, to uint16) *TcpUdpParameter {
+	return &TcpUdpParameter{
+		long:  "--source-port",
+		short: "--sport",
+		value: portRange(from, to),
+	}
+}
+
 func tcpUdp(proto string, params []*TcpUdpParameter) *ProtocolParameter {
 	var parameters []ParameterBuilder
 
@@ -69,6 +69,46 @@ var _ = Describe("ProtocolParameter", func() {
 			),
 		)
 
+		DescribeTable("DestinationPortRange",
+			func(from, to int, verbose bool, want string) {
+				// when
+				got := DestinationPortRange(uint16(from), uint16(to)).Build(verbose)
+
+				// then
+				Expect(got).To(Equal(want))
+			},
+			Entry("range 1000-2000",
+				1000, 2000, false,
+				"--dport 1000:2000",
+			),
+			Entry("range 1000-2000 - verbose",
+				1000, 2000, true,
+				"--destination-port 1000:2000",
+			),
+			Entry("single port range",
+				22, 22, false,
+				"--dport 22",
+			),
+		)
+
+		DescribeTable("SourcePortRange",
+			func(from, to int, verbose bool, want string) {
+				// when
+				got := SourcePortRange(uint16(from), uint16(to)).Build(verbose)
+
+				// then
+				Expect(got).To(Equal(want))
+			},
+			Entry("range 1000-2000",
+				1000, 2000, false,
+				"--sport 1000:2000",
+			),
+			Entry("range 1000-2000 - verbose",
+				1000, 2000, true,
+				"--source-port 1000:2000",
+			),
+		)
+
 		Describe("NotDestinationPortIf", func() {
 			DescribeTable("should return nil, when predicate returns false",
 				func(port int) {
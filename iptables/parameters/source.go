@@ -26,10 +26,19 @@ func Address(address string) *SourceParameter {
 //
 // ref. iptables(8) > PARAMETERS
 func Source(parameter *SourceParameter) *Parameter {
+	return source(parameter, false)
+}
+
+func NotSource(parameter *SourceParameter) *Parameter {
+	return source(parameter, true)
+}
+
+func source(parameter *SourceParameter, negative bool) *Parameter {
 	return &Parameter{
 		long:       "--source",
 		short:      "-s",
 		parameters: []ParameterBuilder{parameter},
 		negate:     negateSelf,
+		negative:   negative,
 	}
 }
@@ -0,0 +1,126 @@
+package parser
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// order in which iptables-save prints the generic parameters of the rule,
+// all matches are printed after them and the jump at the end
+var parameterOrder = map[string]int{
+	"-s": 0,
+	"-d": 1,
+	"-i": 2,
+	"-o": 3,
+	"-p": 4,
+	"-f": 5,
+	"-m": 6,
+	"-j": 7,
+}
+
+func parameterFlag(parameter string) string {
+	return strings.Fields(strings.TrimPrefix(parameter, "! "))[0]
+}
+
+// normalizeAddress converts the address (i.e. "-d 127.0.0.1" or
+// "-d 10.1.2.3/8") to the form in which iptables-save prints it after
+// the rule is installed ("-d 127.0.0.1/32", "-d 10.0.0.0/8")
+func normalizeAddress(parameter string) string {
+	fields := strings.Fields(parameter)
+	address := fields[len(fields)-1]
+
+	if !strings.Contains(address, "/") {
+		if strings.Contains(address, ":") {
+			address += "/128"
+		} else {
+			address += "/32"
+		}
+	}
+
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		address = network.String()
+	}
+
+	fields[len(fields)-1] = address
+
+	return strings.Join(fields, " ")
+}
+
+// Canonical returns the rule specification (without the command and the chain
+// name) in the form which doesn't depend on the order of its parameters and
+// on the way it was written, so the rule we would install can be compared
+// with the one read from the iptables-save output
+func Canonical(rule string) (string, error) {
+	args, err := tokenize(rule)
+	if err != nil {
+		return "", err
+	}
+
+	parameters, err := ParseRule(args)
+	if err != nil {
+		return "", err
+	}
+
+	var result []string
+
+	for _, parameter := range parameters {
+		built := parameter.Build(false)
+
+		switch parameterFlag(built) {
+		case "-s", "-d":
+			built = normalizeAddress(built)
+		}
+
+		result = append(result, built)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return position(result[i]) < position(result[j])
+	})
+
+	return strings.Join(result, " "), nil
+}
+
+func position(parameter string) int {
+	if order, ok := parameterOrder[parameterFlag(parameter)]; ok {
+		return order
+	}
+
+	return parameterOrder["-m"]
+}
+
+// JumpTarget returns the target of the rule (i.e. "MESH_OUTBOUND" for
+// "-p tcp -j MESH_OUTBOUND"), or an empty string if the rule has no target
+func JumpTarget(rule string) string {
+	args, err := tokenize(rule)
+	if err != nil {
+		return ""
+	}
+
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-j" || args[i] == "--jump" {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
+
+// CommentOf returns the comment of the rule (i.e. "kuma-net:dev::dns" for
+// "-p udp -m comment --comment kuma-net:dev::dns -j RETURN"), or an empty
+// string if the rule has no comment
+func CommentOf(rule string) string {
+	args, err := tokenize(rule)
+	if err != nil {
+		return ""
+	}
+
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "--comment" {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,68 @@
+package parser_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/iptables/parser"
+)
+
+var _ = Describe("Canonical", func() {
+	DescribeTable("should return the same rule for different forms of it",
+		func(built string, saved string) {
+			// when
+			a, err := parser.Canonical(built)
+			Expect(err).ToNot(HaveOccurred())
+			b, err := parser.Canonical(saved)
+			Expect(err).ToNot(HaveOccurred())
+
+			// then
+			Expect(a).To(Equal(b))
+		},
+		Entry("different order of parameters",
+			"-p tcp ! --dport 53 -o lo ! -d 127.0.0.1/32 -m owner --uid-owner 5678 -j RETURN",
+			"! -d 127.0.0.1/32 -o lo -p tcp -m tcp ! --dport 53 -m owner --uid-owner 5678 -j RETURN",
+		),
+		Entry("match before the protocol",
+			"-i docker -m udp -p udp --dport 53 -j REDIRECT --to-ports 15053",
+			"-i docker -p udp -m udp --dport 53 -j REDIRECT --to-ports 15053",
+		),
+		Entry("address without mask",
+			"-d 8.8.8.8 -j RETURN",
+			"-d 8.8.8.8/32 -j RETURN",
+		),
+		Entry("IPv6 network with host bits set",
+			"! -d ::6/24 -j RETURN",
+			"! -d ::/24 -j RETURN",
+		),
+		Entry("default log level",
+			"-j LOG --log-prefix OUTPUT: --log-level 4",
+			`-j LOG --log-prefix "OUTPUT:"`,
+		),
+		Entry("quoted comment",
+			"-p tcp -m comment --comment kuma-net:dev::capture-inbound -j MESH_INBOUND",
+			`-p tcp -m comment --comment "kuma-net:dev::capture-inbound" -j MESH_INBOUND`,
+		),
+	)
+
+	DescribeTable("JumpTarget",
+		func(rule string, want string) {
+			Expect(parser.JumpTarget(rule)).To(Equal(want))
+		},
+		Entry("user defined chain", "-p tcp -j MESH_OUTBOUND", "MESH_OUTBOUND"),
+		Entry("target with options", "-p tcp -j REDIRECT --to-ports 15001", "REDIRECT"),
+		Entry("no target", "-p tcp", ""),
+	)
+
+	DescribeTable("CommentOf",
+		func(rule string, want string) {
+			Expect(parser.CommentOf(rule)).To(Equal(want))
+		},
+		Entry("comment without whitespaces",
+			"-p udp -m comment --comment kuma-net:dev::dns -j RETURN",
+			"kuma-net:dev::dns",
+		),
+		Entry("quoted comment", `-m comment --comment "foo bar" -j RETURN`, "foo bar"),
+		Entry("no comment", "-p tcp -j MESH_OUTBOUND", ""),
+	)
+})
@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Counter holds packet and byte counters of a single rule read from
+// the "iptables-save --counters" output
+type Counter struct {
+	Table string
+	Chain string
+	// Rule is the rule specification (without the command and the chain name)
+	// as printed by iptables-save
+	Rule    string
+	Packets uint64
+	Bytes   uint64
+}
+
+// parseCounters parses the "[packets:bytes]" prefix of the rule and returns
+// the counters and the rest of the line
+func parseCounters(line string) (uint64, uint64, string, error) {
+	end := strings.Index(line, "]")
+	if !strings.HasPrefix(line, "[") || end < 0 {
+		return 0, 0, "", fmt.Errorf("missing counters: %s", line)
+	}
+
+	values := strings.SplitN(line[1:end], ":", 2)
+	if len(values) != 2 {
+		return 0, 0, "", fmt.Errorf("invalid counters: %s", line[:end+1])
+	}
+
+	packets, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid packets counter: %s", err)
+	}
+
+	bytes, err := strconv.ParseUint(values[1], 10, 64)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid bytes counter: %s", err)
+	}
+
+	return packets, bytes, strings.TrimSpace(line[end+1:]), nil
+}
+
+// ParseCounters reads counters of all the rules (from all the tables) from
+// the "iptables-save --counters" formatted input, in order in which rules
+// are printed
+func ParseCounters(r io.Reader) ([]Counter, error) {
+	var counters []Counter
+	scanner := bufio.NewScanner(r)
+	current := ""
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "*"):
+			current = strings.TrimSpace(line[1:])
+		case line == "COMMIT":
+			current = ""
+		case current == "":
+			return nil, fmt.Errorf("line %d: no table specified: %s", lineNumber, line)
+		default:
+			packets, bytes, rest, err := parseCounters(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+
+			fields := strings.SplitN(rest, " ", 3)
+			if len(fields) < 2 || (fields[0] != "-A" && fields[0] != "--append") {
+				return nil, fmt.Errorf("line %d: unsupported rule: %s", lineNumber, rest)
+			}
+
+			rule := ""
+			if len(fields) == 3 {
+				rule = fields[2]
+			}
+
+			counters = append(counters, Counter{
+				Table:   current,
+				Chain:   fields[1],
+				Rule:    rule,
+				Packets: packets,
+				Bytes:   bytes,
+			})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading iptables rules failed: %s", err)
+	}
+
+	return counters, nil
+}
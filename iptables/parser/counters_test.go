@@ -0,0 +1,80 @@
+package parser_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/iptables/parser"
+)
+
+var _ = Describe("ParseCounters", func() {
+	It("should read counters of the rules from all the tables", func() {
+		// given
+		input := `# Generated by iptables-save v1.8.7
+*raw
+:PREROUTING ACCEPT [10:600]
+:OUTPUT ACCEPT [10:600]
+[3:180] -A OUTPUT -p udp -m udp --dport 53 -j CT --zone 1
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:MESH_OUTBOUND - [0:0]
+[0:0] -A PREROUTING -p tcp -j MESH_INBOUND
+[1204:72240] -A MESH_OUTBOUND -p tcp -m tcp --dport 5432 -m comment --comment "kuma-net:dev::exclude-outbound-port" -j RETURN
+COMMIT
+`
+
+		// when
+		counters, err := parser.ParseCounters(strings.NewReader(input))
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(counters).To(Equal([]parser.Counter{
+			{
+				Table:   "raw",
+				Chain:   "OUTPUT",
+				Rule:    "-p udp -m udp --dport 53 -j CT --zone 1",
+				Packets: 3,
+				Bytes:   180,
+			},
+			{
+				Table:   "nat",
+				Chain:   "PREROUTING",
+				Rule:    "-p tcp -j MESH_INBOUND",
+				Packets: 0,
+				Bytes:   0,
+			},
+			{
+				Table:   "nat",
+				Chain:   "MESH_OUTBOUND",
+				Rule:    `-p tcp -m tcp --dport 5432 -m comment --comment "kuma-net:dev::exclude-outbound-port" -j RETURN`,
+				Packets: 1204,
+				Bytes:   72240,
+			},
+		}))
+	})
+
+	DescribeTable("should return error for invalid input",
+		func(input string, want string) {
+			// when
+			_, err := parser.ParseCounters(strings.NewReader(input))
+
+			// then
+			Expect(err).To(MatchError(want))
+		},
+		Entry("rule without counters",
+			"*nat\n-A OUTPUT -p tcp -j MESH_OUTBOUND\nCOMMIT\n",
+			"line 2: missing counters: -A OUTPUT -p tcp -j MESH_OUTBOUND",
+		),
+		Entry("invalid counters",
+			"*nat\n[a:1] -A OUTPUT -p tcp -j MESH_OUTBOUND\nCOMMIT\n",
+			`line 2: invalid packets counter: strconv.ParseUint: parsing "a": invalid syntax`,
+		),
+		Entry("rule outside of the table",
+			"[1:1] -A OUTPUT -p tcp -j MESH_OUTBOUND\n",
+			"line 1: no table specified: [1:1] -A OUTPUT -p tcp -j MESH_OUTBOUND",
+		),
+	)
+})
@@ -0,0 +1,233 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kumahq/kuma-net/iptables/chain"
+	"github.com/kumahq/kuma-net/iptables/table"
+)
+
+// Tables is the typed representation of the iptables-save output. Only
+// tables we are managing (raw, nat, mangle and filter) are parsed, other ones
+// are skipped
+type Tables struct {
+	Raw    *table.RawTable
+	Nat    *table.NatTable
+	Mangle *table.MangleTable
+	Filter *table.FilterTable
+
+	chains map[string]map[string]*chain.Chain
+	// built-in chains in order in which iptables-save prints them
+	builtin map[string][]string
+	// custom chains in order of their declaration
+	custom map[string][]string
+}
+
+func newTables() *Tables {
+	raw := table.Raw()
+	nat := table.Nat()
+	mangle := table.Mangle()
+	filter := table.Filter()
+
+	tables := &Tables{
+		Raw:     raw,
+		Nat:     nat,
+		Mangle:  mangle,
+		Filter:  filter,
+		chains:  map[string]map[string]*chain.Chain{},
+		builtin: map[string][]string{},
+		custom:  map[string][]string{},
+	}
+
+	tables.withBuiltin("raw", raw.Prerouting(), raw.Output())
+	tables.withBuiltin("nat",
+		nat.Prerouting(),
+		nat.Input(),
+		nat.Output(),
+		nat.Postrouting(),
+	)
+	tables.withBuiltin("mangle",
+		mangle.Prerouting(),
+		mangle.Input(),
+		mangle.Forward(),
+		mangle.Output(),
+		mangle.Postrouting(),
+	)
+	tables.withBuiltin("filter", filter.Input(), filter.Forward(), filter.Output())
+
+	return tables
+}
+
+func (t *Tables) withBuiltin(tableName string, chains ...*chain.Chain) {
+	t.chains[tableName] = map[string]*chain.Chain{}
+
+	for _, c := range chains {
+		t.chains[tableName][c.Name()] = c
+		t.builtin[tableName] = append(t.builtin[tableName], c.Name())
+	}
+}
+
+// Chain returns the chain (built-in or custom) from the provided table, or nil
+// if there is no such chain
+func (t *Tables) Chain(tableName, chainName string) *chain.Chain {
+	return t.chains[tableName][chainName]
+}
+
+// BuiltinChains returns names of the built-in chains of the provided table
+func (t *Tables) BuiltinChains(tableName string) []string {
+	return t.builtin[tableName]
+}
+
+// CustomChains returns names of the custom chains from the provided table
+// in order in which they were declared
+func (t *Tables) CustomChains(tableName string) []string {
+	return t.custom[tableName]
+}
+
+func (t *Tables) newChain(tableName, chainName string) {
+	if _, ok := t.chains[tableName][chainName]; ok {
+		return
+	}
+
+	c := chain.NewChain(chainName)
+
+	switch tableName {
+	case "raw":
+		t.Raw.WithChain(c)
+	case "nat":
+		t.Nat.WithChain(c)
+	case "mangle":
+		t.Mangle.WithChain(c)
+	case "filter":
+		t.Filter.WithChain(c)
+	}
+
+	t.chains[tableName][chainName] = c
+	t.custom[tableName] = append(t.custom[tableName], chainName)
+}
+
+// stripCounters removes the "[packets:bytes]" prefix which is present
+// when the output was generated with the "--counters" flag
+func stripCounters(line string) string {
+	if !strings.HasPrefix(line, "[") {
+		return line
+	}
+
+	if end := strings.Index(line, "]"); end >= 0 {
+		return strings.TrimSpace(line[end+1:])
+	}
+
+	return line
+}
+
+func (t *Tables) parseRule(tableName string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("missing chain name")
+	}
+
+	command := args[0]
+	chainName := args[1]
+	args = args[2:]
+
+	c := t.Chain(tableName, chainName)
+	if c == nil {
+		return fmt.Errorf("chain %s doesn't exist in table %s", chainName, tableName)
+	}
+
+	switch command {
+	case "-A", "--append":
+		parameters, err := ParseRule(args)
+		if err != nil {
+			return err
+		}
+
+		c.Append(parameters...)
+	case "-I", "--insert":
+		position := 1
+
+		if len(args) > 0 {
+			if value, err := strconv.Atoi(args[0]); err == nil {
+				position = value
+				args = args[1:]
+			}
+		}
+
+		parameters, err := ParseRule(args)
+		if err != nil {
+			return err
+		}
+
+		c.Insert(position, parameters...)
+	default:
+		return fmt.Errorf("unsupported command %s", command)
+	}
+
+	return nil
+}
+
+// Parse converts the iptables-save (or iptables-restore) formatted input
+// into the typed representation
+func Parse(r io.Reader) (*Tables, error) {
+	tables := newTables()
+	scanner := bufio.NewScanner(r)
+	current := ""
+	skip := false
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "*"):
+			current = strings.TrimSpace(line[1:])
+			_, known := tables.chains[current]
+			skip = !known
+		case line == "COMMIT":
+			current = ""
+			skip = false
+		case skip:
+			continue
+		case current == "":
+			return nil, fmt.Errorf("line %d: no table specified: %s", lineNumber, line)
+		case strings.HasPrefix(line, ":"):
+			// :CHAIN POLICY [packets:bytes], where POLICY is "-" for custom chains
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: invalid chain declaration: %s", lineNumber, line)
+			}
+
+			if fields[1] == "-" {
+				tables.newChain(current, fields[0])
+			}
+		default:
+			args, err := tokenize(stripCounters(line))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+
+			if len(args) == 2 && (args[0] == "-N" || args[0] == "--new-chain") {
+				tables.newChain(current, args[1])
+				continue
+			}
+
+			if err := tables.parseRule(current, args); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading iptables rules failed: %s", err)
+	}
+
+	return tables, nil
+}
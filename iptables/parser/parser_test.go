@@ -0,0 +1,168 @@
+package parser_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kumahq/kuma-net/iptables/parser"
+)
+
+var _ = Describe("Parse", func() {
+	It("should convert iptables-save output into the typed tables", func() {
+		// given
+		input := `# Generated by iptables-save v1.8.7
+*security
+:INPUT ACCEPT [0:0]
+-A INPUT -j ACCEPT
+COMMIT
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:MESH_EGRESS_LOCKDOWN - [0:0]
+-A OUTPUT -j MESH_EGRESS_LOCKDOWN
+-A MESH_EGRESS_LOCKDOWN -p tcp -j REJECT --reject-with tcp-reset
+COMMIT
+*raw
+:PREROUTING ACCEPT [10:600]
+:OUTPUT ACCEPT [10:600]
+-A PREROUTING -p udp -m udp --sport 53 -j CT --zone 1
+-A OUTPUT -p udp -m udp --dport 53 -m owner --uid-owner 5678 -j CT --zone 1
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:MESH_INBOUND - [0:0]
+:MESH_OUTBOUND - [0:0]
+[5:300] -A PREROUTING -p tcp -j MESH_INBOUND
+-A OUTPUT -p tcp -j MESH_OUTBOUND
+-A MESH_INBOUND -p tcp -m tcp --dport 22 -j RETURN
+-A MESH_INBOUND -p tcp -m tcp ! --dport 1000:2000 -j RETURN
+-A MESH_OUTBOUND ! -d 127.0.0.1/32 -o lo -m owner --uid-owner 5678 -j RETURN
+-A MESH_OUTBOUND -s 127.0.0.6/32 -o lo -j RETURN
+-A MESH_OUTBOUND -p tcp -j REDIRECT --to-ports 15001
+COMMIT
+`
+
+		// when
+		tables, err := parser.Parse(strings.NewReader(input))
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tables.CustomChains("nat")).To(Equal([]string{"MESH_INBOUND", "MESH_OUTBOUND"}))
+		Expect(tables.Chain("security", "INPUT")).To(BeNil())
+		Expect(tables.Filter.Build(false)).To(Equal(`* filter
+-N MESH_EGRESS_LOCKDOWN
+-A OUTPUT -j MESH_EGRESS_LOCKDOWN
+-A MESH_EGRESS_LOCKDOWN -p tcp -j REJECT --reject-with tcp-reset
+COMMIT`))
+		Expect(tables.Raw.Build(false)).To(Equal(`* raw
+-A PREROUTING -p udp --sport 53 -j CT --zone 1
+-A OUTPUT -p udp --dport 53 -m owner --uid-owner 5678 -j CT --zone 1
+COMMIT`))
+		Expect(tables.Nat.Build(false)).To(Equal(`* nat
+-N MESH_INBOUND
+-N MESH_OUTBOUND
+-A PREROUTING -p tcp -j MESH_INBOUND
+-A OUTPUT -p tcp -j MESH_OUTBOUND
+-A MESH_INBOUND -p tcp --dport 22 -j RETURN
+-A MESH_INBOUND -p tcp ! --dport 1000:2000 -j RETURN
+-A MESH_OUTBOUND ! -d 127.0.0.1/32 -o lo -m owner --uid-owner 5678 -j RETURN
+-A MESH_OUTBOUND -s 127.0.0.6/32 -o lo -j RETURN
+-A MESH_OUTBOUND -p tcp -j REDIRECT --to-ports 15001
+COMMIT`))
+		Expect(tables.Mangle.Build(false)).To(BeEmpty())
+	})
+
+	It("should parse iptables-restore formatted input with new chains", func() {
+		// given
+		input := `* nat
+-N MESH_OUTBOUND
+-A OUTPUT -p tcp -j MESH_OUTBOUND
+-I MESH_OUTBOUND 1 -p tcp -j RETURN
+COMMIT
+`
+
+		// when
+		tables, err := parser.Parse(strings.NewReader(input))
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tables.Nat.Build(false)).To(Equal(strings.TrimSpace(input)))
+	})
+
+	DescribeTable("should keep unknown matches and targets as they are",
+		func(rule string) {
+			// given
+			input := "*mangle\n-A OUTPUT " + rule + "\nCOMMIT\n"
+
+			// when
+			tables, err := parser.Parse(strings.NewReader(input))
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tables.Mangle.Build(false)).
+				To(Equal("* mangle\n-A OUTPUT " + rule + "\nCOMMIT"))
+		},
+		Entry("comment match",
+			`-m comment --comment "kuma: exclude outbound port" -j RETURN`,
+		),
+		Entry("unknown target",
+			"-j MARK --set-xmark 0x1/0xffffffff",
+		),
+		Entry("unknown protocol and multiple conntrack states",
+			"! -p icmp -m conntrack --ctstate INVALID,NEW -j DROP",
+		),
+		Entry("multiport match with ranges and negation",
+			"-p tcp -m multiport ! --dports 22,1000:2000 -j RETURN",
+		),
+		Entry("set match",
+			"-m set --match-set MESH_OUT_EXCLUDE_NET dst -j RETURN",
+		),
+		Entry("conntrack direction",
+			"-p udp -m conntrack --ctdir REPLY -j RETURN",
+		),
+		Entry("log with prefix containing spaces",
+			`-j LOG --log-prefix "a \"b\"" --log-level 7`,
+		),
+		Entry("tcp match with unknown options",
+			"-p tcp -m tcp --tcp-flags FIN,SYN SYN -j RETURN",
+		),
+		Entry("negated interfaces and source",
+			"! -s 10.0.0.0/8 ! -i eth0 ! -o lo -j RETURN",
+		),
+		Entry("fragment flag",
+			"! -f -j RETURN",
+		),
+	)
+
+	DescribeTable("should return error for invalid input",
+		func(input string, errorMessage string) {
+			// when
+			_, err := parser.Parse(strings.NewReader(input))
+
+			// then
+			Expect(err).To(MatchError(errorMessage))
+		},
+		Entry("unknown chain",
+			"*nat\n-A MESH_OUTBOUND -j RETURN\nCOMMIT\n",
+			"line 2: chain MESH_OUTBOUND doesn't exist in table nat",
+		),
+		Entry("rule outside of the table",
+			"-A OUTPUT -j RETURN\n",
+			"line 1: no table specified: -A OUTPUT -j RETURN",
+		),
+		Entry("unterminated quote",
+			"*nat\n-A OUTPUT -m comment --comment \"abc -j RETURN\nCOMMIT\n",
+			"line 2: unterminated quoted argument in line: -A OUTPUT -m comment --comment \"abc -j RETURN",
+		),
+		Entry("missing value",
+			"*nat\n-A OUTPUT -s\nCOMMIT\n",
+			"line 2: missing value for -s",
+		),
+	)
+})
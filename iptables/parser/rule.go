@@ -0,0 +1,464 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/kumahq/kuma-net/iptables/parameters"
+	"github.com/kumahq/kuma-net/iptables/parameters/match/conntrack"
+)
+
+// option is a single option of a match or a target (i.e. "! --dport 53")
+type option struct {
+	name     string
+	values   []string
+	negative bool
+}
+
+// ruleParser walks through arguments of a single rule
+type ruleParser struct {
+	args []string
+	pos  int
+}
+
+func (p *ruleParser) done() bool {
+	return p.pos >= len(p.args)
+}
+
+func (p *ruleParser) peek(offset int) string {
+	if p.pos+offset >= len(p.args) {
+		return ""
+	}
+
+	return p.args[p.pos+offset]
+}
+
+func (p *ruleParser) take() string {
+	arg := p.args[p.pos]
+	p.pos++
+
+	return arg
+}
+
+func (p *ruleParser) value(flag string) (string, error) {
+	if p.done() {
+		return "", fmt.Errorf("missing value for %s", flag)
+	}
+
+	return p.take(), nil
+}
+
+func isFlag(arg string) bool {
+	return strings.HasPrefix(arg, "-") && len(arg) > 1
+}
+
+// values takes all the following arguments which are not flags
+func (p *ruleParser) values() []string {
+	var result []string
+
+	for !p.done() && !isFlag(p.peek(0)) && p.peek(0) != "!" {
+		result = append(result, p.take())
+	}
+
+	return result
+}
+
+// options takes all the following long options (with their values) which
+// belong to the match or the target
+func (p *ruleParser) options() []option {
+	var result []option
+
+	for !p.done() {
+		negative := false
+		if p.peek(0) == "!" && strings.HasPrefix(p.peek(1), "--") {
+			negative = true
+			p.take()
+		}
+
+		if !strings.HasPrefix(p.peek(0), "--") {
+			break
+		}
+
+		result = append(result, option{
+			name:     p.take(),
+			values:   p.values(),
+			negative: negative,
+		})
+	}
+
+	return result
+}
+
+func raw(options []option) []string {
+	var result []string
+
+	for _, o := range options {
+		if o.negative {
+			result = append(result, "!")
+		}
+
+		result = append(append(result, o.name), o.values...)
+	}
+
+	return result
+}
+
+func negateIf(negative bool, parameter ParameterBuilder) {
+	if negative {
+		parameter.Negate()
+	}
+}
+
+func parsePortRange(value string) (uint16, uint16, error) {
+	bounds := strings.SplitN(value, ":", 2)
+
+	from, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q: %s", value, err)
+	}
+
+	to := from
+	if len(bounds) == 2 {
+		if to, err = strconv.ParseUint(bounds[1], 10, 16); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q: %s", value, err)
+		}
+	}
+
+	return uint16(from), uint16(to), nil
+}
+
+// tcpUdpParameters returns typed parameters for tcp/udp match options, or false
+// if there are options we don't model
+func tcpUdpParameters(options []option) ([]*TcpUdpParameter, bool) {
+	var result []*TcpUdpParameter
+
+	for _, o := range options {
+		if len(o.values) != 1 {
+			return nil, false
+		}
+
+		from, to, err := parsePortRange(o.values[0])
+		if err != nil {
+			return nil, false
+		}
+
+		var parameter *TcpUdpParameter
+
+		switch o.name {
+		case "--dport", "--destination-port":
+			parameter = DestinationPortRange(from, to)
+		case "--sport", "--source-port":
+			parameter = SourcePortRange(from, to)
+		default:
+			return nil, false
+		}
+
+		negateIf(o.negative, parameter)
+		result = append(result, parameter)
+	}
+
+	return result, true
+}
+
+func ownerMatch(options []option) *MatchParameter {
+	var parameters []*OwnerParameter
+
+	for _, o := range options {
+		if len(o.values) != 1 {
+			return nil
+		}
+
+		var parameter *OwnerParameter
+
+		switch o.name {
+		case "--uid-owner":
+			parameter = Uid(o.values[0])
+		case "--gid-owner":
+			parameter = Gid(o.values[0])
+		default:
+			return nil
+		}
+
+		negateIf(o.negative, parameter)
+		parameters = append(parameters, parameter)
+	}
+
+	return Owner(parameters...)
+}
+
+func conntrackMatch(options []option) *MatchParameter {
+	var parameters []*ConntrackParameter
+
+	for _, o := range options {
+		if len(o.values) != 1 {
+			return nil
+		}
+
+		var parameter *ConntrackParameter
+
+		switch o.name {
+		case "--ctstate":
+			var states []conntrack.State
+			for _, state := range strings.Split(o.values[0], ",") {
+				states = append(states, conntrack.State(state))
+			}
+
+			parameter = Ctstate(states[0], states[1:]...)
+		case "--ctdir":
+			if o.negative {
+				return nil
+			}
+
+			parameter = Ctdir(conntrack.Direction(o.values[0]))
+		default:
+			return nil
+		}
+
+		negateIf(o.negative, parameter)
+		parameters = append(parameters, parameter)
+	}
+
+	return Conntrack(parameters...)
+}
+
+func singleOption(options []option, name string) (string, bool) {
+	if len(options) != 1 || options[0].name != name ||
+		options[0].negative || len(options[0].values) != 1 {
+		return "", false
+	}
+
+	return options[0].values[0], true
+}
+
+func jumpParameter(target string, options []option) *JumpParameter {
+	switch target {
+	case "RETURN":
+		if len(options) == 0 {
+			return Return()
+		}
+	case "DROP":
+		if len(options) == 0 {
+			return Drop()
+		}
+	case "REDIRECT":
+		if value, ok := singleOption(options, "--to-ports"); ok {
+			if port, err := strconv.ParseUint(value, 10, 16); err == nil {
+				return ToPort(uint16(port))
+			}
+		}
+	case "CT":
+		if value, ok := singleOption(options, "--zone"); ok {
+			return Ct(Zone(value))
+		}
+	case "LOG":
+		if jump := logParameter(options); jump != nil {
+			return jump
+		}
+	}
+
+	if len(options) == 0 {
+		return ToUserDefinedChain(target)
+	}
+
+	return Target(target, raw(options)...)
+}
+
+func logParameter(options []option) *JumpParameter {
+	var prefix *string
+	// default log level (warning)
+	level := uint16(4)
+
+	for _, o := range options {
+		if o.negative || len(o.values) != 1 {
+			return nil
+		}
+
+		switch o.name {
+		case "--log-prefix":
+			prefix = &o.values[0]
+		case "--log-level":
+			value, err := strconv.ParseUint(o.values[0], 10, 16)
+			if err != nil {
+				return nil
+			}
+			level = uint16(value)
+		default:
+			return nil
+		}
+	}
+
+	if prefix == nil {
+		return nil
+	}
+
+	return Log(*prefix, level)
+}
+
+// ParseRule converts arguments of a single rule (without the command and
+// the chain name, i.e. "-p tcp -m tcp --dport 22 -j RETURN") into typed
+// parameters. Matches, targets and flags which are not modelled by typed
+// parameters are kept as opaque ones, so the rule can be built back
+// without any loss
+func ParseRule(args []string) ([]*Parameter, error) {
+	p := &ruleParser{args: args}
+	var result []*Parameter
+
+	// tcp/udp options are parts of the protocol parameter in our model
+	// ("-p tcp --dport 22"), so we have to remember where the protocol is
+	protocolIndex := -1
+	protocolName := ""
+	protocolNegative := false
+	matches := map[string][]*TcpUdpParameter{}
+
+	for !p.done() {
+		negative := false
+		if p.peek(0) == "!" {
+			negative = true
+			p.take()
+		}
+
+		if p.done() {
+			return nil, fmt.Errorf("unexpected end of the rule after '!'")
+		}
+
+		flag := p.take()
+
+		switch flag {
+		case "-p", "--protocol":
+			value, err := p.value(flag)
+			if err != nil {
+				return nil, err
+			}
+
+			switch value {
+			case "tcp", "udp":
+				protocolIndex = len(result)
+				protocolName = value
+				protocolNegative = negative
+				result = append(result, nil)
+			default:
+				parameter := Opaque(flag, value)
+				negateIf(negative, parameter)
+				result = append(result, parameter)
+			}
+		case "-s", "--source", "-d", "--destination":
+			value, err := p.value(flag)
+			if err != nil {
+				return nil, err
+			}
+
+			source := flag == "-s" || flag == "--source"
+
+			switch {
+			case source && negative:
+				result = append(result, NotSource(Address(value)))
+			case source:
+				result = append(result, Source(Address(value)))
+			case negative:
+				result = append(result, NotDestination(value))
+			default:
+				result = append(result, Destination(value))
+			}
+		case "-i", "--in-interface", "-o", "--out-interface":
+			value, err := p.value(flag)
+			if err != nil {
+				return nil, err
+			}
+
+			in := flag == "-i" || flag == "--in-interface"
+
+			switch {
+			case in && negative:
+				result = append(result, NotInInterface(value))
+			case in:
+				result = append(result, InInterface(value))
+			case negative:
+				result = append(result, NotOutInterface(value))
+			default:
+				result = append(result, OutInterface(value))
+			}
+		case "-m", "--match":
+			name, err := p.value(flag)
+			if err != nil {
+				return nil, err
+			}
+
+			options := p.options()
+
+			switch name {
+			case "tcp", "udp":
+				// the match can be specified before the protocol
+				// (i.e. "-m udp -p udp --dport 53"), so its options are merged
+				// with the protocol when the whole rule is parsed
+				if parameters, ok := tcpUdpParameters(options); ok {
+					matches[name] = append(matches[name], parameters...)
+					continue
+				}
+			case "owner":
+				if match := ownerMatch(options); match != nil {
+					result = append(result, Match(match))
+					continue
+				}
+			case "conntrack":
+				if match := conntrackMatch(options); match != nil {
+					result = append(result, Match(match))
+					continue
+				}
+			case "comment":
+				if comment, ok := singleOption(options, "--comment"); ok {
+					result = append(result, Match(Comment(comment)))
+					continue
+				}
+			}
+
+			result = append(result, Match(OpaqueMatch(name, raw(options)...)))
+		case "-j", "--jump":
+			target, err := p.value(flag)
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, Jump(jumpParameter(target, p.options())))
+		default:
+			parameter := Opaque(flag, p.values()...)
+			negateIf(negative, parameter)
+			result = append(result, parameter)
+		}
+	}
+
+	for _, name := range []string{"tcp", "udp"} {
+		parameters, ok := matches[name]
+		if !ok || (name == protocolName && !protocolNegative) {
+			continue
+		}
+
+		// options of the tcp/udp match without the matching protocol cannot
+		// be merged with it, so we keep them as they are
+		match := OpaqueMatch(name)
+		if len(parameters) > 0 {
+			var args []string
+			for _, parameter := range parameters {
+				args = append(args, parameter.Build(false))
+			}
+
+			match = OpaqueMatch(name, strings.Fields(strings.Join(args, " "))...)
+		}
+
+		result = append(result, Match(match))
+	}
+
+	if protocolIndex >= 0 {
+		switch {
+		case protocolNegative:
+			result[protocolIndex] = Opaque("-p", protocolName)
+			result[protocolIndex].Negate()
+		case protocolName == "tcp":
+			result[protocolIndex] = Protocol(Tcp(matches[protocolName]...))
+		default:
+			result[protocolIndex] = Protocol(Udp(matches[protocolName]...))
+		}
+	}
+
+	return result, nil
+}
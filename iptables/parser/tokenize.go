@@ -0,0 +1,56 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokenize splits the line from the iptables-save output into arguments
+// the same way iptables-restore does it: arguments are separated by
+// whitespaces, unless they are wrapped in double quotes (inside which
+// the quote and the backslash can be escaped by the backslash)
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	hasToken := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case c == '\\' && inQuotes && i+1 < len(line) &&
+			(line[i+1] == '"' || line[i+1] == '\\'):
+			i++
+			current.WriteByte(line[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			hasToken = true
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if hasToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				hasToken = false
+			}
+		default:
+			current.WriteByte(c)
+			hasToken = true
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted argument in line: %s", line)
+	}
+
+	if hasToken {
+		tokens = append(tokens, current.String())
+	}
+
+	return tokens, nil
+}
+
+// Tokenize splits the line from the iptables-save (or "iptables -S") output
+// into arguments, so they can be passed to the iptables command
+func Tokenize(line string) ([]string, error) {
+	return tokenize(line)
+}
@@ -7,12 +7,7 @@ import (
 
 func Setup(cfg config.Config) (string, error) {
 	if cfg.DryRun {
-		// TODO (bartsmykla): we should generate IPv4 and IPv6 when cfg.IPv6 is
-		//  set, but currently in DryRun mode we would just display IPv6
-		//  configuration when cfg.IPv6 is set
-		// TODO (bartsmykla): I think dns servers should be provided as a config
-		//  value instead of explicit function parameter here
-		output, err := builder.BuildIPTables(cfg, nil, cfg.IPv6)
+		output, err := builder.BuildIPTablesDryRun(cfg)
 		if err != nil {
 			return "", err
 		}
@@ -22,5 +17,10 @@ func Setup(cfg config.Config) (string, error) {
 		return output, nil
 	}
 
-	return builder.RestoreIPTables(cfg)
+	result, err := builder.RestoreIPTables(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Output, nil
 }
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/kumahq/kuma-net/iptables/chain"
+	"github.com/kumahq/kuma-net/iptables/commands"
 	. "github.com/kumahq/kuma-net/iptables/consts"
 )
 
@@ -67,3 +68,25 @@ func (b *TableBuilder) Build(verbose bool) string {
 
 	return strings.Join(lines, "\n")
 }
+
+// BuildCleanup will generate commands which remove everything Build would
+// install: rules from the built-in chains are deleted one by one (so
+// the rules which were not created by us stay untouched), and custom chains
+// are flushed first and deleted afterwards, as they can reference each other
+func (b *TableBuilder) BuildCleanup(verbose bool) []string {
+	var lines []string
+
+	for _, c := range b.chains {
+		lines = append(lines, c.BuildDeletions(verbose)...)
+	}
+
+	for _, c := range b.newChains {
+		lines = append(lines, commands.Flush(c.Name()).Build(verbose))
+	}
+
+	for _, c := range b.newChains {
+		lines = append(lines, commands.DeleteChain(c.Name()).Build(verbose))
+	}
+
+	return lines
+}
@@ -10,6 +10,9 @@ type MangleTable struct {
 	forward     *chain.Chain
 	output      *chain.Chain
 	postrouting *chain.Chain
+
+	// custom chains
+	chains []*chain.Chain
 }
 
 func (t *MangleTable) Prerouting() *chain.Chain {
@@ -32,9 +35,16 @@ func (t *MangleTable) Postrouting() *chain.Chain {
 	return t.postrouting
 }
 
-func (t *MangleTable) Build(verbose bool) string {
-	table := &TableBuilder{
-		name: "mangle",
+func (t *MangleTable) WithChain(chain *chain.Chain) *MangleTable {
+	t.chains = append(t.chains, chain)
+
+	return t
+}
+
+func (t *MangleTable) builder() *TableBuilder {
+	return &TableBuilder{
+		name:      "mangle",
+		newChains: t.chains,
 		chains: []*chain.Chain{
 			t.prerouting,
 			t.input,
@@ -43,8 +53,14 @@ func (t *MangleTable) Build(verbose bool) string {
 			t.postrouting,
 		},
 	}
+}
+
+func (t *MangleTable) Build(verbose bool) string {
+	return t.builder().Build(verbose)
+}
 
-	return table.Build(verbose)
+func (t *MangleTable) BuildCleanup(verbose bool) []string {
+	return t.builder().BuildCleanup(verbose)
 }
 
 func Mangle() *MangleTable {
@@ -36,8 +36,8 @@ func (t *NatTable) WithChain(chain *chain.Chain) *NatTable {
 	return t
 }
 
-func (t *NatTable) Build(verbose bool) string {
-	table := &TableBuilder{
+func (t *NatTable) builder() *TableBuilder {
+	return &TableBuilder{
 		name:      "nat",
 		newChains: t.chains,
 		chains: []*chain.Chain{
@@ -47,8 +47,14 @@ func (t *NatTable) Build(verbose bool) string {
 			t.postrouting,
 		},
 	}
+}
+
+func (t *NatTable) Build(verbose bool) string {
+	return t.builder().Build(verbose)
+}
 
-	return table.Build(verbose)
+func (t *NatTable) BuildCleanup(verbose bool) []string {
+	return t.builder().BuildCleanup(verbose)
 }
 
 func Nat() *NatTable {
@@ -7,6 +7,9 @@ import (
 type RawTable struct {
 	prerouting *chain.Chain
 	output     *chain.Chain
+
+	// custom chains
+	chains []*chain.Chain
 }
 
 func (t *RawTable) Prerouting() *chain.Chain {
@@ -17,16 +20,29 @@ func (t *RawTable) Output() *chain.Chain {
 	return t.output
 }
 
-func (t *RawTable) Build(verbose bool) string {
-	table := &TableBuilder{
-		name: "raw",
+func (t *RawTable) WithChain(chain *chain.Chain) *RawTable {
+	t.chains = append(t.chains, chain)
+
+	return t
+}
+
+func (t *RawTable) builder() *TableBuilder {
+	return &TableBuilder{
+		name:      "raw",
+		newChains: t.chains,
 		chains: []*chain.Chain{
 			t.prerouting,
 			t.output,
 		},
 	}
+}
+
+func (t *RawTable) Build(verbose bool) string {
+	return t.builder().Build(verbose)
+}
 
-	return table.Build(verbose)
+func (t *RawTable) BuildCleanup(verbose bool) []string {
+	return t.builder().BuildCleanup(verbose)
 }
 
 func Raw() *RawTable {
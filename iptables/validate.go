@@ -0,0 +1,12 @@
+package iptables
+
+import (
+	"github.com/kumahq/kuma-net/iptables/builder"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+// Validate checks if the rules generated with the provided configuration
+// would be accepted by iptables-restore, without applying them
+func Validate(cfg config.Config) error {
+	return builder.ValidateIPTables(cfg)
+}
@@ -0,0 +1,150 @@
+package nflog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Event describes the packet logged to the NFLOG group. Decision is the prefix
+// of the NFLOG rule, which in the rules generated by the builder describes
+// the decision made about the packet (i.e. "captured" or "excluded-port")
+type Event struct {
+	Time            time.Time `json:"time"`
+	Decision        string    `json:"decision"`
+	Protocol        string    `json:"protocol"`
+	Source          string    `json:"source"`
+	SourcePort      uint16    `json:"sourcePort,omitempty"`
+	Destination     string    `json:"destination"`
+	DestinationPort uint16    `json:"destinationPort,omitempty"`
+	// UID and GID of the socket owner, available only for locally generated
+	// packets
+	UID  *uint32 `json:"uid,omitempty"`
+	GID  *uint32 `json:"gid,omitempty"`
+	Mark uint32  `json:"mark,omitempty"`
+}
+
+var protocols = map[uint8]string{
+	1:  "icmp",
+	6:  "tcp",
+	17: "udp",
+	58: "ipv6-icmp",
+}
+
+func protocolName(protocol uint8) string {
+	if name, ok := protocols[protocol]; ok {
+		return name
+	}
+
+	return strconv.Itoa(int(protocol))
+}
+
+// decodePayload fills the event with the 5-tuple read from the IPv4 or IPv6
+// header of the packet (ports are read only for TCP and UDP packets)
+func decodePayload(event *Event, payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("empty payload")
+	}
+
+	var protocol uint8
+	var transport []byte
+
+	switch payload[0] >> 4 {
+	case 4:
+		headerLen := int(payload[0]&0x0f) * 4
+		if len(payload) < 20 || headerLen < 20 || len(payload) < headerLen {
+			return fmt.Errorf("truncated IPv4 header")
+		}
+
+		protocol = payload[9]
+		event.Source = net.IP(payload[12:16]).String()
+		event.Destination = net.IP(payload[16:20]).String()
+
+		// only the first fragment holds the transport header
+		if binary.BigEndian.Uint16(payload[6:8])&0x1fff == 0 {
+			transport = payload[headerLen:]
+		}
+	case 6:
+		if len(payload) < 40 {
+			return fmt.Errorf("truncated IPv6 header")
+		}
+
+		protocol = payload[6]
+		event.Source = net.IP(payload[8:24]).String()
+		event.Destination = net.IP(payload[24:40]).String()
+		transport = payload[40:]
+	default:
+		return fmt.Errorf("unknown IP version %d", payload[0]>>4)
+	}
+
+	event.Protocol = protocolName(protocol)
+
+	if (protocol == 6 || protocol == 17) && len(transport) >= 4 {
+		event.SourcePort = binary.BigEndian.Uint16(transport[0:2])
+		event.DestinationPort = binary.BigEndian.Uint16(transport[2:4])
+	}
+
+	return nil
+}
+
+func uint32Ptr(b []byte) *uint32 {
+	v := binary.BigEndian.Uint32(b)
+	return &v
+}
+
+// parseEvent parses the NFULNL_MSG_PACKET message (without the netlink
+// header). When the packet has no timestamp, the provided time is used
+func parseEvent(data []byte, now time.Time) (Event, error) {
+	event := Event{Time: now}
+
+	if len(data) < nl.SizeofNfgenmsg {
+		return event, fmt.Errorf("truncated message")
+	}
+
+	attrs, err := nl.ParseRouteAttr(data[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return event, fmt.Errorf("cannot parse attributes: %s", err)
+	}
+
+	var payload []byte
+
+	for _, attr := range attrs {
+		value := attr.Value
+
+		switch attr.Attr.Type {
+		case attrPrefix:
+			event.Decision = strings.TrimRight(string(value), "\x00")
+		case attrPayload:
+			payload = value
+		case attrMark:
+			if len(value) >= 4 {
+				event.Mark = binary.BigEndian.Uint32(value)
+			}
+		case attrUID:
+			if len(value) >= 4 {
+				event.UID = uint32Ptr(value)
+			}
+		case attrGID:
+			if len(value) >= 4 {
+				event.GID = uint32Ptr(value)
+			}
+		case attrTimestamp:
+			if len(value) >= 16 {
+				sec := binary.BigEndian.Uint64(value[0:8])
+				usec := binary.BigEndian.Uint64(value[8:16])
+				event.Time = time.Unix(int64(sec), int64(usec)*int64(time.Microsecond))
+			}
+		}
+	}
+
+	if err := decodePayload(&event, payload); err != nil {
+		return event, err
+	}
+
+	return event, nil
+}
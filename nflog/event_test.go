@@ -0,0 +1,113 @@
+package nflog
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func message(family uint8, attrs ...*nl.RtAttr) []byte {
+	data := nfgenmsg{family: family, group: 1337}.Serialize()
+
+	for _, attr := range attrs {
+		data = append(data, attr.Serialize()...)
+	}
+
+	return data
+}
+
+var ipv4TCP = []byte{
+	0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+	10, 0, 0, 1, // source
+	10, 0, 0, 2, // destination
+	0xd4, 0x31, // source port 54321
+	0x15, 0x38, // destination port 5432
+}
+
+var ipv6UDP = append([]byte{
+	0x60, 0x00, 0x00, 0x00, 0x00, 0x08, 0x11, 0x40,
+	0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, // source
+	0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, // destination
+}, 0x9c, 0x40, 0x00, 0x35) // ports 40000 -> 53
+
+var _ = Describe("NFLOG events", func() {
+	now := time.Unix(1700000000, 0).UTC()
+
+	It("should parse IPv4 TCP packet with the socket owner", func() {
+		// given
+		data := message(unix.AF_INET,
+			nl.NewRtAttr(attrPrefix, nl.ZeroTerminated("excluded-port")),
+			nl.NewRtAttr(attrUID, be32(1000)),
+			nl.NewRtAttr(attrGID, be32(1001)),
+			nl.NewRtAttr(attrMark, be32(0x539)),
+			nl.NewRtAttr(attrPayload, ipv4TCP),
+		)
+
+		// when
+		event, err := parseEvent(data, now)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		line, err := json.Marshal(event)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(line)).To(Equal(`{"time":"2023-11-14T22:13:20Z",` +
+			`"decision":"excluded-port","protocol":"tcp",` +
+			`"source":"10.0.0.1","sourcePort":54321,` +
+			`"destination":"10.0.0.2","destinationPort":5432,` +
+			`"uid":1000,"gid":1001,"mark":1337}`))
+	})
+
+	It("should parse IPv6 UDP packet with the timestamp", func() {
+		// given
+		timestamp := make([]byte, 16)
+		binary.BigEndian.PutUint64(timestamp, 1600000000)
+		binary.BigEndian.PutUint64(timestamp[8:], 500)
+		data := message(unix.AF_INET6,
+			nl.NewRtAttr(attrPrefix, nl.ZeroTerminated("dns")),
+			nl.NewRtAttr(attrTimestamp, timestamp),
+			nl.NewRtAttr(attrPayload, ipv6UDP),
+		)
+
+		// when
+		event, err := parseEvent(data, now)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(event).To(Equal(Event{
+			Time:            time.Unix(1600000000, 500000),
+			Decision:        "dns",
+			Protocol:        "udp",
+			Source:          "fd00::1",
+			SourcePort:      40000,
+			Destination:     "fd00::2",
+			DestinationPort: 53,
+		}))
+	})
+
+	DescribeTable("should return error for invalid packets",
+		func(payload []byte, want string) {
+			// given
+			data := message(unix.AF_INET, nl.NewRtAttr(attrPayload, payload))
+
+			// when
+			_, err := parseEvent(data, now)
+
+			// then
+			Expect(err).To(MatchError(want))
+		},
+		Entry("truncated IPv4 header", ipv4TCP[:12], "truncated IPv4 header"),
+		Entry("truncated IPv6 header", ipv6UDP[:20], "truncated IPv6 header"),
+		Entry("unknown IP version", []byte{0x50}, "unknown IP version 5"),
+	)
+})
@@ -0,0 +1,133 @@
+package nflog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// constants from linux/netfilter/nfnetlink_log.h, which are not exported
+// by the netlink packages
+const (
+	msgPacket = 0 // NFULNL_MSG_PACKET
+	msgConfig = 1 // NFULNL_MSG_CONFIG
+
+	attrConfigCmd  = 1 // NFULA_CFG_CMD
+	attrConfigMode = 2 // NFULA_CFG_MODE
+
+	configCmdBind   = 1 // NFULNL_CFG_CMD_BIND
+	configCmdPfBind = 3 // NFULNL_CFG_CMD_PF_BIND
+
+	copyPacket = 2 // NFULNL_COPY_PACKET
+
+	attrPacketHdr = 1  // NFULA_PACKET_HDR
+	attrMark      = 2  // NFULA_MARK
+	attrTimestamp = 3  // NFULA_TIMESTAMP
+	attrPayload   = 9  // NFULA_PAYLOAD
+	attrPrefix    = 10 // NFULA_PREFIX
+	attrUID       = 11 // NFULA_UID
+	attrGID       = 14 // NFULA_GID
+)
+
+// copyRange is the amount of bytes of every packet copied to the userspace,
+// which is enough to read IPv4 (with options) or IPv6 header and ports
+const copyRange = 128
+
+// nfgenmsg is the header of the nfnetlink messages. nl.Nfgenmsg is not used,
+// as it expects the resource id (the group) to be already in the network
+// byte order
+type nfgenmsg struct {
+	family uint8
+	group  uint16
+}
+
+func (m nfgenmsg) Len() int {
+	return nl.SizeofNfgenmsg
+}
+
+func (m nfgenmsg) Serialize() []byte {
+	b := make([]byte, nl.SizeofNfgenmsg)
+	b[0] = m.family
+	b[1] = nl.NFNETLINK_V0
+	binary.BigEndian.PutUint16(b[2:], m.group)
+
+	return b
+}
+
+func newConfigRequest(family uint8, group uint16) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(
+		msgConfig|(unix.NFNL_SUBSYS_ULOG<<8),
+		unix.NLM_F_REQUEST|unix.NLM_F_ACK,
+	)
+	req.AddData(nfgenmsg{family: family, group: group})
+
+	return req
+}
+
+// request sends the request and waits for the acknowledgement
+func request(s *nl.NetlinkSocket, req *nl.NetlinkRequest) error {
+	if err := s.Send(req); err != nil {
+		return err
+	}
+
+	for {
+		msgs, _, err := s.Receive()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR || m.Header.Seq != req.Seq {
+				continue
+			}
+
+			if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+
+			return nil
+		}
+	}
+}
+
+// bind binds the socket to the NFLOG group, so it will receive packets sent
+// to it (including their payloads)
+func bind(s *nl.NetlinkSocket, group uint16) error {
+	// kernels older than 3.17 require binding the nfnetlink_log to
+	// the protocol families, newer ones ignore these requests
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		req := newConfigRequest(family, 0)
+		req.AddData(nl.NewRtAttr(attrConfigCmd, []byte{configCmdPfBind}))
+		_ = request(s, req)
+	}
+
+	req := newConfigRequest(unix.AF_UNSPEC, group)
+	req.AddData(nl.NewRtAttr(attrConfigCmd, []byte{configCmdBind}))
+	if err := request(s, req); err != nil {
+		return fmt.Errorf("cannot bind to NFLOG group %d: %s", group, err)
+	}
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, copyRange)
+	mode[4] = copyPacket
+
+	req = newConfigRequest(unix.AF_UNSPEC, group)
+	req.AddData(nl.NewRtAttr(attrConfigMode, mode))
+	if err := request(s, req); err != nil {
+		return fmt.Errorf("cannot set copy mode of NFLOG group %d: %s", group, err)
+	}
+
+	return nil
+}
+
+// isTransient reports if the error was returned because of the receive
+// timeout, or because the socket buffer overflowed (packets are dropped then,
+// but the following ones can be still received)
+func isTransient(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) ||
+		errors.Is(err, unix.EINTR) || errors.Is(err, unix.ENOBUFS)
+}
@@ -0,0 +1,67 @@
+package nflog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// pollInterval is the interval in which the listener checks if it should
+// stop, when there are no packets
+var pollInterval = unix.Timeval{Sec: 1}
+
+// Listen reads packets sent to the NFLOG group (i.e. by the rules generated
+// in the nflog logging mode) and writes them to the writer as JSON lines
+// (one Event per line), until the context is done. Packets which cannot be
+// decoded are skipped
+func Listen(ctx context.Context, group uint16, w io.Writer) error {
+	s, err := nl.Subscribe(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("cannot open netfilter netlink socket: %s", err)
+	}
+	defer s.Close()
+
+	if err := bind(s, group); err != nil {
+		return err
+	}
+
+	if err := s.SetReceiveTimeout(&pollInterval); err != nil {
+		return fmt.Errorf("cannot set receive timeout: %s", err)
+	}
+
+	encoder := json.NewEncoder(w)
+	packetType := uint16(msgPacket | (unix.NFNL_SUBSYS_ULOG << 8))
+
+	for ctx.Err() == nil {
+		msgs, _, err := s.Receive()
+		if err != nil {
+			if isTransient(err) {
+				continue
+			}
+
+			return fmt.Errorf("cannot receive NFLOG packets: %s", err)
+		}
+
+		for _, m := range msgs {
+			if m.Header.Type != packetType {
+				continue
+			}
+
+			event, err := parseEvent(m.Data, time.Now())
+			if err != nil {
+				continue
+			}
+
+			if err := encoder.Encode(event); err != nil {
+				return fmt.Errorf("cannot write NFLOG event: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
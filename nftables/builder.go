@@ -0,0 +1,681 @@
+//go:build linux
+
+package nftables
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/google/nftables"
+
+	"github.com/kumahq/kuma-net/iptables/builder"
+	"github.com/kumahq/kuma-net/iptables/consts"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+const (
+	tcp = consts.TCP
+	udp = consts.UDP
+)
+
+func hook(
+	chainType nftables.ChainType,
+	chainHook *nftables.ChainHook,
+	priority *nftables.ChainPriority,
+) *Hook {
+	return &Hook{Type: chainType, Hook: chainHook, Priority: priority}
+}
+
+// families returns the list of families we should generate rules for
+func families(cfg config.Config) []Family {
+	if cfg.IPv6 {
+		return []Family{IPv4, IPv6}
+	}
+
+	return []Family{IPv4}
+}
+
+// ipv4Only prepends the statement limiting the rule to the IPv4 traffic when
+// IPv6 is disabled. The inet table sees the traffic of both families, and
+// the IPv6 one has to be left untouched then, the same as by the iptables
+// backend
+func ipv4Only(cfg config.Config, statements ...*Statement) []*Statement {
+	if cfg.IPv6 {
+		return statements
+	}
+
+	return append([]*Statement{NFProto(IPv4)}, statements...)
+}
+
+// dnsServersOfFamily returns only these DNS servers which belong to the provided
+// family
+func dnsServersOfFamily(dnsServers []string, family Family) []string {
+	var result []string
+
+	for _, server := range dnsServers {
+		if f, err := FamilyOf(server); err == nil && f == family {
+			result = append(result, server)
+		}
+	}
+
+	return result
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseID(kind string, id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", kind, id, err)
+	}
+
+	return uint32(value), nil
+}
+
+// owner holds statements identifying the sidecar's traffic. The traffic
+// belongs to the sidecar when it matches any of the sidecar statements (so
+// every one of them has to be used in a separate rule), and doesn't belong
+// to it when it matches all the notSidecar ones. systemdResolved (when
+// the systemd-resolved stub is redirected) identifies queries of
+// systemd-resolved to its upstream servers, which mustn't be redirected back
+type owner struct {
+	sidecar         []*Statement
+	notSidecar      []*Statement
+	systemdResolved *Statement
+}
+
+func buildOwner(cfg config.Owner) (owner, error) {
+	var result owner
+
+	for _, id := range cfg.UIDList() {
+		uid, err := parseID("UID", id)
+		if err != nil {
+			return owner{}, err
+		}
+
+		result.sidecar = append(result.sidecar, SkUID(uid))
+		result.notSidecar = append(result.notSidecar, NotSkUID(uid))
+	}
+
+	if cfg.GID != "" {
+		gid, err := parseID("GID", cfg.GID)
+		if err != nil {
+			return owner{}, err
+		}
+
+		result.sidecar = append(result.sidecar, SkGID(gid))
+		result.notSidecar = append(result.notSidecar, NotSkGID(gid))
+	}
+
+	if cfg.Mark != 0 {
+		result.sidecar = append(result.sidecar, Mark(cfg.Mark))
+		result.notSidecar = append(result.notSidecar, NotMark(cfg.Mark))
+	}
+
+	return result, nil
+}
+
+func buildMeshInbound(
+	cfg config.TrafficFlow,
+	prefix string,
+	meshInboundRedirect string,
+	families []Family,
+) (*Chain, error) {
+	meshInbound := NewChain(cfg.Chain.GetFullName(prefix))
+	if !cfg.Enabled {
+		return meshInbound.Append(L4Proto(tcp), Return()), nil
+	}
+
+	// Excluded inbound sources
+	for _, family := range families {
+		for _, cidr := range config.CIDRsOfFamily(cfg.ExcludeInboundSourceIPs, family == IPv6) {
+			source, err := Source(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("incorrect excluded inbound source: %s", err)
+			}
+
+			meshInbound.Append(source, Return())
+		}
+	}
+
+	// Include inbound ports
+	for _, r := range cfg.IncludedPorts() {
+		meshInbound.Append(destinationPorts(r), Jump(meshInboundRedirect))
+	}
+
+	if !cfg.HasIncludedPorts() {
+		// Excluded inbound ports
+		for _, r := range cfg.ExcludedPorts() {
+			meshInbound.Append(destinationPorts(r), Return())
+		}
+
+		meshInbound.Append(L4Proto(tcp), Jump(meshInboundRedirect))
+	}
+
+	return meshInbound, nil
+}
+
+// destinationPorts matches TCP destination port, or the range of ports
+func destinationPorts(r config.Range) *Statement {
+	return DestinationPortRange(tcp, uint16(r.From), uint16(r.To))
+}
+
+func buildMeshOutbound(
+	cfg config.Config,
+	dnsServers []string,
+	loopback string,
+	owner owner,
+) (*Chain, error) {
+	prefix := cfg.Redirect.NamePrefix
+	inboundRedirectChainName := cfg.Redirect.Inbound.RedirectChain.GetFullName(prefix)
+	outboundChainName := cfg.Redirect.Outbound.Chain.GetFullName(prefix)
+	outboundRedirectChainName := cfg.Redirect.Outbound.RedirectChain.GetFullName(prefix)
+	includePorts := cfg.Redirect.Outbound.IncludedPorts()
+	dnsRedirectPort := cfg.Redirect.DNS.Port
+
+	meshOutbound := NewChain(outboundChainName)
+	if !cfg.Redirect.Outbound.Enabled {
+		return meshOutbound.Append(L4Proto(tcp), Return()), nil
+	}
+
+	// Excluded outbound ports
+	if len(includePorts) == 0 {
+		for _, r := range cfg.Redirect.Outbound.ExcludedPorts() {
+			meshOutbound.Append(destinationPorts(r), Return())
+		}
+	}
+
+	// When DNS is redirected, TCP traffic to port 53 shouldn't be treated as
+	// a traffic which could be redirected back to the inbound listener
+	tcpTraffic := L4Proto(tcp)
+	if cfg.ShouldRedirectDNS() {
+		tcpTraffic = NotDestinationPort(tcp, consts.DNSPort)
+	}
+
+	for _, family := range families(cfg) {
+		localhost := consts.LocalhostCIDRIPv4
+		inboundPassthroughSourceAddress := consts.InboundPassthroughSourceAddressCIDRIPv4
+		if family == IPv6 {
+			localhost = consts.LocalhostCIDRIPv6
+			inboundPassthroughSourceAddress = consts.InboundPassthroughSourceAddressCIDRIPv6
+		}
+
+		inboundPassthroughSource, err := Source(inboundPassthroughSourceAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		notLocalhost, err := NotDestination(localhost)
+		if err != nil {
+			return nil, err
+		}
+
+		// look at the description in the iptables builder (buildMeshOutbound)
+		// for the detailed explanation of these rules
+		meshOutbound.Append(
+			inboundPassthroughSource,
+			OutInterface(loopback),
+			Return(),
+		)
+
+		for _, sidecar := range owner.sidecar {
+			meshOutbound.Append(
+				tcpTraffic,
+				OutInterface(loopback),
+				notLocalhost,
+				sidecar,
+				Jump(inboundRedirectChainName),
+			)
+		}
+	}
+
+	notSidecar := append([]*Statement{tcpTraffic, OutInterface(loopback)}, owner.notSidecar...)
+	meshOutbound.Append(append(notSidecar, Return())...)
+
+	for _, sidecar := range owner.sidecar {
+		meshOutbound.Append(sidecar, Return())
+	}
+
+	if cfg.ShouldRedirectDNS() {
+		if owner.systemdResolved != nil {
+			meshOutbound.Append(
+				DestinationPort(tcp, consts.DNSPort),
+				owner.systemdResolved,
+				Return(),
+			)
+		}
+
+		if cfg.ShouldCaptureAllDNS() {
+			meshOutbound.Append(
+				DestinationPort(tcp, consts.DNSPort),
+				Redirect(dnsRedirectPort),
+			)
+		} else {
+			for _, family := range families(cfg) {
+				for _, dnsIp := range dnsServersOfFamily(dnsServers, family) {
+					destination, err := Destination(dnsIp)
+					if err != nil {
+						return nil, fmt.Errorf("invalid DNS server: %s", err)
+					}
+
+					meshOutbound.Append(
+						destination,
+						DestinationPort(tcp, consts.DNSPort),
+						Redirect(dnsRedirectPort),
+					)
+				}
+			}
+		}
+	}
+
+	for _, family := range families(cfg) {
+		localhost := consts.LocalhostCIDRIPv4
+		if family == IPv6 {
+			localhost = consts.LocalhostCIDRIPv6
+		}
+
+		destination, err := Destination(localhost)
+		if err != nil {
+			return nil, err
+		}
+
+		meshOutbound.Append(destination, Return())
+	}
+
+	// Excluded outbound destinations
+	for _, family := range families(cfg) {
+		for _, cidr := range config.CIDRsOfFamily(cfg.Redirect.Outbound.ExcludeOutboundIPs, family == IPv6) {
+			destination, err := Destination(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("incorrect excluded outbound destination: %s", err)
+			}
+
+			meshOutbound.Append(destination, Return())
+		}
+	}
+
+	// when included destinations are set, only the traffic to them will be
+	// redirected (nil means any destination)
+	includeDestinations := []*Statement{nil}
+	if len(cfg.Redirect.Outbound.IncludeOutboundIPs) > 0 {
+		includeDestinations = nil
+		for _, family := range families(cfg) {
+			for _, cidr := range config.CIDRsOfFamily(cfg.Redirect.Outbound.IncludeOutboundIPs, family == IPv6) {
+				destination, err := Destination(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("incorrect included outbound destination: %s", err)
+				}
+
+				includeDestinations = append(includeDestinations, destination)
+			}
+		}
+	}
+
+	for _, destination := range includeDestinations {
+		var statements []*Statement
+		if destination != nil {
+			statements = append(statements, destination)
+		}
+
+		if len(includePorts) > 0 {
+			for _, r := range includePorts {
+				meshOutbound.Append(append(statements,
+					destinationPorts(r),
+					Jump(outboundRedirectChainName),
+				)...)
+			}
+		} else {
+			meshOutbound.Append(append(statements, Jump(outboundRedirectChainName))...)
+		}
+	}
+
+	return meshOutbound, nil
+}
+
+func buildMeshRedirect(cfg config.TrafficFlow, prefix string, ipv6 bool) *Chain {
+	meshRedirect := NewChain(cfg.RedirectChain.GetFullName(prefix))
+
+	if !ipv6 || cfg.PortIPv6 == 0 || cfg.PortIPv6 == cfg.Port {
+		return meshRedirect.Append(L4Proto(tcp), Redirect(cfg.Port))
+	}
+
+	return meshRedirect.
+		Append(NFProto(IPv4), L4Proto(tcp), Redirect(cfg.Port)).
+		Append(NFProto(IPv6), L4Proto(tcp), Redirect(cfg.PortIPv6))
+}
+
+func buildOutput(cfg config.Config, dnsServers []string, owner owner) (*Chain, error) {
+	outboundChainName := cfg.Redirect.Outbound.Chain.GetFullName(cfg.Redirect.NamePrefix)
+	dnsRedirectPort := cfg.Redirect.DNS.Port
+
+	output := NewBaseChain("output_nat", hook(
+		nftables.ChainTypeNAT,
+		nftables.ChainHookOutput,
+		nftables.ChainPriorityNATDest,
+	))
+
+	if cfg.ShouldLog() {
+		output.Append(ipv4Only(cfg, Log(consts.OutputLogPrefix, cfg.Log.Level))...)
+	}
+
+	// Excluded outbound ports for UIDs
+	for _, uIDsToPorts := range cfg.Redirect.Outbound.ExcludePortsForUIDs {
+		if _, err := protocolNumber(uIDsToPorts.Protocol); err != nil {
+			return nil, err
+		}
+
+		uids, err := uIDsToPorts.UIDs.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid UIDs: %s", err)
+		}
+
+		ports, err := uIDsToPorts.Ports.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports: %s", err)
+		}
+
+		for _, p := range ports {
+			if p.To > math.MaxUint16 {
+				return nil, fmt.Errorf("invalid ports: %d is not a valid port", p.To)
+			}
+		}
+
+		for _, u := range uids {
+			for _, p := range ports {
+				output.Append(
+					DestinationPortRange(uIDsToPorts.Protocol, uint16(p.From), uint16(p.To)),
+					SkUIDRange(u.From, u.To),
+					Return(),
+				)
+			}
+		}
+	}
+
+	if cfg.ShouldRedirectDNS() {
+		for _, sidecar := range owner.sidecar {
+			output.Append(
+				DestinationPort(udp, consts.DNSPort),
+				sidecar,
+				Return(),
+			)
+		}
+
+		if owner.systemdResolved != nil {
+			output.Append(
+				DestinationPort(udp, consts.DNSPort),
+				owner.systemdResolved,
+				Return(),
+			)
+		}
+
+		if cfg.ShouldCaptureAllDNS() {
+			output.Append(ipv4Only(cfg,
+				DestinationPort(udp, consts.DNSPort),
+				Redirect(dnsRedirectPort),
+			)...)
+		} else {
+			for _, family := range families(cfg) {
+				for _, dnsIp := range dnsServersOfFamily(dnsServers, family) {
+					destination, err := Destination(dnsIp)
+					if err != nil {
+						return nil, fmt.Errorf("invalid DNS server: %s", err)
+					}
+
+					output.Append(
+						destination,
+						DestinationPort(udp, consts.DNSPort),
+						Redirect(dnsRedirectPort),
+					)
+				}
+			}
+		}
+	}
+
+	return output.Append(ipv4Only(cfg, L4Proto(tcp), Jump(outboundChainName))...), nil
+}
+
+func buildPrerouting(cfg config.Config) (*Chain, error) {
+	inboundChainName := cfg.Redirect.Inbound.Chain.GetFullName(cfg.Redirect.NamePrefix)
+
+	prerouting := NewBaseChain("prerouting_nat", hook(
+		nftables.ChainTypeNAT,
+		nftables.ChainHookPrerouting,
+		nftables.ChainPriorityNATDest,
+	))
+
+	if cfg.ShouldLog() {
+		prerouting.Append(ipv4Only(cfg, Log(consts.PreroutingLogPrefix, cfg.Log.Level))...)
+	}
+
+	for _, family := range families(cfg) {
+		for _, network := range cfg.Redirect.VNet.NetworksOfFamily(family == IPv6) {
+			notDestination, err := NotDestination(network.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("incorrect CIDR definition: %s", err)
+			}
+
+			if network.RedirectDNS {
+				prerouting.Append(ipv4Only(cfg,
+					InInterface(network.Interface),
+					DestinationPort(udp, consts.DNSPort),
+					Redirect(cfg.Redirect.DNS.Port),
+				)...)
+			}
+
+			prerouting.Append(
+				notDestination,
+				InInterface(network.Interface),
+				L4Proto(tcp),
+				Redirect(network.TCPPort(cfg.Redirect.Outbound.Port)),
+			)
+		}
+	}
+
+	return prerouting.Append(ipv4Only(cfg, L4Proto(tcp), Jump(inboundChainName))...), nil
+}
+
+// buildConntrackZones builds chains which are the equivalent of the iptables'
+// raw table rules, splitting DNS traffic from the sidecar and from
+// the application into separate conntrack zones
+func buildConntrackZones(cfg config.Config, dnsServers []string, owner owner) ([]*Chain, error) {
+	if !cfg.Redirect.DNS.Enabled || !cfg.Redirect.DNS.ConntrackZoneSplit {
+		return nil, nil
+	}
+
+	// zones are validated to fit in 16 bits
+	conntrackZoneSidecar := uint16(cfg.Redirect.DNS.SidecarConntrackZone)
+	conntrackZoneApp := uint16(cfg.Redirect.DNS.ApplicationConntrackZone)
+
+	output := NewBaseChain("output_raw", hook(
+		nftables.ChainTypeFilter,
+		nftables.ChainHookOutput,
+		nftables.ChainPriorityRaw,
+	))
+	prerouting := NewBaseChain("prerouting_raw", hook(
+		nftables.ChainTypeFilter,
+		nftables.ChainHookPrerouting,
+		nftables.ChainPriorityRaw,
+	))
+
+	for _, sidecar := range owner.sidecar {
+		output.Append(ipv4Only(cfg,
+			DestinationPort(udp, consts.DNSPort),
+			sidecar,
+			CtZoneSet(conntrackZoneSidecar),
+		)...)
+	}
+
+	if owner.systemdResolved != nil {
+		output.Append(ipv4Only(cfg,
+			DestinationPort(udp, consts.DNSPort),
+			owner.systemdResolved,
+			CtZoneSet(conntrackZoneSidecar),
+		)...)
+	}
+
+	for _, sidecar := range owner.sidecar {
+		output.Append(ipv4Only(cfg,
+			SourcePort(udp, cfg.Redirect.DNS.Port),
+			sidecar,
+			CtZoneSet(conntrackZoneApp),
+		)...)
+	}
+
+	if cfg.ShouldCaptureAllDNS() {
+		output.Append(ipv4Only(cfg, DestinationPort(udp, consts.DNSPort), CtZoneSet(conntrackZoneApp))...)
+		prerouting.Append(ipv4Only(cfg, SourcePort(udp, consts.DNSPort), CtZoneSet(conntrackZoneSidecar))...)
+	} else {
+		for _, family := range families(cfg) {
+			for _, ip := range dnsServersOfFamily(dnsServers, family) {
+				destination, err := Destination(ip)
+				if err != nil {
+					return nil, fmt.Errorf("invalid DNS server: %s", err)
+				}
+
+				source, err := Source(ip)
+				if err != nil {
+					return nil, fmt.Errorf("invalid DNS server: %s", err)
+				}
+
+				output.Append(
+					destination,
+					DestinationPort(udp, consts.DNSPort),
+					CtZoneSet(conntrackZoneApp),
+				)
+				prerouting.Append(
+					source,
+					SourcePort(udp, consts.DNSPort),
+					CtZoneSet(conntrackZoneSidecar),
+				)
+			}
+		}
+	}
+
+	return []*Chain{prerouting, output}, nil
+}
+
+func buildMangle(cfg config.Config) *Chain {
+	return NewBaseChain("prerouting_mangle", hook(
+		nftables.ChainTypeFilter,
+		nftables.ChainHookPrerouting,
+		nftables.ChainPriorityMangle,
+	)).AppendIf(cfg.ShouldDropInvalidPackets, ipv4Only(cfg, CtStateInvalid(), Drop())...)
+}
+
+// BuildTable builds the inet table with all the rules necessary to enable
+// the transparent proxy for IPv4 and (when cfg.IPv6 is set) IPv6 traffic. It's
+// the nftables' equivalent of the iptables rules built by the iptables/builder
+// package. dnsServers can contain both IPv4 and IPv6 addresses
+func BuildTable(cfg config.Config, dnsServers []string, loopback string) (*Table, error) {
+	cfg = config.MergeConfigWithDefaults(cfg)
+	prefix := cfg.Redirect.NamePrefix
+	inboundRedirectChainName := cfg.Redirect.Inbound.RedirectChain.GetFullName(prefix)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err)
+	}
+
+	if cfg.ShouldLockdownEgress() {
+		return nil, fmt.Errorf("egress lockdown is not supported by the nftables backend")
+	}
+
+	if cfg.Redirect.Inbound.Mode == config.RedirectModeTProxy ||
+		cfg.Redirect.Outbound.Mode == config.RedirectModeTProxy {
+		return nil, fmt.Errorf("tproxy redirect mode is not supported by the nftables backend")
+	}
+
+	if cfg.Redirect.Inbound.UDP.Enabled || cfg.Redirect.Outbound.UDP.Enabled {
+		return nil, fmt.Errorf("UDP interception is not supported by the nftables backend")
+	}
+
+	if cfg.ShouldUseIPSet() {
+		return nil, fmt.Errorf("ipset sets are not supported by the nftables backend")
+	}
+
+	if cfg.ShouldNflog() {
+		return nil, fmt.Errorf("nflog logging mode is not supported by the nftables backend")
+	}
+
+	owner, err := buildOwner(cfg.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, server := range dnsServers {
+		if _, err := FamilyOf(server); err != nil {
+			return nil, fmt.Errorf("invalid DNS server: %s", err)
+		}
+	}
+
+	if cfg.ShouldRedirectDNS() && !cfg.ShouldCaptureAllDNS() &&
+		contains(dnsServers, consts.SystemdResolvedStub) {
+		// the same as with iptables, the missing user doesn't fail
+		// the whole installation, only its queries aren't exempted
+		id, err := builder.SystemdResolvedUID(cfg)
+		if err != nil {
+			_, _ = fmt.Fprintf(cfg.RuntimeStdout, "[WARNING] %s. Queries of "+
+				"systemd-resolved to the upstream DNS servers won't be exempted "+
+				"from the redirection\n", err)
+		} else {
+			uid, err := parseID("UID", id)
+			if err != nil {
+				return nil, err
+			}
+
+			owner.systemdResolved = SkUID(uid)
+		}
+	}
+
+	output, err := buildOutput(cfg, dnsServers, owner)
+	if err != nil {
+		return nil, fmt.Errorf("could not build output rules: %s", err)
+	}
+
+	prerouting, err := buildPrerouting(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not build prerouting rules: %s", err)
+	}
+
+	meshInbound, err := buildMeshInbound(cfg.Redirect.Inbound, prefix, inboundRedirectChainName, families(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("could not build inbound rules: %s", err)
+	}
+
+	meshOutbound, err := buildMeshOutbound(cfg, dnsServers, loopback, owner)
+	if err != nil {
+		return nil, fmt.Errorf("could not build outbound rules: %s", err)
+	}
+
+	conntrackZones, err := buildConntrackZones(cfg, dnsServers, owner)
+	if err != nil {
+		return nil, fmt.Errorf("could not build conntrack zone rules: %s", err)
+	}
+
+	table := NewTable(cfg.Nftables.TableName).
+		// regular chains are declared first, as base chains jump to them
+		WithChain(buildMeshRedirect(cfg.Redirect.Inbound, prefix, cfg.IPv6)).
+		WithChain(buildMeshRedirect(cfg.Redirect.Outbound, prefix, cfg.IPv6)).
+		WithChain(meshInbound).
+		WithChain(meshOutbound)
+
+	for _, chain := range conntrackZones {
+		table.WithChain(chain)
+	}
+
+	if cfg.ShouldDropInvalidPackets() {
+		table.WithChain(buildMangle(cfg))
+	}
+
+	return table.
+		WithChain(prerouting).
+		WithChain(output), nil
+}
@@ -0,0 +1,335 @@
+//go:build linux
+
+package nftables_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/nftables"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("BuildTable", func() {
+	DescribeTable("should build table with provided rules",
+		func(cfg config.Config, dnsServers []string, expect ...string) {
+			// when
+			table, err := BuildTable(cfg, dnsServers, "lo")
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+
+			output := table.Build()
+			for _, rule := range expect {
+				Expect(output).To(ContainSubstring(rule))
+			}
+		},
+		Entry("default configuration",
+			config.Config{
+				Redirect: config.Redirect{
+					Inbound:  config.TrafficFlow{Enabled: true},
+					Outbound: config.TrafficFlow{Enabled: true},
+				},
+			},
+			nil,
+			"table inet kuma\ndelete table inet kuma\ntable inet kuma {\n",
+			"\tchain MESH_INBOUND_REDIRECT {\n\t\tmeta l4proto tcp redirect to :15006\n\t}",
+			"\tchain MESH_OUTBOUND_REDIRECT {\n\t\tmeta l4proto tcp redirect to :15001\n\t}",
+			"\tchain MESH_INBOUND {\n\t\tmeta l4proto tcp jump MESH_INBOUND_REDIRECT\n\t}",
+			`		ip saddr 127.0.0.6/32 oifname "lo" return
+		meta l4proto tcp oifname "lo" ip daddr != 127.0.0.1/32 meta skuid 5678 jump MESH_INBOUND_REDIRECT
+		meta l4proto tcp oifname "lo" meta skuid != 5678 return
+		meta skuid 5678 return
+		ip daddr 127.0.0.1/32 return
+		jump MESH_OUTBOUND_REDIRECT`,
+			`	chain prerouting_nat {
+		type nat hook prerouting priority -100; policy accept;
+		meta nfproto ipv4 meta l4proto tcp jump MESH_INBOUND
+	}`,
+			`	chain output_nat {
+		type nat hook output priority -100; policy accept;
+		meta nfproto ipv4 meta l4proto tcp jump MESH_OUTBOUND
+	}`,
+		),
+		Entry("IPv4 and IPv6 with DNS servers and conntrack zones",
+			config.Config{
+				Redirect: config.Redirect{
+					NamePrefix: "KUMA_",
+					Inbound:    config.TrafficFlow{Enabled: true},
+					Outbound:   config.TrafficFlow{Enabled: true},
+					DNS: config.DNS{
+						Enabled:            true,
+						ConntrackZoneSplit: true,
+					},
+				},
+				Nftables: config.Nftables{TableName: "mesh"},
+				IPv6:     true,
+			},
+			[]string{"8.8.8.8", "2001:4860:4860::8888"},
+			"table inet mesh {\n",
+			"\t\tmeta nfproto ipv4 meta l4proto tcp redirect to :15006\n"+
+				"\t\tmeta nfproto ipv6 meta l4proto tcp redirect to :15010\n",
+			`ip6 saddr ::6/128 oifname "lo" return`,
+			`tcp dport != 53 oifname "lo" ip6 daddr != ::1/128 meta skuid 5678 jump KUMA_MESH_INBOUND_REDIRECT`,
+			"ip daddr 8.8.8.8/32 tcp dport 53 redirect to :15053",
+			"ip6 daddr 2001:4860:4860::8888/128 udp dport 53 redirect to :15053",
+			"ip6 saddr 2001:4860:4860::8888/128 udp sport 53 ct zone set 1",
+			"udp sport 15053 meta skuid 5678 ct zone set 2",
+			"ip6 daddr ::1/128 return",
+		),
+		Entry("excluded ports, virtual networks and invalid packets",
+			config.Config{
+				Redirect: config.Redirect{
+					Inbound: config.TrafficFlow{
+						Enabled:      true,
+						ExcludePorts: []uint16{22},
+					},
+					Outbound: config.TrafficFlow{
+						Enabled:      true,
+						ExcludePorts: []uint16{5432},
+						ExcludePortsForUIDs: []config.UIDsToPorts{{
+							Protocol: "udp",
+							UIDs:     "1000,1005:1006",
+							Ports:    "80:81",
+						}},
+					},
+					VNet: config.VNet{
+						Networks: []config.VNetNetwork{
+							{Interface: "docker0", CIDR: "172.18.0.0/16", RedirectTCPPort: 15002},
+							{Interface: "docker+", CIDR: "172.17.0.0/16", RedirectDNS: true},
+							{Interface: "br0", CIDR: "fd00::/8", RedirectDNS: true},
+						},
+					},
+				},
+				DropInvalidPackets: true,
+			},
+			nil,
+			"tcp dport 22 return\n\t\tmeta l4proto tcp jump MESH_INBOUND_REDIRECT",
+			"\tchain MESH_OUTBOUND {\n\t\ttcp dport 5432 return\n",
+			"udp dport 80-81 meta skuid 1000 return\n\t\tudp dport 80-81 meta skuid 1005-1006 return",
+			`		ip daddr != 172.18.0.0/16 iifname "docker0" meta l4proto tcp redirect to :15002
+		meta nfproto ipv4 iifname "docker*" udp dport 53 redirect to :15053
+		ip daddr != 172.17.0.0/16 iifname "docker*" meta l4proto tcp redirect to :15001
+		meta nfproto ipv4 meta l4proto tcp jump MESH_INBOUND`,
+			"type filter hook prerouting priority -150; policy accept;\n\t\tmeta nfproto ipv4 ct state invalid drop",
+		),
+		Entry("port ranges",
+			config.Config{
+				Redirect: config.Redirect{
+					Inbound: config.TrafficFlow{
+						Enabled:           true,
+						IncludePortRanges: "8000:8080",
+					},
+					Outbound: config.TrafficFlow{
+						Enabled:           true,
+						ExcludePortRanges: "5432,30000:32767",
+					},
+				},
+			},
+			nil,
+			"\tchain MESH_INBOUND {\n\t\ttcp dport 8000-8080 jump MESH_INBOUND_REDIRECT\n\t}",
+			"\tchain MESH_OUTBOUND {\n\t\ttcp dport 5432 return\n\t\ttcp dport 30000-32767 return\n",
+		),
+		Entry("sidecar identified by multiple UIDs, GID and mark",
+			config.Config{
+				Owner: config.Owner{UID: "5678", UIDs: []string{"0"}, GID: "1337", Mark: 0x10},
+				Redirect: config.Redirect{
+					Inbound:  config.TrafficFlow{Enabled: true},
+					Outbound: config.TrafficFlow{Enabled: true},
+				},
+			},
+			nil,
+			`		meta l4proto tcp oifname "lo" ip daddr != 127.0.0.1/32 meta skgid 1337 jump MESH_INBOUND_REDIRECT
+		meta l4proto tcp oifname "lo" ip daddr != 127.0.0.1/32 meta mark 0x00000010 jump MESH_INBOUND_REDIRECT
+		meta l4proto tcp oifname "lo" meta skuid != 5678 meta skuid != 0 meta skgid != 1337 meta mark != 0x00000010 return
+		meta skuid 5678 return
+		meta skuid 0 return
+		meta skgid 1337 return
+		meta mark 0x00000010 return`,
+		),
+		Entry("systemd-resolved stub",
+			config.Config{
+				Redirect: config.Redirect{
+					Inbound:  config.TrafficFlow{Enabled: true},
+					Outbound: config.TrafficFlow{Enabled: true},
+					DNS: config.DNS{
+						Enabled:             true,
+						ConntrackZoneSplit:  true,
+						SystemdResolvedUser: "101",
+					},
+				},
+			},
+			[]string{"127.0.0.53", "10.0.0.10"},
+			"\t\tmeta skuid 5678 return\n\t\ttcp dport 53 meta skuid 101 return\n",
+			"\t\tudp dport 53 meta skuid 5678 return\n\t\tudp dport 53 meta skuid 101 return\n",
+			"\t\tmeta nfproto ipv4 udp dport 53 meta skuid 101 ct zone set 1\n",
+			"ip daddr 127.0.0.53/32 udp dport 53 redirect to :15053",
+		),
+		Entry("non-default conntrack zones",
+			config.Config{
+				Redirect: config.Redirect{
+					Inbound:  config.TrafficFlow{Enabled: true},
+					Outbound: config.TrafficFlow{Enabled: true},
+					DNS: config.DNS{
+						Enabled:                  true,
+						CaptureAll:               true,
+						ConntrackZoneSplit:       true,
+						SidecarConntrackZone:     4001,
+						ApplicationConntrackZone: 4002,
+					},
+				},
+			},
+			nil,
+			"\t\tmeta nfproto ipv4 udp dport 53 meta skuid 5678 ct zone set 4001\n",
+			"\t\tmeta nfproto ipv4 udp sport 15053 meta skuid 5678 ct zone set 4002\n",
+			"\t\tmeta nfproto ipv4 udp dport 53 ct zone set 4002\n",
+			"\t\tmeta nfproto ipv4 udp sport 53 ct zone set 4001\n",
+		),
+	)
+
+	It("should skip IPv6 virtual networks when IPv6 is disabled", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				VNet: config.VNet{Networks: []config.VNetNetwork{{Interface: "br0", CIDR: "fd00::/8"}}},
+			},
+		}
+
+		// when
+		table, err := BuildTable(cfg, nil, "lo")
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(table.Build()).ToNot(ContainSubstring("br0"))
+	})
+
+	It("should leave the IPv6 traffic untouched when IPv6 is disabled", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound:  config.TrafficFlow{Enabled: true},
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled:            true,
+					CaptureAll:         true,
+					ConntrackZoneSplit: true,
+				},
+			},
+		}
+
+		// when
+		table, err := BuildTable(cfg, nil, "lo")
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+
+		output := table.Build()
+		for _, rule := range []string{
+			"\t\tmeta nfproto ipv4 meta l4proto tcp jump MESH_INBOUND\n",
+			"\t\tmeta nfproto ipv4 meta l4proto tcp jump MESH_OUTBOUND\n",
+			"\t\tmeta nfproto ipv4 udp dport 53 meta skuid 5678 ct zone set 1\n",
+			"\t\tmeta nfproto ipv4 udp sport 15053 meta skuid 5678 ct zone set 2\n",
+			"\t\tmeta nfproto ipv4 udp dport 53 ct zone set 2\n",
+			"\t\tmeta nfproto ipv4 udp sport 53 ct zone set 1\n",
+		} {
+			Expect(output).To(ContainSubstring(rule))
+		}
+		Expect(output).ToNot(ContainSubstring("\t\tmeta l4proto tcp jump MESH_INBOUND\n"))
+		Expect(output).ToNot(ContainSubstring("\t\tmeta l4proto tcp jump MESH_OUTBOUND\n"))
+		Expect(output).ToNot(ContainSubstring("\t\tudp dport 53 ct zone set"))
+	})
+
+	It("should skip the stub exemption when the systemd-resolved user doesn't exist", func() {
+		// given
+		var stdout strings.Builder
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Inbound:  config.TrafficFlow{Enabled: true},
+				Outbound: config.TrafficFlow{Enabled: true},
+				DNS: config.DNS{
+					Enabled:             true,
+					SystemdResolvedUser: "kuma-net-missing-user",
+				},
+			},
+			RuntimeStdout: &stdout,
+		}
+
+		// when
+		table, err := BuildTable(cfg, []string{"127.0.0.53", "10.0.0.10"}, "lo")
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(table.Build()).To(ContainSubstring("ip daddr 127.0.0.53/32 udp dport 53 redirect to :15053"))
+		Expect(table.Build()).ToNot(ContainSubstring("tcp dport 53 meta skuid"))
+		Expect(stdout.String()).To(ContainSubstring(
+			`[WARNING] cannot find user "kuma-net-missing-user" systemd-resolved runs as`,
+		))
+	})
+
+	DescribeTable("should return an error for invalid configuration",
+		func(cfg config.Config) {
+			_, err := BuildTable(cfg, nil, "lo")
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("invalid owner", config.Config{Owner: config.Owner{UID: "envoy"}}),
+		Entry("invalid owner's group", config.Config{Owner: config.Owner{GID: "envoy"}}),
+		Entry("ipset sets", config.Config{IPSet: config.IPSet{Enabled: true}}),
+		Entry("nflog logging mode", config.Config{
+			Log: config.LogConfig{Enabled: true, Mode: config.LogModeNflog},
+		}),
+		Entry("invalid virtual network's CIDR", config.Config{
+			Redirect: config.Redirect{VNet: config.VNet{Networks: []config.VNetNetwork{
+				{Interface: "docker0", CIDR: "172.17.0.0/33"},
+			}}},
+		}),
+		Entry("invalid virtual network's interface", config.Config{
+			Redirect: config.Redirect{VNet: config.VNet{Networks: []config.VNetNetwork{
+				{Interface: "docker+0", CIDR: "172.17.0.0/16"},
+			}}},
+		}),
+		Entry("virtual networks of the same family on the interface", config.Config{
+			Redirect: config.Redirect{VNet: config.VNet{Networks: []config.VNetNetwork{
+				{Interface: "docker0", CIDR: "172.17.0.0/16"},
+				{Interface: "docker0", CIDR: "172.18.0.0/16"},
+			}}},
+		}),
+		Entry("invalid protocol in excluded ports for UIDs", config.Config{
+			Redirect: config.Redirect{Outbound: config.TrafficFlow{
+				ExcludePortsForUIDs: []config.UIDsToPorts{{Protocol: "icmp", UIDs: "1", Ports: "1"}},
+			}},
+		}),
+		Entry("invalid excluded port range", config.Config{
+			Redirect: config.Redirect{Inbound: config.TrafficFlow{
+				ExcludePortRanges: "30000:70000",
+			}},
+		}),
+		Entry("excluded ports and port ranges set together", config.Config{
+			Redirect: config.Redirect{Outbound: config.TrafficFlow{
+				ExcludePorts:      []uint16{5432},
+				ExcludePortRanges: "30000:32767",
+			}},
+		}),
+		Entry("invalid excluded outbound CIDR", config.Config{
+			Redirect: config.Redirect{Outbound: config.TrafficFlow{
+				ExcludeOutboundIPs: []string{"10.0.0.0/33"},
+			}},
+		}),
+		Entry("conntrack zone out of range", config.Config{
+			Redirect: config.Redirect{DNS: config.DNS{
+				Enabled:              true,
+				ConntrackZoneSplit:   true,
+				SidecarConntrackZone: 70000,
+			}},
+		}),
+		Entry("the same conntrack zones", config.Config{
+			Redirect: config.Redirect{DNS: config.DNS{
+				Enabled:                  true,
+				ConntrackZoneSplit:       true,
+				SidecarConntrackZone:     2,
+				ApplicationConntrackZone: 2,
+			}},
+		}),
+	)
+})
@@ -0,0 +1,89 @@
+//go:build linux
+
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+
+	"github.com/kumahq/kuma-net/iptables/builder"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+func buildTable(cfg config.Config) (*Table, error) {
+	ipv4, ipv6, err := builder.GetDnsServersIfNecessary(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsServers := append(ipv4, ipv6...)
+
+	loopback, err := builder.GetLoopback()
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain loopback interface: %s", err)
+	}
+
+	return BuildTable(cfg, dnsServers, loopback.Name)
+}
+
+// Setup installs the transparent proxy rules as a single nftables inet table.
+// When cfg.DryRun is set, the table will be just printed in the "nft -f"
+// syntax instead
+func Setup(cfg config.Config) (string, error) {
+	cfg = config.MergeConfigWithDefaults(cfg)
+
+	table, err := buildTable(cfg)
+	if err != nil {
+		return "", fmt.Errorf("unable to build nftables rules: %s", err)
+	}
+
+	output := table.Build()
+
+	if cfg.DryRun {
+		_, _ = cfg.RuntimeStdout.Write([]byte(output))
+
+		return output, nil
+	}
+
+	_, _ = fmt.Fprintln(cfg.RuntimeStdout, "Applying following nftables rules:")
+	_, _ = fmt.Fprintln(cfg.RuntimeStdout, output)
+
+	conn, err := nftables.New()
+	if err != nil {
+		return "", fmt.Errorf("unable to open nftables netlink connection: %s", err)
+	}
+
+	if err := table.Apply(conn); err != nil {
+		return "", err
+	}
+
+	_, _ = cfg.RuntimeStdout.Write([]byte("nftables set to diverge the traffic " +
+		"to Envoy.\n"))
+
+	return output, nil
+}
+
+// Cleanup removes the nftables table installed by Setup
+func Cleanup(cfg config.Config) (string, error) {
+	cfg = config.MergeConfigWithDefaults(cfg)
+	table := NewTable(cfg.Nftables.TableName)
+	output := fmt.Sprintf("delete table inet %s\n", table.Name())
+
+	if cfg.DryRun {
+		_, _ = cfg.RuntimeStdout.Write([]byte(output))
+
+		return output, nil
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return "", fmt.Errorf("unable to open nftables netlink connection: %s", err)
+	}
+
+	if err := table.Delete(conn); err != nil {
+		return "", err
+	}
+
+	return output, nil
+}
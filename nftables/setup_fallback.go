@@ -0,0 +1,17 @@
+//go:build !linux
+
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+func Setup(config.Config) (string, error) {
+	return "", fmt.Errorf("nftables are supported only on linux")
+}
+
+func Cleanup(config.Config) (string, error) {
+	return "", fmt.Errorf("nftables are supported only on linux")
+}
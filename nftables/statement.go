@@ -0,0 +1,508 @@
+//go:build linux
+
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// register is the nftables register used by all the expressions generated
+// in this package. Each statement loads the data it needs and compares it
+// straight away, so there is no need to use more than one
+const register = 1
+
+// ifNameSize is the size of interface names in the kernel (IFNAMSIZ)
+const ifNameSize = 16
+
+type Family string
+
+const (
+	IPv4 Family = "ipv4"
+	IPv6 Family = "ipv6"
+)
+
+func (f Family) nfproto() byte {
+	if f == IPv6 {
+		return unix.NFPROTO_IPV6
+	}
+
+	return unix.NFPROTO_IPV4
+}
+
+// addressKeyword returns the payload keyword used by nft for the family
+// i.e. "ip daddr 127.0.0.1" or "ip6 daddr ::1"
+func (f Family) addressKeyword() string {
+	if f == IPv6 {
+		return "ip6"
+	}
+
+	return "ip"
+}
+
+// FamilyOf returns the family of the provided address or CIDR
+func FamilyOf(address string) (Family, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(address); err != nil {
+			return "", fmt.Errorf("invalid IP address or CIDR: %s", address)
+		}
+	}
+
+	if ip.To4() != nil {
+		return IPv4, nil
+	}
+
+	return IPv6, nil
+}
+
+// Statement is a single part of the rule (a match, or a verdict). It can be
+// rendered in the nft syntax, which is used by the dry run, and as netlink
+// expressions, which are used to apply the rule
+type Statement struct {
+	text  string
+	exprs []expr.Any
+}
+
+func (s *Statement) Build() string {
+	return s.text
+}
+
+func (s *Statement) Expressions() []expr.Any {
+	return s.exprs
+}
+
+func cmp(negative bool, data []byte) *expr.Cmp {
+	op := expr.CmpOpEq
+	if negative {
+		op = expr.CmpOpNeq
+	}
+
+	return &expr.Cmp{Op: op, Register: register, Data: data}
+}
+
+func operator(negative bool) string {
+	if negative {
+		return "!= "
+	}
+
+	return ""
+}
+
+func protocolNumber(protocol string) (byte, error) {
+	switch protocol {
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol %s, only 'tcp' or 'udp' allowed", protocol)
+	}
+}
+
+func mustProtocolNumber(protocol string) byte {
+	number, err := protocolNumber(protocol)
+	if err != nil {
+		panic(err)
+	}
+
+	return number
+}
+
+// NFProto matches packets of the provided family ("meta nfproto ipv4")
+func NFProto(family Family) *Statement {
+	return &Statement{
+		text: fmt.Sprintf("meta nfproto %s", family),
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: register},
+			cmp(false, []byte{family.nfproto()}),
+		},
+	}
+}
+
+// L4Proto matches packets of the provided transport protocol
+// ("meta l4proto tcp"). Only "tcp" and "udp" are allowed
+func L4Proto(protocol string) *Statement {
+	return &Statement{
+		text: fmt.Sprintf("meta l4proto %s", protocol),
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: register},
+			cmp(false, []byte{mustProtocolNumber(protocol)}),
+		},
+	}
+}
+
+func port(protocol string, destination bool, from, to uint16, negative bool) *Statement {
+	keyword := "sport"
+	offset := uint32(0)
+	if destination {
+		keyword = "dport"
+		offset = 2
+	}
+
+	exprs := append(L4Proto(protocol).Expressions(), &expr.Payload{
+		DestRegister: register,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       offset,
+		Len:          2,
+	})
+
+	value := strconv.Itoa(int(from))
+	if from == to {
+		exprs = append(exprs, cmp(negative, binaryutil.BigEndian.PutUint16(from)))
+	} else {
+		value = fmt.Sprintf("%d-%d", from, to)
+		exprs = append(exprs, rangeExpr(
+			negative,
+			binaryutil.BigEndian.PutUint16(from),
+			binaryutil.BigEndian.PutUint16(to),
+		))
+	}
+
+	return &Statement{
+		text:  fmt.Sprintf("%s %s %s%s", protocol, keyword, operator(negative), value),
+		exprs: exprs,
+	}
+}
+
+func rangeExpr(negative bool, from, to []byte) *expr.Range {
+	op := expr.CmpOpEq
+	if negative {
+		op = expr.CmpOpNeq
+	}
+
+	return &expr.Range{Op: op, Register: register, FromData: from, ToData: to}
+}
+
+// DestinationPort matches transport protocol's destination port
+// ("tcp dport 53")
+func DestinationPort(protocol string, p uint16) *Statement {
+	return port(protocol, true, p, p, false)
+}
+
+// NotDestinationPort matches transport protocol's destination port different
+// from the provided one ("tcp dport != 53")
+func NotDestinationPort(protocol string, p uint16) *Statement {
+	return port(protocol, true, p, p, true)
+}
+
+// DestinationPortRange matches transport protocol's destination ports from
+// the provided range ("tcp dport 1000-1005")
+func DestinationPortRange(protocol string, from, to uint16) *Statement {
+	return port(protocol, true, from, to, false)
+}
+
+// SourcePort matches transport protocol's source port ("udp sport 53")
+func SourcePort(protocol string, p uint16) *Statement {
+	return port(protocol, false, p, p, false)
+}
+
+func address(cidr string, source bool, negative bool) (*Statement, error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %s", err)
+	}
+
+	family := IPv4
+	ip := network.IP.To4()
+	offset := uint32(12)
+	if ip == nil {
+		family = IPv6
+		ip = network.IP.To16()
+		offset = 8
+	}
+
+	keyword := "saddr"
+	if !source {
+		keyword = "daddr"
+		offset += uint32(len(ip))
+	}
+
+	exprs := append(NFProto(family).Expressions(), &expr.Payload{
+		DestRegister: register,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          uint32(len(ip)),
+	})
+
+	if ones, bits := network.Mask.Size(); ones != bits {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: register,
+			DestRegister:   register,
+			Len:            uint32(len(ip)),
+			Mask:           network.Mask,
+			Xor:            make([]byte, len(ip)),
+		})
+	}
+
+	return &Statement{
+		text: fmt.Sprintf("%s %s %s%s",
+			family.addressKeyword(), keyword, operator(negative), network),
+		exprs: append(exprs, cmp(negative, ip)),
+	}, nil
+}
+
+// Source matches packets with the source address from the provided CIDR
+// (or IP address)
+func Source(cidr string) (*Statement, error) {
+	return address(cidr, true, false)
+}
+
+// Destination matches packets with the destination address from
+// the provided CIDR (or IP address)
+func Destination(cidr string) (*Statement, error) {
+	return address(cidr, false, false)
+}
+
+// NotDestination matches packets with the destination address outside
+// the provided CIDR (or IP address)
+func NotDestination(cidr string) (*Statement, error) {
+	return address(cidr, false, true)
+}
+
+func ifName(key expr.MetaKey, keyword string, name string) *Statement {
+	// iptables' wildcard "docker+" is represented by "docker*" in nft, and
+	// in such case only the prefix is compared
+	data := make([]byte, ifNameSize)
+	copy(data, name)
+
+	if strings.HasSuffix(name, "+") {
+		name = strings.TrimSuffix(name, "+")
+		data = []byte(name)
+		keyword = fmt.Sprintf("%s %q", keyword, name+"*")
+	} else {
+		keyword = fmt.Sprintf("%s %q", keyword, name)
+	}
+
+	return &Statement{
+		text: keyword,
+		exprs: []expr.Any{
+			&expr.Meta{Key: key, Register: register},
+			cmp(false, data),
+		},
+	}
+}
+
+// InInterface matches packets received via the provided interface
+// ("iifname "eth0""). If the name ends with "+", any interface which begins
+// with this name will match
+func InInterface(name string) *Statement {
+	return ifName(expr.MetaKeyIIFNAME, "iifname", name)
+}
+
+// OutInterface matches packets going to be sent via the provided interface
+// ("oifname "lo""). If the name ends with "+", any interface which begins
+// with this name will match
+func OutInterface(name string) *Statement {
+	return ifName(expr.MetaKeyOIFNAME, "oifname", name)
+}
+
+func skuid(from, to uint32, negative bool) *Statement {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeySKUID, Register: register},
+	}
+
+	value := strconv.Itoa(int(from))
+	if from == to {
+		exprs = append(exprs, cmp(negative, binaryutil.NativeEndian.PutUint32(from)))
+	} else {
+		// UIDs are stored in the host byte order, so to compare ranges
+		// we have to convert them first
+		value = fmt.Sprintf("%d-%d", from, to)
+		exprs = append(exprs,
+			&expr.Byteorder{
+				SourceRegister: register,
+				DestRegister:   register,
+				Op:             expr.ByteorderHton,
+				Len:            4,
+				Size:           4,
+			},
+			rangeExpr(
+				negative,
+				binaryutil.BigEndian.PutUint32(from),
+				binaryutil.BigEndian.PutUint32(to),
+			),
+		)
+	}
+
+	return &Statement{
+		text:  fmt.Sprintf("meta skuid %s%s", operator(negative), value),
+		exprs: exprs,
+	}
+}
+
+// SkUID matches packets which socket is owned by the provided user
+// ("meta skuid 5678")
+func SkUID(uid uint32) *Statement {
+	return skuid(uid, uid, false)
+}
+
+// NotSkUID matches packets which socket is not owned by the provided user
+// ("meta skuid != 5678")
+func NotSkUID(uid uint32) *Statement {
+	return skuid(uid, uid, true)
+}
+
+// SkUIDRange matches packets which socket is owned by the user from
+// the provided range ("meta skuid 1000-1005")
+func SkUIDRange(from, to uint32) *Statement {
+	return skuid(from, to, false)
+}
+
+func skgid(gid uint32, negative bool) *Statement {
+	return &Statement{
+		text: fmt.Sprintf("meta skgid %s%d", operator(negative), gid),
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeySKGID, Register: register},
+			cmp(negative, binaryutil.NativeEndian.PutUint32(gid)),
+		},
+	}
+}
+
+// SkGID matches packets which socket is owned by the provided group
+// ("meta skgid 5678")
+func SkGID(gid uint32) *Statement {
+	return skgid(gid, false)
+}
+
+// NotSkGID matches packets which socket is not owned by the provided group
+// ("meta skgid != 5678")
+func NotSkGID(gid uint32) *Statement {
+	return skgid(gid, true)
+}
+
+func mark(value uint32, negative bool) *Statement {
+	return &Statement{
+		text: fmt.Sprintf("meta mark %s0x%08x", operator(negative), value),
+		exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: register},
+			cmp(negative, binaryutil.NativeEndian.PutUint32(value)),
+		},
+	}
+}
+
+// Mark matches packets with the provided mark ("meta mark 0x00000539")
+func Mark(value uint32) *Statement {
+	return mark(value, false)
+}
+
+// NotMark matches packets without the provided mark ("meta mark != 0x00000539")
+func NotMark(value uint32) *Statement {
+	return mark(value, true)
+}
+
+// CtStateInvalid matches packets which are associated with no known
+// connection ("ct state invalid")
+func CtStateInvalid() *Statement {
+	return &Statement{
+		text: "ct state invalid",
+		exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeySTATE, Register: register},
+			&expr.Bitwise{
+				SourceRegister: register,
+				DestRegister:   register,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitINVALID),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			cmp(true, binaryutil.NativeEndian.PutUint32(0)),
+		},
+	}
+}
+
+// CtZoneSet sets the conntrack zone of the packet ("ct zone set 1")
+func CtZoneSet(zone uint16) *Statement {
+	return &Statement{
+		text: fmt.Sprintf("ct zone set %d", zone),
+		exprs: []expr.Any{
+			&expr.Immediate{
+				Register: register,
+				Data:     binaryutil.NativeEndian.PutUint16(zone),
+			},
+			&expr.Ct{Key: expr.CtKeyZONE, Register: register, SourceRegister: true},
+		},
+	}
+}
+
+// Log logs the packet to the kernel log with the provided prefix and level
+// ("log prefix "OUTPUT:" level debug")
+func Log(prefix string, level uint16) *Statement {
+	levels := []string{
+		"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug",
+	}
+
+	levelName := strconv.Itoa(int(level))
+	if int(level) < len(levels) {
+		levelName = levels[level]
+	}
+
+	return &Statement{
+		text: fmt.Sprintf("log prefix %q level %s", prefix, levelName),
+		exprs: []expr.Any{
+			&expr.Log{
+				Key:   1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_LEVEL,
+				Level: expr.LogLevel(level),
+				Data:  []byte(prefix),
+			},
+		},
+	}
+}
+
+// Redirect redirects the packet to the provided port on the local machine
+// ("redirect to :15001"). As the port is a part of the transport protocol
+// header, the rule has to match the protocol (i.e. by L4Proto) beforehand
+func Redirect(p uint16) *Statement {
+	return &Statement{
+		text: fmt.Sprintf("redirect to :%d", p),
+		exprs: []expr.Any{
+			&expr.Immediate{
+				Register: register,
+				Data:     binaryutil.BigEndian.PutUint16(p),
+			},
+			&expr.Redir{RegisterProtoMin: register},
+		},
+	}
+}
+
+func verdict(text string, kind expr.VerdictKind, chain string) *Statement {
+	return &Statement{
+		text:  text,
+		exprs: []expr.Any{&expr.Verdict{Kind: kind, Chain: chain}},
+	}
+}
+
+// Return stops processing of the current chain and resumes at the next rule
+// of the calling chain
+func Return() *Statement {
+	return verdict("return", expr.VerdictReturn, "")
+}
+
+// Jump continues processing at the first rule of the provided chain
+func Jump(chain string) *Statement {
+	return verdict(fmt.Sprintf("jump %s", chain), expr.VerdictJump, chain)
+}
+
+// Drop drops the packet
+func Drop() *Statement {
+	return verdict("drop", expr.VerdictDrop, "")
+}
+
+// Accept stops processing of the ruleset and accepts the packet
+func Accept() *Statement {
+	return verdict("accept", expr.VerdictAccept, "")
+}
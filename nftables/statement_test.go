@@ -0,0 +1,95 @@
+//go:build linux
+
+package nftables_test
+
+import (
+	"github.com/google/nftables/expr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kumahq/kuma-net/nftables"
+)
+
+var _ = Describe("Statement", func() {
+	DescribeTable("should build valid nft syntax",
+		func(statement *Statement, want string) {
+			Expect(statement.Build()).To(Equal(want))
+		},
+		Entry("nfproto", NFProto(IPv6), "meta nfproto ipv6"),
+		Entry("l4proto", L4Proto("udp"), "meta l4proto udp"),
+		Entry("destination port", DestinationPort("tcp", 53), "tcp dport 53"),
+		Entry("negated destination port", NotDestinationPort("tcp", 53), "tcp dport != 53"),
+		Entry("destination port range", DestinationPortRange("udp", 1000, 1005), "udp dport 1000-1005"),
+		Entry("source port", SourcePort("udp", 53), "udp sport 53"),
+		Entry("in interface", InInterface("eth0"), `iifname "eth0"`),
+		Entry("in interface with wildcard", InInterface("docker+"), `iifname "docker*"`),
+		Entry("out interface", OutInterface("lo"), `oifname "lo"`),
+		Entry("socket uid", SkUID(5678), "meta skuid 5678"),
+		Entry("negated socket uid", NotSkUID(5678), "meta skuid != 5678"),
+		Entry("socket uid range", SkUIDRange(1000, 1005), "meta skuid 1000-1005"),
+		Entry("socket gid", SkGID(5678), "meta skgid 5678"),
+		Entry("negated socket gid", NotSkGID(5678), "meta skgid != 5678"),
+		Entry("mark", Mark(0x539), "meta mark 0x00000539"),
+		Entry("negated mark", NotMark(0x539), "meta mark != 0x00000539"),
+		Entry("invalid conntrack state", CtStateInvalid(), "ct state invalid"),
+		Entry("conntrack zone", CtZoneSet(2), "ct zone set 2"),
+		Entry("log", Log("OUTPUT:", 7), `log prefix "OUTPUT:" level debug`),
+		Entry("redirect", Redirect(15001), "redirect to :15001"),
+		Entry("return", Return(), "return"),
+		Entry("jump", Jump("MESH_OUTBOUND"), "jump MESH_OUTBOUND"),
+		Entry("drop", Drop(), "drop"),
+	)
+
+	DescribeTable("should build valid address matches",
+		func(build func(string) (*Statement, error), address string, want string) {
+			// when
+			statement, err := build(address)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(statement.Build()).To(Equal(want))
+		},
+		Entry("IPv4 source", Source, "127.0.0.6", "ip saddr 127.0.0.6/32"),
+		Entry("IPv6 source", Source, "::6/128", "ip6 saddr ::6/128"),
+		Entry("IPv4 destination", Destination, "10.0.0.0/8", "ip daddr 10.0.0.0/8"),
+		Entry("IPv6 negated destination", NotDestination, "fd00::/8", "ip6 daddr != fd00::/8"),
+	)
+
+	It("should reject invalid addresses", func() {
+		_, err := Destination("10.0.0.300/8")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should compare the interface prefix only when wildcard is used", func() {
+		// when
+		exprs := InInterface("docker+").Expressions()
+
+		// then
+		Expect(exprs).To(HaveLen(2))
+		Expect(exprs[1]).To(Equal(&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte("docker"),
+		}))
+	})
+
+	It("should mask the address when CIDR is not a single address", func() {
+		// when
+		statement, err := Destination("10.1.0.0/16")
+		Expect(err).ToNot(HaveOccurred())
+		exprs := statement.Expressions()
+
+		// then
+		Expect(exprs).To(ContainElement(&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       16,
+			Len:          4,
+		}))
+		Expect(exprs[len(exprs)-1]).To(Equal(&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{10, 1, 0, 0},
+		}))
+	})
+})
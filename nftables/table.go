@@ -0,0 +1,238 @@
+//go:build linux
+
+package nftables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+type Rule struct {
+	statements []*Statement
+}
+
+func (r *Rule) Build() string {
+	var result []string
+
+	for _, statement := range r.statements {
+		result = append(result, statement.Build())
+	}
+
+	return strings.Join(result, " ")
+}
+
+func (r *Rule) Expressions() []expr.Any {
+	var result []expr.Any
+
+	for _, statement := range r.statements {
+		result = append(result, statement.Expressions()...)
+	}
+
+	return result
+}
+
+// Hook describes the base chain, which is the entry point for packets
+// from the networking stack
+type Hook struct {
+	Type     nftables.ChainType
+	Hook     *nftables.ChainHook
+	Priority *nftables.ChainPriority
+}
+
+func (h *Hook) Build() string {
+	hooks := map[nftables.ChainHook]string{
+		*nftables.ChainHookPrerouting:  "prerouting",
+		*nftables.ChainHookInput:       "input",
+		*nftables.ChainHookForward:     "forward",
+		*nftables.ChainHookOutput:      "output",
+		*nftables.ChainHookPostrouting: "postrouting",
+	}
+
+	return fmt.Sprintf("type %s hook %s priority %d; policy accept;",
+		h.Type, hooks[*h.Hook], *h.Priority)
+}
+
+type Chain struct {
+	name  string
+	hook  *Hook
+	rules []*Rule
+}
+
+func (c *Chain) Name() string {
+	return c.name
+}
+
+func (c *Chain) Append(statements ...*Statement) *Chain {
+	c.rules = append(c.rules, &Rule{statements: statements})
+
+	return c
+}
+
+func (c *Chain) AppendIf(predicate func() bool, statements ...*Statement) *Chain {
+	if predicate() {
+		return c.Append(statements...)
+	}
+
+	return c
+}
+
+func (c *Chain) Build() []string {
+	var lines []string
+
+	if c.hook != nil {
+		lines = append(lines, c.hook.Build())
+	}
+
+	for _, rule := range c.rules {
+		lines = append(lines, rule.Build())
+	}
+
+	return lines
+}
+
+func NewChain(name string) *Chain {
+	return &Chain{name: name}
+}
+
+func NewBaseChain(name string, hook *Hook) *Chain {
+	return &Chain{name: name, hook: hook}
+}
+
+// Table is a single inet table which holds rules for both IPv4 and IPv6
+type Table struct {
+	name   string
+	chains []*Chain
+}
+
+func (t *Table) Name() string {
+	return t.name
+}
+
+func (t *Table) WithChain(chain *Chain) *Table {
+	t.chains = append(t.chains, chain)
+
+	return t
+}
+
+// Build will generate the table in the syntax accepted by "nft -f". Table is
+// declared and deleted first, so applying the output will atomically replace
+// the previously installed table (if any)
+func (t *Table) Build() string {
+	lines := []string{
+		fmt.Sprintf("table inet %s", t.name),
+		fmt.Sprintf("delete table inet %s", t.name),
+		fmt.Sprintf("table inet %s {", t.name),
+	}
+
+	for i, chain := range t.chains {
+		if i > 0 {
+			lines = append(lines, "")
+		}
+
+		lines = append(lines, fmt.Sprintf("\tchain %s {", chain.Name()))
+
+		for _, line := range chain.Build() {
+			lines = append(lines, "\t\t"+line)
+		}
+
+		lines = append(lines, "\t}")
+	}
+
+	lines = append(lines, "}")
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (t *Table) nftTable() *nftables.Table {
+	return &nftables.Table{Name: t.name, Family: nftables.TableFamilyINet}
+}
+
+func exists(conn *nftables.Conn, table *nftables.Table) (bool, error) {
+	tables, err := conn.ListTablesOfFamily(table.Family)
+	if err != nil {
+		return false, fmt.Errorf("listing nftables tables failed: %s", err)
+	}
+
+	for _, t := range tables {
+		if t.Name == table.Name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Apply will replace the previously installed table (if any) with this one
+// in a single netlink batch, so the change is atomic
+func (t *Table) Apply(conn *nftables.Conn) error {
+	table := t.nftTable()
+
+	found, err := exists(conn, table)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		conn.DelTable(table)
+	}
+
+	conn.AddTable(table)
+
+	chains := map[string]*nftables.Chain{}
+
+	// all chains have to be added before rules, as rules can jump to chains
+	// which are declared later
+	for _, c := range t.chains {
+		chain := &nftables.Chain{Name: c.Name(), Table: table}
+		if c.hook != nil {
+			policy := nftables.ChainPolicyAccept
+			chain.Type = c.hook.Type
+			chain.Hooknum = c.hook.Hook
+			chain.Priority = c.hook.Priority
+			chain.Policy = &policy
+		}
+
+		chains[c.Name()] = conn.AddChain(chain)
+	}
+
+	for _, c := range t.chains {
+		for _, rule := range c.rules {
+			conn.AddRule(&nftables.Rule{
+				Table: table,
+				Chain: chains[c.Name()],
+				Exprs: rule.Expressions(),
+			})
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("applying nftables table %s failed: %s", t.name, err)
+	}
+
+	return nil
+}
+
+// Delete will remove the table (and all of its chains and rules) if it exists
+func (t *Table) Delete(conn *nftables.Conn) error {
+	table := t.nftTable()
+
+	found, err := exists(conn, table)
+	if err != nil || !found {
+		return err
+	}
+
+	conn.DelTable(table)
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("deleting nftables table %s failed: %s", t.name, err)
+	}
+
+	return nil
+}
+
+func NewTable(name string) *Table {
+	return &Table{name: name}
+}
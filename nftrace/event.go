@@ -0,0 +1,177 @@
+package nftrace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// constants from linux/netfilter.h, which are not exported by the unix
+// package
+const (
+	verdictDrop   = 0 // NF_DROP
+	verdictAccept = 1 // NF_ACCEPT
+	verdictStolen = 2 // NF_STOLEN
+	verdictQueue  = 3 // NF_QUEUE
+	verdictRepeat = 4 // NF_REPEAT
+	verdictMask   = 0x000000ff
+)
+
+// attrTypeMask removes the NLA_F_NESTED and NLA_F_NET_BYTEORDER flags from
+// the attribute type (NLA_TYPE_MASK)
+const attrTypeMask = 0x3fff
+
+// Type describes why the trace event was emitted
+type Type string
+
+const (
+	// TypeRule is emitted when the packet matched the rule
+	TypeRule Type = "rule"
+	// TypeReturn is emitted when the packet reached the end of the user
+	// defined chain, and returns to the calling one
+	TypeReturn Type = "return"
+	// TypePolicy is emitted when the packet reached the end of the base chain,
+	// so the chain policy was applied
+	TypePolicy Type = "policy"
+)
+
+var types = map[uint32]Type{
+	unix.NFT_TRACETYPE_POLICY: TypePolicy,
+	unix.NFT_TRACETYPE_RETURN: TypeReturn,
+	unix.NFT_TRACETYPE_RULE:   TypeRule,
+}
+
+// Event describes a single step of the traced packet through the netfilter
+// chains. Events of the same packet share the ID
+type Event struct {
+	ID     uint32
+	IPv6   bool
+	Type   Type
+	Table  string
+	Chain  string
+	Handle uint64
+	// Verdict is the verdict of the rule or the policy (i.e. "accept",
+	// "jump" or "continue")
+	Verdict string
+	// Target is the chain the packet jumped to, when the verdict is "jump"
+	// or "goto"
+	Target string
+}
+
+// String returns the human-readable description of the event, i.e.
+// "nat KUMA_MESH_OUTBOUND rule 12: jump KUMA_MESH_OUTBOUND_REDIRECT"
+func (e Event) String() string {
+	step := string(e.Type)
+	if e.Type == TypeRule {
+		step = fmt.Sprintf("rule %d", e.Handle)
+	}
+
+	verdict := e.Verdict
+	if e.Target != "" {
+		verdict += " " + e.Target
+	}
+
+	return fmt.Sprintf("%s %s %s: %s", e.Table, e.Chain, step, verdict)
+}
+
+var verdicts = map[int32]string{
+	verdictDrop:       "drop",
+	verdictAccept:     "accept",
+	verdictStolen:     "stolen",
+	verdictQueue:      "queue",
+	verdictRepeat:     "repeat",
+	unix.NFT_CONTINUE: "continue",
+	unix.NFT_BREAK:    "break",
+	unix.NFT_JUMP:     "jump",
+	unix.NFT_GOTO:     "goto",
+	unix.NFT_RETURN:   "return",
+}
+
+func verdictName(code int32) string {
+	// queue verdicts hold the queue number in the upper bits
+	if code >= 0 {
+		code &= verdictMask
+	}
+
+	if name, ok := verdicts[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("verdict %d", code)
+}
+
+func parseVerdict(event *Event, data []byte) error {
+	attrs, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return fmt.Errorf("cannot parse verdict: %s", err)
+	}
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type & attrTypeMask {
+		case unix.NFTA_VERDICT_CODE:
+			if len(attr.Value) >= 4 {
+				event.Verdict = verdictName(int32(binary.BigEndian.Uint32(attr.Value)))
+			}
+		case unix.NFTA_VERDICT_CHAIN:
+			event.Target = strings.TrimRight(string(attr.Value), "\x00")
+		}
+	}
+
+	return nil
+}
+
+// parseEvent parses the NFT_MSG_TRACE message (without the netlink header)
+func parseEvent(data []byte) (Event, error) {
+	var event Event
+
+	if len(data) < nl.SizeofNfgenmsg {
+		return event, fmt.Errorf("truncated message")
+	}
+
+	event.IPv6 = data[0] == unix.NFPROTO_IPV6
+
+	attrs, err := nl.ParseRouteAttr(data[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return event, fmt.Errorf("cannot parse attributes: %s", err)
+	}
+
+	for _, attr := range attrs {
+		value := attr.Value
+
+		switch attr.Attr.Type & attrTypeMask {
+		case unix.NFTA_TRACE_ID:
+			if len(value) >= 4 {
+				event.ID = binary.BigEndian.Uint32(value)
+			}
+		case unix.NFTA_TRACE_TYPE:
+			if len(value) >= 4 {
+				event.Type = types[binary.BigEndian.Uint32(value)]
+			}
+		case unix.NFTA_TRACE_TABLE:
+			event.Table = strings.TrimRight(string(value), "\x00")
+		case unix.NFTA_TRACE_CHAIN:
+			event.Chain = strings.TrimRight(string(value), "\x00")
+		case unix.NFTA_TRACE_RULE_HANDLE:
+			if len(value) >= 8 {
+				event.Handle = binary.BigEndian.Uint64(value)
+			}
+		case unix.NFTA_TRACE_VERDICT:
+			if err := parseVerdict(&event, value); err != nil {
+				return event, err
+			}
+		case unix.NFTA_TRACE_POLICY:
+			if len(value) >= 4 {
+				event.Verdict = verdictName(int32(binary.BigEndian.Uint32(value)))
+			}
+		}
+	}
+
+	if event.Type == "" {
+		return event, fmt.Errorf("unknown trace type")
+	}
+
+	return event, nil
+}
@@ -0,0 +1,122 @@
+package nftrace
+
+import (
+	"encoding/binary"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func be64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func message(family uint8, attrs ...*nl.RtAttr) []byte {
+	data := []byte{family, nl.NFNETLINK_V0, 0, 0}
+
+	for _, attr := range attrs {
+		data = append(data, attr.Serialize()...)
+	}
+
+	return data
+}
+
+func verdict(code int32, chain string) *nl.RtAttr {
+	attr := nl.NewRtAttr(unix.NFTA_TRACE_VERDICT|unix.NLA_F_NESTED, nil)
+	attr.AddRtAttr(unix.NFTA_VERDICT_CODE, be32(uint32(code)))
+
+	if chain != "" {
+		attr.AddRtAttr(unix.NFTA_VERDICT_CHAIN, nl.ZeroTerminated(chain))
+	}
+
+	return attr
+}
+
+var _ = Describe("nf_trace events", func() {
+	DescribeTable("should parse the event",
+		func(data []byte, want Event, description string) {
+			// when
+			event, err := parseEvent(data)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(event).To(Equal(want))
+			Expect(event.String()).To(Equal(description))
+		},
+		Entry("rule jumping to the chain",
+			message(unix.NFPROTO_IPV4,
+				nl.NewRtAttr(unix.NFTA_TRACE_TABLE, nl.ZeroTerminated("nat")),
+				nl.NewRtAttr(unix.NFTA_TRACE_CHAIN, nl.ZeroTerminated("KUMA_MESH_OUTBOUND")),
+				nl.NewRtAttr(unix.NFTA_TRACE_ID, be32(0xa1)),
+				nl.NewRtAttr(unix.NFTA_TRACE_TYPE, be32(unix.NFT_TRACETYPE_RULE)),
+				nl.NewRtAttr(unix.NFTA_TRACE_RULE_HANDLE, be64(9)),
+				verdict(unix.NFT_JUMP, "KUMA_MESH_OUTBOUND_REDIRECT"),
+			),
+			Event{
+				ID:      0xa1,
+				Type:    TypeRule,
+				Table:   "nat",
+				Chain:   "KUMA_MESH_OUTBOUND",
+				Handle:  9,
+				Verdict: "jump",
+				Target:  "KUMA_MESH_OUTBOUND_REDIRECT",
+			},
+			"nat KUMA_MESH_OUTBOUND rule 9: jump KUMA_MESH_OUTBOUND_REDIRECT",
+		),
+		Entry("policy of the base chain",
+			message(unix.NFPROTO_IPV6,
+				nl.NewRtAttr(unix.NFTA_TRACE_TABLE, nl.ZeroTerminated("raw")),
+				nl.NewRtAttr(unix.NFTA_TRACE_CHAIN, nl.ZeroTerminated("OUTPUT")),
+				nl.NewRtAttr(unix.NFTA_TRACE_ID, be32(0xb2)),
+				nl.NewRtAttr(unix.NFTA_TRACE_TYPE, be32(unix.NFT_TRACETYPE_POLICY)),
+				nl.NewRtAttr(unix.NFTA_TRACE_POLICY, be32(verdictAccept)),
+			),
+			Event{
+				ID:      0xb2,
+				IPv6:    true,
+				Type:    TypePolicy,
+				Table:   "raw",
+				Chain:   "OUTPUT",
+				Verdict: "accept",
+			},
+			"raw OUTPUT policy: accept",
+		),
+		Entry("rule queueing the packet",
+			message(unix.NFPROTO_IPV4,
+				nl.NewRtAttr(unix.NFTA_TRACE_TABLE, nl.ZeroTerminated("mangle")),
+				nl.NewRtAttr(unix.NFTA_TRACE_CHAIN, nl.ZeroTerminated("PREROUTING")),
+				nl.NewRtAttr(unix.NFTA_TRACE_TYPE, be32(unix.NFT_TRACETYPE_RULE)),
+				nl.NewRtAttr(unix.NFTA_TRACE_RULE_HANDLE, be64(3)),
+				verdict(verdictQueue|5<<16, ""),
+			),
+			Event{
+				Type:    TypeRule,
+				Table:   "mangle",
+				Chain:   "PREROUTING",
+				Handle:  3,
+				Verdict: "queue",
+			},
+			"mangle PREROUTING rule 3: queue",
+		),
+	)
+
+	It("should reject events without the type", func() {
+		// when
+		_, err := parseEvent(message(unix.NFPROTO_IPV4,
+			nl.NewRtAttr(unix.NFTA_TRACE_TABLE, nl.ZeroTerminated("nat")),
+		))
+
+		// then
+		Expect(err).To(MatchError("unknown trace type"))
+	})
+})
@@ -0,0 +1,82 @@
+package nftrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// pollInterval is the interval in which the listener checks if it should
+// stop, when there are no events
+var pollInterval = unix.Timeval{Sec: 1}
+
+// isTransient reports if the error was returned because of the receive
+// timeout, or because the socket buffer overflowed (events are dropped then,
+// but the following ones can be still received)
+func isTransient(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) ||
+		errors.Is(err, unix.EINTR) || errors.Is(err, unix.ENOBUFS)
+}
+
+// Monitor receives nf_trace events (emitted for packets marked by the TRACE
+// target, when rules are installed by the nft variant of iptables)
+type Monitor struct {
+	socket *nl.NetlinkSocket
+}
+
+// Subscribe starts receiving nf_trace events. Events are buffered by
+// the socket until they are read by Listen, so the monitor should be created
+// before packets are marked to not miss any of them
+func Subscribe() (*Monitor, error) {
+	s, err := nl.Subscribe(unix.NETLINK_NETFILTER, unix.NFNLGRP_NFTRACE)
+	if err != nil {
+		return nil, fmt.Errorf("cannot subscribe to nf_trace events: %s", err)
+	}
+
+	if err := s.SetReceiveTimeout(&pollInterval); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("cannot set receive timeout: %s", err)
+	}
+
+	return &Monitor{socket: s}, nil
+}
+
+// Close stops receiving the events
+func (m *Monitor) Close() {
+	m.socket.Close()
+}
+
+// Listen calls the handler with every received event, until the context
+// is done. Events which cannot be decoded are skipped
+func (m *Monitor) Listen(ctx context.Context, handler func(Event)) error {
+	traceType := uint16(unix.NFT_MSG_TRACE | (unix.NFNL_SUBSYS_NFTABLES << 8))
+
+	for ctx.Err() == nil {
+		msgs, _, err := m.socket.Receive()
+		if err != nil {
+			if isTransient(err) {
+				continue
+			}
+
+			return fmt.Errorf("cannot receive nf_trace events: %s", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Type != traceType {
+				continue
+			}
+
+			event, err := parseEvent(msg.Data)
+			if err != nil {
+				continue
+			}
+
+			handler(event)
+		}
+	}
+
+	return nil
+}
@@ -638,6 +638,110 @@ var _ = Describe("Outbound IPv4 DNS/UDP conntrack zone splitting", func() {
 	)
 })
 
+var _ = Describe("Outbound IPv4 DNS/UDP conntrack zone splitting with non-default zones", func() {
+	var err error
+	var ns *netns.NetNS
+
+	BeforeEach(func() {
+		ns, err = netns.NewNetNSBuilder().
+			WithBeforeExecFuncs(sysctl.SetLocalPortRange(32768, 32770)).
+			Build()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(ns.Cleanup()).To(Succeed())
+	})
+
+	DescribeTable("should be redirected to provided port",
+		func(sidecarZone uint32, applicationZone uint32) {
+			// given
+			uid := uintptr(5678)
+			port := socket.GenerateRandomPortsSlice(1, consts.DNSPort)[0]
+			s1Address := fmt.Sprintf("%s:%d", ns.Veth().PeerAddress(), consts.DNSPort)
+			s2Address := fmt.Sprintf("%s:%d", consts.LocalhostIPv4, port)
+			tproxyConfig := config.Config{
+				Redirect: config.Redirect{
+					DNS: config.DNS{
+						Enabled:                  true,
+						Port:                     port,
+						ConntrackZoneSplit:       true,
+						CaptureAll:               true,
+						SidecarConntrackZone:     sidecarZone,
+						ApplicationConntrackZone: applicationZone,
+					},
+					Outbound: config.TrafficFlow{
+						Enabled: true,
+					},
+					Inbound: config.TrafficFlow{
+						Enabled: true,
+					},
+				},
+				Owner:         config.Owner{UID: strconv.Itoa(int(uid))},
+				RuntimeStdout: ioutil.Discard,
+			}
+			want := map[string]uint{
+				s1Address: blackbox_tests.DNSConntrackZoneSplittingStressCallsAmount,
+				s2Address: blackbox_tests.DNSConntrackZoneSplittingStressCallsAmount,
+			}
+
+			s1ReadyC, s1ErrC := udp.UnsafeStartUDPServer(
+				ns,
+				s1Address,
+				udp.ReplyWithLocalAddr,
+			)
+			Consistently(s1ErrC).ShouldNot(Receive())
+			Eventually(s1ReadyC).Should(BeClosed())
+
+			s2ReadyC, s2ErrC := udp.UnsafeStartUDPServer(
+				ns,
+				s2Address,
+				udp.ReplyWithLocalAddr,
+				sysctl.SetUnprivilegedPortStart(0),
+				syscall.SetUID(uid),
+			)
+			Consistently(s2ErrC).ShouldNot(Receive())
+			Eventually(s2ReadyC).Should(BeClosed())
+
+			// when
+			Eventually(ns.UnsafeExec(func() {
+				Expect(builder.RestoreIPTables(tproxyConfig)).Error().To(Succeed())
+			})).Should(BeClosed())
+
+			results := udp.NewResultMap()
+
+			exec1ErrC := ns.UnsafeExecInLoop(
+				blackbox_tests.DNSConntrackZoneSplittingStressCallsAmount,
+				time.Millisecond,
+				func() {
+					Expect(udp.DialAddrAndIncreaseResultMap(s1Address, results)).To(Succeed())
+				},
+				syscall.SetUID(uid),
+			)
+
+			exec2ErrC := ns.UnsafeExecInLoop(
+				blackbox_tests.DNSConntrackZoneSplittingStressCallsAmount,
+				time.Millisecond,
+				func() {
+					Expect(udp.DialAddrAndIncreaseResultMap(s1Address, results)).To(Succeed())
+				},
+			)
+
+			Consistently(exec1ErrC).ShouldNot(Receive())
+			Consistently(exec2ErrC).ShouldNot(Receive())
+			Eventually(exec1ErrC, blackbox_tests.DNSConntrackZoneSplittingTestTimeout).
+				Should(BeClosed())
+			Eventually(exec2ErrC, blackbox_tests.DNSConntrackZoneSplittingTestTimeout).
+				Should(BeClosed())
+
+			Expect(results.GetFinalResults()).To(BeEquivalentTo(want))
+		},
+		Entry("zones 4001 and 4002", uint32(4001), uint32(4002)),
+		Entry("zones in the reversed order", uint32(2), uint32(1)),
+		Entry("the highest zone", uint32(config.MaxConntrackZone), uint32(1000)),
+	)
+})
+
 var _ = Describe("Outbound IPv6 DNS/UDP conntrack zone splitting", func() {
 	var err error
 	var ns *netns.NetNS
@@ -1071,7 +1175,9 @@ var _ = Describe("Outbound IPv4 DNS/UDP traffic to port 53 from specific input i
 						Enabled: true,
 					},
 					// interface name and its network
-					VNet: config.VNet{Networks: []string{"s-peer+:192.168.0.2/16"}},
+					VNet: config.VNet{Networks: []config.VNetNetwork{
+						{Interface: "s-peer+", CIDR: "192.168.0.2/16", RedirectDNS: true},
+					}},
 				},
 				RuntimeStdout: ioutil.Discard,
 			}
@@ -1159,7 +1265,9 @@ var _ = Describe("Outbound IPv6 DNS/UDP traffic to port 53 from specific input i
 						Enabled: true,
 					},
 					// interface name and its network
-					VNet: config.VNet{Networks: []string{"s-peer+:fd00::10:1:2/64"}},
+					VNet: config.VNet{Networks: []config.VNetNetwork{
+						{Interface: "s-peer+", CIDR: "fd00::10:1:2/64", RedirectDNS: true},
+					}},
 				},
 				IPv6:          true,
 				RuntimeStdout: ioutil.Discard,
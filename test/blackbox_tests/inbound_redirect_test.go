@@ -684,3 +684,240 @@ var _ = Describe("Inbound IPv6 TCP traffic from any ports", func() {
 		}(),
 	)
 })
+
+var _ = Describe("Inbound IPv4 TCP traffic from excluded source IPs", func() {
+	var err error
+	var ns *netns.NetNS
+
+	BeforeEach(func() {
+		ns, err = netns.NewNetNSBuilder().Build()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(ns.Cleanup()).To(Succeed())
+	})
+
+	DescribeTable("should not be redirected to the inbound_redirection port",
+		func(serverPort, randomPort uint16) {
+			// given
+			peerAddress := ns.Veth().PeerAddress()
+			// the traffic is originated from the host's side of the veth pair
+			sourceCIDR := fmt.Sprintf("%s/32", ns.Veth().Address().To4())
+			tproxyConfig := config.Config{
+				Redirect: config.Redirect{
+					Inbound: config.TrafficFlow{
+						Enabled:                 true,
+						Port:                    serverPort,
+						ExcludeInboundSourceIPs: []string{"fd00::/8", sourceCIDR},
+					},
+					Outbound: config.TrafficFlow{
+						Enabled: true,
+					},
+				},
+				RuntimeStdout: ioutil.Discard,
+			}
+
+			redirectReadyC, redirectErrC := tcp.UnsafeStartTCPServer(
+				ns,
+				fmt.Sprintf(":%d", serverPort),
+				tcp.ReplyWith("redirectServer"),
+				tcp.CloseConn,
+			)
+			Eventually(redirectReadyC).Should(BeClosed())
+			Consistently(redirectErrC).ShouldNot(Receive())
+
+			randomReadyC, randomErrC := tcp.UnsafeStartTCPServer(
+				ns,
+				fmt.Sprintf(":%d", randomPort),
+				tcp.ReplyWith("randomServer"),
+				tcp.CloseConn,
+			)
+			Eventually(randomReadyC).Should(BeClosed())
+			Consistently(randomErrC).ShouldNot(Receive())
+
+			// when
+			Eventually(ns.UnsafeExec(func() {
+				Expect(builder.RestoreIPTables(tproxyConfig)).Error().To(Succeed())
+			})).Should(BeClosed())
+
+			// then
+			Expect(tcp.DialIPWithPortAndGetReply(peerAddress, randomPort)).
+				To(Equal("randomServer"))
+
+			// and, then
+			Eventually(randomErrC).Should(BeClosed())
+			Consistently(redirectErrC).ShouldNot(Receive())
+		},
+		func() []TableEntry {
+			var entries []TableEntry
+			var lockedPorts []uint16
+
+			for i := 0; i < blackbox_tests.TestCasesAmount; i++ {
+				randomPorts := socket.GenerateRandomPortsSlice(2, lockedPorts...)
+				// This gives us more entropy as all generated ports will be
+				// different from each other
+				lockedPorts = append(lockedPorts, randomPorts...)
+				desc := fmt.Sprintf("to port %%d, from port %%d")
+				entry := Entry(
+					EntryDescription(desc),
+					randomPorts[0],
+					randomPorts[1],
+				)
+				entries = append(entries, entry)
+			}
+
+			return entries
+		}(),
+	)
+
+	DescribeTable("should be redirected to the inbound_redirection port "+
+		"when the source is not excluded",
+		func(serverPort, randomPort uint16) {
+			// given
+			peerAddress := ns.Veth().PeerAddress()
+			tproxyConfig := config.Config{
+				Redirect: config.Redirect{
+					Inbound: config.TrafficFlow{
+						Enabled:                 true,
+						Port:                    serverPort,
+						ExcludeInboundSourceIPs: []string{"192.0.2.0/24"},
+					},
+					Outbound: config.TrafficFlow{
+						Enabled: true,
+					},
+				},
+				RuntimeStdout: ioutil.Discard,
+			}
+
+			redirectReadyC, redirectErrC := tcp.UnsafeStartTCPServer(
+				ns,
+				fmt.Sprintf(":%d", serverPort),
+				tcp.ReplyWithOriginalDstIPv4,
+				tcp.CloseConn,
+			)
+			Eventually(redirectReadyC).Should(BeClosed())
+			Consistently(redirectErrC).ShouldNot(Receive())
+
+			// when
+			Eventually(ns.UnsafeExec(func() {
+				Expect(builder.RestoreIPTables(tproxyConfig)).Error().To(Succeed())
+			})).Should(BeClosed())
+
+			// then
+			Expect(tcp.DialIPWithPortAndGetReply(peerAddress, randomPort)).
+				To(Equal(fmt.Sprintf("%s:%d", peerAddress, randomPort)))
+
+			// and, then
+			Eventually(redirectErrC).Should(BeClosed())
+		},
+		func() []TableEntry {
+			var entries []TableEntry
+			var lockedPorts []uint16
+
+			for i := 0; i < blackbox_tests.TestCasesAmount; i++ {
+				randomPorts := socket.GenerateRandomPortsSlice(2, lockedPorts...)
+				// This gives us more entropy as all generated ports will be
+				// different from each other
+				lockedPorts = append(lockedPorts, randomPorts...)
+				desc := fmt.Sprintf("to port %%d, from port %%d")
+				entry := Entry(
+					EntryDescription(desc),
+					randomPorts[0],
+					randomPorts[1],
+				)
+				entries = append(entries, entry)
+			}
+
+			return entries
+		}(),
+	)
+})
+
+var _ = Describe("Inbound IPv6 TCP traffic from excluded source IPs", func() {
+	var err error
+	var ns *netns.NetNS
+
+	BeforeEach(func() {
+		ns, err = netns.NewNetNSBuilder().WithIPv6(true).Build()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(ns.Cleanup()).To(Succeed())
+	})
+
+	DescribeTable("should not be redirected to the inbound_redirection port",
+		func(serverPort, randomPort uint16) {
+			// given
+			peerAddress := ns.Veth().PeerAddress()
+			// the traffic is originated from the host's side of the veth pair
+			sourceCIDR := fmt.Sprintf("%s/128", ns.Veth().Address())
+			tproxyConfig := config.Config{
+				Redirect: config.Redirect{
+					Inbound: config.TrafficFlow{
+						Enabled:                 true,
+						PortIPv6:                serverPort,
+						ExcludeInboundSourceIPs: []string{"10.0.0.0/8", sourceCIDR},
+					},
+					Outbound: config.TrafficFlow{
+						Enabled: true,
+					},
+				},
+				IPv6:          true,
+				RuntimeStdout: ioutil.Discard,
+			}
+
+			redirectReadyC, redirectErrC := tcp.UnsafeStartTCPServer(
+				ns,
+				fmt.Sprintf(":%d", serverPort),
+				tcp.ReplyWith("redirectServer"),
+				tcp.CloseConn,
+			)
+			Eventually(redirectReadyC).Should(BeClosed())
+			Consistently(redirectErrC).ShouldNot(Receive())
+
+			randomReadyC, randomErrC := tcp.UnsafeStartTCPServer(
+				ns,
+				fmt.Sprintf(":%d", randomPort),
+				tcp.ReplyWith("randomServer"),
+				tcp.CloseConn,
+			)
+			Eventually(randomReadyC).Should(BeClosed())
+			Consistently(randomErrC).ShouldNot(Receive())
+
+			// when
+			Eventually(ns.UnsafeExec(func() {
+				Expect(builder.RestoreIPTables(tproxyConfig)).Error().To(Succeed())
+			})).Should(BeClosed())
+
+			// then
+			Expect(tcp.DialIPWithPortAndGetReply(peerAddress, randomPort)).
+				To(Equal("randomServer"))
+
+			// and, then
+			Eventually(randomErrC).Should(BeClosed())
+			Consistently(redirectErrC).ShouldNot(Receive())
+		},
+		func() []TableEntry {
+			var entries []TableEntry
+			var lockedPorts []uint16
+
+			for i := 0; i < blackbox_tests.TestCasesAmount; i++ {
+				randomPorts := socket.GenerateRandomPortsSlice(2, lockedPorts...)
+				// This gives us more entropy as all generated ports will be
+				// different from each other
+				lockedPorts = append(lockedPorts, randomPorts...)
+				desc := fmt.Sprintf("to port %%d, from port %%d")
+				entry := Entry(
+					EntryDescription(desc),
+					randomPorts[0],
+					randomPorts[1],
+				)
+				entries = append(entries, entry)
+			}
+
+			return entries
+		}(),
+	)
+})
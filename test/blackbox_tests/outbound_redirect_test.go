@@ -1009,7 +1009,9 @@ var _ = Describe("Outbound IPv4 TCP traffic from specific interface to other ip
 						Enabled: true,
 					},
 					VNet: config.VNet{
-						Networks: []string{"s-peer+:192.168.0.1/32"},
+						Networks: []config.VNetNetwork{
+							{Interface: "s-peer+", CIDR: "192.168.0.1/32", RedirectDNS: true},
+						},
 					},
 				},
 				RuntimeStdout: ioutil.Discard,
@@ -1100,7 +1102,9 @@ var _ = Describe("Outbound IPv6 TCP traffic from specific interface to other ip
 						Enabled: true,
 					},
 					VNet: config.VNet{
-						Networks: []string{"s-peer+:fd00::10:1:1/128"},
+						Networks: []config.VNetNetwork{
+							{Interface: "s-peer+", CIDR: "fd00::10:1:1/128", RedirectDNS: true},
+						},
 					},
 				},
 				IPv6:          true,
@@ -3,14 +3,53 @@ package config
 import (
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 )
 
 const DebugLogLevel uint16 = 7
 
+// Owner identifies the sidecar. The traffic of the sidecar is never redirected,
+// so it's identified by any of the provided UIDs, GID or the socket mark
+// (i.e. when the sidecar runs as root, or next to the helper processes
+// which should be treated the same way)
 type Owner struct {
+	// UID defaults to 5678 only when none of UID, UIDs, GID and Mark is set
 	UID string
+	// UIDs are additional users, the traffic of which should be treated
+	// as the sidecar's one
+	UIDs []string
+	// GID when set, the traffic of processes from this group will be treated
+	// as the sidecar's one
+	GID string
+	// Mark when set (non 0), the traffic from sockets marked with it
+	// (SO_MARK) will be treated as the sidecar's one
+	Mark uint32
+}
+
+// UIDList returns all UIDs identifying the sidecar, starting from UID
+func (o Owner) UIDList() []string {
+	var result []string
+
+	if o.UID != "" {
+		result = append(result, o.UID)
+	}
+
+	for _, uid := range o.UIDs {
+		if uid != "" && uid != o.UID {
+			result = append(result, uid)
+		}
+	}
+
+	return result
+}
+
+// IsUIDOnly reports if the sidecar is identified only by a single UID
+func (o Owner) IsUIDOnly() bool {
+	return len(o.UIDList()) == 1 && o.GID == "" && o.Mark == 0
 }
 
 // ValueOrRangeList is a format acceptable by iptables in which
@@ -20,15 +59,156 @@ type Owner struct {
 // ranges and multiple values can be mixed e.g. 1000,1005:1006 meaning 1000,1005,1006
 type ValueOrRangeList string
 
+// Range represents a single element of the ValueOrRangeList, where for single
+// values From is equal to To
+type Range struct {
+	From uint32
+	To   uint32
+}
+
+// String returns the range in the ValueOrRangeList format (i.e. 1000 or 1000:1003)
+func (r Range) String() string {
+	if r.From == r.To {
+		return strconv.FormatUint(uint64(r.From), 10)
+	}
+
+	return fmt.Sprintf("%d:%d", r.From, r.To)
+}
+
+// NewValueOrRangeList builds the list from the provided values and ranges
+func NewValueOrRangeList(ranges ...Range) ValueOrRangeList {
+	var elements []string
+
+	for _, r := range ranges {
+		elements = append(elements, r.String())
+	}
+
+	return ValueOrRangeList(strings.Join(elements, ","))
+}
+
+// PortsToRanges converts the provided ports into single value ranges
+func PortsToRanges(ports ...uint16) []Range {
+	var result []Range
+
+	for _, port := range ports {
+		result = append(result, Range{From: uint32(port), To: uint32(port)})
+	}
+
+	return result
+}
+
+// Parse splits the list into its values and ranges
+func (l ValueOrRangeList) Parse() ([]Range, error) {
+	var result []Range
+
+	for _, element := range strings.Split(string(l), ",") {
+		bounds := strings.SplitN(strings.TrimSpace(element), ":", 2)
+
+		from, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q in %q: %s", element, l, err)
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid value %q in %q: %s", element, l, err)
+			}
+		}
+
+		if from > to {
+			return nil, fmt.Errorf("invalid range %q in %q: start is greater than end", element, l)
+		}
+
+		result = append(result, Range{From: uint32(from), To: uint32(to)})
+	}
+
+	return result, nil
+}
+
 type UIDsToPorts struct {
 	Protocol string
 	UIDs     ValueOrRangeList
 	Ports    ValueOrRangeList
 }
 
+// RedirectMode selects the mechanism which diverts the traffic to the proxy
+type RedirectMode string
+
+const (
+	// RedirectModeRedirect uses the nat REDIRECT target, which rewrites
+	// the destination of the traffic. The proxy can read the original
+	// destination with SO_ORIGINAL_DST
+	RedirectModeRedirect RedirectMode = "redirect"
+	// RedirectModeTProxy uses the mangle TPROXY target, which delivers
+	// the traffic to the proxy without changing it (the original destination
+	// is the local address of the accepted socket). It's supported only for
+	// the inbound traffic and requires from the proxy to:
+	//   - set IP_TRANSPARENT (IPV6_TRANSPARENT) on the inbound listener socket,
+	//     so it can accept connections to non-local addresses,
+	//   - set IP_TRANSPARENT and SO_MARK (with TProxy.Mark) on the upstream
+	//     sockets, when it preserves the original source address of the traffic
+	//     forwarded to the application, so the responses will be delivered
+	//     back to the proxy,
+	//   - run with CAP_NET_ADMIN capability, which is required to set
+	//     both socket options
+	// In Envoy it means "transparent: true" for the inbound listener and
+	// the SO_MARK socket option for the upstream connections
+	RedirectModeTProxy RedirectMode = "tproxy"
+)
+
+// UDP is the configuration of the transparent interception of the UDP traffic
+// (DNS is intercepted separately, see DNS). The traffic is diverted to the proxy
+// with the mangle TPROXY target and the policy routing configured by TProxy
+// (outbound traffic is marked and routed through the loopback interface first),
+// which requires from the proxy to:
+//   - set IP_TRANSPARENT (IPV6_TRANSPARENT) on its UDP sockets, so it can
+//     receive datagrams sent to non-local addresses, and send the responses
+//     from the original destination addresses,
+//   - set IP_RECVORIGDSTADDR (IPV6_RECVORIGDSTADDR), to read the original
+//     destination of every received datagram,
+//   - run with CAP_NET_ADMIN capability
+type UDP struct {
+	Enabled bool
+	// Port is the port of the proxy's UDP listener
+	Port uint16
+	// PortIPv6 is the port of the proxy's UDP listener for IPv6 traffic
+	// (Port is used when not set)
+	PortIPv6     uint16
+	Chain        Chain
+	ExcludePorts []uint16
+	IncludePorts []uint16
+	// ExcludePortRanges are excluded ports in the ValueOrRangeList format
+	// (i.e. "30000:32767"). It's an alternative to ExcludePorts, so only one
+	// of them can be set
+	ExcludePortRanges ValueOrRangeList
+	// IncludePortRanges are included ports in the ValueOrRangeList format
+	// (i.e. "8000:8080"). It's an alternative to IncludePorts, so only one
+	// of them can be set
+	IncludePortRanges ValueOrRangeList
+}
+
+// ExcludedPorts returns ports from ExcludePorts or ExcludePortRanges
+func (c UDP) ExcludedPorts() []Range {
+	return portRanges(c.ExcludePorts, c.ExcludePortRanges)
+}
+
+// IncludedPorts returns ports from IncludePorts or IncludePortRanges
+func (c UDP) IncludedPorts() []Range {
+	return portRanges(c.IncludePorts, c.IncludePortRanges)
+}
+
+// HasIncludedPorts reports if the traffic is limited to the included ports
+func (c UDP) HasIncludedPorts() bool {
+	return len(c.IncludePorts) > 0 || c.IncludePortRanges != ""
+}
+
 // TrafficFlow is a struct for Inbound/Outbound configuration
 type TrafficFlow struct {
-	Enabled             bool
+	Enabled bool
+	// Mode selects how the traffic is diverted to the proxy (redirect
+	// by default)
+	Mode                RedirectMode
 	Port                uint16
 	PortIPv6            uint16
 	Chain               Chain
@@ -36,18 +216,301 @@ type TrafficFlow struct {
 	ExcludePorts        []uint16
 	ExcludePortsForUIDs []UIDsToPorts
 	IncludePorts        []uint16
+	// ExcludePortRanges are excluded ports in the ValueOrRangeList format
+	// (i.e. "30000:32767"). It's an alternative to ExcludePorts, so only one
+	// of them can be set
+	ExcludePortRanges ValueOrRangeList
+	// IncludePortRanges are included ports in the ValueOrRangeList format
+	// (i.e. "8000:8080"). It's an alternative to IncludePorts, so only one
+	// of them can be set
+	IncludePortRanges ValueOrRangeList
+	// UDP is the configuration of the UDP traffic interception (disabled
+	// by default)
+	UDP UDP
+	// ExcludeOutboundIPs are destination CIDRs (or addresses, IPv4 and IPv6
+	// can be mixed), the outbound traffic to which won't be redirected
+	// (used only by the outbound traffic flow)
+	ExcludeOutboundIPs []string
+	// IncludeOutboundIPs when set, limits the redirected outbound traffic
+	// to the traffic to these destination CIDRs (or addresses, IPv4 and IPv6
+	// can be mixed). When used together with IncludePorts, only the traffic
+	// to these destinations and ports will be redirected (used only by
+	// the outbound traffic flow)
+	IncludeOutboundIPs []string
+	// ExcludeInboundSourceIPs are source CIDRs (or addresses, IPv4 and IPv6
+	// can be mixed), the inbound traffic from which won't be redirected
+	// (used only by the inbound traffic flow)
+	ExcludeInboundSourceIPs []string
+}
+
+func portRanges(ports []uint16, ranges ValueOrRangeList) []Range {
+	result := PortsToRanges(ports...)
+
+	if ranges != "" {
+		// the configuration is validated before it's used, so ranges
+		// are always valid here
+		parsed, _ := ranges.Parse()
+		result = append(result, parsed...)
+	}
+
+	return result
+}
+
+// ExcludedPorts returns ports from ExcludePorts or ExcludePortRanges
+func (c TrafficFlow) ExcludedPorts() []Range {
+	return portRanges(c.ExcludePorts, c.ExcludePortRanges)
 }
 
+// IncludedPorts returns ports from IncludePorts or IncludePortRanges
+func (c TrafficFlow) IncludedPorts() []Range {
+	return portRanges(c.IncludePorts, c.IncludePortRanges)
+}
+
+// HasIncludedPorts reports if the traffic is limited to the included ports
+func (c TrafficFlow) HasIncludedPorts() bool {
+	return len(c.IncludePorts) > 0 || c.IncludePortRanges != ""
+}
+
+// validatePortRanges validates the <field>PortRanges, which cannot be set
+// together with the <field>Ports (i.e. ExcludePortRanges and ExcludePorts),
+// as it would be unclear which one should be used
+func validatePortRanges(field string, ports []uint16, ranges ValueOrRangeList) error {
+	if ranges == "" {
+		return nil
+	}
+
+	if len(ports) > 0 {
+		return fmt.Errorf("%sPortRanges: cannot be used together with %sPorts, "+
+			"all the ports have to be provided in one of them", field, field)
+	}
+
+	field += "PortRanges"
+
+	parsed, err := ranges.Parse()
+	if err != nil {
+		return fmt.Errorf("%s: %s", field, err)
+	}
+
+	for _, r := range parsed {
+		if r.From == 0 || r.To > 65535 {
+			return fmt.Errorf("%s: invalid port range %q, ports have to be between 1 and 65535",
+				field, r.String())
+		}
+	}
+
+	return nil
+}
+
+// MaxConntrackZone is the maximal conntrack zone ID accepted by the kernel
+const MaxConntrackZone = 65535
+
 type DNS struct {
 	Enabled            bool
 	CaptureAll         bool
 	Port               uint16
 	ConntrackZoneSplit bool
 	ResolvConfigPath   string
+	// Servers are IP addresses of DNS servers which traffic will be
+	// redirected, when not all DNS traffic is captured. When empty, servers
+	// are read from ResolvConfigPath
+	Servers []string
+	// SystemdResolvedConfigPath is the resolv.conf file with the upstream
+	// servers of systemd-resolved. It's read when ResolvConfigPath points
+	// at the local stub of systemd-resolved, as applications (i.e. in
+	// containers) can query the upstream servers directly
+	SystemdResolvedConfigPath string
+	// SystemdResolvedUser is the user (name or UID) systemd-resolved runs as.
+	// When the local stub is used, its queries to the upstream servers are not
+	// redirected, as they are made on behalf of the DNS proxy
+	SystemdResolvedUser string
+	// SidecarConntrackZone and ApplicationConntrackZone are conntrack zones
+	// DNS traffic is split into when ConntrackZoneSplit is enabled (queries
+	// of the sidecar and their responses go to the first one, queries of
+	// the application and responses of the DNS proxy to the second one).
+	// They can be changed when the default ones are already used on the node
+	// (i.e. by Cilium, Calico or OVS)
+	SidecarConntrackZone     uint32
+	ApplicationConntrackZone uint32
+}
+
+// TProxy is the configuration of the policy routing used by the tproxy
+// redirect mode
+type TProxy struct {
+	// Mark is the firewall mark of packets which have to be delivered
+	// locally to the proxy
+	Mark uint32
+	// RouteTable is the routing table with the local default route, which
+	// is looked up for packets marked with Mark
+	RouteTable int
+	// DivertChain is the mangle chain which marks packets of the already
+	// established connections
+	DivertChain Chain
+}
+
+// VNetNetwork is the virtual network (i.e. of the docker containers) which
+// traffic, entering through the interface, is redirected to the sidecar
+type VNetNetwork struct {
+	// Interface is the name of the interface the traffic enters through. When
+	// it ends with "+", it matches all interfaces with the preceding prefix
+	// (i.e. "docker+")
+	Interface string
+	// CIDR of the network. Traffic to the addresses of the network is not
+	// redirected
+	CIDR string
+	// RedirectDNS enables redirection of the DNS traffic (UDP port 53) to
+	// the DNS proxy (Redirect.DNS.Port)
+	RedirectDNS bool
+	// RedirectTCPPort is the port TCP traffic is redirected to. When 0,
+	// Redirect.Outbound.Port is used
+	RedirectTCPPort uint16
+}
+
+// TCPPort returns the port TCP traffic of the network is redirected to
+func (n VNetNetwork) TCPPort(outboundPort uint16) uint16 {
+	if n.RedirectTCPPort != 0 {
+		return n.RedirectTCPPort
+	}
+
+	return outboundPort
 }
 
 type VNet struct {
-	Networks []string
+	// Networks are redirected in the provided order, so the more specific
+	// interfaces (i.e. "docker0") should precede the wildcard ones
+	// (i.e. "docker+")
+	Networks []VNetNetwork
+}
+
+// NetworksOfFamily returns virtual networks which CIDRs are of the requested
+// family, in the configured order. Networks are expected to be already
+// validated
+func (v VNet) NetworksOfFamily(ipv6 bool) []VNetNetwork {
+	var result []VNetNetwork
+
+	for _, network := range v.Networks {
+		if _, isIPv6, err := ParseCIDR(network.CIDR); err == nil && isIPv6 == ipv6 {
+			result = append(result, network)
+		}
+	}
+
+	return result
+}
+
+// ParseVNetNetworks parses virtual networks in the "interface:cidr" format
+// (i.e. "docker0:172.17.0.0/16"), in which they were defined before they
+// became typed. Only the first ":" separates the interface from the CIDR, so
+// IPv6 CIDRs can be used. DNS traffic of these networks is redirected
+func ParseVNetNetworks(networks []string) ([]VNetNetwork, error) {
+	var result []VNetNetwork
+
+	for _, network := range networks {
+		pair := strings.SplitN(network, ":", 2)
+		if len(pair) < 2 {
+			return nil, fmt.Errorf("incorrect definition of virtual network: %s", network)
+		}
+
+		result = append(result, VNetNetwork{
+			Interface:   pair[0],
+			CIDR:        pair[1],
+			RedirectDNS: true,
+		})
+	}
+
+	return result, nil
+}
+
+// IFNameMaxLength is the maximal length of the interface's name accepted by
+// the kernel
+const IFNameMaxLength = 15
+
+// validateInterfaceName checks if the name is the valid interface's name,
+// which can end with the iptables' wildcard "+"
+func validateInterfaceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("interface name cannot be empty")
+	}
+
+	if len(name) > IFNameMaxLength {
+		return fmt.Errorf("interface name %q is longer than %d characters",
+			name, IFNameMaxLength)
+	}
+
+	base := strings.TrimSuffix(name, "+")
+	if base == "." || base == ".." || strings.ContainsAny(base, "+/:! \t\n") {
+		return fmt.Errorf("invalid interface name %q", name)
+	}
+
+	return nil
+}
+
+func validateVNet(vnet VNet) error {
+	seen := map[string]bool{}
+
+	for i, network := range vnet.Networks {
+		field := fmt.Sprintf("Redirect.VNet.Networks[%d]", i)
+
+		if err := validateInterfaceName(network.Interface); err != nil {
+			return fmt.Errorf("%s.Interface: %s", field, err)
+		}
+
+		_, ipv6, err := ParseCIDR(network.CIDR)
+		if err != nil {
+			return fmt.Errorf("%s.CIDR: %s", field, err)
+		}
+
+		// rules of the next network of the same family would be shadowed
+		// by the rules of the previous one
+		key := fmt.Sprintf("%s/%t", network.Interface, ipv6)
+		if seen[key] {
+			return fmt.Errorf("%s.Interface: interface %q already has the network "+
+				"of the same family", field, network.Interface)
+		}
+
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// EgressLockdown when enabled will reject outbound TCP and UDP traffic which
+// bypasses the sidecar (i.e. sent from the excluded ports or by raw sockets),
+// unless its destination is on the allow-list
+type EgressLockdown struct {
+	Enabled bool
+	Chain   Chain
+	// AllowedIPs are addresses or CIDRs (IPv4 and IPv6) which can be reached
+	// directly
+	AllowedIPs []string
+	// AllowedPorts are destination ports (TCP and UDP) which can be reached
+	// directly
+	AllowedPorts []uint16
+}
+
+// IPSetMaxNameLength is the maximal length of the set's name accepted by
+// the kernel
+const IPSetMaxNameLength = 31
+
+// IPSetTempSuffix is the suffix of the temporary sets, which are filled with
+// the new members and then swapped with the sets, when the rules are re-applied
+const IPSetTempSuffix = "-tmp"
+
+// IPSet when enabled will match the excluded outbound IPs, and the excluded
+// inbound and outbound TCP ports using ipset sets instead of the separate rules.
+// Members of these sets can be then added or removed at runtime without
+// touching the chains (look at the ipset package). When the rules are
+// re-applied, members of the sets are replaced with the configured ones, so
+// the members added at runtime are not kept
+type IPSet struct {
+	Enabled bool
+	// ExcludeOutboundIPs is the name of the hash:net set holding the excluded
+	// outbound IPs. The name of the IPv6 set has the "6" suffix
+	ExcludeOutboundIPs string
+	// ExcludeOutboundPorts is the name of the bitmap:port set holding
+	// the excluded outbound ports
+	ExcludeOutboundPorts string
+	// ExcludeInboundPorts is the name of the bitmap:port set holding
+	// the excluded inbound ports
+	ExcludeInboundPorts string
 }
 
 type Redirect struct {
@@ -57,6 +520,7 @@ type Redirect struct {
 	Outbound   TrafficFlow
 	DNS        DNS
 	VNet       VNet
+	TProxy     TProxy
 }
 
 type Chain struct {
@@ -78,15 +542,168 @@ type Ebpf struct {
 	ProgramsSourcePath string
 }
 
+type Nftables struct {
+	Enabled bool
+	// TableName is the name of the inet table which will hold all the rules
+	TableName string
+}
+
+// IPTablesMode is the variant of the iptables binaries which will be used
+// to install the rules
+type IPTablesMode string
+
+const (
+	// IPTablesModeAuto will use the variant which is already used by other
+	// components on the host (i.e. kube-proxy or CNI). When the variant cannot
+	// be determined, binaries without the variant suffix (i.e. "iptables")
+	// will be used
+	IPTablesModeAuto   IPTablesMode = "auto"
+	IPTablesModeLegacy IPTablesMode = "legacy"
+	IPTablesModeNft    IPTablesMode = "nft"
+)
+
+type IPTables struct {
+	// Mode selects the variant of iptables binaries (auto by default)
+	Mode IPTablesMode
+}
+
+// Executable returns the name of the binary (i.e. "iptables",
+// "iptables-save" or "iptables-restore") in the variant selected by the mode
+// i.e. "ip6tables-nft-save" for "iptables-save" with nft mode and IPv6
+func (t IPTables) Executable(name string, ipv6 bool) string {
+	if ipv6 {
+		name = strings.Replace(name, "iptables", "ip6tables", 1)
+	}
+
+	switch t.Mode {
+	case IPTablesModeLegacy, IPTablesModeNft:
+		prefix := name[:strings.Index(name, "tables")+len("tables")]
+		return prefix + "-" + string(t.Mode) + strings.TrimPrefix(name, prefix)
+	default:
+		return name
+	}
+}
+
+// LogMode selects the way packets are logged when logging is enabled
+type LogMode string
+
+const (
+	// LogModeLog logs every packet entering OUTPUT and PREROUTING chains
+	// of the nat table to the kernel log (-j LOG)
+	LogModeLog LogMode = "log"
+	// LogModeNflog sends the packets to the NFLOG group with prefixes
+	// describing the decision made about them (i.e. "captured" or
+	// "excluded-port"), limiting the rate of logged packets (-j NFLOG)
+	LogModeNflog LogMode = "nflog"
+)
+
+// DefaultNflogGroup is the NFLOG group the packets are sent to by default
+const DefaultNflogGroup uint16 = 1337
+
 type LogConfig struct {
 	Enabled bool
 	Level   uint16
+	// Mode selects the target used to log packets (log by default)
+	Mode LogMode
+	// NflogGroup is the group the packets are sent to in the nflog mode
+	NflogGroup uint16
+	// RateLimit is the maximal average rate of packets logged in the nflog
+	// mode, in the format of the iptables limit match (i.e. "10/second" or
+	// "600/minute")
+	RateLimit string
+	// RateLimitBurst is the maximal amount of packets logged at once, before
+	// the rate limit takes effect
+	RateLimitBurst uint16
+}
+
+// ShouldNflog reports if the packets should be logged with the decisions made
+// about them to the NFLOG group (-j NFLOG)
+func (c LogConfig) ShouldNflog() bool {
+	return c.Enabled && c.Mode == LogModeNflog
+}
+
+// limitScale is the scale of the average period between packets used by
+// the iptables limit match
+const limitScale = 10000
+
+// limitUnits are units of the iptables limit match with the amount of
+// scaled periods in them, from the longest one
+var limitUnits = []struct {
+	name   string
+	short  string
+	period uint32
+}{
+	{name: "day", short: "day", period: limitScale * 24 * 60 * 60},
+	{name: "hour", short: "hour", period: limitScale * 60 * 60},
+	{name: "minute", short: "min", period: limitScale * 60},
+	{name: "second", short: "sec", period: limitScale},
+}
+
+// ParseLimitRate parses the rate in the format of the iptables limit match
+// ("<amount>/<unit>", where unit is "second", "minute", "hour", "day" or
+// their prefix i.e. "sec") and returns the average period between packets
+// the same way iptables does it
+func ParseLimitRate(rate string) (uint32, error) {
+	parts := strings.SplitN(rate, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, fmt.Errorf("invalid rate %q, expected format: <amount>/<unit> "+
+			"(i.e. 10/second)", rate)
+	}
+
+	amount, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || amount == 0 {
+		return 0, fmt.Errorf("invalid amount in rate %q", rate)
+	}
+
+	for _, unit := range limitUnits {
+		if strings.HasPrefix(unit.name, strings.ToLower(parts[1])) {
+			if amount > uint64(unit.period) {
+				return 0, fmt.Errorf("rate %q is too fast", rate)
+			}
+
+			return unit.period / uint32(amount), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid unit in rate %q, only second, minute, "+
+		"hour or day allowed", rate)
+}
+
+// FormatLimitRate returns the rate with the provided average period between
+// packets in the format iptables prints it (i.e. "10/sec")
+func FormatLimitRate(period uint32) string {
+	if period == 0 {
+		return "inf"
+	}
+
+	i := 1
+	for ; i < len(limitUnits); i++ {
+		if period > limitUnits[i].period ||
+			limitUnits[i].period/period < limitUnits[i].period%period {
+			break
+		}
+	}
+
+	unit := limitUnits[i-1]
+
+	return fmt.Sprintf("%d/%s", unit.period/period, unit.short)
 }
 
 type Config struct {
 	Owner    Owner
 	Redirect Redirect
 	Ebpf     Ebpf
+	// Nftables when enabled will install the transparent proxy rules using
+	// nftables instead of iptables
+	Nftables Nftables
+	// IPTables holds the configuration of iptables binaries which will be used
+	IPTables IPTables
+	// EgressLockdown when enabled will generate filter table rules rejecting
+	// the outbound traffic which doesn't go through the sidecar
+	EgressLockdown EgressLockdown
+	// IPSet when enabled will use ipset sets for the exclusion lists, so they
+	// can be updated at runtime
+	IPSet IPSet
 	// DropInvalidPackets when set will enable configuration which should drop
 	// packets in invalid states
 	DropInvalidPackets bool
@@ -109,6 +726,18 @@ type Config struct {
 	Log LogConfig
 }
 
+// ShouldLog reports if all the packets entering the nat table should be
+// logged to the kernel log (-j LOG)
+func (c Config) ShouldLog() bool {
+	return c.Log.Enabled && c.Log.Mode != LogModeNflog
+}
+
+// ShouldNflog reports if the packets should be logged with the decisions made
+// about them to the NFLOG group (-j NFLOG)
+func (c Config) ShouldNflog() bool {
+	return c.Log.ShouldNflog()
+}
+
 // ShouldDropInvalidPackets is just a convenience function which can be used in
 // iptables conditional command generations instead of inlining anonymous functions
 // i.e. AppendIf(ShouldDropInvalidPackets, Match(...), Jump(Drop()))
@@ -116,6 +745,39 @@ func (c Config) ShouldDropInvalidPackets() bool {
 	return c.DropInvalidPackets
 }
 
+// ShouldLockdownEgress reports if the egress traffic bypassing the proxy should be dropped
+func (c Config) ShouldLockdownEgress() bool {
+	return c.EgressLockdown.Enabled
+}
+
+// ShouldUseIPSet reports if the exclusion lists should be matched with ipset sets
+func (c Config) ShouldUseIPSet() bool {
+	return c.IPSet.Enabled
+}
+
+// ShouldTProxyInbound reports if the inbound traffic should be diverted with TPROXY
+func (c Config) ShouldTProxyInbound() bool {
+	return c.Redirect.Inbound.Enabled && c.Redirect.Inbound.Mode == RedirectModeTProxy
+}
+
+// ShouldInterceptInboundUDP reports if the inbound UDP traffic should be intercepted
+func (c Config) ShouldInterceptInboundUDP() bool {
+	return c.Redirect.Inbound.Enabled && c.Redirect.Inbound.UDP.Enabled
+}
+
+// ShouldInterceptOutboundUDP reports if the outbound UDP traffic should be intercepted
+func (c Config) ShouldInterceptOutboundUDP() bool {
+	return c.Redirect.Outbound.Enabled && c.Redirect.Outbound.UDP.Enabled
+}
+
+// ShouldConfigureTProxyRouting reports if any of the features, which divert
+// the traffic with TPROXY target (and so require the policy routing), is enabled
+func (c Config) ShouldConfigureTProxyRouting() bool {
+	return c.ShouldTProxyInbound() ||
+		c.ShouldInterceptInboundUDP() ||
+		c.ShouldInterceptOutboundUDP()
+}
+
 // ShouldRedirectDNS is just a convenience function which can be used in
 // iptables conditional command generations instead of inlining anonymous functions
 // i.e. AppendIf(ShouldRedirectDNS, Match(...), Jump(Drop()))
@@ -132,9 +794,11 @@ func (c Config) ShouldCaptureAllDNS() bool {
 
 // ShouldConntrackZoneSplit is a function which will check if DNS redirection and
 // conntrack zone splitting settings are enabled (return false if not), and then
-// will verify if there is conntrack iptables extension available to apply
-// the DNS conntrack zone splitting iptables rules
-func (c Config) ShouldConntrackZoneSplit() bool {
+// will verify if there are conntrack extensions available to apply the DNS
+// conntrack zone splitting rules of the provided family. Extensions are probed
+// with the binary (in the variant selected by the mode) which will apply them,
+// as they can be available for IPv4, but not for IPv6
+func (c Config) ShouldConntrackZoneSplit(ipv6 bool) bool {
 	if !c.Redirect.DNS.Enabled || !c.Redirect.DNS.ConntrackZoneSplit {
 		return false
 	}
@@ -142,19 +806,207 @@ func (c Config) ShouldConntrackZoneSplit() bool {
 	// There are situations where conntrack extension is not present (WSL2)
 	// instead of failing the whole iptables application, we can log the warning,
 	// skip conntrack related rules and move forward
-	if err := exec.Command("iptables", "-m", "conntrack", "--help").Run(); err != nil {
-		_, _ = fmt.Fprintf(c.RuntimeStdout,
-			"[WARNING] error occurred when validating if 'conntrack' iptables "+
-				"module is present. Rules for DNS conntrack zone "+
-				"splitting won't be applied: %s\n", err,
-		)
+	iptables := c.IPTables.Executable("iptables", ipv6)
+	for _, args := range [][]string{
+		{"-m", "conntrack", "--help"},
+		{"-j", "CT", "--help"},
+	} {
+		if err := exec.Command(iptables, args...).Run(); err != nil {
+			_, _ = fmt.Fprintf(c.RuntimeStdout,
+				"[WARNING] error occurred when validating if '%s' %s "+
+					"extension is present. Rules for DNS conntrack zone "+
+					"splitting won't be applied: %s\n", args[1], iptables, err,
+			)
 
-		return false
+			return false
+		}
 	}
 
 	return true
 }
 
+// ParseCIDR parses the CIDR or a single IP address (which is treated as /32
+// or /128 network) and reports if it's an IPv6 one
+func ParseCIDR(cidr string) (*net.IPNet, bool, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, false, fmt.Errorf("invalid IP address or CIDR %q", cidr)
+		}
+
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, false, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true, nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid IP address or CIDR %q: %s", cidr, err)
+	}
+
+	return network, network.IP.To4() == nil, nil
+}
+
+// CIDRsOfFamily returns CIDRs (or addresses) from the list which are of
+// the requested family. CIDRs are expected to be already validated
+func CIDRsOfFamily(cidrs []string, ipv6 bool) []string {
+	var result []string
+
+	for _, cidr := range cidrs {
+		if _, isIPv6, err := ParseCIDR(cidr); err == nil && isIPv6 == ipv6 {
+			result = append(result, cidr)
+		}
+	}
+
+	return result
+}
+
+func validateCIDRs(field string, cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("%s: %s", field, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks if the values provided in the configuration are correct.
+// It has to be called on the configuration merged with the defaults
+// (MergeConfigWithDefaults), as empty fields are not valid on their own
+func (c Config) Validate() error {
+	if err := validateCIDRs(
+		"Redirect.Outbound.ExcludeOutboundIPs",
+		c.Redirect.Outbound.ExcludeOutboundIPs,
+	); err != nil {
+		return err
+	}
+
+	if err := validateCIDRs(
+		"Redirect.Inbound.ExcludeInboundSourceIPs",
+		c.Redirect.Inbound.ExcludeInboundSourceIPs,
+	); err != nil {
+		return err
+	}
+
+	if err := validateCIDRs(
+		"Redirect.Outbound.IncludeOutboundIPs",
+		c.Redirect.Outbound.IncludeOutboundIPs,
+	); err != nil {
+		return err
+	}
+
+	if err := validateVNet(c.Redirect.VNet); err != nil {
+		return err
+	}
+
+	for _, server := range c.Redirect.DNS.Servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("Redirect.DNS.Servers: invalid IP address %q", server)
+		}
+	}
+
+	if c.Redirect.DNS.Enabled && c.Redirect.DNS.ConntrackZoneSplit {
+		for field, zone := range map[string]uint32{
+			"Redirect.DNS.SidecarConntrackZone":     c.Redirect.DNS.SidecarConntrackZone,
+			"Redirect.DNS.ApplicationConntrackZone": c.Redirect.DNS.ApplicationConntrackZone,
+		} {
+			if zone == 0 || zone > MaxConntrackZone {
+				return fmt.Errorf("%s: invalid zone %d, zones have to be between 1 and %d",
+					field, zone, MaxConntrackZone)
+			}
+		}
+
+		if c.Redirect.DNS.SidecarConntrackZone == c.Redirect.DNS.ApplicationConntrackZone {
+			return fmt.Errorf("Redirect.DNS.ApplicationConntrackZone: %d is already used "+
+				"as Redirect.DNS.SidecarConntrackZone", c.Redirect.DNS.ApplicationConntrackZone)
+		}
+	}
+
+	for field, ports := range map[string]struct {
+		list   []uint16
+		ranges ValueOrRangeList
+	}{
+		"Redirect.Inbound.Exclude": {
+			c.Redirect.Inbound.ExcludePorts,
+			c.Redirect.Inbound.ExcludePortRanges,
+		},
+		"Redirect.Inbound.Include": {
+			c.Redirect.Inbound.IncludePorts,
+			c.Redirect.Inbound.IncludePortRanges,
+		},
+		"Redirect.Outbound.Exclude": {
+			c.Redirect.Outbound.ExcludePorts,
+			c.Redirect.Outbound.ExcludePortRanges,
+		},
+		"Redirect.Outbound.Include": {
+			c.Redirect.Outbound.IncludePorts,
+			c.Redirect.Outbound.IncludePortRanges,
+		},
+		"Redirect.Inbound.UDP.Exclude": {
+			c.Redirect.Inbound.UDP.ExcludePorts,
+			c.Redirect.Inbound.UDP.ExcludePortRanges,
+		},
+		"Redirect.Inbound.UDP.Include": {
+			c.Redirect.Inbound.UDP.IncludePorts,
+			c.Redirect.Inbound.UDP.IncludePortRanges,
+		},
+		"Redirect.Outbound.UDP.Exclude": {
+			c.Redirect.Outbound.UDP.ExcludePorts,
+			c.Redirect.Outbound.UDP.ExcludePortRanges,
+		},
+		"Redirect.Outbound.UDP.Include": {
+			c.Redirect.Outbound.UDP.IncludePorts,
+			c.Redirect.Outbound.UDP.IncludePortRanges,
+		},
+	} {
+		if err := validatePortRanges(field, ports.list, ports.ranges); err != nil {
+			return err
+		}
+	}
+
+	if c.IPSet.Enabled {
+		for _, name := range []string{
+			c.IPSet.ExcludeOutboundIPs + "6",
+			c.IPSet.ExcludeOutboundPorts,
+			c.IPSet.ExcludeInboundPorts,
+		} {
+			// the name of the temporary set has to fit as well
+			if len(c.Redirect.NamePrefix+name+IPSetTempSuffix) > IPSetMaxNameLength {
+				return fmt.Errorf("IPSet: name of the set %q is longer than %d characters",
+					c.Redirect.NamePrefix+name, IPSetMaxNameLength-len(IPSetTempSuffix))
+			}
+		}
+	}
+
+	if c.Log.Enabled {
+		switch c.Log.Mode {
+		case "", LogModeLog:
+		case LogModeNflog:
+			if _, err := ParseLimitRate(c.Log.RateLimit); err != nil {
+				return fmt.Errorf("Log.RateLimit: %s", err)
+			}
+		default:
+			return fmt.Errorf("Log.Mode: unknown mode %q, only %q or %q allowed",
+				c.Log.Mode, LogModeLog, LogModeNflog)
+		}
+	}
+
+	if len(c.Owner.UIDList()) == 0 && c.Owner.GID == "" && c.Owner.Mark == 0 {
+		return fmt.Errorf("Owner: sidecar has to be identified by UID, GID or mark")
+	}
+
+	if c.Owner.Mark != 0 && c.ShouldConfigureTProxyRouting() &&
+		c.Owner.Mark == c.Redirect.TProxy.Mark {
+		return fmt.Errorf("Owner.Mark: 0x%x is already used as Redirect.TProxy.Mark",
+			c.Owner.Mark)
+	}
+
+	return nil
+}
+
 func defaultConfig() Config {
 	return Config{
 		Owner: Owner{UID: "5678"},
@@ -162,30 +1014,55 @@ func defaultConfig() Config {
 			NamePrefix: "",
 			Inbound: TrafficFlow{
 				Enabled:       true,
+				Mode:          RedirectModeRedirect,
 				Port:          15006,
 				PortIPv6:      15010,
 				Chain:         Chain{Name: "MESH_INBOUND"},
 				RedirectChain: Chain{Name: "MESH_INBOUND_REDIRECT"},
 				ExcludePorts:  []uint16{},
 				IncludePorts:  []uint16{},
+				UDP: UDP{
+					Enabled:      false,
+					Port:         15007,
+					Chain:        Chain{Name: "MESH_INBOUND_UDP"},
+					ExcludePorts: []uint16{},
+					IncludePorts: []uint16{},
+				},
 			},
 			Outbound: TrafficFlow{
 				Enabled:       true,
+				Mode:          RedirectModeRedirect,
 				Port:          15001,
 				Chain:         Chain{Name: "MESH_OUTBOUND"},
 				RedirectChain: Chain{Name: "MESH_OUTBOUND_REDIRECT"},
 				ExcludePorts:  []uint16{},
 				IncludePorts:  []uint16{},
+				UDP: UDP{
+					Enabled:      false,
+					Port:         15002,
+					Chain:        Chain{Name: "MESH_OUTBOUND_UDP"},
+					ExcludePorts: []uint16{},
+					IncludePorts: []uint16{},
+				},
 			},
 			DNS: DNS{
-				Port:               15053,
-				Enabled:            false,
-				CaptureAll:         true,
-				ConntrackZoneSplit: true,
-				ResolvConfigPath:   "/etc/resolv.conf",
+				Port:                      15053,
+				Enabled:                   false,
+				CaptureAll:                true,
+				ConntrackZoneSplit:        true,
+				ResolvConfigPath:          "/etc/resolv.conf",
+				SystemdResolvedConfigPath: "/run/systemd/resolve/resolv.conf",
+				SystemdResolvedUser:       "systemd-resolve",
+				SidecarConntrackZone:      1,
+				ApplicationConntrackZone:  2,
 			},
 			VNet: VNet{
-				Networks: []string{},
+				Networks: []VNetNetwork{},
+			},
+			TProxy: TProxy{
+				Mark:        0x539,
+				RouteTable:  133,
+				DivertChain: Chain{Name: "MESH_INBOUND_DIVERT"},
 			},
 		},
 		Ebpf: Ebpf{
@@ -193,6 +1070,25 @@ func defaultConfig() Config {
 			BPFFSPath:          "/run/kuma/bpf",
 			ProgramsSourcePath: "/kuma/ebpf",
 		},
+		Nftables: Nftables{
+			Enabled:   false,
+			TableName: "kuma",
+		},
+		IPTables: IPTables{
+			Mode: IPTablesModeAuto,
+		},
+		EgressLockdown: EgressLockdown{
+			Enabled:      false,
+			Chain:        Chain{Name: "MESH_EGRESS_LOCKDOWN"},
+			AllowedIPs:   []string{},
+			AllowedPorts: []uint16{},
+		},
+		IPSet: IPSet{
+			Enabled:              false,
+			ExcludeOutboundIPs:   "MESH_OUT_EXCLUDE_NET",
+			ExcludeOutboundPorts: "MESH_OUT_EXCLUDE_PORT",
+			ExcludeInboundPorts:  "MESH_IN_EXCLUDE_PORT",
+		},
 		DropInvalidPackets: false,
 		IPv6:               false,
 		RuntimeStdout:      os.Stdout,
@@ -200,18 +1096,54 @@ func defaultConfig() Config {
 		Verbose:            true,
 		DryRun:             false,
 		Log: LogConfig{
-			Enabled: false,
-			Level:   DebugLogLevel,
+			Enabled:        false,
+			Level:          DebugLogLevel,
+			Mode:           LogModeLog,
+			NflogGroup:     DefaultNflogGroup,
+			RateLimit:      "10/second",
+			RateLimitBurst: 5,
 		},
 	}
 }
 
+func mergeUDP(result UDP, cfg UDP) UDP {
+	result.Enabled = cfg.Enabled
+	if cfg.Port != 0 {
+		result.Port = cfg.Port
+	}
+
+	if cfg.PortIPv6 != 0 {
+		result.PortIPv6 = cfg.PortIPv6
+	}
+
+	if cfg.Chain.Name != "" {
+		result.Chain.Name = cfg.Chain.Name
+	}
+
+	if len(cfg.ExcludePorts) > 0 {
+		result.ExcludePorts = cfg.ExcludePorts
+	}
+
+	if len(cfg.IncludePorts) > 0 {
+		result.IncludePorts = cfg.IncludePorts
+	}
+
+	result.ExcludePortRanges = cfg.ExcludePortRanges
+	result.IncludePortRanges = cfg.IncludePortRanges
+
+	return result
+}
+
 func MergeConfigWithDefaults(cfg Config) Config {
 	result := defaultConfig()
 
 	// .Owner
-	if cfg.Owner.UID != "" {
-		result.Owner.UID = cfg.Owner.UID
+	// the default UID is used only when the sidecar isn't identified
+	// in any other way, as otherwise the traffic of an unrelated user
+	// would be treated as the sidecar's one
+	if cfg.Owner.UID != "" || len(cfg.Owner.UIDs) > 0 || cfg.Owner.GID != "" ||
+		cfg.Owner.Mark != 0 {
+		result.Owner = cfg.Owner
 	}
 
 	// .Redirect
@@ -221,6 +1153,10 @@ func MergeConfigWithDefaults(cfg Config) Config {
 
 	// .Redirect.Inbound
 	result.Redirect.Inbound.Enabled = cfg.Redirect.Inbound.Enabled
+	if cfg.Redirect.Inbound.Mode != "" {
+		result.Redirect.Inbound.Mode = cfg.Redirect.Inbound.Mode
+	}
+
 	if cfg.Redirect.Inbound.Port != 0 {
 		result.Redirect.Inbound.Port = cfg.Redirect.Inbound.Port
 	}
@@ -245,8 +1181,21 @@ func MergeConfigWithDefaults(cfg Config) Config {
 		result.Redirect.Inbound.IncludePorts = cfg.Redirect.Inbound.IncludePorts
 	}
 
+	result.Redirect.Inbound.ExcludePortRanges = cfg.Redirect.Inbound.ExcludePortRanges
+	result.Redirect.Inbound.IncludePortRanges = cfg.Redirect.Inbound.IncludePortRanges
+
+	if len(cfg.Redirect.Inbound.ExcludeInboundSourceIPs) > 0 {
+		result.Redirect.Inbound.ExcludeInboundSourceIPs = cfg.Redirect.Inbound.ExcludeInboundSourceIPs
+	}
+
+	result.Redirect.Inbound.UDP = mergeUDP(result.Redirect.Inbound.UDP, cfg.Redirect.Inbound.UDP)
+
 	// .Redirect.Outbound
 	result.Redirect.Outbound.Enabled = cfg.Redirect.Outbound.Enabled
+	if cfg.Redirect.Outbound.Mode != "" {
+		result.Redirect.Outbound.Mode = cfg.Redirect.Outbound.Mode
+	}
+
 	if cfg.Redirect.Outbound.Port != 0 {
 		result.Redirect.Outbound.Port = cfg.Redirect.Outbound.Port
 	}
@@ -267,10 +1216,23 @@ func MergeConfigWithDefaults(cfg Config) Config {
 		result.Redirect.Outbound.IncludePorts = cfg.Redirect.Outbound.IncludePorts
 	}
 
+	result.Redirect.Outbound.ExcludePortRanges = cfg.Redirect.Outbound.ExcludePortRanges
+	result.Redirect.Outbound.IncludePortRanges = cfg.Redirect.Outbound.IncludePortRanges
+
+	if len(cfg.Redirect.Outbound.ExcludeOutboundIPs) > 0 {
+		result.Redirect.Outbound.ExcludeOutboundIPs = cfg.Redirect.Outbound.ExcludeOutboundIPs
+	}
+
+	if len(cfg.Redirect.Outbound.IncludeOutboundIPs) > 0 {
+		result.Redirect.Outbound.IncludeOutboundIPs = cfg.Redirect.Outbound.IncludeOutboundIPs
+	}
+
 	if len(cfg.Redirect.Outbound.ExcludePortsForUIDs) > 0 {
 		result.Redirect.Outbound.ExcludePortsForUIDs = cfg.Redirect.Outbound.ExcludePortsForUIDs
 	}
 
+	result.Redirect.Outbound.UDP = mergeUDP(result.Redirect.Outbound.UDP, cfg.Redirect.Outbound.UDP)
+
 	// .Redirect.DNS
 	result.Redirect.DNS.Enabled = cfg.Redirect.DNS.Enabled
 	result.Redirect.DNS.ConntrackZoneSplit = cfg.Redirect.DNS.ConntrackZoneSplit
@@ -283,11 +1245,44 @@ func MergeConfigWithDefaults(cfg Config) Config {
 		result.Redirect.DNS.Port = cfg.Redirect.DNS.Port
 	}
 
+	if len(cfg.Redirect.DNS.Servers) > 0 {
+		result.Redirect.DNS.Servers = cfg.Redirect.DNS.Servers
+	}
+
+	if cfg.Redirect.DNS.SystemdResolvedConfigPath != "" {
+		result.Redirect.DNS.SystemdResolvedConfigPath = cfg.Redirect.DNS.SystemdResolvedConfigPath
+	}
+
+	if cfg.Redirect.DNS.SystemdResolvedUser != "" {
+		result.Redirect.DNS.SystemdResolvedUser = cfg.Redirect.DNS.SystemdResolvedUser
+	}
+
+	if cfg.Redirect.DNS.SidecarConntrackZone != 0 {
+		result.Redirect.DNS.SidecarConntrackZone = cfg.Redirect.DNS.SidecarConntrackZone
+	}
+
+	if cfg.Redirect.DNS.ApplicationConntrackZone != 0 {
+		result.Redirect.DNS.ApplicationConntrackZone = cfg.Redirect.DNS.ApplicationConntrackZone
+	}
+
 	// .Redirect.VNet
 	if len(cfg.Redirect.VNet.Networks) > 0 {
 		result.Redirect.VNet.Networks = cfg.Redirect.VNet.Networks
 	}
 
+	// .Redirect.TProxy
+	if cfg.Redirect.TProxy.Mark != 0 {
+		result.Redirect.TProxy.Mark = cfg.Redirect.TProxy.Mark
+	}
+
+	if cfg.Redirect.TProxy.RouteTable != 0 {
+		result.Redirect.TProxy.RouteTable = cfg.Redirect.TProxy.RouteTable
+	}
+
+	if cfg.Redirect.TProxy.DivertChain.Name != "" {
+		result.Redirect.TProxy.DivertChain.Name = cfg.Redirect.TProxy.DivertChain.Name
+	}
+
 	// .Ebpf
 	result.Ebpf.Enabled = cfg.Ebpf.Enabled
 	if cfg.Ebpf.InstanceIP != "" {
@@ -302,6 +1297,45 @@ func MergeConfigWithDefaults(cfg Config) Config {
 		result.Ebpf.ProgramsSourcePath = cfg.Ebpf.ProgramsSourcePath
 	}
 
+	// .Nftables
+	result.Nftables.Enabled = cfg.Nftables.Enabled
+	if cfg.Nftables.TableName != "" {
+		result.Nftables.TableName = cfg.Nftables.TableName
+	}
+
+	// .IPTables
+	if cfg.IPTables.Mode != "" {
+		result.IPTables.Mode = cfg.IPTables.Mode
+	}
+
+	// .EgressLockdown
+	result.EgressLockdown.Enabled = cfg.EgressLockdown.Enabled
+	if cfg.EgressLockdown.Chain.Name != "" {
+		result.EgressLockdown.Chain.Name = cfg.EgressLockdown.Chain.Name
+	}
+
+	if len(cfg.EgressLockdown.AllowedIPs) > 0 {
+		result.EgressLockdown.AllowedIPs = cfg.EgressLockdown.AllowedIPs
+	}
+
+	if len(cfg.EgressLockdown.AllowedPorts) > 0 {
+		result.EgressLockdown.AllowedPorts = cfg.EgressLockdown.AllowedPorts
+	}
+
+	// .IPSet
+	result.IPSet.Enabled = cfg.IPSet.Enabled
+	if cfg.IPSet.ExcludeOutboundIPs != "" {
+		result.IPSet.ExcludeOutboundIPs = cfg.IPSet.ExcludeOutboundIPs
+	}
+
+	if cfg.IPSet.ExcludeOutboundPorts != "" {
+		result.IPSet.ExcludeOutboundPorts = cfg.IPSet.ExcludeOutboundPorts
+	}
+
+	if cfg.IPSet.ExcludeInboundPorts != "" {
+		result.IPSet.ExcludeInboundPorts = cfg.IPSet.ExcludeInboundPorts
+	}
+
 	// .DropInvalidPackets
 	result.DropInvalidPackets = cfg.DropInvalidPackets
 
@@ -330,5 +1364,21 @@ func MergeConfigWithDefaults(cfg Config) Config {
 		result.Log.Level = cfg.Log.Level
 	}
 
+	if cfg.Log.Mode != "" {
+		result.Log.Mode = cfg.Log.Mode
+	}
+
+	if cfg.Log.NflogGroup != 0 {
+		result.Log.NflogGroup = cfg.Log.NflogGroup
+	}
+
+	if cfg.Log.RateLimit != "" {
+		result.Log.RateLimit = cfg.Log.RateLimit
+	}
+
+	if cfg.Log.RateLimitBurst != 0 {
+		result.Log.RateLimitBurst = cfg.Log.RateLimitBurst
+	}
+
 	return result
 }
@@ -1,16 +1,29 @@
 package transparent_proxy
 
 import (
+	"fmt"
+
 	"github.com/kumahq/kuma-net/ebpf"
 	"github.com/kumahq/kuma-net/iptables"
+	"github.com/kumahq/kuma-net/nftables"
 	"github.com/kumahq/kuma-net/transparent-proxy/config"
 )
 
 func Setup(cfg config.Config) (string, error) {
+	// fields left empty are filled with the defaults, so only the merged
+	// configuration can be validated
+	if err := config.MergeConfigWithDefaults(cfg).Validate(); err != nil {
+		return "", fmt.Errorf("invalid configuration: %s", err)
+	}
+
 	if cfg.Ebpf.Enabled {
 		return ebpf.Setup(cfg)
 	}
 
+	if cfg.Nftables.Enabled {
+		return nftables.Setup(cfg)
+	}
+
 	return iptables.Setup(cfg)
 }
 
@@ -19,5 +32,9 @@ func Cleanup(cfg config.Config) (string, error) {
 		return ebpf.Cleanup(cfg)
 	}
 
-	panic("currently not supported")
+	if cfg.Nftables.Enabled {
+		return nftables.Cleanup(cfg)
+	}
+
+	return iptables.Cleanup(cfg)
 }
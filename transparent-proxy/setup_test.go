@@ -0,0 +1,96 @@
+package transparent_proxy_test
+
+import (
+	"io"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	transparent_proxy "github.com/kumahq/kuma-net/transparent-proxy"
+	"github.com/kumahq/kuma-net/transparent-proxy/config"
+)
+
+var _ = Describe("Setup", func() {
+	DescribeTable("should accept configurations relying on the defaults",
+		func(cfg config.Config) {
+			// given
+			cfg.DryRun = true
+			cfg.RuntimeStdout = io.Discard
+
+			// when
+			output, err := transparent_proxy.Setup(cfg)
+
+			// then
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(ContainSubstring("-A MESH_OUTBOUND"))
+		},
+		Entry("minimal configuration", config.Config{}),
+		Entry("DNS conntrack zone splitting without zones", config.Config{
+			Redirect: config.Redirect{
+				DNS: config.DNS{
+					Enabled:            true,
+					CaptureAll:         true,
+					ConntrackZoneSplit: true,
+				},
+			},
+		}),
+		Entry("nflog logging mode without the rate limit", config.Config{
+			Log: config.LogConfig{Enabled: true, Mode: config.LogModeNflog},
+		}),
+	)
+
+	It("should identify the sidecar by the default UID when the owner is empty", func() {
+		// given
+		cfg := config.Config{
+			Owner: config.Owner{},
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{Enabled: true},
+			},
+			DryRun:        true,
+			RuntimeStdout: io.Discard,
+		}
+
+		// when
+		output, err := transparent_proxy.Setup(cfg)
+
+		// then
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring("-m owner --uid-owner 5678"))
+	})
+
+	It("should reject the owner without any UID, GID or mark", func() {
+		// given
+		cfg := config.Config{
+			Owner:         config.Owner{UIDs: []string{""}},
+			DryRun:        true,
+			RuntimeStdout: io.Discard,
+		}
+
+		// when
+		_, err := transparent_proxy.Setup(cfg)
+
+		// then
+		Expect(err).To(MatchError(
+			"invalid configuration: Owner: sidecar has to be identified by UID, GID or mark",
+		))
+	})
+
+	It("should reject invalid configuration", func() {
+		// given
+		cfg := config.Config{
+			Redirect: config.Redirect{
+				Outbound: config.TrafficFlow{ExcludeOutboundIPs: []string{"10.0.0.0/33"}},
+			},
+			DryRun:        true,
+			RuntimeStdout: io.Discard,
+		}
+
+		// when
+		_, err := transparent_proxy.Setup(cfg)
+
+		// then
+		Expect(err).To(MatchError(ContainSubstring(
+			"invalid configuration: Redirect.Outbound.ExcludeOutboundIPs",
+		)))
+	})
+})
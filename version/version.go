@@ -0,0 +1,45 @@
+package version
+
+import (
+	"runtime/debug"
+)
+
+const modulePath = "github.com/kumahq/kuma-net"
+
+// Version of kuma-net. It can be set when building the binary
+// (-ldflags "-X github.com/kumahq/kuma-net/version.Version=1.0.0"), otherwise
+// the version of the module is read from the build information
+var Version = ""
+
+// unknown is returned when the version is neither set, nor available
+// in the build information (i.e. in tests or in the development builds)
+const unknown = "dev"
+
+// Get returns the version of kuma-net
+func Get() string {
+	if Version != "" {
+		return Version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return unknown
+	}
+
+	module := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			module = dep
+		}
+	}
+
+	if module.Path != modulePath || module.Version == "" || module.Version == "(devel)" {
+		return unknown
+	}
+
+	if module.Replace != nil && module.Replace.Version != "" {
+		return module.Replace.Version
+	}
+
+	return module.Version
+}